@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+	"github.com/vgheri/matriarch/parser/sql/astutils"
+)
+
+// joinLookupBatchSize is the maximum number of values of the IN list of a lookup query.
+const joinLookupBatchSize = 500
+
+var ErrJoinRowLimitExceeded = errors.New("cross-shard join exceeds the maximum number of rows")
+
+// crossShardJoin is the plan of an inner join between two sharded tables which are not co-located.
+// Matriarch executes it in three steps:
+//  1. the driving table is read from the shard owning the rows selected by the where clause, or from every shard
+//  2. the joined values of the driving rows are looked up in batches in the other table, using IN lists
+//     routed to the shards owning the values when the join column is the primary vindex of the other table
+//  3. the rows are joined in memory using a hash join, and the target list is projected
+type crossShardJoin struct {
+	// Left and Right are the keys of the joined tables, in the order of the FROM clause.
+	Left  string
+	Right string
+	// References are the names qualifying the columns of each table in the statement, i.e. its alias or its name.
+	References map[string]string
+	// Condition is the equality of the columns used to join the tables, with Condition.LeftTable equal to Left.
+	Condition joinCondition
+	// Predicates are the expressions of the where clause filtering the rows of each table.
+	Predicates map[string][]string
+	// Equalities are the constant values of the columns of each table, used to route the driving table.
+	Equalities map[string]map[string]string
+	// Targets are the columns returned by the statement.
+	Targets []joinTarget
+	// Limit is the maximum number of rows returned by the statement, -1 if unlimited.
+	Limit int64
+}
+
+// joinTarget is a column of the target list of a cross-shard join.
+// An empty Column selects all the columns of the table.
+type joinTarget struct {
+	Table  string
+	Column string
+	Name   string
+}
+
+// planCrossShardJoin builds the plan of a select statement joining two sharded tables which are not co-located.
+// Limitations: the tables must be joined with an inner join on the equality of one column,
+// all columns must be qualified with the name or the alias of their table, and the where clause must be a list of expressions linked by AND,
+// each one referencing a single table. DISTINCT, GROUP BY, ORDER BY, OFFSET and set operations are not supported.
+func planCrossShardJoin(s *pg.SelectStmt, sql string, vschema *Vschema) (*crossShardJoin, error) {
+	switch {
+	case s.WithClause != nil || s.Op != 0:
+		return nil, errors.New("cannot execute cross-shard join: WITH clauses and set operations are not supported")
+	case !isEmptyList(s.DistinctClause) || !isEmptyList(s.GroupClause) || !isEmptyNode(s.HavingClause) || !isEmptyList(s.WindowClause):
+		return nil, errors.New("cannot execute cross-shard join: DISTINCT, GROUP BY, HAVING and WINDOW clauses are not supported")
+	case !isEmptyList(s.SortClause) || !isEmptyNode(s.LimitOffset):
+		return nil, errors.New("cannot execute cross-shard join: ORDER BY and OFFSET clauses are not supported")
+	case !isEmptyList(s.LockingClause) || s.IntoClause != nil:
+		return nil, errors.New("cannot execute cross-shard join: locking and INTO clauses are not supported")
+	}
+	j := &crossShardJoin{
+		References: make(map[string]string),
+		Predicates: make(map[string][]string),
+		Equalities: make(map[string]map[string]string),
+		Limit:      -1,
+	}
+	var conditions []joinCondition
+	switch {
+	case len(s.FromClause.Items) == 1:
+		join, ok := s.FromClause.Items[0].(*pg.JoinExpr)
+		if !ok {
+			return nil, errors.New("cannot execute cross-shard join: unsupported FROM clause")
+		}
+		// 0 = JOIN_INNER. See JoinType in https://doxygen.postgresql.org/nodes_8h.html
+		if join.Jointype != 0 || join.IsNatural {
+			return nil, errors.New("cannot execute cross-shard join: only inner joins are supported")
+		}
+		left, lok := join.Larg.(*pg.RangeVar)
+		right, rok := join.Rarg.(*pg.RangeVar)
+		if !lok || !rok {
+			return nil, errors.New("cannot execute cross-shard join: only joins between two tables are supported")
+		}
+		if err := j.setTables(left, right, vschema); err != nil {
+			return nil, err
+		}
+		walkJoinConditions(join, &conditions)
+		if isEmptyList(join.UsingClause) {
+			condition, ok := join.Quals.(*pg.A_Expr)
+			if !ok {
+				return nil, errors.New("cannot execute cross-shard join: the join condition must be the equality of two columns")
+			}
+			if _, ok = parseJoinCondition(condition); !ok {
+				return nil, errors.New("cannot execute cross-shard join: the join condition must be the equality of two columns qualified with their table name")
+			}
+		}
+	case len(s.FromClause.Items) == 2:
+		left, lok := s.FromClause.Items[0].(*pg.RangeVar)
+		right, rok := s.FromClause.Items[1].(*pg.RangeVar)
+		if !lok || !rok {
+			return nil, errors.New("cannot execute cross-shard join: only joins between two tables are supported")
+		}
+		if err := j.setTables(left, right, vschema); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("cannot execute cross-shard join: only joins between two tables are supported")
+	}
+
+	if !isEmptyNode(s.WhereClause) {
+		// The where clause is split in the expressions linked by AND, so that each one can be sent
+		// to the shards of the table it references.
+		conjuncts := []ast.Node{s.WhereClause}
+		// 0 = AND, 1 = OR, 2 NOT. See https://doxygen.postgresql.org/primnodes_8h.html#a27f637bf3e2c33cc8e48661a8864c7af
+		if b, ok := s.WhereClause.(*pg.BoolExpr); ok && b.Boolop == 0 {
+			conjuncts = b.Args.Items
+		}
+		span, _ := whereClauseSpan(sql)
+		spans := []textSpan{span}
+		if len(conjuncts) > 1 {
+			spans = splitConjuncts(sql, span)
+		}
+		if len(spans) != len(conjuncts) {
+			return nil, errors.New("cannot execute cross-shard join: cannot split the where clause in its expressions")
+		}
+		for i, conjunct := range conjuncts {
+			if expr, ok := conjunct.(*pg.A_Expr); ok {
+				if condition, ok := parseJoinCondition(expr); ok {
+					conditions = append(conditions, condition)
+					continue
+				}
+			}
+			table, err := j.predicateTable(conjunct)
+			if err != nil {
+				return nil, err
+			}
+			j.Predicates[table] = append(j.Predicates[table], sql[spans[i].Start:spans[i].End])
+			if expr, ok := conjunct.(*pg.A_Expr); ok {
+				if column, value, ok := constantEquality(expr); ok {
+					if j.Equalities[table] == nil {
+						j.Equalities[table] = make(map[string]string)
+					}
+					j.Equalities[table][column] = value
+				}
+			}
+		}
+	}
+
+	for _, condition := range conditions {
+		switch {
+		case condition.LeftTable == j.Left && condition.RightTable == j.Right:
+		case condition.LeftTable == j.Right && condition.RightTable == j.Left:
+			condition = joinCondition{condition.RightTable, condition.RightColumn, condition.LeftTable, condition.LeftColumn}
+		default:
+			return nil, fmt.Errorf("cannot execute cross-shard join: the join condition references unknown tables %s and %s",
+				condition.LeftTable, condition.RightTable)
+		}
+		if j.Condition.LeftTable != "" {
+			return nil, errors.New("cannot execute cross-shard join: only joins on a single column are supported")
+		}
+		j.Condition = condition
+	}
+	if j.Condition.LeftTable == "" {
+		return nil, errors.New("cannot execute cross-shard join: missing join condition")
+	}
+
+	if err := j.setTargets(s.TargetList); err != nil {
+		return nil, err
+	}
+	if !isEmptyNode(s.LimitCount) {
+		limit, ok := s.LimitCount.(*pg.A_Const)
+		if !ok {
+			return nil, errors.New("cannot execute cross-shard join: LIMIT must be an integer constant")
+		}
+		count, ok := limit.Val.(*pg.Integer)
+		if !ok {
+			return nil, errors.New("cannot execute cross-shard join: LIMIT must be an integer constant")
+		}
+		j.Limit = count.Ival
+	}
+	return j, nil
+}
+
+func (j *crossShardJoin) setTables(left, right *pg.RangeVar, vschema *Vschema) error {
+	j.Left = *left.Relname
+	j.Right = *right.Relname
+	if j.Left == j.Right {
+		return errors.New("cannot execute cross-shard join: self joins are not supported")
+	}
+	for _, rv := range []*pg.RangeVar{left, right} {
+		t := vschema.GetTable(*rv.Relname)
+		if t == nil {
+			return fmt.Errorf("cannot execute cross-shard join, table %s is not part of the vschema", *rv.Relname)
+		}
+		if t.Type != Sharded {
+			return fmt.Errorf("cannot execute cross-shard join: only joins between two sharded tables are supported, %s is a %s table", t.Key(), t.Type)
+		}
+		j.References[t.Key()] = t.Name
+		if rv.Alias != nil && rv.Alias.Aliasname != nil {
+			j.References[t.Key()] = *rv.Alias.Aliasname
+		}
+	}
+	return nil
+}
+
+// predicateTable returns the table referenced by an expression of the where clause.
+// Expressions without column references, such as now() > '2020-01-01', are evaluated on the left table.
+func (j *crossShardJoin) predicateTable(node ast.Node) (string, error) {
+	if len(astutils.Search(node, func(n ast.Node) bool {
+		_, ok := n.(*pg.SubLink)
+		return ok
+	}).Items) > 0 {
+		return "", errors.New("cannot execute cross-shard join: subqueries are not supported")
+	}
+	table := j.Left
+	found := false
+	for _, ref := range astutils.Search(node, func(n ast.Node) bool {
+		_, ok := n.(*pg.ColumnRef)
+		return ok
+	}).Items {
+		t, _, ok := qualifiedColumnName(ref)
+		if !ok || (t != j.Left && t != j.Right) {
+			return "", errors.New("cannot execute cross-shard join: columns must be qualified with their table name")
+		}
+		if found && t != table {
+			return "", errors.New("cannot execute cross-shard join: expressions of the where clause can only reference one table")
+		}
+		table = t
+		found = true
+	}
+	return table, nil
+}
+
+func (j *crossShardJoin) setTargets(targets *ast.List) error {
+	for _, item := range targets.Items {
+		target, ok := item.(*pg.ResTarget)
+		if !ok {
+			return errors.New("cannot execute cross-shard join: unsupported target list")
+		}
+		ref, ok := target.Val.(*pg.ColumnRef)
+		if !ok {
+			return errors.New("cannot execute cross-shard join: only columns are supported in the target list")
+		}
+		fields := ref.Fields.Items
+		if len(fields) == 1 {
+			if _, ok := fields[0].(*pg.A_Star); ok {
+				j.Targets = append(j.Targets, joinTarget{Table: j.Left}, joinTarget{Table: j.Right})
+				continue
+			}
+		}
+		if len(fields) != 2 {
+			return errors.New("cannot execute cross-shard join: columns of the target list must be qualified with their table name")
+		}
+		table, ok := fields[0].(*pg.String)
+		if !ok || (table.Str != j.Left && table.Str != j.Right) {
+			return errors.New("cannot execute cross-shard join: columns of the target list must be qualified with their table name")
+		}
+		switch column := fields[1].(type) {
+		case *pg.A_Star:
+			j.Targets = append(j.Targets, joinTarget{Table: table.Str})
+		case *pg.String:
+			name := column.Str
+			if target.Name != nil {
+				name = *target.Name
+			}
+			j.Targets = append(j.Targets, joinTarget{Table: table.Str, Column: column.Str, Name: name})
+		default:
+			return errors.New("cannot execute cross-shard join: unsupported target list")
+		}
+	}
+	return nil
+}
+
+// constantEquality returns the column and value of an equality between a column qualified with its table name and a constant.
+func constantEquality(node *pg.A_Expr) (column, value string, ok bool) {
+	if node.Kind != 0 || len(node.Name.Items) != 1 {
+		return "", "", false
+	}
+	if op, ok := node.Name.Items[0].(*pg.String); !ok || op.Str != "=" {
+		return "", "", false
+	}
+	if _, column, ok = qualifiedColumnName(node.Lexpr); !ok {
+		return "", "", false
+	}
+	if value, ok = constantValue(node.Rexpr); !ok {
+		return "", "", false
+	}
+	return column, value, true
+}
+
+// drivingShards returns the shards owning the rows of the table selected by the where clause:
+// the shard owning the keyspace id when all the primary vindex columns are specified, every shard otherwise.
+func (j *crossShardJoin) drivingShards(table string, cluster *Cluster, vschema *Vschema) ([]*Shard, bool, error) {
+	columns := vschema.GetTable(table).GetPrimaryVIndex().Columns
+	if len(columns) == 0 {
+		return cluster.Shards, false, nil
+	}
+	var values []string
+	for _, column := range columns {
+		value, ok := j.Equalities[table][column]
+		if !ok {
+			return cluster.Shards, false, nil
+		}
+		values = append(values, value)
+	}
+	concat, err := vschema.GetTable(table).KeyspaceId(values)
+	if err != nil {
+		return nil, false, err
+	}
+	shard, err := cluster.GetShardForTable(vschema.GetTable(table), concat)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot select destination shard for cross-shard join: %w", err)
+	}
+	return []*Shard{shard}, true, nil
+}
+
+// tableQuery returns the statement reading the rows of a table filtered by the where clause,
+// and by the additional condition when not empty.
+// The table is named as in the statement, so that the expressions of the where clause can be reused as they are.
+func (j *crossShardJoin) tableQuery(table *Table, condition string) string {
+	predicates := j.Predicates[table.Key()]
+	if condition != "" {
+		predicates = append(predicates[:len(predicates):len(predicates)], condition)
+	}
+	sql := fmt.Sprintf("SELECT * FROM %s", table.SQLName())
+	if reference := j.References[table.Key()]; reference != table.Name {
+		sql += " AS " + quoteIdentifier(reference)
+	}
+	if len(predicates) > 0 {
+		sql += " WHERE (" + strings.Join(predicates, ") AND (") + ")"
+	}
+	return sql
+}
+
+// drivingTable returns whether the left table drives the join, i.e. its rows are read first, and the shards owning
+// the rows of the driving table. The driving table is the one whose rows are selected by its primary vindex, if any.
+func (j *crossShardJoin) drivingTable(cluster *Cluster, vschema *Vschema) (left bool, shards []*Shard, err error) {
+	shards, routed, err := j.drivingShards(j.Left, cluster, vschema)
+	if err != nil || routed {
+		return true, shards, err
+	}
+	rightShards, routed, err := j.drivingShards(j.Right, cluster, vschema)
+	if err != nil {
+		return false, nil, err
+	}
+	if routed {
+		return false, rightShards, nil
+	}
+	return true, shards, nil
+}
+
+// lookupCondition returns the condition selecting the rows of the lookup table joined with the given values.
+func (j *crossShardJoin) lookupCondition(lookup, lookupColumn string, values []string) string {
+	var literals []string
+	for _, value := range values {
+		literals = append(literals, quoteLiteral(value))
+	}
+	return fmt.Sprintf("%s.%s IN (%s)", quoteIdentifier(j.References[lookup]), quoteIdentifier(lookupColumn), strings.Join(literals, ", "))
+}
+
+// execute runs the plan on the shards and returns the joined rows.
+// rowLimit is the maximum number of rows, read from the shards or joined, held in memory.
+func (j *crossShardJoin) execute(ctx context.Context, cluster *Cluster, vschema *Vschema, rowLimit int) (*pgconn.Result, error) {
+	driving, lookup := j.Left, j.Right
+	drivingColumn, lookupColumn := j.Condition.LeftColumn, j.Condition.RightColumn
+	left, shards, err := j.drivingTable(cluster, vschema)
+	if err != nil {
+		return nil, err
+	}
+	if !left {
+		driving, lookup = j.Right, j.Left
+		drivingColumn, lookupColumn = j.Condition.RightColumn, j.Condition.LeftColumn
+	}
+	rows := 0
+	drivingResult, err := queryShards(ctx, shards, j.tableQuery(vschema.GetTable(driving), ""))
+	if err != nil {
+		return nil, err
+	}
+	if rows += len(drivingResult.Rows); rows > rowLimit {
+		return nil, fmt.Errorf("%w: %d rows read from table %s", ErrJoinRowLimitExceeded, rows, driving)
+	}
+	index := fieldIndex(drivingResult, drivingColumn)
+	if index == -1 {
+		return nil, fmt.Errorf("cannot execute cross-shard join: column %s.%s does not exist", driving, drivingColumn)
+	}
+	var values []string
+	seen := make(map[string]bool)
+	for _, row := range drivingResult.Rows {
+		if row[index] != nil && !seen[string(row[index])] {
+			seen[string(row[index])] = true
+			values = append(values, string(row[index]))
+		}
+	}
+
+	// Lookup values are routed to the shard owning them when the join column is the primary vindex of the lookup table
+	valuesByShard := make(map[*Shard][]string)
+	var lookupShards []*Shard
+	if pv := vschema.GetTable(lookup).GetPrimaryVIndex(); len(pv.Columns) == 1 && pv.Columns[0] == lookupColumn {
+		for _, value := range values {
+			concat, err := vschema.GetTable(lookup).KeyspaceId([]string{value})
+			if err != nil {
+				return nil, err
+			}
+			shard, err := cluster.GetShardForTable(vschema.GetTable(lookup), concat)
+			if err != nil {
+				return nil, fmt.Errorf("cannot select destination shard for cross-shard join: %w", err)
+			}
+			if _, ok := valuesByShard[shard]; !ok {
+				lookupShards = append(lookupShards, shard)
+			}
+			valuesByShard[shard] = append(valuesByShard[shard], value)
+		}
+	} else if len(values) > 0 {
+		for _, shard := range cluster.Shards {
+			lookupShards = append(lookupShards, shard)
+			valuesByShard[shard] = values
+		}
+	}
+	lookupResult := &pgconn.Result{}
+	if len(lookupShards) == 0 {
+		// No rows to look up, the statement is only executed to describe the columns of the table
+		res, err := queryShards(ctx, []*Shard{cluster.AnyShard()}, j.tableQuery(vschema.GetTable(lookup), "false"))
+		if err != nil {
+			return nil, err
+		}
+		lookupResult = res
+	}
+	for _, shard := range lookupShards {
+		shardValues := valuesByShard[shard]
+		for start := 0; start < len(shardValues); start += joinLookupBatchSize {
+			end := start + joinLookupBatchSize
+			if end > len(shardValues) {
+				end = len(shardValues)
+			}
+			condition := j.lookupCondition(lookup, lookupColumn, shardValues[start:end])
+			res, err := queryShards(ctx, []*Shard{shard}, j.tableQuery(vschema.GetTable(lookup), condition))
+			if err != nil {
+				return nil, err
+			}
+			lookupResult.FieldDescriptions = res.FieldDescriptions
+			lookupResult.Rows = append(lookupResult.Rows, res.Rows...)
+			if rows += len(res.Rows); rows > rowLimit {
+				return nil, fmt.Errorf("%w: %d rows read from tables %s and %s", ErrJoinRowLimitExceeded, rows, driving, lookup)
+			}
+		}
+	}
+	if driving == j.Left {
+		return j.join(drivingResult, lookupResult, rowLimit)
+	}
+	return j.join(lookupResult, drivingResult, rowLimit)
+}
+
+// join joins the rows of the left and right tables with a hash join, and projects the target list.
+func (j *crossShardJoin) join(left, right *pgconn.Result, rowLimit int) (*pgconn.Result, error) {
+	leftIndex := fieldIndex(left, j.Condition.LeftColumn)
+	if leftIndex == -1 {
+		return nil, fmt.Errorf("cannot execute cross-shard join: column %s.%s does not exist", j.Left, j.Condition.LeftColumn)
+	}
+	rightIndex := fieldIndex(right, j.Condition.RightColumn)
+	if rightIndex == -1 {
+		return nil, fmt.Errorf("cannot execute cross-shard join: column %s.%s does not exist", j.Right, j.Condition.RightColumn)
+	}
+	// Each output column is described by the table it comes from and its index in the rows of the table
+	type source struct {
+		right bool
+		index int
+	}
+	result := &pgconn.Result{}
+	var sources []source
+	for _, target := range j.Targets {
+		res := left
+		if target.Table == j.Right {
+			res = right
+		}
+		if target.Column == "" {
+			for i := range res.FieldDescriptions {
+				sources = append(sources, source{res == right, i})
+				result.FieldDescriptions = append(result.FieldDescriptions, res.FieldDescriptions[i])
+			}
+			continue
+		}
+		i := fieldIndex(res, target.Column)
+		if i == -1 {
+			return nil, fmt.Errorf("cannot execute cross-shard join: column %s.%s does not exist", target.Table, target.Column)
+		}
+		field := res.FieldDescriptions[i]
+		field.Name = []byte(target.Name)
+		sources = append(sources, source{res == right, i})
+		result.FieldDescriptions = append(result.FieldDescriptions, field)
+	}
+
+	hash := make(map[string][][][]byte)
+	for _, row := range right.Rows {
+		if row[rightIndex] != nil {
+			hash[string(row[rightIndex])] = append(hash[string(row[rightIndex])], row)
+		}
+	}
+	for _, leftRow := range left.Rows {
+		if leftRow[leftIndex] == nil {
+			continue
+		}
+		for _, rightRow := range hash[string(leftRow[leftIndex])] {
+			if j.Limit >= 0 && int64(len(result.Rows)) >= j.Limit {
+				return j.complete(result), nil
+			}
+			if len(result.Rows) >= rowLimit {
+				return nil, fmt.Errorf("%w: more than %d joined rows", ErrJoinRowLimitExceeded, rowLimit)
+			}
+			row := make([][]byte, len(sources))
+			for i, s := range sources {
+				if s.right {
+					row[i] = rightRow[s.index]
+				} else {
+					row[i] = leftRow[s.index]
+				}
+			}
+			result.Rows = append(result.Rows, row)
+		}
+	}
+	return j.complete(result), nil
+}
+
+func (j *crossShardJoin) complete(result *pgconn.Result) *pgconn.Result {
+	result.CommandTag = pgconn.CommandTag(fmt.Sprintf("SELECT %d", len(result.Rows)))
+	return result
+}
+
+// fieldIndex returns the index of the column in the rows of the result, -1 if the result doesn't have it.
+func fieldIndex(result *pgconn.Result, column string) int {
+	for i, field := range result.FieldDescriptions {
+		if string(field.Name) == column {
+			return i
+		}
+	}
+	return -1
+}
+
+// queryShards executes a select statement on each shard and returns all the rows read.
+func queryShards(ctx context.Context, shards []*Shard, sql string) (*pgconn.Result, error) {
+	merged := &pgconn.Result{}
+	for _, shard := range shards {
+		conn, err := shard.Conn.Acquire(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cannot acquire connection to shard %s: %w", shard.Name, err)
+		}
+		results, err := conn.Exec(ctx, sql).ReadAll()
+		conn.Release()
+		if err != nil {
+			return nil, fmt.Errorf("cannot execute statement on shard %s: %w", shard.Name, err)
+		}
+		for _, res := range results {
+			merged.FieldDescriptions = res.FieldDescriptions
+			merged.Rows = append(merged.Rows, res.Rows...)
+		}
+	}
+	return merged, nil
+}
+
+// processCrossShardJoin executes a select statement joining two sharded tables which are not co-located.
+func (mock *PGMock) processCrossShardJoin(s *pg.SelectStmt, q QueryMessage, cluster *Cluster, vschema *Vschema) error {
+	j, err := planCrossShardJoin(s, q.String, vschema)
+	if err != nil {
+		return err
+	}
+	mock.logger.Log("msg", fmt.Sprintf("executing cross-shard join between tables %s and %s", j.Left, j.Right))
+	result, err := j.execute(context.Background(), cluster, vschema, mock.settings.JoinRowLimit)
+	if err != nil {
+		return err
+	}
+	return mock.FinaliseExecuteSequence("SELECT", []*pgconn.Result{result})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+)
+
+func TestPlanCrossShardJoin(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected *crossShardJoin
+	}{
+		{
+			name: "join with predicates on both tables",
+			sql:  "select orders.id, m.name as member from public.members m join orders on orders.member_id = m.id where m.id = 'a' and orders.amount > 10 limit 5",
+			expected: &crossShardJoin{
+				Left:       "members",
+				Right:      "orders",
+				References: map[string]string{"members": "m", "orders": "orders"},
+				Condition:  joinCondition{"members", "id", "orders", "member_id"},
+				Predicates: map[string][]string{
+					"members": {"m.id = 'a'"},
+					"orders":  {"orders.amount > 10"},
+				},
+				Equalities: map[string]map[string]string{"members": {"id": "a"}},
+				Targets: []joinTarget{
+					{Table: "orders", Column: "id", Name: "id"},
+					{Table: "members", Column: "name", Name: "member"},
+				},
+				Limit: 5,
+			},
+		},
+		{
+			name: "join condition in the where clause",
+			sql:  "select * from orders, members where members.id = orders.member_id",
+			expected: &crossShardJoin{
+				Left:       "orders",
+				Right:      "members",
+				References: map[string]string{"members": "members", "orders": "orders"},
+				Condition:  joinCondition{"orders", "member_id", "members", "id"},
+				Predicates: map[string][]string{},
+				Equalities: map[string]map[string]string{},
+				Targets:    []joinTarget{{Table: "orders"}, {Table: "members"}},
+				Limit:      -1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := parseSelectStmt(t, tt.sql)
+			resolveRelations(s, testVschema, []string{defaultSchema})
+			observed, err := planCrossShardJoin(s, tt.sql, testVschema)
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if !reflect.DeepEqual(tt.expected, observed) {
+				t.Fatalf("expected plan %+v, observed %+v", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestPlanCrossShardJoinErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+	}{
+		{
+			name: "order by is not supported",
+			sql:  "select * from members join orders on orders.member_id = members.id order by members.id",
+		},
+		{
+			name: "outer joins are not supported",
+			sql:  "select * from members left join orders on orders.member_id = members.id",
+		},
+		{
+			name: "unqualified columns are not supported",
+			sql:  "select * from members join orders on orders.member_id = members.id where amount > 10",
+		},
+		{
+			name: "expressions referencing both tables are not supported",
+			sql:  "select * from members join orders on orders.member_id = members.id where orders.amount > members.credit",
+		},
+		{
+			name: "missing join condition",
+			sql:  "select * from members, orders where members.id = 'a'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := planCrossShardJoin(parseSelectStmt(t, tt.sql), tt.sql, testVschema); err == nil {
+				t.Fatalf("expected error, test succeeded")
+			}
+		})
+	}
+}
+
+func TestCrossShardJoinJoin(t *testing.T) {
+	fields := func(names ...string) []pgproto3.FieldDescription {
+		var descriptions []pgproto3.FieldDescription
+		for _, name := range names {
+			descriptions = append(descriptions, pgproto3.FieldDescription{Name: []byte(name)})
+		}
+		return descriptions
+	}
+	row := func(values ...string) [][]byte {
+		var r [][]byte
+		for _, v := range values {
+			if v == "" {
+				r = append(r, nil)
+			} else {
+				r = append(r, []byte(v))
+			}
+		}
+		return r
+	}
+	members := &pgconn.Result{
+		FieldDescriptions: fields("id", "name"),
+		Rows:              [][][]byte{row("m1", "alice"), row("m2", "bob"), row("m3", "carol")},
+	}
+	orders := &pgconn.Result{
+		FieldDescriptions: fields("id", "member_id"),
+		Rows:              [][][]byte{row("o1", "m1"), row("o2", "m2"), row("o3", "m1"), row("o4", "")},
+	}
+	j := &crossShardJoin{
+		Left:      "members",
+		Right:     "orders",
+		Condition: joinCondition{"members", "id", "orders", "member_id"},
+		Targets:   []joinTarget{{Table: "members", Column: "name", Name: "member"}, {Table: "orders"}},
+		Limit:     -1,
+	}
+	observed, err := j.join(members, orders, 100)
+	if err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	expected := &pgconn.Result{
+		FieldDescriptions: fields("member", "id", "member_id"),
+		Rows: [][][]byte{
+			row("alice", "o1", "m1"),
+			row("alice", "o3", "m1"),
+			row("bob", "o2", "m2"),
+		},
+		CommandTag: pgconn.CommandTag("SELECT 3"),
+	}
+	if !reflect.DeepEqual(expected, observed) {
+		t.Fatalf("expected result %+v, observed %+v", expected, observed)
+	}
+
+	j.Limit = 1
+	if observed, err = j.join(members, orders, 100); err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if len(observed.Rows) != 1 || string(observed.CommandTag) != "SELECT 1" {
+		t.Fatalf("expected the limit to be applied, observed %d rows", len(observed.Rows))
+	}
+
+	j.Limit = -1
+	if _, err = j.join(members, orders, 2); !errors.Is(err, ErrJoinRowLimitExceeded) {
+		t.Fatalf("expected error %v, got %v", ErrJoinRowLimitExceeded, err)
+	}
+}
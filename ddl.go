@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgconn"
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+	"github.com/vgheri/matriarch/parser/sql/catalog"
+)
+
+// schemaCatalog is the catalog of the tables of a keyspace held by Matriarch. It is loaded from the first shard on
+// startup and kept up to date by the DDL statements executed through Matriarch, so that Matriarch knows the
+// column types of the tables created after startup.
+type schemaCatalog struct {
+	mu      sync.Mutex
+	catalog *catalog.Catalog
+}
+
+// loadSchemaCatalog reads the definitions of the tables of every schema of a shard into a catalog.
+func loadSchemaCatalog(ctx context.Context, shard *Shard) (*schemaCatalog, error) {
+	c, err := loadShardCatalog(ctx, shard, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &schemaCatalog{catalog: c}, nil
+}
+
+// Apply applies a DDL statement executed on the shards to the catalog.
+func (s *schemaCatalog) Apply(stmt ast.Statement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.catalog.Update(stmt)
+}
+
+// Replace replaces the catalog, e.g. with a catalog loaded again from a shard when a statement could not be applied.
+func (s *schemaCatalog) Replace(other *schemaCatalog) {
+	other.mu.Lock()
+	c := other.catalog
+	other.mu.Unlock()
+	s.mu.Lock()
+	s.catalog = c
+	s.mu.Unlock()
+}
+
+// ColumnType returns the type of a column, as used to normalise the values of vindex columns, see typeCategory.
+// It is empty when the column doesn't exist, or when its values cannot be hashed into keyspace ids.
+func (s *schemaCatalog) ColumnType(schema, table, column string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := catalogTable(s.catalog, schema, table)
+	if t == nil {
+		return ""
+	}
+	col := catalogColumn(t, column)
+	if col == nil || columnTypeCategory(col) == "" {
+		return ""
+	}
+	return col.Type.Name
+}
+
+// isDDLStmt reports whether a statement changes the definition of the objects of the shards, and is executed on
+// every shard. The statements creating or altering the tables, schemas and types are applied to the catalog.
+func isDDLStmt(node ast.Node) bool {
+	switch node.(type) {
+	case *ast.CreateTableStmt, *ast.AlterTableStmt, *ast.AlterTableSetSchemaStmt, *ast.RenameTableStmt,
+		*ast.RenameColumnStmt, *ast.DropTableStmt, *ast.CreateSchemaStmt, *ast.DropSchemaStmt,
+		*ast.CommentOnTableStmt, *ast.CommentOnColumnStmt, *ast.CommentOnSchemaStmt, *ast.CommentOnTypeStmt,
+		*ast.CreateEnumStmt, *ast.CompositeTypeStmt, *ast.AlterTypeAddValueStmt, *ast.AlterTypeRenameValueStmt,
+		*ast.DropTypeStmt, *ast.CreateFunctionStmt, *ast.DropFunctionStmt, *pg.IndexStmt, *pg.DropStmt:
+		return true
+	}
+	return false
+}
+
+// vindexColumns returns the key of the table named by a DDL statement and its columns used by the vindexes of the
+// vschema: the vindex columns of a table of the vschema, or the value and keyspace_id columns of a lookup table.
+// The key is empty when the table isn't used by any vindex. Names without schema are resolved with the search path.
+func vindexColumns(vschema *Vschema, name *ast.TableName, searchPath []string) (string, []string) {
+	schemas := searchPath
+	if name.Schema != "" {
+		schemas = []string{name.Schema}
+	}
+	for _, schema := range schemas {
+		if table := vschema.ResolveTable(schema, name.Name, nil); table != nil {
+			var columns []string
+			for _, v := range table.VIndexes {
+				for _, column := range v.Columns {
+					if stringArrayContainsValue(columns, column) == -1 {
+						columns = append(columns, column)
+					}
+				}
+			}
+			if len(columns) == 0 {
+				return "", nil
+			}
+			return table.Key(), columns
+		}
+		for _, table := range vschema.Tables {
+			for _, v := range table.LookupVIndexes() {
+				if table.SchemaName() != schema || v.Lookup.Table != name.Name {
+					continue
+				}
+				key := name.Name
+				if table.Schema != "" {
+					key = table.Schema + "." + name.Name
+				}
+				return key, []string{"value", "keyspace_id"}
+			}
+		}
+	}
+	return "", nil
+}
+
+// checkDDLVindexes rejects the DDL statements which would drop, alter the type of or rename a column used by a
+// vindex, or drop or rename a table with such columns, as Matriarch could no longer route the statements reading
+// and writing the table. The table must be removed from the vschema, or its vindexes changed, first.
+func checkDDLVindexes(node ast.Node, vschema *Vschema, searchPath []string) error {
+	switch s := node.(type) {
+	case *ast.AlterTableStmt:
+		key, columns := vindexColumns(vschema, s.Table, searchPath)
+		if key == "" || s.Cmds == nil {
+			return nil
+		}
+		for _, item := range s.Cmds.Items {
+			cmd, ok := item.(*ast.AlterTableCmd)
+			if !ok {
+				continue
+			}
+			var column, change string
+			switch cmd.Subtype {
+			case ast.AT_DropColumn:
+				change = "drop"
+				if cmd.Name != nil {
+					column = *cmd.Name
+				}
+			case ast.AT_AlterColumnType:
+				change = "alter the type of"
+				column = cmd.Def.Colname
+			default:
+				continue
+			}
+			if stringArrayContainsValue(columns, column) != -1 {
+				return fmt.Errorf("cannot %s column %s of table %s, used by a vindex", change, column, key)
+			}
+		}
+	case *ast.RenameColumnStmt:
+		key, columns := vindexColumns(vschema, s.Table, searchPath)
+		if key != "" && s.Col != nil && stringArrayContainsValue(columns, s.Col.Name) != -1 {
+			return fmt.Errorf("cannot rename column %s of table %s, used by a vindex", s.Col.Name, key)
+		}
+	case *ast.DropTableStmt:
+		for _, name := range s.Tables {
+			if key, columns := vindexColumns(vschema, name, searchPath); key != "" {
+				return fmt.Errorf("cannot drop table %s, its columns %s are used by vindexes", key, strings.Join(columns, ", "))
+			}
+		}
+	case *ast.RenameTableStmt:
+		if key, columns := vindexColumns(vschema, s.Table, searchPath); key != "" {
+			return fmt.Errorf("cannot rename table %s, its columns %s are used by vindexes", key, strings.Join(columns, ", "))
+		}
+	case *ast.AlterTableSetSchemaStmt:
+		if key, columns := vindexColumns(vschema, s.Table, searchPath); key != "" {
+			return fmt.Errorf("cannot move table %s to another schema, its columns %s are used by vindexes", key, strings.Join(columns, ", "))
+		}
+	}
+	return nil
+}
+
+// ddlShardsError returns the error of a DDL statement which failed on a shard, reporting the shards on which the
+// statement was applied and the shards on which it was not executed. Errors reported by PostgreSQL keep their
+// SQLSTATE, the shards being reported in their detail.
+func ddlShardsError(err error, applied []string, failed string, skipped []string) error {
+	shards := "applied on no shard"
+	if len(applied) > 0 {
+		shards = "applied on shards " + strings.Join(applied, ", ")
+	}
+	shards += ", failed on shard " + failed
+	if len(skipped) > 0 {
+		shards += ", not executed on shards " + strings.Join(skipped, ", ")
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		shardErr := *pgErr
+		shardErr.Detail = strings.TrimSpace(pgErr.Detail + " DDL statement " + shards + ".")
+		return &shardErr
+	}
+	return fmt.Errorf("cannot execute DDL statement, %s: %w", shards, err)
+}
+
+// execDDL executes a DDL statement on each shard, one at a time and outside of any transaction, as some DDL
+// statements cannot run inside a transaction block, e.g. CREATE INDEX CONCURRENTLY. Execution stops at the first
+// shard failing, the shards before it keeping the change, see ddlShardsError.
+// It returns the results of all the shards, in the same order as the shards.
+func execDDL(ctx context.Context, shards []*Shard, sql string) ([]*pgconn.Result, error) {
+	var results []*pgconn.Result
+	for i, shard := range shards {
+		conn, err := shard.Conn.Acquire(ctx)
+		if err == nil {
+			var res []*pgconn.Result
+			res, err = conn.Exec(ctx, sql).ReadAll()
+			conn.Release()
+			results = append(results, res...)
+		}
+		if err != nil {
+			var applied, skipped []string
+			for _, s := range shards[:i] {
+				applied = append(applied, s.Name)
+			}
+			for _, s := range shards[i+1:] {
+				skipped = append(skipped, s.Name)
+			}
+			return nil, ddlShardsError(err, applied, shard.Name, skipped)
+		}
+	}
+	return results, nil
+}
+
+// processDDLStmt executes a DDL statement on every shard, see execDDL, and applies it to the catalog of the keyspace.
+// The types of the vindex columns of the tables created by the statement are then read from the catalog.
+// Statements changing the columns used by vindexes are rejected, see checkDDLVindexes.
+func (mock *PGMock) processDDLStmt(stmt ast.Statement, q QueryMessage, cluster *Cluster, vschema *Vschema) error {
+	if err := checkDDLVindexes(stmt.Raw.Stmt, vschema, mock.settings.SearchPathOrDefault()); err != nil {
+		return err
+	}
+	mock.logger.Log("msg", "executing DDL statement on every shard")
+	ctx := context.Background()
+	results, err := execDDL(ctx, cluster.Shards, q.String)
+	if err != nil {
+		return err
+	}
+	if mock.catalog != nil {
+		if err = mock.catalog.Apply(stmt); err != nil {
+			level.Warn(mock.logger).Log("msg", fmt.Sprintf("cannot apply DDL statement to the catalog, reloading it from shard %s: %s",
+				cluster.Shards[0].Name, err.Error()))
+			if loaded, err := loadSchemaCatalog(ctx, cluster.Shards[0]); err != nil {
+				level.Warn(mock.logger).Log("msg", fmt.Sprintf("cannot reload the catalog: %s", err.Error()))
+			} else {
+				mock.catalog.Replace(loaded)
+			}
+		}
+		if mock.vschemas != nil {
+			mock.vschemas.UpdateColumnTypes(mock.catalog)
+		}
+	}
+	return mock.FinaliseExecuteSequence("DDL", results[:1])
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/vgheri/matriarch/parser/engine"
+	"github.com/vgheri/matriarch/parser/sql/ast"
+)
+
+func parseStatement(t *testing.T, sql string) ast.Statement {
+	stmts, err := engine.NewParser().Parse(strings.NewReader(sql))
+	if err != nil {
+		t.Fatalf("cannot parse %s: %v", sql, err)
+	}
+	if len(stmts) != 1 {
+		t.Fatalf("expected a single statement, got %d", len(stmts))
+	}
+	return stmts[0]
+}
+
+func TestIsDDLStmt(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{sql: "create table orders (id uuid, amount numeric)", expected: true},
+		{sql: "alter table orders add column status text", expected: true},
+		{sql: "alter table orders add constraint amount_positive check (amount > 0)", expected: true},
+		{sql: "create index orders_amount_idx on orders (amount)", expected: true},
+		{sql: "create unique index concurrently members_name_idx on members (name)", expected: true},
+		{sql: "drop index orders_amount_idx", expected: true},
+		{sql: "drop table if exists carts", expected: true},
+		{sql: "alter table orders rename column amount to total", expected: true},
+		{sql: "comment on table orders is 'orders of the members'", expected: true},
+		{sql: "create schema sales", expected: true},
+		{sql: "select * from orders", expected: false},
+		{sql: "delete from orders where id = 'a'", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			stmt := parseStatement(t, tt.sql)
+			// relations of DDL statements are resolved like the ones of other statements
+			resolveRelations(stmt.Raw.Stmt, testVschema, []string{defaultSchema})
+			if observed := isDDLStmt(stmt.Raw.Stmt); observed != tt.expected {
+				t.Fatalf("expected %t, observed %t", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestCheckDDLVindexes(t *testing.T) {
+	tests := []struct {
+		sql        string
+		searchPath []string
+		err        string
+	}{
+		{sql: "alter table orders add column status text"},
+		{sql: "alter table orders drop column amount"},
+		{sql: "alter table orders drop column id", err: "cannot drop column id of table orders, used by a vindex"},
+		{sql: "alter table public.members alter column email type varchar(256)", err: "cannot alter the type of column email of table members"},
+		{sql: "alter table order_items rename column order_id to purchase_id", err: "cannot rename column order_id of table order_items"},
+		{sql: "alter table members_email_lookup drop column keyspace_id", err: "cannot drop column keyspace_id of table members_email_lookup"},
+		{sql: "alter table sales.orders drop column id"},
+		{sql: "alter table orders drop column id", searchPath: []string{"sales"}},
+		{sql: "drop table categories, carts"},
+		{sql: "drop table carts, orders_archive", err: "cannot drop table orders_archive, its columns id are used by vindexes"},
+		{sql: "drop table members_email_lookup", err: "cannot drop table members_email_lookup, its columns value, keyspace_id are used by vindexes"},
+		{sql: "alter table members rename to users", err: "cannot rename table members, its columns id, email are used by vindexes"},
+		{sql: "alter table orders set schema sales", err: "cannot move table orders to another schema"},
+		{sql: "create index orders_member_idx on orders (id)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			searchPath := tt.searchPath
+			if searchPath == nil {
+				searchPath = []string{defaultSchema}
+			}
+			err := checkDDLVindexes(parseStatement(t, tt.sql).Raw.Stmt, testVschema, searchPath)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("expected test to succeed, got error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error containing %s, observed %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestDDLShardsError(t *testing.T) {
+	shardErr := &pgconn.PgError{Severity: "ERROR", Code: "42P07", Message: `relation "orders" already exists`}
+	err := ddlShardsError(shardErr, []string{"ecommerce_$80"}, "ecommerce_80$", nil)
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "42P07" || pgErr.Message != shardErr.Message {
+		t.Fatalf("expected the error of the shard to be kept, observed %v", err)
+	}
+	if expected := "DDL statement applied on shards ecommerce_$80, failed on shard ecommerce_80$."; pgErr.Detail != expected {
+		t.Fatalf("expected detail %q, observed %q", expected, pgErr.Detail)
+	}
+	err = ddlShardsError(errors.New("connection refused"), nil, "ecommerce_$80", []string{"ecommerce_80$"})
+	expected := "cannot execute DDL statement, applied on no shard, failed on shard ecommerce_$80, not executed on shards ecommerce_80$: connection refused"
+	if err.Error() != expected {
+		t.Fatalf("expected error %q, observed %q", expected, err.Error())
+	}
+}
+
+func TestSchemaCatalog(t *testing.T) {
+	c, err := buildCatalog("CREATE TABLE orders (id uuid, amount numeric, created_at timestamp);")
+	if err != nil {
+		t.Fatalf("cannot build catalog: %v", err)
+	}
+	s := &schemaCatalog{catalog: c}
+	for _, sql := range []string{
+		"create table carts (id bigint, member_id uuid)",
+		"alter table orders add column member_id uuid",
+		"alter table orders alter column amount type bigint",
+		"drop table carts",
+		"create index orders_member_idx on orders (member_id)",
+	} {
+		if err = s.Apply(parseStatement(t, sql)); err != nil {
+			t.Fatalf("cannot apply %s: %v", sql, err)
+		}
+	}
+	tests := []struct {
+		table, column string
+		expected      string
+	}{
+		{table: "orders", column: "id", expected: "uuid"},
+		{table: "orders", column: "member_id", expected: "uuid"},
+		{table: "orders", column: "amount", expected: "int8"},
+		{table: "orders", column: "created_at", expected: ""},
+		{table: "orders", column: "status", expected: ""},
+		{table: "carts", column: "id", expected: ""},
+	}
+	for _, tt := range tests {
+		if observed := s.ColumnType(defaultSchema, tt.table, tt.column); observed != tt.expected {
+			t.Fatalf("expected type %q for %s.%s, observed %q", tt.expected, tt.table, tt.column, observed)
+		}
+	}
+}
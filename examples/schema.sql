@@ -1,11 +1,22 @@
+-- Tables are annotated for Matriarch with -- matriarch: comments or COMMENT ON statements,
+-- see matriarch vschema generate.
 CREATE TABLE members (
-    id uuid,
+    id uuid, -- matriarch: primary_vindex
+    -- matriarch: lookup_vindex(table=members_email_lookup, unique=true)
     email varchar(128),
     hashed_password varchar(128),
     name varchar(128),
     PRIMARY KEY (id)
 );
 
+CREATE TABLE members_email_lookup (
+    value text NOT NULL,
+    keyspace_id text NOT NULL
+);
+
+CREATE UNIQUE INDEX members_email_lookup_value_idx ON members_email_lookup (value);
+
+-- matriarch: primary_vindex(id) secondary_vindex(ean)
 CREATE TABLE products (
     id uuid,
     name varchar(128),
@@ -16,20 +27,20 @@ CREATE TABLE products (
 );
 
 CREATE TABLE orders (
-    id uuid,
+    id uuid, -- matriarch: primary_vindex
     member_id uuid,
     amount decimal,
-    PRIMARY KEY (id),
+    PRIMARY KEY (id)
 );
 
 CREATE TABLE order_items (
     id uuid,
-    order_id uuid,
+    order_id uuid, -- matriarch: primary_vindex references(orders.id)
     product_id uuid,
     quantity int,
     amount int,
     PRIMARY KEY (id),
-    CONSTRAINT order_id FOREIGN KEY (order_id) REFERENCES orders (id),
+    CONSTRAINT order_id FOREIGN KEY (order_id) REFERENCES orders (id)
 );
 
 CREATE TABLE categories (
@@ -39,6 +50,14 @@ CREATE TABLE categories (
     PRIMARY KEY (id)
 );
 
+COMMENT ON TABLE categories IS 'Product categories, matriarch: reference';
+
+-- Backing table of the Matriarch sequences, only on the shard storing them
+CREATE TABLE matriarch_sequences (
+    name text PRIMARY KEY,
+    next_value bigint NOT NULL
+);
+
 -- Example queries
 SELECT
     *
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/vgheri/matriarch/parser/engine"
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+	"github.com/vgheri/matriarch/parser/sql/astutils"
+)
+
+// explainStep is a step of the execution of a statement by Matriarch, as returned by VEXPLAIN.
+type explainStep struct {
+	// Operation describes what Matriarch does, e.g. route, scatter or replicate.
+	Operation string
+	// Relations are the tables read or written by the step.
+	Relations []string
+	// VIndex is the vindex selecting the shard, as table(columns), followed by the lookup table of lookup vindexes.
+	VIndex string
+	// Table is the table of the primary vindex, whose function maps VIndexValues to keyspace ids, nil for lookup vindexes.
+	Table *Table
+	// KeyspaceIds are the keyspace ids selecting the shard when they are read from a lookup table, instead of being
+	// mapped from VIndexValues.
+	KeyspaceIds []uint64
+	// VIndexValues are the vindex values selecting the shard, normalised and concatenated, see Table.KeyspaceId.
+	VIndexValues []string
+	// Shard is the name of the shard executing the step, empty when it is only known at execution time.
+	Shard string
+	// SQL is the statement sent to the shard.
+	SQL string
+	// Executable reports whether SQL is executed as is by the shard, so that the step can be analyzed.
+	Executable bool
+}
+
+// explainStatement returns the statement explained by VEXPLAIN [ANALYZE] <statement> or by
+// EXPLAIN (MATRIARCH [, ANALYZE]) <statement>, and whether it must be analyzed. ok is false for other statements.
+func explainStatement(sql string) (stmt string, analyze bool, ok bool) {
+	var tokens []token
+	for _, t := range tokenize(sql) {
+		if t.Kind != tokenComment {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) < 2 || tokens[0].Kind != tokenIdent {
+		return "", false, false
+	}
+	switch strings.ToLower(tokens[0].Text) {
+	case "vexplain":
+		next := 1
+		if tokens[1].Kind == tokenIdent && strings.EqualFold(tokens[1].Text, "analyze") {
+			analyze = true
+			next++
+		}
+		if next == len(tokens) {
+			return "", false, false
+		}
+		// comments following VEXPLAIN, e.g. routing hints, are part of the explained statement
+		return strings.TrimSpace(sql[tokens[next-1].End:]), analyze, true
+	case "explain":
+		if tokens[1].Text != "(" {
+			return "", false, false
+		}
+		// options are a list of names, each one optionally followed by a boolean value
+		var matriarch bool
+		for i := 2; i < len(tokens); i++ {
+			if tokens[i].Text == ")" {
+				if !matriarch || i+1 == len(tokens) {
+					return "", false, false
+				}
+				return strings.TrimSpace(sql[tokens[i].End:]), analyze, true
+			}
+			if tokens[i].Text == "," || (tokens[i-1].Text != "(" && tokens[i-1].Text != ",") {
+				continue
+			}
+			enabled := true
+			if i+1 < len(tokens) && tokens[i+1].Text != "," && tokens[i+1].Text != ")" {
+				value := strings.Trim(strings.ToLower(tokens[i+1].Text), "'")
+				enabled = value != "false" && value != "off" && value != "0"
+			}
+			switch strings.ToLower(tokens[i].Text) {
+			case "matriarch":
+				matriarch = enabled
+			case "analyze":
+				analyze = enabled
+			}
+		}
+	}
+	return "", false, false
+}
+
+// processExplain returns the steps of the execution of a statement as a result set, with one row per step and shard.
+// When analyze is true, the statement is executed and the number of rows and the time spent by each shard are added.
+// Only SELECT statements executed as is by the shards can be analyzed.
+func (mock *PGMock) processExplain(sql string, analyze bool, cluster *Cluster, vschema *Vschema) error {
+	stmts, err := engine.NewParser().Parse(strings.NewReader(sql))
+	if err != nil {
+		return fmt.Errorf("cannot parse explained statement: %w", err)
+	}
+	if len(stmts) != 1 {
+		return errors.New("only one statement can be explained")
+	}
+	stmt := stmts[0]
+	text := statementText(sql, stmt.Raw)
+	offset := stmt.Raw.StmtLocation + strings.Index(sql[stmt.Raw.StmtLocation:], text)
+	text = mock.resolveStatement(stmt.Raw.Stmt, text, offset, vschema)
+	hint, err := mock.routingHint(text)
+	if err != nil {
+		return err
+	}
+	var steps []explainStep
+	if hint != nil {
+		steps, err = hintSteps(stmt.Raw.Stmt, hint, text, cluster, vschema)
+	} else {
+		steps, err = mock.explain(stmt.Raw.Stmt, text, cluster, vschema)
+	}
+	if err != nil {
+		return err
+	}
+	columns := []string{"operation", "relations", "vindex", "vindex_values", "keyspace_ids", "shard", "sql"}
+	if analyze {
+		columns = append(columns, "rows", "time_ms")
+	}
+	result := &pgconn.Result{}
+	for _, column := range columns {
+		result.FieldDescriptions = append(result.FieldDescriptions, pgproto3.FieldDescription{
+			Name: []byte(column), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1,
+		})
+	}
+	for _, step := range steps {
+		var keyspaceIds []string
+		for _, keyspaceId := range step.KeyspaceIds {
+			keyspaceIds = append(keyspaceIds, fmt.Sprintf("%016x", keyspaceId))
+		}
+		// values of lookup vindexes don't have a keyspace id
+		for _, value := range step.VIndexValues {
+			if step.Table == nil {
+				break
+			}
+			keyspaceId, err := step.Table.MapKeyspaceId(value)
+			if err != nil {
+				return err
+			}
+			keyspaceIds = append(keyspaceIds, fmt.Sprintf("%016x", keyspaceId))
+		}
+		row := [][]byte{
+			[]byte(step.Operation),
+			[]byte(strings.Join(step.Relations, ", ")),
+			[]byte(step.VIndex),
+			[]byte(strings.Join(step.VIndexValues, ", ")),
+			[]byte(strings.Join(keyspaceIds, ", ")),
+			[]byte(step.Shard),
+			[]byte(step.SQL),
+		}
+		if analyze {
+			if _, ok := stmt.Raw.Stmt.(*pg.SelectStmt); !ok || !step.Executable {
+				return errors.New("only SELECT statements executed as is by the shards can be analyzed")
+			}
+			rows, elapsed, err := analyzeStep(step, cluster)
+			if err != nil {
+				return err
+			}
+			row = append(row, []byte(fmt.Sprintf("%d", rows)), []byte(fmt.Sprintf("%.3f", elapsed.Seconds()*1000)))
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return mock.FinaliseExecuteSequence("EXPLAIN", []*pgconn.Result{result})
+}
+
+// analyzeStep executes a step and returns the number of rows returned by the shard and the time it took.
+func analyzeStep(step explainStep, cluster *Cluster) (int, time.Duration, error) {
+	for _, shard := range cluster.Shards {
+		if shard.Name == step.Shard {
+			start := time.Now()
+			result, err := queryShards(context.Background(), []*Shard{shard}, step.SQL)
+			if err != nil {
+				return 0, 0, err
+			}
+			return len(result.Rows), time.Since(start), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("cannot find shard %s", step.Shard)
+}
+
+// explain returns the steps of the execution of a statement, without executing it.
+// sql is the text of the statement.
+func (mock *PGMock) explain(stmt ast.Node, sql string, cluster *Cluster, vschema *Vschema) ([]explainStep, error) {
+	switch s := stmt.(type) {
+	case *pg.SelectStmt:
+		return mock.explainSelect(s, sql, cluster, vschema)
+	case *pg.InsertStmt:
+		return mock.explainInsert(s, sql, cluster, vschema)
+	case *pg.UpdateStmt:
+		return mock.explainDML(s, *s.Relation.Relname, s.WhereClause, "UPDATE", sql, cluster, vschema)
+	case *pg.DeleteStmt:
+		return mock.explainDML(s, *s.Relation.Relname, s.WhereClause, "DELETE", sql, cluster, vschema)
+	}
+	return nil, fmt.Errorf("cannot explain statement %s", sql)
+}
+
+// explainSelect returns the steps of the execution of a select statement, see processSelectStmt.
+func (mock *PGMock) explainSelect(s *pg.SelectStmt, sql string, cluster *Cluster, vschema *Vschema) ([]explainStep, error) {
+	if s.Op > 0 || hasSubqueries(s) {
+		return mock.explainSelectWithSubqueries(s, sql, cluster, vschema)
+	}
+	if isEmptyList(s.FromClause) {
+		return nil, errors.New("cannot route select statement without a FROM clause")
+	}
+	route, err := mock.planSelectRoute(s, cluster, vschema, nil)
+	if errors.Is(err, ErrNonColocatedJoin) {
+		return mock.explainCrossShardJoin(s, sql, cluster, vschema)
+	}
+	if err != nil {
+		return nil, err
+	}
+	step := explainStep{Operation: "route", Relations: route.Relations, SQL: sql, Executable: true}
+	var steps []explainStep
+	switch {
+	case route.Lookup != nil:
+		if steps, err = lookupSteps(route.Table, vschema.GetTable(route.Table), *route.Lookup, route.LookupValues, cluster); err != nil {
+			return nil, err
+		}
+		step.VIndex = lookupVIndexName(route.Table, *route.Lookup)
+		step.KeyspaceIds = route.LookupKeyspaceIds
+	case route.Table != "":
+		step.VIndex = vindexName(route.Table, vschema)
+		step.Table = vschema.GetTable(route.Table)
+		step.VIndexValues = route.KeyspaceIds
+	}
+	switch {
+	case route.Shards == nil:
+		step.Operation = "route to any shard"
+		step.Shard = cluster.AnyShard().Name
+		return append(steps, step), nil
+	case len(route.Shards) == 1:
+		if route.Unsharded != "" && route.Table == "" {
+			step.Operation = "route to unsharded shard"
+		}
+		step.Shard = route.Shards[0].Name
+		return append(steps, step), nil
+	}
+	// The statement is executed on several shards, see processScatterSelect
+	if !isEmptyList(s.SortClause) {
+		return nil, fmt.Errorf("ORDER BY clauses require all primary vindex columns in the where clause: %w", ErrMissingPrimaryVIndex)
+	}
+	if err := checkScatterSelect(s); err != nil {
+		return nil, err
+	}
+	for _, shard := range route.Shards {
+		step.Operation = "scatter"
+		step.Shard = shard.Name
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// explainSelectWithSubqueries returns the steps of the execution of a select statement containing subqueries,
+// see processSelectWithSubqueries. When the statement cannot be pushed down to a single shard, the steps
+// evaluating its uncorrelated subqueries are followed by a step executing the statement with their results,
+// whose shard is only known at execution time.
+func (mock *PGMock) explainSelectWithSubqueries(s *pg.SelectStmt, sql string, cluster *Cluster, vschema *Vschema) ([]explainStep, error) {
+	relations := statementRelations(s)
+	target, err := mock.routeSelectTree(sql, s, cluster, vschema, nil)
+	if err == nil {
+		step := explainStep{Operation: "route", Relations: relations, SQL: sql, Executable: true}
+		if target == nil {
+			step.Operation = "route to any shard"
+			target = cluster.AnyShard()
+		}
+		step.Shard = target.Name
+		return []explainStep{step}, nil
+	}
+	if !isRoutingError(err) {
+		return nil, err
+	}
+	ctes, err := withClauseNames(s, nil)
+	if err != nil {
+		return nil, err
+	}
+	var steps []explainStep
+	for _, span := range subquerySpans(sql) {
+		text := sql[span.Start+1 : span.End-1]
+		sub, err := mock.parseSelect(text, vschema)
+		if err != nil {
+			return nil, err
+		}
+		if referencesEnclosingRelations(sub, ctes) {
+			continue
+		}
+		if target, err := mock.routeSelectTree(text, sub, cluster, vschema, nil); err == nil && target == nil {
+			continue
+		}
+		subSteps, err := mock.explainSelect(sub, text, cluster, vschema)
+		if err != nil {
+			return nil, fmt.Errorf("cannot explain subquery %s: %w", text, err)
+		}
+		for _, step := range subSteps {
+			step.Operation = "subquery: " + step.Operation
+			steps = append(steps, step)
+		}
+	}
+	return append(steps, explainStep{Operation: "execute with subquery results", Relations: relations, SQL: sql}), nil
+}
+
+// explainCrossShardJoin returns the steps of the execution of a join between sharded tables which are not co-located,
+// see crossShardJoin.execute. The values looked up in the joined table are only known at execution time.
+func (mock *PGMock) explainCrossShardJoin(s *pg.SelectStmt, sql string, cluster *Cluster, vschema *Vschema) ([]explainStep, error) {
+	j, err := planCrossShardJoin(s, sql, vschema)
+	if err != nil {
+		return nil, err
+	}
+	left, shards, err := j.drivingTable(cluster, vschema)
+	if err != nil {
+		return nil, err
+	}
+	driving, lookup, lookupColumn := j.Left, j.Right, j.Condition.RightColumn
+	if !left {
+		driving, lookup, lookupColumn = j.Right, j.Left, j.Condition.LeftColumn
+	}
+	var steps []explainStep
+	for _, shard := range shards {
+		step := explainStep{
+			Operation:  "join: read driving table",
+			Relations:  []string{driving},
+			Shard:      shard.Name,
+			SQL:        j.tableQuery(vschema.GetTable(driving), ""),
+			Executable: true,
+		}
+		if len(shards) == 1 {
+			var values []string
+			for _, column := range vschema.GetTable(driving).GetPrimaryVIndex().Columns {
+				values = append(values, j.Equalities[driving][column])
+			}
+			keyspaceId, err := vschema.GetTable(driving).KeyspaceId(values)
+			if err != nil {
+				return nil, err
+			}
+			step.VIndex = vindexName(driving, vschema)
+			step.Table = vschema.GetTable(driving)
+			step.VIndexValues = []string{keyspaceId}
+		}
+		steps = append(steps, step)
+	}
+	step := explainStep{
+		Operation: "join: look up joined rows",
+		Relations: []string{lookup},
+		SQL:       j.tableQuery(vschema.GetTable(lookup), j.lookupCondition(lookup, lookupColumn, []string{"..."})),
+	}
+	if pv := vschema.GetTable(lookup).GetPrimaryVIndex(); len(pv.Columns) == 1 && pv.Columns[0] == lookupColumn {
+		step.VIndex = vindexName(lookup, vschema)
+		step.Table = vschema.GetTable(lookup)
+	}
+	return append(steps, step), nil
+}
+
+// explainInsert returns the steps of the execution of an INSERT statement, see processInsertStmt.
+func (mock *PGMock) explainInsert(s *pg.InsertStmt, sql string, cluster *Cluster, vschema *Vschema) ([]explainStep, error) {
+	relation := *s.Relation.Relname
+	table := vschema.GetTable(relation)
+	if table == nil {
+		return nil, fmt.Errorf("cannot process message, table %s is not part of the vschema", relation)
+	}
+	if table.Type == Reference {
+		return replicateSteps("INSERT", relation, sql, cluster), nil
+	}
+	if table.Type == Unsharded {
+		return unshardedSteps(s, table, sql, cluster, vschema)
+	}
+	if isEmptyList(s.Cols) {
+		return nil, fmt.Errorf("cannot insert rows without specifying the list of columns")
+	}
+	if sequenceColumnOmitted(s, table) {
+		// the keyspace ids are only known once the values of the sequence are allocated, see fillSequenceColumn
+		shard, err := cluster.sequenceShard(table)
+		if err != nil {
+			return nil, err
+		}
+		return []explainStep{{
+			Operation: fmt.Sprintf("fill column %s with sequence %s, when its values run out", table.Sequence.Column, table.Sequence.SequenceName(table)),
+			Relations: []string{sequenceTable},
+			Shard:     shard.Name,
+			SQL:       sequenceAllocation(table.Sequence.SequenceName(table), table.Sequence.blockSize()),
+		}, {
+			Operation: "insert rows in the shards owning their keyspace ids",
+			Relations: []string{relation},
+			VIndex:    vindexName(relation, vschema),
+			Table:     vschema.GetTable(relation),
+			SQL:       sql,
+		}}, nil
+	}
+	var columns []string
+	for _, item := range s.Cols.Items {
+		columns = append(columns, *item.(*pg.ResTarget).Name)
+	}
+	indexes, err := primaryVIndexIndexes(table, columns)
+	if err != nil {
+		return nil, err
+	}
+	ss, ok := s.SelectStmt.(*pg.SelectStmt)
+	if !ok {
+		return nil, fmt.Errorf("unknown type in InsertStmt->SelectStmt %#v", s.SelectStmt)
+	}
+	if isEmptyList(ss.ValuesLists) {
+		return mock.explainInsertSelect(ss, relation, indexes, sql, cluster, vschema)
+	}
+	if err := checkLookupInsert(s, table); err != nil {
+		return nil, err
+	}
+	targets, rowsByShard, keyspaceIds, err := insertRowsByShard(ss, indexes, table, cluster)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := insertLookupChanges(ss, columns, table)
+	if err != nil {
+		return nil, err
+	}
+	spans, err := valuesListSpans(sql)
+	if err != nil {
+		return nil, err
+	}
+	var steps []explainStep
+	for _, target := range targets {
+		step := explainStep{
+			Operation: "route",
+			Relations: []string{relation},
+			VIndex:    vindexName(relation, vschema),
+			Table:     vschema.GetTable(relation),
+			Shard:     target.Name,
+			SQL:       sql,
+		}
+		for _, row := range rowsByShard[target] {
+			if stringArrayContainsValue(step.VIndexValues, keyspaceIds[row]) == -1 {
+				step.VIndexValues = append(step.VIndexValues, keyspaceIds[row])
+			}
+		}
+		if len(targets) > 1 {
+			step.Operation = "insert rows in cross-shard transaction"
+			step.SQL = rewriteValuesList(sql, spans, rowsByShard[target])
+		} else if len(changes) > 0 {
+			step.Operation = "insert rows in cross-shard transaction"
+		}
+		steps = append(steps, step)
+	}
+	for _, change := range changes {
+		shard, err := cluster.GetShardForKeyspaceId(change.Value)
+		if err != nil {
+			return nil, err
+		}
+		operation := "insert lookup row in cross-shard transaction"
+		if change.VIndex.Lookup.Unique {
+			operation = "claim unique lookup value in cross-shard transaction"
+		}
+		steps = append(steps, explainStep{
+			Operation:   operation,
+			Relations:   []string{change.VIndex.Lookup.Table},
+			VIndex:      lookupVIndexName(relation, change.VIndex),
+			KeyspaceIds: []uint64{change.KeyspaceId},
+			Shard:       shard.Name,
+			SQL:         change.statement(),
+		})
+	}
+	return steps, nil
+}
+
+// explainInsertSelect returns the steps of the execution of an INSERT INTO ... SELECT statement, see processInsertSelectStmt.
+func (mock *PGMock) explainInsertSelect(source *pg.SelectStmt, relation string, indexes []int, sql string, cluster *Cluster, vschema *Vschema) ([]explainStep, error) {
+	sources := cluster.Shards
+	if isEmptyList(source.FromClause) {
+		sources = cluster.Shards[:1]
+	} else {
+		shards, err := mock.routeSelectShards(source, cluster, vschema, nil)
+		if err != nil {
+			return nil, err
+		}
+		if shards != nil {
+			sources = shards
+		}
+	}
+	var steps []explainStep
+	if isColocatedInsertSelect(source, vschema.GetTable(relation), indexes, vschema) {
+		for _, shard := range sources {
+			steps = append(steps, explainStep{
+				Operation: "insert selected rows in cross-shard transaction",
+				Relations: append([]string{relation}, statementRelations(source)...),
+				Shard:     shard.Name,
+				SQL:       sql,
+			})
+		}
+		return steps, nil
+	}
+	span, err := insertSelectSpan(sql)
+	if err != nil {
+		return nil, err
+	}
+	for _, shard := range sources {
+		steps = append(steps, explainStep{
+			Operation: "read rows to insert",
+			Relations: statementRelations(source),
+			Shard:     shard.Name,
+			SQL:       sql[span.Start:span.End],
+		})
+	}
+	return append(steps, explainStep{
+		Operation: "insert rows in cross-shard transaction",
+		Relations: []string{relation},
+		VIndex:    vindexName(relation, vschema),
+		Table:     vschema.GetTable(relation),
+		SQL:       sql[:span.Start] + "VALUES (...)" + sql[span.End:],
+	}), nil
+}
+
+// explainDML returns the steps of the execution of an UPDATE or DELETE statement, see processUpdateStmt and
+// processDeleteStmt.
+func (mock *PGMock) explainDML(stmt ast.Node, relation string, where ast.Node, command, sql string, cluster *Cluster, vschema *Vschema) ([]explainStep, error) {
+	table := vschema.GetTable(relation)
+	if table == nil {
+		return nil, fmt.Errorf("cannot process %s statement, table %s is not part of the vschema", command, relation)
+	}
+	if table.Type == Reference {
+		return replicateSteps(command, relation, sql, cluster), nil
+	}
+	if table.Type == Unsharded {
+		return unshardedSteps(stmt, table, sql, cluster, vschema)
+	}
+	update, _ := stmt.(*pg.UpdateStmt)
+	lookups := table.LookupVIndexes()
+	if update != nil {
+		lookups = updatedLookupVIndexes(update, table)
+	}
+	whereClauseColumns, whereClauseValues, err := parseDMLWhereClause(where, relation, command)
+	var targets []*Shard
+	var indexes []int
+	if err == nil {
+		targets, indexes, err = routeDMLShards(table, whereClauseColumns, whereClauseValues, cluster, command)
+	}
+	if err == nil && indexes == nil {
+		return lookupDMLSteps(stmt, relation, table, lookups, whereClauseColumns, whereClauseValues, sql, targets, cluster)
+	}
+	if err != nil {
+		if !mock.settings.AllowScatterDML {
+			return nil, fmt.Errorf("%w. Set %s to on to execute the statement on every shard", err, settingAllowScatterDML)
+		}
+		if len(lookups) > 0 {
+			return lookupWriteSteps(stmt, relation, table, lookups, sql, cluster.Shards, cluster)
+		}
+		var steps []explainStep
+		for _, shard := range cluster.Shards {
+			steps = append(steps, explainStep{
+				Operation: "scatter in cross-shard transaction",
+				Relations: []string{relation},
+				Shard:     shard.Name,
+				SQL:       sql,
+			})
+		}
+		return steps, nil
+	}
+	target := targets[0]
+	var values []string
+	for _, i := range indexes {
+		values = append(values, whereClauseValues[i])
+	}
+	keyspaceId, err := table.KeyspaceId(values)
+	if err != nil {
+		return nil, err
+	}
+	step := explainStep{
+		Operation:    "route",
+		Relations:    []string{relation},
+		VIndex:       vindexName(relation, vschema),
+		Table:        vschema.GetTable(relation),
+		VIndexValues: []string{keyspaceId},
+		Shard:        target.Name,
+		SQL:          sql,
+	}
+	if update != nil {
+		newKeyspaceId, updated, err := updatedKeyspaceId(update, table, whereClauseValues, indexes)
+		if err != nil {
+			return nil, err
+		}
+		if updated && len(table.LookupVIndexes()) > 0 {
+			return nil, fmt.Errorf("cannot update primary vindex columns of table %s with lookup vindexes", table.Key())
+		}
+		if updated {
+			newTarget, err := cluster.GetShardForTable(table, newKeyspaceId)
+			if err != nil {
+				return nil, fmt.Errorf("cannot select destination shard for UPDATE statement: %w", err)
+			}
+			if newTarget != target {
+				// see moveUpdatedRows
+				updateStmt, _ := splitReturningClause(sql)
+				step.Operation = "move rows: update and delete"
+				step.SQL = updateStmt + " RETURNING ctid, *"
+				return []explainStep{step, {
+					Operation:    "move rows: insert",
+					Relations:    []string{relation},
+					VIndex:       step.VIndex,
+					Table:        step.Table,
+					VIndexValues: []string{newKeyspaceId},
+					Shard:        newTarget.Name,
+					SQL:          fmt.Sprintf("INSERT INTO %s VALUES (...)", table.SQLName()),
+				}}, nil
+			}
+		}
+	}
+	if len(lookups) > 0 {
+		return lookupWriteSteps(stmt, relation, table, lookups, sql, targets, cluster)
+	}
+	return []explainStep{step}, nil
+}
+
+// replicateSteps returns the steps of the execution of a statement writing to a reference table on every shard.
+func replicateSteps(command, relation, sql string, cluster *Cluster) []explainStep {
+	var steps []explainStep
+	for _, shard := range cluster.Shards {
+		steps = append(steps, explainStep{
+			Operation: fmt.Sprintf("replicate %s in cross-shard transaction", command),
+			Relations: []string{relation},
+			Shard:     shard.Name,
+			SQL:       sql,
+		})
+	}
+	return steps
+}
+
+// unshardedSteps returns the step of the execution of a statement writing to an unsharded table, see execUnshardedStmt.
+func unshardedSteps(stmt ast.Node, table *Table, sql string, cluster *Cluster, vschema *Vschema) ([]explainStep, error) {
+	shard, err := unshardedStmtShard(stmt, table, cluster, vschema)
+	if err != nil {
+		return nil, err
+	}
+	return []explainStep{{Operation: "route to unsharded shard", Relations: statementRelations(stmt), Shard: shard.Name, SQL: sql}}, nil
+}
+
+// vindexName returns the primary vindex of a table as table(columns).
+func vindexName(relation string, vschema *Vschema) string {
+	return fmt.Sprintf("%s(%s)", relation, strings.Join(vschema.GetTable(relation).GetPrimaryVIndex().Columns, ", "))
+}
+
+// statementRelations returns the distinct relations referenced by a statement, including its subqueries.
+func statementRelations(stmt ast.Node) []string {
+	var relations []string
+	for _, node := range astutils.Search(stmt, func(node ast.Node) bool {
+		_, ok := node.(*pg.RangeVar)
+		return ok
+	}).Items {
+		if rv := node.(*pg.RangeVar); rv.Relname != nil && stringArrayContainsValue(relations, *rv.Relname) == -1 {
+			relations = append(relations, *rv.Relname)
+		}
+	}
+	return relations
+}
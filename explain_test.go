@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/vgheri/matriarch/parser/engine"
+)
+
+func TestExplainStatement(t *testing.T) {
+	tests := []struct {
+		sql     string
+		stmt    string
+		analyze bool
+		ok      bool
+	}{
+		{sql: "vexplain select * from orders", stmt: "select * from orders", ok: true},
+		{sql: "VEXPLAIN ANALYZE select * from orders", stmt: "select * from orders", analyze: true, ok: true},
+		{sql: "/* c */ vexplain delete from orders", stmt: "delete from orders", ok: true},
+		{sql: "explain (matriarch) select 1", stmt: "select 1", ok: true},
+		{sql: "EXPLAIN (MATRIARCH, ANALYZE) select 1", stmt: "select 1", analyze: true, ok: true},
+		{sql: "explain (analyze false, matriarch on) select 1", stmt: "select 1", ok: true},
+		{sql: "vexplain /* matriarch: scatter */ select 1", stmt: "/* matriarch: scatter */ select 1", ok: true},
+		{sql: "explain (matriarch off) select 1"},
+		{sql: "explain (analyze) select 1"},
+		{sql: "explain select 1"},
+		{sql: "vexplain"},
+		{sql: "select 'vexplain'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			stmt, analyze, ok := explainStatement(tt.sql)
+			if stmt != tt.stmt || analyze != tt.analyze || ok != tt.ok {
+				t.Fatalf("expected (%s, %t, %t), observed (%s, %t, %t)", tt.stmt, tt.analyze, tt.ok, stmt, analyze, ok)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	cluster := testCluster(t)
+	owned := findKeyspaceId(t, cluster, cluster.Shards[0], true)
+	other := findKeyspaceId(t, cluster, cluster.Shards[0], false)
+	tests := []struct {
+		name       string
+		sql        string
+		scatterDML bool
+		operations []string
+		shards     []string
+		sqls       []string
+		err        bool
+	}{
+		{
+			name:       "select routed to one shard",
+			sql:        fmt.Sprintf("select * from orders where id = '%s'", owned),
+			operations: []string{"route"},
+			shards:     []string{cluster.Shards[0].Name},
+		},
+		{
+			name:       "select scattered to the shards of the IN list",
+			sql:        fmt.Sprintf("select * from orders where id in ('%s', '%s')", owned, other),
+			operations: []string{"scatter", "scatter"},
+			shards:     []string{cluster.Shards[0].Name, cluster.Shards[1].Name},
+		},
+		{
+			name: "scattered select with ORDER BY",
+			sql:  "select * from orders order by id",
+			err:  true,
+		},
+		{
+			name:       "cross-shard join",
+			sql:        fmt.Sprintf("select * from members join orders on orders.member_id = members.id where members.id = '%s'", owned),
+			operations: []string{"join: read driving table", "join: look up joined rows"},
+			shards:     []string{cluster.Shards[0].Name, ""},
+		},
+		{
+			name:       "insert split between shards",
+			sql:        fmt.Sprintf("insert into orders (id, amount) values ('%s', 1), ('%s', 2)", owned, other),
+			operations: []string{"insert rows in cross-shard transaction", "insert rows in cross-shard transaction"},
+			shards:     []string{cluster.Shards[0].Name, cluster.Shards[1].Name},
+			sqls: []string{
+				fmt.Sprintf("insert into orders (id, amount) values ('%s', 1)", owned),
+				fmt.Sprintf("insert into orders (id, amount) values ('%s', 2)", other),
+			},
+		},
+		{
+			name:       "insert into reference table",
+			sql:        "insert into categories (id) values (1)",
+			operations: []string{"replicate INSERT in cross-shard transaction", "replicate INSERT in cross-shard transaction"},
+			shards:     []string{cluster.Shards[0].Name, cluster.Shards[1].Name},
+		},
+		{
+			name:       "update moving rows",
+			sql:        fmt.Sprintf("update orders set id = '%s' where id = '%s'", other, owned),
+			operations: []string{"move rows: update and delete", "move rows: insert"},
+			shards:     []string{cluster.Shards[0].Name, cluster.Shards[1].Name},
+		},
+		{
+			name: "delete without primary vindex",
+			sql:  "delete from orders where amount > 1",
+			err:  true,
+		},
+		{
+			name:       "scattered delete",
+			sql:        "delete from orders where amount > 1",
+			scatterDML: true,
+			operations: []string{"scatter in cross-shard transaction", "scatter in cross-shard transaction"},
+			shards:     []string{cluster.Shards[0].Name, cluster.Shards[1].Name},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &PGMock{logger: log.NewNopLogger(), settings: defaultSessionSettings()}
+			mock.settings.AllowScatterDML = tt.scatterDML
+			stmts, err := engine.NewParser().Parse(strings.NewReader(tt.sql))
+			if err != nil {
+				t.Fatalf("cannot parse %s: %v", tt.sql, err)
+			}
+			resolveRelations(stmts[0].Raw.Stmt, testVschema, []string{defaultSchema})
+			steps, err := mock.explain(stmts[0].Raw.Stmt, tt.sql, cluster, testVschema)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, test succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if len(steps) != len(tt.operations) {
+				t.Fatalf("expected %d steps, observed %+v", len(tt.operations), steps)
+			}
+			for i, step := range steps {
+				if step.Operation != tt.operations[i] || step.Shard != tt.shards[i] {
+					t.Fatalf("expected step %d to be %s on %s, observed %s on %s", i, tt.operations[i], tt.shards[i], step.Operation, step.Shard)
+				}
+				if tt.sqls != nil && step.SQL != tt.sqls[i] {
+					t.Fatalf("expected step %d to execute %s, observed %s", i, tt.sqls[i], step.SQL)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/vgheri/matriarch/pgpool"
+)
+
+// fakeResult is the result of a statement returned by a fakeShard.
+type fakeResult struct {
+	columns []string
+	rows    [][]string
+	tag     string
+	// err is the message of the error returned instead of the result, with the SQLSTATE code when set
+	err  string
+	code string
+}
+
+// fakeShard is a PostgreSQL server standing in for a shard in tests. It records the statements it receives
+// through the simple query protocol, and answers them with the result returned by respond, or with a command
+// tag made of the first keyword of the statement when respond is nil or returns no tag.
+type fakeShard struct {
+	listener net.Listener
+	respond  func(sql string) fakeResult
+
+	mu      sync.Mutex
+	queries []string
+}
+
+// startFakeShards starts a fakeShard for each shard of a keyspace and connects the shards to them.
+func startFakeShards(t *testing.T, keyspace string, count int, respond func(shard, sql string) fakeResult) (*Cluster, map[string]*fakeShard) {
+	t.Helper()
+	hosts := make([]string, count)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("localhost:%d", 5432+i)
+	}
+	shards, err := buildShards(keyspace, hosts)
+	if err != nil {
+		t.Fatalf("cannot build shards: %v", err)
+	}
+	fakes := make(map[string]*fakeShard)
+	for _, shard := range shards {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("cannot listen: %v", err)
+		}
+		name := shard.Name
+		fake := &fakeShard{listener: listener}
+		if respond != nil {
+			fake.respond = func(sql string) fakeResult { return respond(name, sql) }
+		}
+		go fake.serve()
+		shard.Host = listener.Addr().String()
+		shard.Conn, err = pgpool.Connect(context.Background(), fmt.Sprintf("postgres://%s/%s?sslmode=disable", shard.Host, shard.Name))
+		if err != nil {
+			t.Fatalf("cannot connect to fake shard %s: %v", shard.Name, err)
+		}
+		fakes[shard.Name] = fake
+	}
+	cluster := &Cluster{Shards: shards}
+	t.Cleanup(func() {
+		cluster.Shutdown()
+		for _, fake := range fakes {
+			fake.listener.Close()
+		}
+	})
+	return cluster, fakes
+}
+
+// Queries returns the statements received by the shard, except the ones opening and closing transactions.
+func (s *fakeShard) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var queries []string
+	for _, q := range s.queries {
+		switch strings.Fields(strings.ToUpper(q))[0] {
+		case "BEGIN", "COMMIT", "ROLLBACK", "PREPARE":
+			continue
+		}
+		queries = append(queries, q)
+	}
+	return queries
+}
+
+func (s *fakeShard) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *fakeShard) serveConn(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	for {
+		msg, err := backend.ReceiveStartupMessage()
+		if err != nil {
+			return
+		}
+		if _, ok := msg.(*pgproto3.SSLRequest); ok {
+			if _, err = conn.Write([]byte("N")); err != nil {
+				return
+			}
+			continue
+		}
+		break
+	}
+	if err := backend.Send(&pgproto3.AuthenticationOk{}); err != nil {
+		return
+	}
+	if err := backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'}); err != nil {
+		return
+	}
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		switch m := msg.(type) {
+		case *pgproto3.Query:
+			s.mu.Lock()
+			s.queries = append(s.queries, m.String)
+			s.mu.Unlock()
+			if err = s.sendResult(backend, m.String); err != nil {
+				return
+			}
+		case *pgproto3.Terminate:
+			return
+		}
+	}
+}
+
+func (s *fakeShard) sendResult(backend *pgproto3.Backend, sql string) error {
+	var res fakeResult
+	if s.respond != nil {
+		res = s.respond(sql)
+	}
+	if res.err != "" {
+		if err := backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: res.code, Message: res.err}); err != nil {
+			return err
+		}
+		return backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	}
+	if res.tag == "" {
+		res.tag = strings.ToUpper(strings.Fields(sql)[0])
+	}
+	if len(res.columns) > 0 {
+		fields := make([]pgproto3.FieldDescription, len(res.columns))
+		for i, column := range res.columns {
+			fields[i] = pgproto3.FieldDescription{Name: []byte(column), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1}
+		}
+		if err := backend.Send(&pgproto3.RowDescription{Fields: fields}); err != nil {
+			return err
+		}
+	}
+	for _, row := range res.rows {
+		values := make([][]byte, len(row))
+		for i, v := range row {
+			values[i] = []byte(v)
+		}
+		if err := backend.Send(&pgproto3.DataRow{Values: values}); err != nil {
+			return err
+		}
+	}
+	if err := backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(res.tag)}); err != nil {
+		return err
+	}
+	return backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+}
+
+// processQuery processes a query with a PGMock, as received from a client, and returns the command tags
+// sent back to the client.
+func processQuery(t *testing.T, sql string, cluster *Cluster, vschema *Vschema) ([]string, error) {
+	t.Helper()
+	tags, _, err := processQueryRows(t, sql, cluster, vschema)
+	return tags, err
+}
+
+// processQueryRows processes a query like processQuery, and also returns the rows sent back to the client.
+func processQueryRows(t *testing.T, sql string, cluster *Cluster, vschema *Vschema) ([]string, [][]string, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	mock := NewMock(server, log.NewNopLogger(), nil, false)
+	type received struct {
+		tags []string
+		rows [][]string
+	}
+	done := make(chan received, 1)
+	go func() {
+		frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(client), client)
+		var r received
+		for {
+			msg, err := frontend.Receive()
+			if err != nil {
+				done <- r
+				return
+			}
+			switch m := msg.(type) {
+			case *pgproto3.CommandComplete:
+				r.tags = append(r.tags, string(m.CommandTag))
+			case *pgproto3.DataRow:
+				var row []string
+				for _, v := range m.Values {
+					row = append(row, string(v))
+				}
+				r.rows = append(r.rows, row)
+			}
+		}
+	}()
+	err := mock.Process(&pgproto3.Query{String: sql}, cluster, vschema)
+	server.Close()
+	r := <-done
+	return r.tags, r.rows, err
+}
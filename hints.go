@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/vgheri/matriarch/parser/metadata"
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+)
+
+// routingHintPrefix starts the comments directing a statement to shards, e.g. /* matriarch: scatter */.
+const routingHintPrefix = "matriarch:"
+
+var ErrRoutingHintsDisabled = errors.New("routing hints are disabled")
+
+// routingHint directs a statement to shards, bypassing the planner. Hints are written in a comment
+// preceding the statement, with one of the forms:
+//
+//	/* matriarch: shard=<shard name> */
+//	/* matriarch: keyspace_id=<keyspace id> */, with the keyspace id in hexadecimal, as returned by VEXPLAIN
+//	/* matriarch: scatter */, to execute the statement on every shard
+type routingHint struct {
+	Shard      string
+	KeyspaceId uint64
+	Scatter    bool
+}
+
+// parseRoutingHint returns the routing hint of a statement, found in the comments preceding it,
+// or nil when the statement has no hint.
+func parseRoutingHint(sql string) (*routingHint, error) {
+	var hint *routingHint
+	for _, t := range tokenize(sql) {
+		if t.Kind != tokenComment {
+			break
+		}
+		directive, ok := metadata.Directive(t.Text, routingHintPrefix)
+		if !ok {
+			continue
+		}
+		if hint != nil {
+			return nil, errors.New("a statement can only have one routing hint")
+		}
+		hint = &routingHint{}
+		name, value := directive, ""
+		if i := strings.Index(directive, "="); i != -1 {
+			name, value = strings.TrimSpace(directive[:i]), strings.TrimSpace(directive[i+1:])
+		}
+		switch strings.ToLower(name) {
+		case "shard":
+			hint.Shard = value
+		case "keyspace_id":
+			keyspaceId, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(value), "0x"), 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid keyspace id in routing hint %s: %w", t.Text, err)
+			}
+			hint.KeyspaceId = keyspaceId
+		case "scatter":
+			hint.Scatter = true
+		default:
+			return nil, fmt.Errorf("invalid routing hint %s. Expected shard=<name>, keyspace_id=<hexadecimal id> or scatter", t.Text)
+		}
+		if (value == "") != hint.Scatter {
+			return nil, fmt.Errorf("invalid routing hint %s", t.Text)
+		}
+	}
+	return hint, nil
+}
+
+// Shards returns the shards of the cluster designated by the hint.
+func (h *routingHint) Shards(cluster *Cluster) ([]*Shard, error) {
+	if h.Scatter {
+		return cluster.Shards, nil
+	}
+	if h.Shard == "" {
+		shard, err := cluster.GetShardForChecksum(h.KeyspaceId)
+		if err != nil {
+			return nil, err
+		}
+		return []*Shard{shard}, nil
+	}
+	shard, err := cluster.GetShardByName(h.Shard)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing hint: %w", err)
+	}
+	return []*Shard{shard}, nil
+}
+
+// hintedCommand returns the name of a statement which can be directed by a routing hint.
+func hintedCommand(stmt ast.Node) (string, error) {
+	switch stmt.(type) {
+	case *pg.SelectStmt:
+		return "SELECT", nil
+	case *pg.InsertStmt:
+		return "INSERT", nil
+	case *pg.UpdateStmt:
+		return "UPDATE", nil
+	case *pg.DeleteStmt:
+		return "DELETE", nil
+	}
+	return "", errors.New("routing hints can only direct SELECT, INSERT, UPDATE and DELETE statements")
+}
+
+// writtenTable returns the table of the vschema written by an INSERT, UPDATE or DELETE statement, or nil.
+func writtenTable(stmt ast.Node, vschema *Vschema) *Table {
+	var relation *pg.RangeVar
+	switch s := stmt.(type) {
+	case *pg.InsertStmt:
+		relation = s.Relation
+	case *pg.UpdateStmt:
+		relation = s.Relation
+	case *pg.DeleteStmt:
+		relation = s.Relation
+	}
+	if relation == nil || relation.Relname == nil {
+		return nil
+	}
+	return vschema.GetTable(*relation.Relname)
+}
+
+// checkHintedWrite rejects the writes directed by a routing hint which Matriarch must process itself, as hinted
+// statements are executed as they are: writes to tables with lookup vindexes, whose lookup tables are maintained
+// by Matriarch and enforce the uniqueness of unique vindexes, and writes to tables with a sequence column, filled
+// by Matriarch. Writes to reference tables must be directed to every shard, otherwise their copies would diverge,
+// and writes to unsharded tables to the shard of the table, the only one it is read from.
+func checkHintedWrite(stmt ast.Node, shards []*Shard, cluster *Cluster, vschema *Vschema) error {
+	table := writtenTable(stmt, vschema)
+	if table == nil {
+		return nil
+	}
+	if lookups := table.LookupVIndexes(); len(lookups) > 0 {
+		return fmt.Errorf("routing hints cannot direct writes to table %s, as Matriarch maintains its lookup table %s",
+			table.Key(), lookups[0].Lookup.Table)
+	}
+	if table.Sequence != nil {
+		return fmt.Errorf("routing hints cannot direct writes to table %s, as Matriarch fills its sequence column %s",
+			table.Key(), table.Sequence.Column)
+	}
+	if table.Type == Reference && len(shards) != len(cluster.Shards) {
+		return fmt.Errorf("writes to reference table %s must be executed on every shard, with /* %s scatter */, "+
+			"as its copies would diverge", table.Key(), routingHintPrefix)
+	}
+	if table.Type == Unsharded {
+		shard, err := cluster.UnshardedShard(table)
+		if err != nil {
+			return err
+		}
+		if len(shards) != 1 || shards[0] != shard {
+			return fmt.Errorf("writes to unsharded table %s must be executed on its shard, with /* %s shard=%s */, "+
+				"as it is only read from that shard", table.Key(), routingHintPrefix, shard.Name)
+		}
+	}
+	return nil
+}
+
+// processHintedStmt executes a statement on the shards designated by its routing hint, as it is.
+// Rows returned by several shards are concatenated, and statements writing on several shards are executed
+// inside a cross-shard transaction. Some writes are rejected, see checkHintedWrite and checkReplicatedStmt.
+func (mock *PGMock) processHintedStmt(stmt ast.Node, hint *routingHint, q QueryMessage, cluster *Cluster, vschema *Vschema) error {
+	command, err := hintedCommand(stmt)
+	if err != nil {
+		return err
+	}
+	shards, err := hint.Shards(cluster)
+	if err != nil {
+		return err
+	}
+	if err = checkHintedWrite(stmt, shards, cluster, vschema); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if table := writtenTable(stmt, vschema); table != nil && table.Type == Reference {
+		if err = checkReplicatedStmt(ctx, stmt, table, cluster); err != nil {
+			return err
+		}
+	}
+	var names []string
+	for _, shard := range shards {
+		names = append(names, shard.Name)
+	}
+	mock.logger.Log("msg", fmt.Sprintf("routing hint, shards selected: %s", strings.Join(names, ", ")))
+	switch {
+	case len(shards) == 1:
+		res, err := shards[0].Conn.Exec(ctx, q.String)
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+		results, err := res.ReadAll()
+		if err != nil {
+			return err
+		}
+		return mock.FinaliseExecuteSequence(command, results)
+	case command == "SELECT":
+		result, err := queryShards(ctx, shards, q.String)
+		if err != nil {
+			return err
+		}
+		result.CommandTag = pgconn.CommandTag(fmt.Sprintf("SELECT %d", len(result.Rows)))
+		return mock.FinaliseExecuteSequence(command, []*pgconn.Result{result})
+	}
+	results, err := execInTransaction(ctx, shards, q.String)
+	if err != nil {
+		return err
+	}
+	return mock.FinaliseExecuteSequence(command, []*pgconn.Result{mergeResults(command, results)})
+}
+
+// routingHint returns the routing hint of a statement, or nil when the statement has none.
+// It returns ErrRoutingHintsDisabled for statements with a hint when hints are disabled.
+func (mock *PGMock) routingHint(sql string) (*routingHint, error) {
+	hint, err := parseRoutingHint(sql)
+	if err != nil || hint == nil {
+		return nil, err
+	}
+	if !mock.routingHints {
+		return nil, fmt.Errorf("%w, remove the comment %s... from the statement", ErrRoutingHintsDisabled, routingHintPrefix)
+	}
+	return hint, nil
+}
+
+// hintSteps returns the steps of the execution of a statement directed by a routing hint, see processHintedStmt.
+func hintSteps(stmt ast.Node, hint *routingHint, sql string, cluster *Cluster, vschema *Vschema) ([]explainStep, error) {
+	if _, err := hintedCommand(stmt); err != nil {
+		return nil, err
+	}
+	shards, err := hint.Shards(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkHintedWrite(stmt, shards, cluster, vschema); err != nil {
+		return nil, err
+	}
+	operation := "route by hint"
+	if len(shards) > 1 {
+		operation = "scatter by hint"
+	}
+	var steps []explainStep
+	for _, shard := range shards {
+		steps = append(steps, explainStep{
+			Operation:  operation,
+			Relations:  statementRelations(stmt),
+			Shard:      shard.Name,
+			SQL:        sql,
+			Executable: true,
+		})
+	}
+	return steps, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/vgheri/matriarch/parser/engine"
+)
+
+func TestParseRoutingHint(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected *routingHint
+		err      bool
+	}{
+		{sql: "select * from orders"},
+		{sql: "/* a comment */ select * from orders"},
+		{sql: "select /* matriarch: scatter */ * from orders"},
+		{sql: "/* matriarch: shard=ecommerce_80$ */ select * from orders", expected: &routingHint{Shard: "ecommerce_80$"}},
+		{sql: "-- matriarch: keyspace_id=0x00000000000000ff\nselect * from orders", expected: &routingHint{KeyspaceId: 0xff}},
+		{sql: "/* matriarch: SCATTER */ delete from orders", expected: &routingHint{Scatter: true}},
+		{sql: "/* matriarch: keyspace_id=xyz */ select * from orders", err: true},
+		{sql: "/* matriarch: shard= */ select * from orders", err: true},
+		{sql: "/* matriarch: scatter=true */ select * from orders", err: true},
+		{sql: "/* matriarch: replica */ select * from orders", err: true},
+		{sql: "/* matriarch: scatter */ /* matriarch: shard=ecommerce_80$ */ select * from orders", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			observed, err := parseRoutingHint(tt.sql)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, test succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if (observed == nil) != (tt.expected == nil) || (observed != nil && *observed != *tt.expected) {
+				t.Fatalf("expected hint %+v, observed %+v", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestRoutingHintShards(t *testing.T) {
+	cluster := testCluster(t)
+	owner, err := cluster.GetShardForKeyspaceId("a")
+	if err != nil {
+		t.Fatalf("cannot find shard owning keyspace id: %v", err)
+	}
+	tests := []struct {
+		hint     *routingHint
+		expected []*Shard
+		err      bool
+	}{
+		{hint: &routingHint{Shard: cluster.Shards[1].Name}, expected: cluster.Shards[1:]},
+		{hint: &routingHint{KeyspaceId: keyspaceIdChecksum("a")}, expected: []*Shard{owner}},
+		{hint: &routingHint{Scatter: true}, expected: cluster.Shards},
+		{hint: &routingHint{Shard: "ecommerce_40$"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%+v", *tt.hint), func(t *testing.T) {
+			observed, err := tt.hint.Shards(cluster)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, test succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if len(observed) != len(tt.expected) {
+				t.Fatalf("expected %d shards, observed %d", len(tt.expected), len(observed))
+			}
+			for i := range observed {
+				if observed[i] != tt.expected[i] {
+					t.Fatalf("expected shard %s, observed %s", tt.expected[i].Name, observed[i].Name)
+				}
+			}
+		})
+	}
+}
+
+func TestRoutingHintDisabled(t *testing.T) {
+	sql := "/* matriarch: scatter */ select * from orders"
+	mock := &PGMock{logger: log.NewNopLogger(), settings: defaultSessionSettings()}
+	if _, err := mock.routingHint(sql); !errors.Is(err, ErrRoutingHintsDisabled) {
+		t.Fatalf("expected error %v, got %v", ErrRoutingHintsDisabled, err)
+	}
+	mock.routingHints = true
+	if hint, err := mock.routingHint(sql); err != nil || hint == nil || !hint.Scatter {
+		t.Fatalf("expected scatter hint, observed %+v (%v)", hint, err)
+	}
+}
+
+func TestCheckHintedWrite(t *testing.T) {
+	vschema := &Vschema{
+		Keyspace: "ecommerce",
+		Tables: []Table{
+			{
+				Name:     "orders",
+				Type:     Sharded,
+				VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}},
+			},
+			{
+				Name: "members",
+				Type: Sharded,
+				VIndexes: []VIndex{
+					{Columns: []string{"id"}, Type: Primary},
+					{Columns: []string{"email"}, Type: Secondary, Lookup: &VIndexLookup{Table: "members_email_lookup", Unique: true}},
+				},
+			},
+			{
+				Name:     "invoices",
+				Type:     Sharded,
+				VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}},
+				Sequence: &Sequence{Column: "id"},
+			},
+			{
+				Name: "categories",
+				Type: Reference,
+			},
+			{
+				Name:  "promotions",
+				Type:  Unsharded,
+				Shard: "ecommerce_80$",
+			},
+		},
+	}
+	cluster := testCluster(t)
+	tests := []struct {
+		sql string
+		err bool
+	}{
+		{sql: "/* matriarch: shard=ecommerce_80$ */ insert into orders (id) values ('a')"},
+		{sql: "/* matriarch: scatter */ update orders set amount = 0"},
+		{sql: "/* matriarch: scatter */ select * from members"},
+		{sql: "/* matriarch: shard=ecommerce_80$ */ insert into members (id, email) values ('a', 'a@example.com')", err: true},
+		{sql: "/* matriarch: scatter */ update members set email = 'a@example.com'", err: true},
+		{sql: "/* matriarch: scatter */ delete from members", err: true},
+		{sql: "/* matriarch: shard=ecommerce_80$ */ insert into invoices (amount) values (1)", err: true},
+		{sql: "/* matriarch: scatter */ insert into categories (id) values (1)"},
+		{sql: "/* matriarch: shard=ecommerce_80$ */ select * from categories"},
+		{sql: "/* matriarch: shard=ecommerce_80$ */ insert into categories (id) values (1)", err: true},
+		{sql: "/* matriarch: keyspace_id=ff */ delete from categories", err: true},
+		{sql: "/* matriarch: shard=ecommerce_80$ */ insert into promotions (id) values (1)"},
+		{sql: "/* matriarch: shard=ecommerce_$80 */ select * from promotions"},
+		{sql: "/* matriarch: shard=ecommerce_$80 */ insert into promotions (id) values (1)", err: true},
+		{sql: "/* matriarch: scatter */ update promotions set code = 'a'", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			stmts, err := engine.NewParser().Parse(strings.NewReader(tt.sql))
+			if err != nil {
+				t.Fatalf("cannot parse %s: %v", tt.sql, err)
+			}
+			hint, err := parseRoutingHint(tt.sql)
+			if err != nil {
+				t.Fatalf("cannot parse routing hint of %s: %v", tt.sql, err)
+			}
+			shards, err := hint.Shards(cluster)
+			if err != nil {
+				t.Fatalf("cannot find the shards of routing hint %+v: %v", *hint, err)
+			}
+			err = checkHintedWrite(stmts[0].Raw.Stmt, shards, cluster, vschema)
+			if tt.err && err == nil {
+				t.Fatalf("expected error, test succeeded")
+			}
+			if !tt.err && err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+		})
+	}
+}
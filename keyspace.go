@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jackc/pgconn"
+)
+
+// KeyspaceConfig models an entry of the keyspaces file, declaring a keyspace served by Matriarch.
+// The name of the keyspace is the keyspace of its vschema.
+type KeyspaceConfig struct {
+	// The path of the vschema file of the keyspace.
+	Vschema string `json:"vschema"`
+	// The addresses of the PostgreSQL servers of the shards of the keyspace, as host:port.
+	Hosts []string `json:"hosts"`
+}
+
+// readKeyspacesFile reads the keyspaces file, a JSON array of keyspaces, e.g.
+// [{"vschema": "ecommerce.json", "hosts": ["localhost:5432", "localhost:5433"]}].
+func readKeyspacesFile(path string) ([]KeyspaceConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %v: %w", path, err)
+	}
+	var configs []KeyspaceConfig
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&configs); err != nil {
+		return nil, fmt.Errorf("cannot decode content of keyspaces file: %w", err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("keyspaces file %s declares no keyspace", path)
+	}
+	for i, config := range configs {
+		if config.Vschema == "" {
+			return nil, fmt.Errorf("keyspaces[%d].vschema: missing, the path of the vschema file", i)
+		}
+		if len(config.Hosts) == 0 {
+			return nil, fmt.Errorf("keyspaces[%d].hosts: missing, the addresses of the shards", i)
+		}
+	}
+	return configs, nil
+}
+
+// Keyspace is a keyspace served by Matriarch: the cluster of its shards, its vschema, the catalog of the tables
+// of its shards and the cache of the plans of its statements.
+type Keyspace struct {
+	Name     string
+	Cluster  *Cluster
+	Vschemas *vschemaStore
+	Catalog  *schemaCatalog
+	Plans    *planCache
+}
+
+// Keyspaces are the keyspaces served by Matriarch. Client connections select a keyspace with the database
+// parameter of their startup message.
+type Keyspaces []*Keyspace
+
+// openKeyspaces reads the vschema of each keyspace, connects to its shards, loads the catalog of their tables from
+// the first shard and prepares the vschema for them, see prepareVschema. Each keyspace has its own plan cache
+// holding at most planCacheSize plans.
+func openKeyspaces(ctx context.Context, configs []KeyspaceConfig, planCacheSize int, schemaCheck string, logger log.Logger) (Keyspaces, error) {
+	var keyspaces Keyspaces
+	for _, config := range configs {
+		vschema, err := readVschemaFile(config.Vschema)
+		if err != nil {
+			keyspaces.Shutdown()
+			return nil, fmt.Errorf("cannot read vschema file %s: %w", config.Vschema, err)
+		}
+		if keyspaces.get(vschema.Keyspace) != nil {
+			keyspaces.Shutdown()
+			return nil, fmt.Errorf("keyspace %s of vschema file %s is declared twice", vschema.Keyspace, config.Vschema)
+		}
+		// Create the cluster, opening a TCP connection with each shard
+		cluster, err := NewCluster(vschema.Keyspace, config.Hosts)
+		if err != nil {
+			keyspaces.Shutdown()
+			return nil, fmt.Errorf("cannot create cluster of keyspace %s: %w", vschema.Keyspace, err)
+		}
+		catalog, err := loadSchemaCatalog(ctx, cluster.Shards[0])
+		if err != nil {
+			cluster.Shutdown()
+			keyspaces.Shutdown()
+			return nil, fmt.Errorf("cannot load catalog of keyspace %s: %w", vschema.Keyspace, err)
+		}
+		if err = prepareVschema(ctx, cluster, vschema, schemaCheck, logger); err != nil {
+			cluster.Shutdown()
+			keyspaces.Shutdown()
+			return nil, fmt.Errorf("cannot prepare vschema of keyspace %s: %w", vschema.Keyspace, err)
+		}
+		keyspaces = append(keyspaces, &Keyspace{
+			Name:     vschema.Keyspace,
+			Cluster:  cluster,
+			Vschemas: newVschemaStore(config.Vschema, vschema, cluster, schemaCheck, logger),
+			Catalog:  catalog,
+			Plans:    newPlanCache(planCacheSize),
+		})
+	}
+	return keyspaces, nil
+}
+
+// get returns the keyspace with the given name, nil when there is none.
+func (k Keyspaces) get(name string) *Keyspace {
+	for _, keyspace := range k {
+		if keyspace.Name == name {
+			return keyspace
+		}
+	}
+	return nil
+}
+
+// Select returns the keyspace selected by the database of a client connection. When a single keyspace is served,
+// it is selected by any database, as clients often connect to a database named after their user.
+// Otherwise an unknown database is rejected with the error PostgreSQL reports for databases which don't exist.
+func (k Keyspaces) Select(database string) (*Keyspace, error) {
+	if keyspace := k.get(database); keyspace != nil {
+		return keyspace, nil
+	}
+	if len(k) == 1 {
+		return k[0], nil
+	}
+	names := make([]string, len(k))
+	for i, keyspace := range k {
+		names[i] = keyspace.Name
+	}
+	return nil, &pgconn.PgError{
+		Severity: "FATAL",
+		Code:     "3D000",
+		Message:  fmt.Sprintf("database \"%s\" does not exist", database),
+		Hint:     fmt.Sprintf("Matriarch serves the keyspaces %s.", strings.Join(names, ", ")),
+	}
+}
+
+// Reload reloads the vschema of every keyspace, see vschemaStore.Reload, and returns the errors of the keyspaces
+// whose vschema could not be reloaded.
+func (k Keyspaces) Reload(ctx context.Context) []error {
+	var errs []error
+	for _, keyspace := range k {
+		if _, _, err := keyspace.Vschemas.Reload(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("cannot reload vschema of keyspace %s, the active vschema is unchanged: %w", keyspace.Name, err))
+		}
+	}
+	return errs
+}
+
+// Shutdown closes the connections to the shards of every keyspace.
+func (k Keyspaces) Shutdown() {
+	for _, keyspace := range k {
+		keyspace.Cluster.Shutdown()
+	}
+}
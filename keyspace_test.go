@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestReadKeyspacesFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []KeyspaceConfig
+		err      string
+	}{
+		{
+			name: "keyspaces",
+			content: `[{"vschema": "ecommerce.json", "hosts": ["localhost:5432", "localhost:5433"]},
+				{"vschema": "billing.json", "hosts": ["localhost:5434"]}]`,
+			expected: []KeyspaceConfig{
+				{Vschema: "ecommerce.json", Hosts: []string{"localhost:5432", "localhost:5433"}},
+				{Vschema: "billing.json", Hosts: []string{"localhost:5434"}},
+			},
+		},
+		{name: "empty", content: `[]`, err: "declares no keyspace"},
+		{name: "unknown field", content: `[{"vschema": "ecommerce.json", "shards": []}]`, err: `unknown field "shards"`},
+		{name: "missing vschema", content: `[{"hosts": ["localhost:5432"]}]`, err: "keyspaces[0].vschema: missing"},
+		{name: "missing hosts", content: `[{"vschema": "ecommerce.json"}]`, err: "keyspaces[0].hosts: missing"},
+	}
+	dir, err := ioutil.TempDir("", "keyspaces")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "keyspaces.json")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("cannot write keyspaces file: %v", err)
+			}
+			observed, err := readKeyspacesFile(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %s, observed %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if !reflect.DeepEqual(observed, tt.expected) {
+				t.Fatalf("expected %+v, observed %+v", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestKeyspacesSelect(t *testing.T) {
+	ecommerce := &Keyspace{Name: "ecommerce"}
+	billing := &Keyspace{Name: "billing"}
+	tests := []struct {
+		name      string
+		keyspaces Keyspaces
+		database  string
+		expected  *Keyspace
+	}{
+		{name: "by name", keyspaces: Keyspaces{ecommerce, billing}, database: "billing", expected: billing},
+		{name: "single keyspace", keyspaces: Keyspaces{ecommerce}, database: "vgheri", expected: ecommerce},
+		{name: "unknown database", keyspaces: Keyspaces{ecommerce, billing}, database: "vgheri"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observed, err := tt.keyspaces.Select(tt.database)
+			if tt.expected != nil {
+				if err != nil || observed != tt.expected {
+					t.Fatalf("expected keyspace %s, observed %+v, error %v", tt.expected.Name, observed, err)
+				}
+				return
+			}
+			pgErr, ok := err.(*pgconn.PgError)
+			if !ok || pgErr.Severity != "FATAL" || pgErr.Code != "3D000" {
+				t.Fatalf("expected fatal error 3D000, observed %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+)
+
+// KeyspaceId returns the keyspace id of a row of the table, from the values of its primary vindex columns
+// in the order of the vindex. Values are normalised according to the type of their column, see normaliseValue,
+// so that the same logical key always produces the same keyspace id, e.g. 1, '1' and 1.0 for an integer column.
+func (t *Table) KeyspaceId(values []string) (string, error) {
+	columns := t.GetPrimaryVIndex().Columns
+	if len(values) != len(columns) {
+		return "", fmt.Errorf("expected %d values for the primary vindex of table %s, got %d", len(columns), t.Key(), len(values))
+	}
+	var concat string
+	for i, column := range columns {
+		value, err := normaliseValue(values[i], t.ColumnTypes[column])
+		if err != nil {
+			return "", fmt.Errorf("invalid value for column %s of table %s: %w", column, t.Key(), err)
+		}
+		concat = appendToConcatenate(concat, value)
+	}
+	return concat, nil
+}
+
+// normaliseValue returns the canonical text of a value of the given PostgreSQL type:
+// uuids are lower case with hyphens, integers are rounded and printed without decimals, numerics without
+// trailing zeros and bytea in hex format. Values of other types, or of an unknown type, are returned as they are.
+func normaliseValue(value, typ string) (string, error) {
+	switch typeCategory(typ) {
+	case "uuid":
+		digits := strings.TrimSpace(value)
+		if strings.HasPrefix(digits, "{") && strings.HasSuffix(digits, "}") {
+			digits = digits[1 : len(digits)-1]
+		}
+		digits = strings.ToLower(strings.ReplaceAll(digits, "-", ""))
+		if _, err := hex.DecodeString(digits); err != nil || len(digits) != 32 {
+			return "", fmt.Errorf("invalid input syntax for type uuid: \"%s\"", value)
+		}
+		return digits[:8] + "-" + digits[8:12] + "-" + digits[12:16] + "-" + digits[16:20] + "-" + digits[20:], nil
+	case "integer":
+		n, ok := parseNumber(value)
+		if !ok {
+			return "", fmt.Errorf("invalid input syntax for type %s: \"%s\"", typ, value)
+		}
+		// round half away from zero, as PostgreSQL does when casting a numeric to an integer
+		half := big.NewRat(1, 2)
+		if n.Sign() < 0 {
+			half.Neg(half)
+		}
+		n.Add(n, half)
+		return new(big.Int).Quo(n.Num(), n.Denom()).String(), nil
+	case "numeric":
+		switch v := strings.ToLower(strings.TrimSpace(value)); v {
+		case "nan":
+			return "NaN", nil
+		case "infinity", "+infinity", "inf", "+inf":
+			return "Infinity", nil
+		case "-infinity", "-inf":
+			return "-Infinity", nil
+		}
+		n, ok := parseNumber(value)
+		if !ok {
+			return "", fmt.Errorf("invalid input syntax for type %s: \"%s\"", typ, value)
+		}
+		scale := 0
+		for r := new(big.Rat).Set(n); !r.IsInt(); scale++ {
+			r.Mul(r, big.NewRat(10, 1))
+		}
+		return n.FloatString(scale), nil
+	case "bytea":
+		b, err := decodeBytea(value)
+		if err != nil {
+			return "", err
+		}
+		return `\x` + hex.EncodeToString(b), nil
+	}
+	return value, nil
+}
+
+// typeCategory returns the category of a PostgreSQL type name, as written in a vschema, in a cast or as returned
+// by format_type: uuid, integer, numeric or bytea. It returns an empty string for the other types.
+func typeCategory(typ string) string {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	typ = strings.TrimPrefix(typ, "pg_catalog.")
+	if i := strings.Index(typ, "("); i != -1 {
+		typ = strings.TrimSpace(typ[:i])
+	}
+	switch typ {
+	case "uuid":
+		return "uuid"
+	case "smallint", "integer", "int", "bigint", "int2", "int4", "int8",
+		"smallserial", "serial", "bigserial", "serial2", "serial4", "serial8":
+		return "integer"
+	case "numeric", "decimal", "real", "double precision", "float", "float4", "float8":
+		return "numeric"
+	case "bytea":
+		return "bytea"
+	}
+	return ""
+}
+
+// parseNumber parses an integer or a decimal number, with an optional exponent.
+func parseNumber(value string) (*big.Rat, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.ContainsAny(value, "/_") {
+		return nil, false
+	}
+	return new(big.Rat).SetString(value)
+}
+
+// decodeBytea decodes a bytea value in hex format, e.g. \x0aff, or in escape format, e.g. a\012\\.
+// See https://www.postgresql.org/docs/current/datatype-binary.html
+func decodeBytea(value string) ([]byte, error) {
+	if strings.HasPrefix(value, `\x`) {
+		b, err := hex.DecodeString(strings.Join(strings.Fields(value[2:]), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hexadecimal data for type bytea: \"%s\"", value)
+		}
+		return b, nil
+	}
+	var b []byte
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] != '\\':
+			b = append(b, value[i])
+		case strings.HasPrefix(value[i:], `\\`):
+			b = append(b, '\\')
+			i++
+		case i+3 < len(value) && value[i+1] >= '0' && value[i+1] <= '3' && isOctalDigit(value[i+2]) && isOctalDigit(value[i+3]):
+			b = append(b, (value[i+1]-'0')<<6|(value[i+2]-'0')<<3|(value[i+3]-'0'))
+			i += 3
+		default:
+			return nil, fmt.Errorf("invalid input syntax for type bytea: \"%s\"", value)
+		}
+	}
+	return b, nil
+}
+
+func isOctalDigit(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// constantValue returns the text of a constant expression of a statement: a string or numeric constant,
+// possibly negated or cast to a type, e.g. '42'::int. Cast values are normalised according to their type,
+// see normaliseValue.
+func constantValue(node ast.Node) (string, bool) {
+	switch n := node.(type) {
+	case *pg.A_Const:
+		switch val := n.Val.(type) {
+		case *pg.String:
+			return val.Str, true
+		case *pg.Float:
+			return val.Str, true
+		case *pg.Integer:
+			return fmt.Sprintf("%d", val.Ival), true
+		}
+	case *pg.TypeCast:
+		value, ok := constantValue(n.Arg)
+		if !ok || n.TypeName == nil || isEmptyList(n.TypeName.Names) {
+			return "", false
+		}
+		name, ok := n.TypeName.Names.Items[len(n.TypeName.Names.Items)-1].(*pg.String)
+		if !ok {
+			return "", false
+		}
+		value, err := normaliseValue(value, name.Str)
+		return value, err == nil
+	case *pg.A_Expr:
+		// unary minus, e.g. -'1'. Negative numbers are parsed as constants.
+		if n.Kind != 0 || !isEmptyNode(n.Lexpr) || len(n.Name.Items) != 1 {
+			return "", false
+		}
+		if op, ok := n.Name.Items[0].(*pg.String); !ok || op.Str != "-" {
+			return "", false
+		}
+		value, ok := constantValue(n.Rexpr)
+		if !ok {
+			return "", false
+		}
+		if strings.HasPrefix(value, "-") {
+			return value[1:], true
+		}
+		return "-" + value, true
+	}
+	return "", false
+}
+
+// missingColumnTypes returns the primary and lookup vindex columns of a sharded table whose type is not declared.
+func missingColumnTypes(table *Table) []string {
+	if table.Type != Sharded {
+		return nil
+	}
+	var missing []string
+	columns := append([]string{}, table.GetPrimaryVIndex().Columns...)
+	for _, v := range table.LookupVIndexes() {
+		columns = append(columns, v.Columns...)
+	}
+	for _, column := range columns {
+		if _, ok := table.ColumnTypes[column]; !ok && stringArrayContainsValue(missing, column) == -1 {
+			missing = append(missing, column)
+		}
+	}
+	return missing
+}
+
+// loadColumnTypes reads from the catalog of every shard the types of the primary and lookup vindex columns whose type
+// is not declared in the vschema. The types found on every shard are declared in the vschema. The columns missing from
+// a shard, or whose type differs between shards, are left without a type, so their values are not normalised, and
+// are listed in the error returned.
+func loadColumnTypes(ctx context.Context, cluster *Cluster, vschema *Vschema) error {
+	var problems []string
+	for i := range vschema.Tables {
+		table := &vschema.Tables[i]
+		missing := missingColumnTypes(table)
+		if len(missing) == 0 {
+			continue
+		}
+		sql := fmt.Sprintf("SELECT attname, format_type(atttypid, NULL) FROM pg_attribute "+
+			"WHERE attrelid = to_regclass(%s) AND attnum > 0 AND NOT attisdropped",
+			quoteLiteral(quoteIdentifier(table.SchemaName())+"."+quoteIdentifier(table.Name)))
+		loaded := make(map[string]string)
+		loadedFrom := make(map[string]string)
+		failed := make(map[string]bool)
+		for _, shard := range cluster.Shards {
+			result, err := queryShards(ctx, []*Shard{shard}, sql)
+			if err != nil {
+				return fmt.Errorf("cannot read column types of table %s: %w", table.Key(), err)
+			}
+			types := make(map[string]string)
+			for _, row := range result.Rows {
+				types[string(row[0])] = string(row[1])
+			}
+			for _, column := range missing {
+				typ, ok := types[column]
+				switch {
+				case !ok:
+					failed[column] = true
+					problems = append(problems, fmt.Sprintf("column %s of table %s not found on shard %s", column, table.Key(), shard.Name))
+				case loaded[column] == "":
+					loaded[column] = typ
+					loadedFrom[column] = shard.Name
+				case loaded[column] != typ:
+					failed[column] = true
+					problems = append(problems, fmt.Sprintf("column %s of table %s is of type %s on shard %s and %s on shard %s",
+						column, table.Key(), loaded[column], loadedFrom[column], typ, shard.Name))
+				}
+			}
+		}
+		for column, typ := range loaded {
+			if failed[column] {
+				continue
+			}
+			if table.ColumnTypes == nil {
+				table.ColumnTypes = make(map[string]string)
+			}
+			table.ColumnTypes[column] = typ
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("cannot read the types of vindex columns, their values are not normalised: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
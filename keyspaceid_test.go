@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+)
+
+func TestNormaliseValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		typ      string
+		expected string
+		err      bool
+	}{
+		{value: "8D007A96-4B5C-4F1E-9D6A-0F8E2C1B3A4D", typ: "uuid", expected: "8d007a96-4b5c-4f1e-9d6a-0f8e2c1b3a4d"},
+		{value: "{8d007a964b5c4f1e9d6a0f8e2c1b3a4d}", typ: "uuid", expected: "8d007a96-4b5c-4f1e-9d6a-0f8e2c1b3a4d"},
+		{value: "8d007a96", typ: "uuid", err: true},
+		{value: "42", typ: "integer", expected: "42"},
+		{value: "1.0", typ: "bigint", expected: "1"},
+		{value: "-2.5", typ: "int4", expected: "-3"},
+		{value: "1e3", typ: "pg_catalog.int8", expected: "1000"},
+		{value: "abc", typ: "integer", err: true},
+		{value: "1.50", typ: "numeric(10,2)", expected: "1.5"},
+		{value: "-0.0", typ: "numeric", expected: "0"},
+		{value: "nan", typ: "numeric", expected: "NaN"},
+		{value: `\x0AFF`, typ: "bytea", expected: `\x0aff`},
+		{value: `a\012\\`, typ: "bytea", expected: `\x610a5c`},
+		{value: `\9`, typ: "bytea", err: true},
+		{value: "ABC ", typ: "text", expected: "ABC "},
+		{value: "ABC", typ: "", expected: "ABC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ+" "+tt.value, func(t *testing.T) {
+			observed, err := normaliseValue(tt.value, tt.typ)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, test succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if observed != tt.expected {
+				t.Fatalf("expected %s, observed %s", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestConstantValue(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected string
+		ok       bool
+	}{
+		{sql: "select * from orders where id = 'a'", expected: "a", ok: true},
+		{sql: "select * from orders where id = -1", expected: "-1", ok: true},
+		{sql: "select * from orders where id = -'1'", expected: "-1", ok: true},
+		{sql: "select * from orders where id = 1.50", expected: "1.50", ok: true},
+		{sql: "select * from orders where id = '1.0'::int", expected: "1", ok: true},
+		{sql: "select * from orders where id = cast('8D007A96-4B5C-4F1E-9D6A-0F8E2C1B3A4D' as uuid)", expected: "8d007a96-4b5c-4f1e-9d6a-0f8e2c1b3a4d", ok: true},
+		{sql: "select * from orders where id = 'a'::uuid"},
+		{sql: "select * from orders where id = lower('A')"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			where, ok := parseSelectStmt(t, tt.sql).WhereClause.(*pg.A_Expr)
+			if !ok {
+				t.Fatalf("expected a where clause expression")
+			}
+			observed, ok := constantValue(where.Rexpr)
+			if ok != tt.ok || observed != tt.expected {
+				t.Fatalf("expected %s (%t), observed %s (%t)", tt.expected, tt.ok, observed, ok)
+			}
+		})
+	}
+}
+
+func TestTableKeyspaceId(t *testing.T) {
+	table := &Table{
+		Name:        "events",
+		Type:        Sharded,
+		ColumnTypes: map[string]string{"tenant_id": "bigint", "id": "uuid"},
+		VIndexes:    []VIndex{{Columns: []string{"tenant_id", "id"}, Type: Primary}},
+	}
+	expected := "1&8d007a96-4b5c-4f1e-9d6a-0f8e2c1b3a4d"
+	for _, values := range [][]string{
+		{"1", "8d007a96-4b5c-4f1e-9d6a-0f8e2c1b3a4d"},
+		{"1.0", "8D007A96-4B5C-4F1E-9D6A-0F8E2C1B3A4D"},
+	} {
+		observed, err := table.KeyspaceId(values)
+		if err != nil {
+			t.Fatalf("expected test to succeed, got error %v", err)
+		}
+		if observed != expected {
+			t.Fatalf("expected keyspace id %s, observed %s", expected, observed)
+		}
+	}
+	if _, err := table.KeyspaceId([]string{"1"}); err == nil {
+		t.Fatalf("expected missing value to error")
+	}
+	if _, err := table.KeyspaceId([]string{"one", "8d007a96-4b5c-4f1e-9d6a-0f8e2c1b3a4d"}); err == nil {
+		t.Fatalf("expected invalid integer to error")
+	}
+}
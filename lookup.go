@@ -0,0 +1,717 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+)
+
+// LookupVIndexes returns the secondary vindexes of the table backed by a lookup table.
+func (t *Table) LookupVIndexes() []VIndex {
+	var vindexes []VIndex
+	for _, v := range t.VIndexes {
+		if v.Type == Secondary && v.Lookup != nil {
+			vindexes = append(vindexes, v)
+		}
+	}
+	return vindexes
+}
+
+// LookupValue returns the value stored in the lookup table of a vindex of the table, from the values of the vindex
+// columns in the order of the vindex. Values are normalised according to the type of their column and joined with &,
+// as the values of the primary vindex, see KeyspaceId.
+func (t *Table) LookupValue(v VIndex, values []string) (string, error) {
+	if len(values) != len(v.Columns) {
+		return "", fmt.Errorf("expected %d values for the lookup vindex %s of table %s, got %d", len(v.Columns), v.Lookup.Table, t.Key(), len(values))
+	}
+	var concat string
+	for i, column := range v.Columns {
+		value, err := normaliseValue(values[i], t.ColumnTypes[column])
+		if err != nil {
+			return "", fmt.Errorf("invalid value for column %s of table %s: %w", column, t.Key(), err)
+		}
+		concat = appendToConcatenate(concat, value)
+	}
+	return concat, nil
+}
+
+// lookupTableName returns the name of the lookup table of a vindex of the table to use in SQL statements.
+func (t *Table) lookupTableName(v VIndex) string {
+	return quoteIdentifier(t.SchemaName()) + "." + quoteIdentifier(v.Lookup.Table)
+}
+
+// lookupVIndexName returns a lookup vindex of a table as table(columns) lookup table, as shown by VEXPLAIN.
+func lookupVIndexName(relation string, v VIndex) string {
+	return fmt.Sprintf("%s(%s) lookup %s", relation, strings.Join(v.Columns, ", "), v.Lookup.Table)
+}
+
+// lookupQuery returns the statement reading the keyspace ids of values from the lookup table of a vindex.
+func lookupQuery(table *Table, v VIndex, values []string) string {
+	literals := make([]string, len(values))
+	for i, value := range values {
+		literals[i] = quoteLiteral(value)
+	}
+	return fmt.Sprintf("SELECT DISTINCT keyspace_id FROM %s WHERE value IN (%s)", table.lookupTableName(v), strings.Join(literals, ", "))
+}
+
+// lookupValuesByShard groups values of a lookup vindex by the shard storing their rows in the lookup table,
+// i.e. the shard owning the crc64 keyspace id of the value. Shards are in the order of the shards of the cluster.
+func (c *Cluster) lookupValuesByShard(values []string) ([]*Shard, map[*Shard][]string, error) {
+	valuesByShard := make(map[*Shard][]string)
+	for _, value := range values {
+		shard, err := c.GetShardForKeyspaceId(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot select the shard of lookup value %s: %w", value, err)
+		}
+		if stringArrayContainsValue(valuesByShard[shard], value) == -1 {
+			valuesByShard[shard] = append(valuesByShard[shard], value)
+		}
+	}
+	var shards []*Shard
+	for _, shard := range c.Shards {
+		if _, ok := valuesByShard[shard]; ok {
+			shards = append(shards, shard)
+		}
+	}
+	return shards, valuesByShard, nil
+}
+
+// LookupKeyspaceIds returns the distinct keyspace ids stored in the lookup table of a vindex of the table for values, sorted.
+func (c *Cluster) LookupKeyspaceIds(ctx context.Context, table *Table, v VIndex, values []string) ([]uint64, error) {
+	shards, valuesByShard, err := c.lookupValuesByShard(values)
+	if err != nil {
+		return nil, err
+	}
+	var keyspaceIds []uint64
+	seen := make(map[uint64]bool)
+	for _, shard := range shards {
+		result, err := queryShards(ctx, []*Shard{shard}, lookupQuery(table, v, valuesByShard[shard]))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read lookup table %s: %w", v.Lookup.Table, err)
+		}
+		for _, row := range result.Rows {
+			keyspaceId, err := strconv.ParseUint(string(row[0]), 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid keyspace id %s in lookup table %s: %w", row[0], v.Lookup.Table, err)
+			}
+			if !seen[keyspaceId] {
+				seen[keyspaceId] = true
+				keyspaceIds = append(keyspaceIds, keyspaceId)
+			}
+		}
+	}
+	sort.Slice(keyspaceIds, func(i, j int) bool { return keyspaceIds[i] < keyspaceIds[j] })
+	return keyspaceIds, nil
+}
+
+// shardsOfKeyspaceIds returns the shards owning keyspace ids, in the order of the shards of the cluster.
+// Shards are nil when there is no keyspace id.
+func (c *Cluster) shardsOfKeyspaceIds(keyspaceIds []uint64) ([]*Shard, error) {
+	owners := make(map[*Shard]bool)
+	for _, keyspaceId := range keyspaceIds {
+		shard, err := c.GetShardForChecksum(keyspaceId)
+		if err != nil {
+			return nil, err
+		}
+		owners[shard] = true
+	}
+	var shards []*Shard
+	for _, shard := range c.Shards {
+		if owners[shard] {
+			shards = append(shards, shard)
+		}
+	}
+	return shards, nil
+}
+
+// lookupChange is a row inserted in, or deleted from, the lookup table of a vindex.
+type lookupChange struct {
+	Table  *Table
+	VIndex VIndex
+	// Values are the values of the vindex columns, and Value the lookup value computed from them.
+	Values     []string
+	Value      string
+	KeyspaceId uint64
+	Delete     bool
+}
+
+// statement returns the statement applying the change to the lookup table. Rows of non-unique vindexes can be
+// stored more than once, one per row of the table, so only one of them is deleted. Rows of unique vindexes are
+// not inserted when the value is already stored, see uniqueViolation.
+func (c lookupChange) statement() string {
+	name := c.Table.lookupTableName(c.VIndex)
+	value, keyspaceId := quoteLiteral(c.Value), quoteLiteral(fmt.Sprintf("%016x", c.KeyspaceId))
+	if c.Delete {
+		return fmt.Sprintf("DELETE FROM %s WHERE ctid IN (SELECT ctid FROM %s WHERE value = %s AND keyspace_id = %s LIMIT 1)",
+			name, name, value, keyspaceId)
+	}
+	if c.VIndex.Lookup.Unique {
+		return fmt.Sprintf("INSERT INTO %s (value, keyspace_id) VALUES (%s, %s) ON CONFLICT (value) DO NOTHING", name, value, keyspaceId)
+	}
+	return fmt.Sprintf("INSERT INTO %s (value, keyspace_id) VALUES (%s, %s)", name, value, keyspaceId)
+}
+
+// uniqueViolation returns the error reported when the value of a unique vindex inserted by the change is already
+// stored in the lookup table, as PostgreSQL reports the violation of a unique constraint named after the lookup table.
+func (c lookupChange) uniqueViolation() *pgconn.PgError {
+	return &pgconn.PgError{
+		Severity:       "ERROR",
+		Code:           "23505",
+		Message:        fmt.Sprintf("duplicate key value violates unique constraint \"%s\"", c.VIndex.Lookup.Table),
+		Detail:         fmt.Sprintf("Key (%s)=(%s) already exists.", strings.Join(c.VIndex.Columns, ", "), strings.Join(c.Values, ", ")),
+		SchemaName:     c.Table.SchemaName(),
+		TableName:      c.Table.Name,
+		ConstraintName: c.VIndex.Lookup.Table,
+	}
+}
+
+// applyLookupChanges applies changes to the lookup tables inside a cross-shard transaction. Rows are deleted before
+// rows are inserted, so that a statement can move a value of a unique vindex from a row to another.
+// Inserting a value of a unique vindex which is already stored fails with a unique violation error.
+func applyLookupChanges(ctx context.Context, tx *ShardTransaction, cluster *Cluster, changes []lookupChange) error {
+	ordered := append([]lookupChange{}, changes...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Delete && !ordered[j].Delete })
+	for _, change := range ordered {
+		shard, err := cluster.GetShardForKeyspaceId(change.Value)
+		if err != nil {
+			return fmt.Errorf("cannot select the shard of lookup value %s: %w", change.Value, err)
+		}
+		results, err := tx.Exec(ctx, shard, change.statement())
+		if err != nil {
+			return fmt.Errorf("cannot update lookup table %s: %w", change.VIndex.Lookup.Table, err)
+		}
+		if !change.Delete && change.VIndex.Lookup.Unique && results[len(results)-1].CommandTag.RowsAffected() == 0 {
+			return change.uniqueViolation()
+		}
+	}
+	return nil
+}
+
+// lookupRowColumns returns the columns of the table needed to maintain the lookup tables of vindexes:
+// the primary vindex columns, followed by the columns of the vindexes.
+func lookupRowColumns(table *Table, vindexes []VIndex) []string {
+	columns := append([]string{}, table.GetPrimaryVIndex().Columns...)
+	for _, v := range vindexes {
+		for _, column := range v.Columns {
+			if stringArrayContainsValue(columns, column) == -1 {
+				columns = append(columns, column)
+			}
+		}
+	}
+	return columns
+}
+
+// rowValues returns the values of columns in a row read with the columns rowColumns.
+// ok is false when one of the values is NULL.
+func rowValues(rowColumns []string, row [][]byte, columns []string) (values []string, ok bool) {
+	for _, column := range columns {
+		value := row[stringArrayContainsValue(rowColumns, column)]
+		if value == nil {
+			return nil, false
+		}
+		values = append(values, string(value))
+	}
+	return values, true
+}
+
+// lookupRowChanges returns the changes of the lookup tables of vindexes when a row of the table, with the columns
+// returned by lookupRowColumns, is written: before is nil when the row is inserted, after is nil when it is deleted.
+// Rows whose vindex columns are NULL are not stored in the lookup tables.
+func lookupRowChanges(table *Table, vindexes []VIndex, columns []string, before, after [][]byte) ([]lookupChange, error) {
+	row := before
+	if row == nil {
+		row = after
+	}
+	values, ok := rowValues(columns, row, table.GetPrimaryVIndex().Columns)
+	if !ok {
+		return nil, fmt.Errorf("cannot maintain lookup vindexes of table %s for a row with a NULL primary vindex column", table.Key())
+	}
+	concat, err := table.KeyspaceId(values)
+	if err != nil {
+		return nil, err
+	}
+	keyspaceId, err := table.MapKeyspaceId(concat)
+	if err != nil {
+		return nil, err
+	}
+	lookupValue := func(row [][]byte, v VIndex) ([]string, string, bool, error) {
+		if row == nil {
+			return nil, "", false, nil
+		}
+		values, ok := rowValues(columns, row, v.Columns)
+		if !ok {
+			return nil, "", false, nil
+		}
+		value, err := table.LookupValue(v, values)
+		return values, value, err == nil, err
+	}
+	var changes []lookupChange
+	for _, v := range vindexes {
+		oldValues, oldValue, hasOld, err := lookupValue(before, v)
+		if err != nil {
+			return nil, err
+		}
+		newValues, newValue, hasNew, err := lookupValue(after, v)
+		if err != nil {
+			return nil, err
+		}
+		if hasOld && hasNew && oldValue == newValue {
+			continue
+		}
+		if hasOld {
+			changes = append(changes, lookupChange{Table: table, VIndex: v, Values: oldValues, Value: oldValue, KeyspaceId: keyspaceId, Delete: true})
+		}
+		if hasNew {
+			changes = append(changes, lookupChange{Table: table, VIndex: v, Values: newValues, Value: newValue, KeyspaceId: keyspaceId})
+		}
+	}
+	return changes, nil
+}
+
+// insertLookupChanges returns the rows to insert in the lookup tables of the table for the rows of the VALUES lists
+// of an INSERT statement with the given columns. Vindex columns must be constants or NULL, and omitted columns are NULL.
+func insertLookupChanges(ss *pg.SelectStmt, columns []string, table *Table) ([]lookupChange, error) {
+	vindexes := table.LookupVIndexes()
+	if len(vindexes) == 0 {
+		return nil, nil
+	}
+	rowColumns := lookupRowColumns(table, vindexes)
+	var changes []lookupChange
+	for _, item := range ss.ValuesLists.Items {
+		values, ok := item.(*ast.List)
+		if !ok {
+			return nil, fmt.Errorf("unknown type in InsertStmt->SelectStmt->ValuesList %#v", item)
+		}
+		row := make([][]byte, len(rowColumns))
+		for i, column := range rowColumns {
+			j := stringArrayContainsValue(columns, column)
+			if j == -1 {
+				continue
+			}
+			value, isNull, err := lookupColumnValue(column, values.Items[j])
+			if err != nil {
+				return nil, err
+			}
+			if !isNull {
+				row[i] = []byte(value)
+			}
+		}
+		rowChanges, err := lookupRowChanges(table, vindexes, rowColumns, nil, row)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, rowChanges...)
+	}
+	return changes, nil
+}
+
+// checkLookupInsert refuses INSERT statements whose rows of the lookup tables cannot be computed before executing them:
+// rows selected from tables, and rows which might not be inserted because of an ON CONFLICT clause.
+func checkLookupInsert(s *pg.InsertStmt, table *Table) error {
+	if len(table.LookupVIndexes()) == 0 {
+		return nil
+	}
+	if s.OnConflictClause != nil {
+		return fmt.Errorf("ON CONFLICT clauses are not supported on table %s with lookup vindexes", table.Key())
+	}
+	if ss, ok := s.SelectStmt.(*pg.SelectStmt); ok && isEmptyList(ss.ValuesLists) {
+		return fmt.Errorf("rows inserted in table %s with lookup vindexes must be listed in a VALUES clause", table.Key())
+	}
+	return nil
+}
+
+// lookupColumnValue returns the value written in a column of a vindex, which must be a constant or NULL.
+func lookupColumnValue(column string, node ast.Node) (value string, isNull bool, err error) {
+	if c, ok := node.(*pg.A_Const); ok {
+		if _, ok := c.Val.(*pg.Null); ok {
+			return "", true, nil
+		}
+	}
+	value, ok := constantValue(node)
+	if !ok {
+		return "", false, fmt.Errorf("column %s part of a lookup vindex can only be written with a constant value", column)
+	}
+	return value, false, nil
+}
+
+// lookupAlternativeValues returns the lookup values of a vindex of a table, referenced as relation in the statement,
+// for each alternative of the where clause. ok is false when an alternative doesn't specify all the vindex columns.
+func lookupAlternativeValues(relation string, table *Table, v VIndex, alternatives []columnValues) (values []string, ok bool, err error) {
+	for _, alternative := range alternatives {
+		var columnValues []string
+		for _, column := range v.Columns {
+			value, found := alternative[tableColumn{relation, column}]
+			if !found {
+				return nil, false, nil
+			}
+			columnValues = append(columnValues, value)
+		}
+		value, err := table.LookupValue(v, columnValues)
+		if err != nil {
+			return nil, false, err
+		}
+		if stringArrayContainsValue(values, value) == -1 {
+			values = append(values, value)
+		}
+	}
+	return values, len(values) > 0, nil
+}
+
+// lookupVIndexRoute returns the route to the shards owning the rows of a table, referenced as relation in the statement,
+// found in the lookup table of the first lookup vindex whose columns are specified by every alternative of the where clause.
+// The route is nil when no lookup vindex can be used. Its shards are nil when the lookup table has no row for the values,
+// as the statement then reads no row of the table and can be served by any shard.
+func lookupVIndexRoute(relation string, table *Table, alternatives []columnValues, cluster *Cluster) (*selectRoute, error) {
+	for _, v := range table.LookupVIndexes() {
+		values, ok, err := lookupAlternativeValues(relation, table, v, alternatives)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		keyspaceIds, err := cluster.LookupKeyspaceIds(context.Background(), table, v, values)
+		if err != nil {
+			return nil, err
+		}
+		shards, err := cluster.shardsOfKeyspaceIds(keyspaceIds)
+		if err != nil {
+			return nil, fmt.Errorf("cannot select destination shard for select statement: %w", err)
+		}
+		lookup := v
+		return &selectRoute{Table: relation, Lookup: &lookup, LookupValues: values, LookupKeyspaceIds: keyspaceIds, Shards: shards}, nil
+	}
+	return nil, nil
+}
+
+// lookupDMLRoute returns the lookup vindex of a table whose columns are all compared to constants in the where clause
+// of an UPDATE or DELETE statement, with the lookup value of the where clause. ok is false when there is none.
+func lookupDMLRoute(table *Table, whereClauseColumns, whereClauseValues []string) (v VIndex, value string, ok bool, err error) {
+	if len(whereClauseColumns) != len(whereClauseValues) {
+		return VIndex{}, "", false, nil
+	}
+	for _, v := range table.LookupVIndexes() {
+		var values []string
+		for _, column := range v.Columns {
+			if i := stringArrayContainsValue(whereClauseColumns, column); i != -1 {
+				values = append(values, whereClauseValues[i])
+			}
+		}
+		if len(values) != len(v.Columns) {
+			continue
+		}
+		value, err := table.LookupValue(v, values)
+		if err != nil {
+			return VIndex{}, "", false, err
+		}
+		return v, value, true, nil
+	}
+	return VIndex{}, "", false, nil
+}
+
+// routeDMLShards returns the shards owning the rows targeted by an UPDATE or DELETE statement: the shard owning their
+// keyspace id when the where clause specifies all the primary vindex columns, see routeDMLStmt, otherwise the shards
+// owning the keyspace ids found in the lookup table of a vindex whose columns are all specified. indexes are returned
+// by routeDMLStmt, nil when the statement is routed with a lookup vindex.
+func routeDMLShards(table *Table, whereClauseColumns, whereClauseValues []string, cluster *Cluster, command string) ([]*Shard, []int, error) {
+	target, indexes, routeErr := routeDMLStmt(table, whereClauseColumns, whereClauseValues, cluster, command)
+	if routeErr == nil {
+		return []*Shard{target}, indexes, nil
+	}
+	v, value, ok, err := lookupDMLRoute(table, whereClauseColumns, whereClauseValues)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, routeErr
+	}
+	keyspaceIds, err := cluster.LookupKeyspaceIds(context.Background(), table, v, []string{value})
+	if err != nil {
+		return nil, nil, err
+	}
+	shards, err := cluster.shardsOfKeyspaceIds(keyspaceIds)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot select destination shard for %s statement: %w", command, err)
+	}
+	return shards, nil, nil
+}
+
+// execDMLStmt executes an UPDATE or DELETE statement on the shards owning the rows it writes, inside a cross-shard
+// transaction when there are several of them. Without shard, e.g. when the lookup table of a vindex has no row for
+// the values of the where clause, the statement doesn't write any row and is executed on any shard.
+func (mock *PGMock) execDMLStmt(command string, q QueryMessage, shards []*Shard, cluster *Cluster) error {
+	if len(shards) == 0 {
+		shards = []*Shard{cluster.AnyShard()}
+	}
+	var names []string
+	for _, shard := range shards {
+		names = append(names, shard.Name)
+	}
+	mock.logger.Log("msg", fmt.Sprintf("shards selected: %s", strings.Join(names, ", ")))
+	if len(shards) > 1 {
+		results, err := execInTransaction(context.Background(), shards, q.String)
+		if err != nil {
+			return err
+		}
+		return mock.FinaliseExecuteSequence(command, []*pgconn.Result{mergeResults(command, results)})
+	}
+	res, err := shards[0].Conn.Exec(context.Background(), q.String)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	results, err := res.ReadAll()
+	if err != nil {
+		return err
+	}
+	return mock.FinaliseExecuteSequence(command, results)
+}
+
+// updatedLookupVIndexes returns the lookup vindexes of the table with columns updated by an UPDATE statement.
+func updatedLookupVIndexes(s *pg.UpdateStmt, table *Table) []VIndex {
+	var vindexes []VIndex
+	for _, v := range table.LookupVIndexes() {
+		for _, item := range s.TargetList.Items {
+			if t, ok := item.(*pg.ResTarget); ok && stringArrayContainsValue(v.Columns, *t.Name) != -1 {
+				vindexes = append(vindexes, v)
+				break
+			}
+		}
+	}
+	return vindexes
+}
+
+// lookupRowsQuery returns the statement reading and locking the rows written by an UPDATE or DELETE statement,
+// with the columns returned by lookupRowColumns. The statement can only read a single table.
+func lookupRowsQuery(sql string, relation *pg.RangeVar, table *Table, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(quoted, ", "), table.SQLName())
+	if relation.Alias != nil && relation.Alias.Aliasname != nil {
+		query += " AS " + quoteIdentifier(*relation.Alias.Aliasname)
+	}
+	if span, ok := whereClauseSpan(sql); ok {
+		query += " WHERE " + sql[span.Start:span.End]
+	}
+	return query + " FOR UPDATE"
+}
+
+// lookupDMLTarget returns the table written by an UPDATE or DELETE statement maintaining lookup tables,
+// and the values assigned to the columns by UPDATE statements, nil for DELETE statements.
+func lookupDMLTarget(stmt ast.Node, table *Table) (*pg.RangeVar, map[string]ast.Node, error) {
+	switch s := stmt.(type) {
+	case *pg.DeleteStmt:
+		if s.WithClause != nil || !isEmptyList(s.UsingClause) {
+			return nil, nil, fmt.Errorf("DELETE statements on table %s with lookup vindexes cannot have WITH or USING clauses", table.Key())
+		}
+		return s.Relation, nil, nil
+	case *pg.UpdateStmt:
+		if s.WithClause != nil || !isEmptyList(s.FromClause) {
+			return nil, nil, fmt.Errorf("UPDATE statements of lookup vindex columns of table %s cannot have WITH or FROM clauses", table.Key())
+		}
+		assignments := make(map[string]ast.Node)
+		for _, item := range s.TargetList.Items {
+			if t, ok := item.(*pg.ResTarget); ok {
+				assignments[*t.Name] = t.Val
+			}
+		}
+		return s.Relation, assignments, nil
+	}
+	return nil, nil, errors.New("lookup vindexes are only maintained by INSERT, UPDATE and DELETE statements")
+}
+
+// execWithLookups executes an UPDATE or DELETE statement on shards inside a cross-shard transaction, together with
+// the changes of the lookup tables of vindexes: the rows written by the statement are first read and locked, so that
+// the lookup rows of their old values are deleted, and the lookup rows of their new values inserted.
+// The new values of updated vindex columns must be constants or NULL.
+func (mock *PGMock) execWithLookups(command string, stmt ast.Node, table *Table, vindexes []VIndex, q QueryMessage, shards []*Shard, cluster *Cluster) error {
+	relation, assignments, err := lookupDMLTarget(stmt, table)
+	if err != nil {
+		return err
+	}
+	columns := lookupRowColumns(table, vindexes)
+	// the new values of the updated columns are the same for every row
+	updated := make(map[int][]byte)
+	for i, column := range columns {
+		val, ok := assignments[column]
+		if !ok {
+			continue
+		}
+		value, isNull, err := lookupColumnValue(column, val)
+		if err != nil {
+			return err
+		}
+		updated[i] = nil
+		if !isNull {
+			updated[i] = []byte(value)
+		}
+	}
+	query := lookupRowsQuery(q.String, relation, table, columns)
+	if len(shards) == 0 {
+		shards = []*Shard{cluster.AnyShard()}
+	}
+	ctx := context.Background()
+	tx, err := NewShardTransaction()
+	if err != nil {
+		return err
+	}
+	var results []*pgconn.Result
+	var changes []lookupChange
+	for _, shard := range shards {
+		mock.logger.Log("msg", fmt.Sprintf("shard selected: %s, maintaining lookup vindexes", shard.Name))
+		rows, err := tx.Exec(ctx, shard, query)
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		for _, before := range rows[len(rows)-1].Rows {
+			var after [][]byte
+			if assignments != nil {
+				after = append([][]byte{}, before...)
+				for i, value := range updated {
+					after[i] = value
+				}
+			}
+			rowChanges, err := lookupRowChanges(table, vindexes, columns, before, after)
+			if err != nil {
+				tx.Rollback(ctx)
+				return err
+			}
+			changes = append(changes, rowChanges...)
+		}
+		res, err := tx.Exec(ctx, shard, q.String)
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		results = append(results, res...)
+	}
+	if err = applyLookupChanges(ctx, tx, cluster, changes); err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	return mock.FinaliseExecuteSequence(command, []*pgconn.Result{mergeResults(command, results)})
+}
+
+// lookupSteps returns the steps reading the keyspace ids of values from the lookup table of a vindex of a table,
+// referenced as relation in the statement, see LookupKeyspaceIds.
+func lookupSteps(relation string, table *Table, v VIndex, values []string, cluster *Cluster) ([]explainStep, error) {
+	shards, valuesByShard, err := cluster.lookupValuesByShard(values)
+	if err != nil {
+		return nil, err
+	}
+	var steps []explainStep
+	for _, shard := range shards {
+		steps = append(steps, explainStep{
+			Operation:    "lookup keyspace ids",
+			Relations:    []string{v.Lookup.Table},
+			VIndex:       lookupVIndexName(relation, v),
+			VIndexValues: valuesByShard[shard],
+			Shard:        shard.Name,
+			SQL:          lookupQuery(table, v, valuesByShard[shard]),
+			Executable:   true,
+		})
+	}
+	return steps, nil
+}
+
+// lookupWriteSteps returns the steps of the execution of an UPDATE or DELETE statement maintaining the lookup tables
+// of vindexes, see execWithLookups.
+func lookupWriteSteps(stmt ast.Node, relation string, table *Table, vindexes []VIndex, sql string, shards []*Shard, cluster *Cluster) ([]explainStep, error) {
+	target, assignments, err := lookupDMLTarget(stmt, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(shards) == 0 {
+		shards = []*Shard{cluster.AnyShard()}
+	}
+	var steps []explainStep
+	for _, shard := range shards {
+		steps = append(steps, explainStep{
+			Operation: "read written rows in cross-shard transaction",
+			Relations: []string{relation},
+			Shard:     shard.Name,
+			SQL:       lookupRowsQuery(sql, target, table, lookupRowColumns(table, vindexes)),
+		}, explainStep{
+			Operation: "write rows in cross-shard transaction",
+			Relations: []string{relation},
+			Shard:     shard.Name,
+			SQL:       sql,
+		})
+	}
+	for _, v := range vindexes {
+		name := table.lookupTableName(v)
+		statements := fmt.Sprintf("DELETE FROM %s WHERE ctid IN (SELECT ctid FROM %s WHERE value = ... AND keyspace_id = ... LIMIT 1)", name, name)
+		if assignments != nil {
+			statements += fmt.Sprintf("; INSERT INTO %s (value, keyspace_id) VALUES (...)", name)
+			if v.Lookup.Unique {
+				statements += " ON CONFLICT (value) DO NOTHING"
+			}
+		}
+		steps = append(steps, explainStep{
+			Operation: "update lookup rows of written rows",
+			Relations: []string{v.Lookup.Table},
+			VIndex:    lookupVIndexName(relation, v),
+			SQL:       statements,
+		})
+	}
+	return steps, nil
+}
+
+// lookupDMLSteps returns the steps of the execution of an UPDATE or DELETE statement routed to shards with a lookup
+// vindex, see routeDMLShards. vindexes are the lookup vindexes maintained by the statement.
+func lookupDMLSteps(stmt ast.Node, relation string, table *Table, vindexes []VIndex, whereClauseColumns, whereClauseValues []string,
+	sql string, shards []*Shard, cluster *Cluster) ([]explainStep, error) {
+	if update, ok := stmt.(*pg.UpdateStmt); ok {
+		for _, item := range update.TargetList.Items {
+			if t, ok := item.(*pg.ResTarget); ok && stringArrayContainsValue(table.GetPrimaryVIndex().Columns, *t.Name) != -1 {
+				return nil, fmt.Errorf("cannot update column %s part of the primary vindex without all primary vindex columns being present in the where clause", *t.Name)
+			}
+		}
+	}
+	v, value, _, err := lookupDMLRoute(table, whereClauseColumns, whereClauseValues)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := lookupSteps(relation, table, v, []string{value}, cluster)
+	if err != nil {
+		return nil, err
+	}
+	if len(vindexes) > 0 {
+		writeSteps, err := lookupWriteSteps(stmt, relation, table, vindexes, sql, shards, cluster)
+		if err != nil {
+			return nil, err
+		}
+		return append(steps, writeSteps...), nil
+	}
+	operation := "route"
+	switch {
+	case len(shards) == 0:
+		operation = "route to any shard"
+		shards = []*Shard{cluster.AnyShard()}
+	case len(shards) > 1:
+		operation = "write rows in cross-shard transaction"
+	}
+	for _, shard := range shards {
+		steps = append(steps, explainStep{
+			Operation: operation,
+			Relations: []string{relation},
+			VIndex:    lookupVIndexName(relation, v),
+			Shard:     shard.Name,
+			SQL:       sql,
+		})
+	}
+	return steps, nil
+}
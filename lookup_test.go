@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgconn"
+
+	"github.com/vgheri/matriarch/parser/engine"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+)
+
+func testLookupTable() *Table {
+	return &Table{
+		Name:        "members",
+		Type:        Sharded,
+		ColumnTypes: map[string]string{"id": "bigint"},
+		VIndexes: []VIndex{
+			{Columns: []string{"id"}, Type: Primary, Function: "identity"},
+			{Columns: []string{"email"}, Type: Secondary, Lookup: &VIndexLookup{Table: "members_email_lookup"}},
+			{Columns: []string{"country", "city"}, Type: Secondary, Lookup: &VIndexLookup{Table: "members_city_lookup"}},
+			{Columns: []string{"name"}, Type: Secondary},
+		},
+	}
+}
+
+func TestLookupRowChanges(t *testing.T) {
+	table := testLookupTable()
+	vindexes := table.LookupVIndexes()
+	columns := lookupRowColumns(table, vindexes)
+	if expected := []string{"id", "email", "country", "city"}; !reflect.DeepEqual(columns, expected) {
+		t.Fatalf("expected columns %v, observed %v", expected, columns)
+	}
+	row := func(values ...string) [][]byte {
+		r := make([][]byte, len(values))
+		for i, v := range values {
+			if v != "NULL" {
+				r[i] = []byte(v)
+			}
+		}
+		return r
+	}
+	email, city := vindexes[0], vindexes[1]
+	tests := []struct {
+		name     string
+		before   [][]byte
+		after    [][]byte
+		expected []lookupChange
+		err      bool
+	}{
+		{
+			name:  "insert",
+			after: row("7.0", "a@b.c", "fr", "paris"),
+			expected: []lookupChange{
+				{Table: table, VIndex: email, Values: []string{"a@b.c"}, Value: "a@b.c", KeyspaceId: 7},
+				{Table: table, VIndex: city, Values: []string{"fr", "paris"}, Value: "fr&paris", KeyspaceId: 7},
+			},
+		},
+		{
+			name:     "insert with NULL vindex column",
+			after:    row("7", "a@b.c", "fr", "NULL"),
+			expected: []lookupChange{{Table: table, VIndex: email, Values: []string{"a@b.c"}, Value: "a@b.c", KeyspaceId: 7}},
+		},
+		{
+			name:   "delete",
+			before: row("7", "a@b.c", "NULL", "NULL"),
+			expected: []lookupChange{
+				{Table: table, VIndex: email, Values: []string{"a@b.c"}, Value: "a@b.c", KeyspaceId: 7, Delete: true},
+			},
+		},
+		{
+			name:   "update",
+			before: row("7", "a@b.c", "fr", "paris"),
+			after:  row("7", "d@e.f", "fr", "paris"),
+			expected: []lookupChange{
+				{Table: table, VIndex: email, Values: []string{"a@b.c"}, Value: "a@b.c", KeyspaceId: 7, Delete: true},
+				{Table: table, VIndex: email, Values: []string{"d@e.f"}, Value: "d@e.f", KeyspaceId: 7},
+			},
+		},
+		{
+			name:   "update to NULL",
+			before: row("7", "a@b.c", "fr", "paris"),
+			after:  row("7", "a@b.c", "fr", "NULL"),
+			expected: []lookupChange{
+				{Table: table, VIndex: city, Values: []string{"fr", "paris"}, Value: "fr&paris", KeyspaceId: 7, Delete: true},
+			},
+		},
+		{
+			name:  "NULL primary vindex",
+			after: row("NULL", "a@b.c", "fr", "paris"),
+			err:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observed, err := lookupRowChanges(table, vindexes, columns, tt.before, tt.after)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, test succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if !reflect.DeepEqual(observed, tt.expected) {
+				t.Fatalf("expected %+v, observed %+v", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestInsertLookupChanges(t *testing.T) {
+	table := testLookupTable()
+	tests := []struct {
+		sql    string
+		values []string
+		err    bool
+	}{
+		{
+			sql:    "insert into members (id, email, country, city) values (1, 'a@b.c', 'fr', 'paris'), (2, NULL, 'fr', 'lyon')",
+			values: []string{"a@b.c", "fr&paris", "fr&lyon"},
+		},
+		{
+			sql:    "insert into members (id, name) values (1, 'a')",
+			values: nil,
+		},
+		{
+			sql: "insert into members (id, email) values (1, lower('A@B.C'))",
+			err: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			s := parseInsertStmt(t, tt.sql)
+			var columns []string
+			for _, item := range s.Cols.Items {
+				columns = append(columns, *item.(*pg.ResTarget).Name)
+			}
+			changes, err := insertLookupChanges(s.SelectStmt.(*pg.SelectStmt), columns, table)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, test succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			var values []string
+			for _, change := range changes {
+				if change.Delete {
+					t.Fatalf("expected only insertions, observed %+v", change)
+				}
+				values = append(values, change.Value)
+			}
+			if !reflect.DeepEqual(values, tt.values) {
+				t.Fatalf("expected lookup values %v, observed %v", tt.values, values)
+			}
+		})
+	}
+}
+
+func TestLookupChangeStatement(t *testing.T) {
+	table := testLookupTable()
+	change := lookupChange{Table: table, VIndex: table.LookupVIndexes()[0], Value: "o'neil", KeyspaceId: 255}
+	expected := `INSERT INTO "public"."members_email_lookup" (value, keyspace_id) VALUES ('o''neil', '00000000000000ff')`
+	if observed := change.statement(); observed != expected {
+		t.Fatalf("expected %s, observed %s", expected, observed)
+	}
+	change.Delete = true
+	expected = `DELETE FROM "public"."members_email_lookup" WHERE ctid IN (SELECT ctid FROM "public"."members_email_lookup" ` +
+		`WHERE value = 'o''neil' AND keyspace_id = '00000000000000ff' LIMIT 1)`
+	if observed := change.statement(); observed != expected {
+		t.Fatalf("expected %s, observed %s", expected, observed)
+	}
+}
+
+func TestUniqueLookupChange(t *testing.T) {
+	table := testLookupTable()
+	v := table.LookupVIndexes()[1]
+	v.Lookup = &VIndexLookup{Table: v.Lookup.Table, Unique: true}
+	change := lookupChange{Table: table, VIndex: v, Values: []string{"fr", "paris"}, Value: "fr&paris", KeyspaceId: 255}
+	expected := `INSERT INTO "public"."members_city_lookup" (value, keyspace_id) VALUES ('fr&paris', '00000000000000ff') ON CONFLICT (value) DO NOTHING`
+	if observed := change.statement(); observed != expected {
+		t.Fatalf("expected %s, observed %s", expected, observed)
+	}
+	err := change.uniqueViolation()
+	if err.Code != "23505" || err.ConstraintName != "members_city_lookup" || err.TableName != "members" {
+		t.Fatalf("expected a unique violation of members_city_lookup on members, observed %+v", err)
+	}
+	if expected := "Key (country, city)=(fr, paris) already exists."; err.Detail != expected {
+		t.Fatalf("expected detail %s, observed %s", expected, err.Detail)
+	}
+}
+
+func TestLookupRowsQuery(t *testing.T) {
+	table := testLookupTable()
+	tests := []struct {
+		sql      string
+		expected string
+	}{
+		{
+			sql:      "delete from members m where m.email = 'a@b.c' returning *",
+			expected: `SELECT "id", "email" FROM "members" AS "m" WHERE m.email = 'a@b.c' FOR UPDATE`,
+		},
+		{
+			sql:      "update members set email = 'd@e.f' where id = 1 and (name = 'a' or name = 'b');",
+			expected: `SELECT "id", "email" FROM "members" WHERE id = 1 and (name = 'a' or name = 'b') FOR UPDATE`,
+		},
+		{
+			sql:      "delete from members",
+			expected: `SELECT "id", "email" FROM "members" FOR UPDATE`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			stmts, err := engine.NewParser().Parse(strings.NewReader(tt.sql))
+			if err != nil {
+				t.Fatalf("cannot parse %s: %v", tt.sql, err)
+			}
+			relation, _, err := lookupDMLTarget(stmts[0].Raw.Stmt, table)
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			columns := lookupRowColumns(table, table.LookupVIndexes()[:1])
+			if observed := lookupRowsQuery(tt.sql, relation, table, columns); observed != tt.expected {
+				t.Fatalf("expected %s, observed %s", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestLookupDMLRoute(t *testing.T) {
+	table := testLookupTable()
+	v, value, ok, err := lookupDMLRoute(table, []string{"name", "city", "country"}, []string{"a", "paris", "fr"})
+	if err != nil || !ok {
+		t.Fatalf("expected a lookup vindex, observed %t (%v)", ok, err)
+	}
+	if v.Lookup.Table != "members_city_lookup" || value != "fr&paris" {
+		t.Fatalf("expected value fr&paris of members_city_lookup, observed %s of %s", value, v.Lookup.Table)
+	}
+	if _, _, ok, _ = lookupDMLRoute(table, []string{"name", "city"}, []string{"a", "paris"}); ok {
+		t.Fatalf("expected no lookup vindex")
+	}
+}
+
+func TestExecWithLookups(t *testing.T) {
+	vschema := &Vschema{
+		Keyspace: "ecommerce",
+		Tables: []Table{{
+			Name: "members",
+			Type: Sharded,
+			VIndexes: []VIndex{
+				{Columns: []string{"id"}, Type: Primary},
+				{Columns: []string{"email"}, Type: Secondary, Lookup: &VIndexLookup{Table: "members_email_lookup", Unique: true}},
+			},
+		}},
+	}
+	table := vschema.GetTable("members")
+	concat, err := table.KeyspaceId([]string{"m1"})
+	if err != nil {
+		t.Fatalf("cannot compute keyspace id: %v", err)
+	}
+	keyspaceId, err := table.MapKeyspaceId(concat)
+	if err != nil {
+		t.Fatalf("cannot map keyspace id: %v", err)
+	}
+	var claimed bool
+	cluster, shards := startFakeShards(t, "ecommerce", 2, func(shard, sql string) fakeResult {
+		switch {
+		case strings.HasPrefix(sql, "SELECT DISTINCT keyspace_id"):
+			return fakeResult{columns: []string{"keyspace_id"}, rows: [][]string{{fmt.Sprintf("%016x", keyspaceId)}}}
+		case strings.HasPrefix(sql, `SELECT "id", "email"`):
+			return fakeResult{columns: []string{"id", "email"}, rows: [][]string{{"m1", "a@example.com"}}}
+		case strings.HasPrefix(sql, "DELETE FROM"):
+			return fakeResult{tag: "DELETE 1"}
+		case strings.HasPrefix(sql, "INSERT INTO") && claimed:
+			return fakeResult{tag: "INSERT 0 1"}
+		case strings.HasPrefix(sql, "INSERT INTO"):
+			return fakeResult{tag: "INSERT 0 0"}
+		case strings.HasPrefix(sql, "delete"):
+			return fakeResult{tag: "DELETE 1"}
+		case strings.HasPrefix(sql, "update"):
+			return fakeResult{tag: "UPDATE 1"}
+		}
+		return fakeResult{}
+	})
+	owner, err := cluster.GetShardForChecksum(keyspaceId)
+	if err != nil {
+		t.Fatalf("cannot find shard owning keyspace id: %v", err)
+	}
+	lookupShard := func(value string) string {
+		shard, err := cluster.GetShardForKeyspaceId(value)
+		if err != nil {
+			t.Fatalf("cannot find shard of lookup value: %v", err)
+		}
+		return shard.Name
+	}
+	type query struct {
+		shard string
+		sql   string
+	}
+	lookupQuery := query{lookupShard("a@example.com"),
+		`SELECT DISTINCT keyspace_id FROM "public"."members_email_lookup" WHERE value IN ('a@example.com')`}
+	rowsQuery := query{owner.Name, `SELECT "id", "email" FROM "members" WHERE email = 'a@example.com' FOR UPDATE`}
+	deleteLookup := query{lookupShard("a@example.com"), fmt.Sprintf(`DELETE FROM "public"."members_email_lookup" `+
+		`WHERE ctid IN (SELECT ctid FROM "public"."members_email_lookup" WHERE value = 'a@example.com' AND keyspace_id = '%016x' LIMIT 1)`, keyspaceId)}
+	insertLookup := query{lookupShard("b@example.com"), fmt.Sprintf(`INSERT INTO "public"."members_email_lookup" (value, keyspace_id) `+
+		`VALUES ('b@example.com', '%016x') ON CONFLICT (value) DO NOTHING`, keyspaceId)}
+	deleteSQL := "delete from members where email = 'a@example.com'"
+	updateSQL := "update members set email = 'b@example.com' where email = 'a@example.com'"
+	tests := []struct {
+		name     string
+		sql      string
+		claimed  bool
+		expected []query
+		tag      string
+		err      bool
+	}{
+		{
+			name:     "delete",
+			sql:      deleteSQL,
+			expected: []query{lookupQuery, rowsQuery, {owner.Name, deleteSQL}, deleteLookup},
+			tag:      "DELETE 1",
+		},
+		{
+			name:     "update",
+			sql:      updateSQL,
+			claimed:  true,
+			expected: []query{lookupQuery, rowsQuery, {owner.Name, updateSQL}, deleteLookup, insertLookup},
+			tag:      "UPDATE 1",
+		},
+		{
+			name:     "update to a value already claimed",
+			sql:      updateSQL,
+			expected: []query{lookupQuery, rowsQuery, {owner.Name, updateSQL}, deleteLookup, insertLookup},
+			err:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, shard := range shards {
+				shard.mu.Lock()
+				shard.queries = nil
+				shard.mu.Unlock()
+			}
+			claimed = tt.claimed
+			tags, err := processQuery(t, tt.sql, cluster, vschema)
+			if tt.err {
+				var pgErr *pgconn.PgError
+				if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+					t.Fatalf("expected a unique violation, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			} else if !reflect.DeepEqual(tags, []string{tt.tag}) {
+				t.Fatalf("expected command tags %v, observed %v", []string{tt.tag}, tags)
+			}
+			expected := make(map[string][]string)
+			for _, q := range tt.expected {
+				expected[q.shard] = append(expected[q.shard], q.sql)
+			}
+			for name, shard := range shards {
+				if observed := shard.Queries(); !reflect.DeepEqual(observed, expected[name]) {
+					t.Fatalf("expected shard %s to execute %v, observed %v", name, expected[name], observed)
+				}
+				if !tt.err {
+					continue
+				}
+				shard.mu.Lock()
+				queries := strings.Join(shard.queries, "\n")
+				shard.mu.Unlock()
+				if strings.Contains(queries, "COMMIT") || (name == owner.Name && !strings.Contains(queries, "ROLLBACK")) {
+					t.Fatalf("expected shard %s to roll back the update, observed %s", name, queries)
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
@@ -19,20 +24,38 @@ var options struct {
 	listenAddress   string
 	hosts           string
 	vschemaFilePath string
+	keyspacesPath   string
 	logLevel        string
+	planCacheSize   int
+	routingHints    bool
+	schemaCheck     string
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "vschema" {
+		os.Exit(vschemaCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage:  %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %s vschema validate [-vschema path] [path...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %s vschema check [-vschema path] [-hosts hosts]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %s vschema generate -keyspace name ddl\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
 	flag.StringVar(&options.listenAddress, "listen", "127.0.0.1:15432", "Proxy listen address")
 	flag.StringVar(&options.hosts, "hosts", "localhost:5432,localhost:5433", "Comma separated list of PostgreSQL server addresses, without empty spaces")
 	flag.StringVar(&options.vschemaFilePath, "vschema", "vschema.json", "Vschema file path")
+	flag.StringVar(&options.keyspacesPath, "keyspaces", "", "Keyspaces file path, declaring the vschema and hosts of each keyspace served, replaces -vschema and -hosts")
 	flag.StringVar(&options.logLevel, "loglevel", "INFO", "Allowed levels: ALL, DEBUG, INFO, WARN, ERROR, NONE")
+	flag.BoolVar(&options.routingHints, "routing-hints", true, "Allow statements to be directed to shards with /* matriarch: ... */ comments")
+	flag.IntVar(&options.planCacheSize, "plan-cache-size", 1000, "Maximum number of statement plans cached, 0 disables the cache")
+	flag.StringVar(&options.schemaCheck, "schema-check", "warn", "Check the vschema against the shard schemas on startup: warn, strict (refuse to start on mismatch) or off")
 	flag.Parse()
+	if options.schemaCheck != "warn" && options.schemaCheck != "strict" && options.schemaCheck != "off" {
+		fmt.Fprintf(os.Stderr, "invalid -schema-check value %s, allowed values are warn, strict and off\n", options.schemaCheck)
+		os.Exit(2)
+	}
 
 	logger := configureLogger(options.logLevel)
 
@@ -44,24 +67,31 @@ func main() {
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go listenForSignals(signals, quit, level.Warn(logger))
 
-	// read vschema file
-	vschema, err := readVschemaFile(options.vschemaFilePath)
-	if err != nil {
-		level.Error(logger).Log("msg", fmt.Sprintf("cannot read vschema file: %s", err.Error()))
-		os.Exit(1)
+	// Without keyspaces file, a single keyspace is served, read from the vschema file
+	configs := []KeyspaceConfig{{Vschema: options.vschemaFilePath, Hosts: strings.Split(options.hosts, ",")}}
+	var err error
+	if options.keyspacesPath != "" {
+		if configs, err = readKeyspacesFile(options.keyspacesPath); err != nil {
+			level.Error(logger).Log("msg", fmt.Sprintf("cannot read keyspaces file: %s", err.Error()))
+			os.Exit(1)
+		}
 	}
-
-	hosts := strings.Split(options.hosts, ",")
-	// Create the cluster, opening a TCP connection with each shard
-	cluster, err := NewCluster(vschema.Keyspace, hosts)
+	// Open the keyspaces, connecting to their shards. Plans are shared by all the client connections to a keyspace
+	keyspaces, err := openKeyspaces(context.Background(), configs, options.planCacheSize, options.schemaCheck, logger)
 	if err != nil {
-		level.Error(logger).Log("msg", fmt.Sprintf("cannot create new cluster: %s", err.Error()))
+		level.Error(logger).Log("msg", err.Error())
 		os.Exit(1)
 	}
-	defer cluster.Shutdown()
-	for _, s := range cluster.Shards {
-		level.Info(logger).Log("msg", fmt.Sprintf("Connected to %s - %s\n", s.Host, s.Name))
+	defer keyspaces.Shutdown()
+	for _, keyspace := range keyspaces {
+		for _, s := range keyspace.Cluster.Shards {
+			level.Info(logger).Log("msg", fmt.Sprintf("Connected to %s - %s\n", s.Host, s.Name))
+		}
 	}
+	// The vschemas are reloaded on SIGHUP and by the RELOAD VSCHEMA command
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go reloadOnSignal(reloads, keyspaces, logger)
 
 	// Start accepting connections from clients
 	ln, err := net.Listen("tcp", options.listenAddress)
@@ -86,7 +116,9 @@ func main() {
 
 	level.Info(logger).Log("msg", fmt.Sprintf("Matriarch started and listening on port %s", options.listenAddress))
 
-	go cluster.Stats(level.Debug(logger))
+	for _, keyspace := range keyspaces {
+		go keyspace.Cluster.Stats(level.Debug(logger))
+	}
 	// main control loop
 	for {
 		// wait for a new client connection
@@ -105,7 +137,7 @@ func main() {
 		quitChannels = append(quitChannels, quitChan)
 		// each client connection lifecycle is managed in its own goroutine
 		go func(clientConn net.Conn, wg *sync.WaitGroup, q chan bool, logger log.Logger) {
-			mock := NewMock(clientConn, logger)
+			mock := NewMock(clientConn, logger, keyspaces, options.routingHints)
 			defer func() {
 				if !mock.IsClosed() {
 					if err := mock.Close(); err != nil {
@@ -136,8 +168,17 @@ func main() {
 					return
 				}
 				// For each incoming client connection, parse the query to identify the shard(s) involved and create a proxy for each backend involved, then send the query
-				err = mock.Process(msg, cluster, vschema)
+				// Each message is processed with the vschema of the keyspace active when it is received
+				keyspace := mock.Keyspace()
+				err = mock.Process(msg, keyspace.Cluster, keyspace.Vschemas.Load())
 				if err != nil {
+					var partial *PartialCommitError
+					if errors.As(err, &partial) {
+						for _, p := range partial.Pending {
+							level.Error(logger).Log("msg", "prepared transaction of a partially committed transaction must be committed manually",
+								"shard", p.Shard, "gid", p.Gid, "committed", strings.Join(partial.Committed, ","))
+						}
+					}
 					logger.Log("msg", fmt.Sprintf("cannot process message from client: %s", err.Error()))
 					mock.SendError(err)
 					return
@@ -183,3 +224,112 @@ func listenForSignals(signals chan os.Signal, quit chan bool, logger log.Logger)
 	logger.Log("msg", fmt.Sprintf("received signal %s", sig.String()))
 	quit <- true // TODO replace with close(quit)
 }
+
+// reloadOnSignal reloads the vschemas of the keyspaces each time a signal is received.
+// Invalid vschema files are logged and ignored.
+func reloadOnSignal(signals chan os.Signal, keyspaces Keyspaces, logger log.Logger) {
+	for sig := range signals {
+		level.Info(logger).Log("msg", fmt.Sprintf("received signal %s, reloading vschemas", sig.String()))
+		for _, err := range keyspaces.Reload(context.Background()) {
+			level.Error(logger).Log("msg", err.Error())
+		}
+	}
+}
+
+// vschemaCommand runs the vschema subcommands and returns the exit status of the process.
+// vschema validate checks vschema files as Matriarch does on startup, e.g. in CI, and prints the problems found.
+// vschema check connects to the shards and compares the vschema to their schemas, see checkShardSchemas.
+// vschema generate prints the vschema described by the annotations of a DDL file, see generateVschema.
+func vschemaCommand(args []string, stdout, stderr io.Writer) int {
+	usage := "usage:  matriarch vschema validate [-vschema path] [path...]\n        matriarch vschema check [-vschema path] [-hosts hosts]\n" +
+		"        matriarch vschema generate -keyspace name ddl"
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "check" && args[0] != "generate") {
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+	flags := flag.NewFlagSet("vschema "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	if args[0] == "generate" {
+		keyspace := flags.String("keyspace", "", "Name of the keyspace of the generated vschema")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if *keyspace == "" || flags.NArg() != 1 {
+			fmt.Fprintln(stderr, usage)
+			return 2
+		}
+		return vschemaGenerate(*keyspace, flags.Arg(0), stdout, stderr)
+	}
+	path := flags.String("vschema", "vschema.json", "Vschema file path, when no path is given as argument")
+	hosts := flags.String("hosts", "localhost:5432,localhost:5433", "Comma separated list of PostgreSQL server addresses, without empty spaces")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{*path}
+	}
+	if args[0] == "check" {
+		if len(paths) > 1 {
+			fmt.Fprintln(stderr, usage)
+			return 2
+		}
+		return vschemaCheck(paths[0], strings.Split(*hosts, ","), stdout, stderr)
+	}
+	status := 0
+	for _, p := range paths {
+		if _, err := readVschemaFile(p); err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", p, err.Error())
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: valid\n", p)
+	}
+	return status
+}
+
+// vschemaGenerate prints the vschema described by the annotations of a DDL file.
+func vschemaGenerate(keyspace, path string, stdout, stderr io.Writer) int {
+	ddl, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "cannot open %s: %s\n", path, err.Error())
+		return 1
+	}
+	vschema, err := generateVschema(keyspace, string(ddl))
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", path, err.Error())
+		return 1
+	}
+	data, err := json.MarshalIndent(vschema, "", "  ")
+	if err != nil {
+		fmt.Fprintf(stderr, "cannot encode vschema: %s\n", err.Error())
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s\n", data)
+	return 0
+}
+
+// vschemaCheck compares a vschema file to the schemas of the shards of the cluster.
+func vschemaCheck(path string, hosts []string, stdout, stderr io.Writer) int {
+	vschema, err := readVschemaFile(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", path, err.Error())
+		return 1
+	}
+	cluster, err := NewCluster(vschema.Keyspace, hosts)
+	if err != nil {
+		fmt.Fprintf(stderr, "cannot create new cluster: %s\n", err.Error())
+		return 1
+	}
+	defer cluster.Shutdown()
+	if err = assignUnshardedShards(cluster, vschema); err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", path, err.Error())
+		return 1
+	}
+	if err = checkShardSchemas(context.Background(), cluster, vschema); err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", path, err.Error())
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: matches the schemas of %d shards\n", path, len(cluster.Shards))
+	return 0
+}
@@ -358,6 +358,7 @@ func TestUpdate(t *testing.T) {
 								Name:      "id",
 								Type:      ast.TypeName{Name: "serial"},
 								IsNotNull: true,
+								IsUnique:  true,
 							},
 						},
 					},
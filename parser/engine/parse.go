@@ -287,6 +287,7 @@ func translate(node nodes.Node) (ast.Node, error) {
 						Colname:   *d.Colname,
 						TypeName:  tn,
 						IsNotNull: isNotNull(d),
+						IsUnique:  isUnique(d),
 						IsArray:   isArray(d.TypeName),
 					}
 
@@ -406,10 +407,27 @@ func translate(node nodes.Node) (ast.Node, error) {
 					Colname:   *n.Colname,
 					TypeName:  tn,
 					IsNotNull: isNotNull(n),
+					IsUnique:  isUnique(n),
 					IsArray:   isArray(n.TypeName),
 				})
 			}
 		}
+		// Table constraints whose key is a single column make it unique
+		for _, elt := range n.TableElts.Items {
+			c, ok := elt.(nodes.Constraint)
+			if !ok || (c.Contype != nodes.CONSTR_PRIMARY && c.Contype != nodes.CONSTR_UNIQUE) || len(c.Keys.Items) != 1 {
+				continue
+			}
+			key, ok := c.Keys.Items[0].(nodes.String)
+			if !ok {
+				continue
+			}
+			for _, col := range create.Cols {
+				if col.Colname == key.Str {
+					col.IsUnique = true
+				}
+			}
+		}
 		return create, nil
 
 	case nodes.CreateEnumStmt:
@@ -549,7 +567,8 @@ func translate(node nodes.Node) (ast.Node, error) {
 			return drop, nil
 
 		}
-		return nil, errSkip
+		// Other objects, e.g. indexes, are not part of the catalog
+		return convert(n)
 
 	case nodes.RenameStmt:
 		switch n.RenameType {
@@ -29,6 +29,16 @@ func isNotNull(n nodes.ColumnDef) bool {
 	return false
 }
 
+// isUnique reports whether the column alone is the key of a primary key or unique constraint.
+func isUnique(n nodes.ColumnDef) bool {
+	for _, c := range n.Constraints.Items {
+		if n, ok := c.(nodes.Constraint); ok && (n.Contype == nodes.CONSTR_PRIMARY || n.Contype == nodes.CONSTR_UNIQUE) {
+			return true
+		}
+	}
+	return false
+}
+
 func IsNamedParamFunc(node nodes.Node) bool {
 	fun, ok := node.(nodes.FuncCall)
 	return ok && join(fun.Funcname, ".") == "sqlc.arg"
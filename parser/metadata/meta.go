@@ -74,3 +74,23 @@ func Parse(t string, commentStyle CommentSyntax) (string, string, error) {
 	}
 	return "", "", nil
 }
+
+// Directive returns the content of a comment starting with prefix, in the dash or star syntax,
+// e.g. "scatter" for /* matriarch: scatter */ and the prefix "matriarch:".
+// ok is false when the comment doesn't start with prefix.
+func Directive(comment, prefix string) (string, bool) {
+	var body string
+	switch {
+	case strings.HasPrefix(comment, "--"):
+		body = comment[2:]
+	case strings.HasPrefix(comment, "/*") && strings.HasSuffix(comment, "*/") && len(comment) >= 4:
+		body = comment[2 : len(comment)-2]
+	default:
+		return "", false
+	}
+	body = strings.TrimSpace(body)
+	if !strings.HasPrefix(body, prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(body[len(prefix):]), true
+}
@@ -16,3 +16,20 @@ func TestParseMetadata(t *testing.T) {
 		}
 	}
 }
+
+func TestDirective(t *testing.T) {
+	for comment, expected := range map[string]string{
+		"/* matriarch: scatter */":          "scatter",
+		"/*matriarch:shard=ecommerce_$80*/": "shard=ecommerce_$80",
+		"-- matriarch: keyspace_id=00ff":    "keyspace_id=00ff",
+	} {
+		if observed, ok := Directive(comment, "matriarch:"); !ok || observed != expected {
+			t.Errorf("expected directive %q, observed %q", expected, observed)
+		}
+	}
+	for _, comment := range []string{"/* scatter */", "-- name: CreateFoo :one", "/**/"} {
+		if _, ok := Directive(comment, "matriarch:"); ok {
+			t.Errorf("expected no directive: %q", comment)
+		}
+	}
+}
@@ -4,6 +4,7 @@ type ColumnDef struct {
 	Colname   string
 	TypeName  *TypeName
 	IsNotNull bool
+	IsUnique  bool
 	IsArray   bool
 	Vals      *List
 }
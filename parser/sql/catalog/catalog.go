@@ -2,6 +2,7 @@ package catalog
 
 import (
 	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
 	"github.com/vgheri/matriarch/parser/sql/sqlerr"
 )
 
@@ -176,6 +177,9 @@ type Column struct {
 	IsNotNull bool
 	IsArray   bool
 	Comment   string
+	// IsUnique is true when the values of the column are unique, i.e. the column alone is the key of a
+	// primary key, unique constraint or unique index without predicate.
+	IsUnique bool
 }
 
 type Type interface {
@@ -299,6 +303,8 @@ func (c *Catalog) Update(stmt ast.Statement) error {
 		err = c.renameColumn(n)
 	case *ast.RenameTableStmt:
 		err = c.renameTable(n)
+	case *pg.IndexStmt:
+		err = c.createIndex(n)
 	}
 	return err
 }
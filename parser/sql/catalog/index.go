@@ -0,0 +1,37 @@
+package catalog
+
+import (
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+	"github.com/vgheri/matriarch/parser/sql/sqlerr"
+)
+
+// createIndex marks the column of a unique index on a single column, without predicate, as unique.
+// Other indexes don't change the catalog.
+func (c *Catalog) createIndex(stmt *pg.IndexStmt) error {
+	if !stmt.Unique || stmt.Relation == nil || stmt.Relation.Relname == nil || stmt.IndexParams == nil || len(stmt.IndexParams.Items) != 1 {
+		return nil
+	}
+	if _, todo := stmt.WhereClause.(*ast.TODO); stmt.WhereClause != nil && !todo {
+		return nil
+	}
+	elem, ok := stmt.IndexParams.Items[0].(*pg.IndexElem)
+	if !ok || elem.Name == nil {
+		return nil
+	}
+	name := &ast.TableName{Name: *stmt.Relation.Relname}
+	if stmt.Relation.Schemaname != nil {
+		name.Schema = *stmt.Relation.Schemaname
+	}
+	_, table, err := c.getTable(name)
+	if err != nil {
+		return err
+	}
+	for _, col := range table.Columns {
+		if col.Name == *elem.Name {
+			col.IsUnique = true
+			return nil
+		}
+	}
+	return sqlerr.ColumnNotFound(table.Rel.Name, *elem.Name)
+}
@@ -73,6 +73,7 @@ func (c *Catalog) alterTable(stmt *ast.AlterTableStmt) error {
 					Type:      *cmd.Def.TypeName,
 					IsNotNull: cmd.Def.IsNotNull,
 					IsArray:   cmd.Def.IsArray,
+					IsUnique:  cmd.Def.IsUnique,
 				})
 
 			case ast.AT_AlterColumnType:
@@ -142,6 +143,7 @@ func (c *Catalog) createTable(stmt *ast.CreateTableStmt) error {
 			Type:      *col.TypeName,
 			IsNotNull: col.IsNotNull,
 			IsArray:   col.IsArray,
+			IsUnique:  col.IsUnique,
 		})
 	}
 	schema.Tables = append(schema.Tables, &tbl)
@@ -23,15 +23,31 @@ type PGMock struct {
 	frontendConn     net.Conn
 	connectionClosed bool
 	logger           log.Logger
+	settings         SessionSettings
+	plans            *planCache
+	// routingHints reports whether statements can be directed to shards by routing hints, see routingHint.
+	routingHints bool
+	// vschemas holds the active vschema, reloaded by the RELOAD VSCHEMA command.
+	vschemas *vschemaStore
+	// catalog holds the definitions of the tables of the shards, updated by DDL statements.
+	catalog *schemaCatalog
+	// keyspaces are the keyspaces served, keyspace is the one selected by the database of the connection.
+	keyspaces Keyspaces
+	keyspace  *Keyspace
+	// database is the database parameter of the startup message of the client.
+	database string
 }
 
-func NewMock(frontendConn net.Conn, logger log.Logger) *PGMock {
+func NewMock(frontendConn net.Conn, logger log.Logger, keyspaces Keyspaces, routingHints bool) *PGMock {
 	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(frontendConn), frontendConn)
 
 	mock := &PGMock{
 		backend:      backend,
 		frontendConn: frontendConn,
 		logger:       logger,
+		settings:     defaultSessionSettings(),
+		routingHints: routingHints,
+		keyspaces:    keyspaces,
 	}
 	return mock
 }
@@ -105,19 +121,43 @@ func (m *PGMock) ReadClientConn() error {
 		if err != nil {
 			return fmt.Errorf("error sending deny SSL request: %w", err)
 		}
-		m.ReadClientConn()
+		return m.ReadClientConn()
+	}
+	if msg, ok := startupMessage.(*pgproto3.StartupMessage); ok {
+		m.database = msg.Parameters["database"]
 	}
 	return nil
 }
 
+// HandleConnectionPhase reads the startup message of the client and selects the keyspace named by its database.
+// Connections to a database which is not a keyspace are rejected.
 func (m *PGMock) HandleConnectionPhase() error {
 	err := m.ReadClientConn()
 	if err != nil {
 		return fmt.Errorf("error reading client connection %w", err)
 	}
+	keyspace, err := m.keyspaces.Select(m.database)
+	if err != nil {
+		// The connection is closed after a fatal error, without ReadyForQuery
+		if pgErr, ok := err.(*pgconn.PgError); ok {
+			if sendErr := m.SendPGSQLErrorMessage(pgErr); sendErr != nil {
+				return fmt.Errorf("cannot send error to client: %w", sendErr)
+			}
+		}
+		return err
+	}
+	m.keyspace = keyspace
+	m.plans = keyspace.Plans
+	m.vschemas = keyspace.Vschemas
+	m.catalog = keyspace.Catalog
 	return m.AcceptUnauthenticatedConnRequestSteps()
 }
 
+// Keyspace returns the keyspace selected by the connection, nil before the connection phase.
+func (m *PGMock) Keyspace() *Keyspace {
+	return m.keyspace
+}
+
 // TODO Use this
 func (m *PGMock) HandleStartup() error {
 	startupMessage, err := m.backend.ReceiveStartupMessage()
@@ -258,6 +298,11 @@ func (m *PGMock) FinaliseExecuteSequence(command string, results []*pgconn.Resul
 			cmdCompleteMsg.CommandTag = []byte(fmt.Sprintf("%s 0 %d", command, result.CommandTag.RowsAffected()))
 		case "DELETE", "UPDATE":
 			cmdCompleteMsg.CommandTag = []byte(fmt.Sprintf("%s %d", command, result.CommandTag.RowsAffected()))
+		case "SET", "RESET", "EXPLAIN", "RELOAD":
+			cmdCompleteMsg.CommandTag = []byte(command)
+		case "DDL":
+			// DDL statements complete with the command tag of the shards, e.g. CREATE TABLE
+			cmdCompleteMsg.CommandTag = result.CommandTag
 		default:
 			cmdCompleteMsg.CommandTag = []byte(fmt.Sprintf("%s %d", command, result.CommandTag.RowsAffected()))
 		}
@@ -287,6 +332,22 @@ func (m *PGMock) FinaliseExecuteSequence(command string, results []*pgconn.Resul
 	return nil
 }
 
+// mergeResults merges the results of a statement executed on several shards into a single result,
+// whose command tag reports the total number of rows affected.
+func mergeResults(command string, results []*pgconn.Result) *pgconn.Result {
+	merged := &pgconn.Result{}
+	var rowsAffected int64
+	for _, result := range results {
+		if len(merged.FieldDescriptions) == 0 {
+			merged.FieldDescriptions = result.FieldDescriptions
+		}
+		merged.Rows = append(merged.Rows, result.Rows...)
+		rowsAffected += result.CommandTag.RowsAffected()
+	}
+	merged.CommandTag = pgconn.CommandTag(fmt.Sprintf("%s %d", command, rowsAffected))
+	return merged
+}
+
 func (p *PGMock) Close() error {
 	closeNotificationMsg := &pgproto3.ErrorResponse{
 		Severity:         "FATAL",
@@ -338,6 +399,28 @@ func (mock *PGMock) Process(msg pgproto3.FrontendMessage, cluster *Cluster, vsch
 		if err != nil {
 			return fmt.Errorf("cannot decode frontend Query message into QueryMessage struct: %w", err)
 		}
+		if reloadVschemaStatement(q.String) {
+			return mock.processReloadVschema()
+		}
+		if sql, analyze, ok := explainStatement(q.String); ok {
+			return mock.processExplain(sql, analyze, cluster, vschema)
+		}
+		// Statements sharing the fingerprint of a cached plan are executed without being parsed and planned
+		key, literals, text, cacheable := mock.planCacheKey(q.String)
+		var cached bool
+		// Statements directed by routing hints are not planned, and their fingerprint ignores comments
+		if hint, err := parseRoutingHint(q.String); err != nil || hint != nil {
+			cacheable = false
+		}
+		if cacheable {
+			var plan *statementPlan
+			if plan, cached = mock.plans.Get(key, vschema); cached {
+				mock.logger.Log("msg", fmt.Sprintf("plan cache hit: %s", key))
+				if handled, err := mock.executePlan(plan, literals, QueryMessage{Type: q.Type, String: text}, cluster); handled {
+					return err
+				}
+			}
+		}
 		res, _ := pg_query.ParseToJSON(q.String)
 		mock.logger.Log("msg", res)
 		stmts, err := engine.NewParser().Parse(strings.NewReader(q.String))
@@ -345,6 +428,25 @@ func (mock *PGMock) Process(msg pgproto3.FrontendMessage, cluster *Cluster, vsch
 			return fmt.Errorf("cannot parse frontend Query message: %w", err)
 		}
 		for _, stmt := range stmts {
+			text := statementText(q.String, stmt.Raw)
+			offset := stmt.Raw.StmtLocation + strings.Index(q.String[stmt.Raw.StmtLocation:], text)
+			q := QueryMessage{Type: q.Type, String: mock.resolveStatement(stmt.Raw.Stmt, text, offset, vschema)}
+			hint, err := mock.routingHint(text)
+			if err != nil {
+				return err
+			}
+			if hint != nil {
+				if err = mock.processHintedStmt(stmt.Raw.Stmt, hint, q, cluster, vschema); err != nil {
+					return err
+				}
+				continue
+			}
+			// Plans are only cached for statements sent as they are to the shards
+			if cacheable && !cached && mock.plans != nil && len(stmts) == 1 && q.String == text {
+				if plan := mock.planStatement(stmt.Raw.Stmt, literals, cluster, vschema); plan != nil {
+					mock.plans.Add(key, vschema, plan)
+				}
+			}
 			switch s := stmt.Raw.Stmt.(type) {
 			case *pg.InsertStmt:
 				if err = mock.processInsertStmt(s, q, cluster, vschema); err != nil {
@@ -362,14 +464,31 @@ func (mock *PGMock) Process(msg pgproto3.FrontendMessage, cluster *Cluster, vsch
 				if err = mock.processSelectStmt(s, q, cluster, vschema); err != nil {
 					return err
 				}
+			case *pg.VariableSetStmt:
+				if err = mock.processVariableSetStmt(s, q); err != nil {
+					return err
+				}
 			default:
-				return fmt.Errorf("Unknown statement %s", q.String)
+				if !isDDLStmt(s) {
+					return fmt.Errorf("Unknown statement %s", q.String)
+				}
+				if err = mock.processDDLStmt(stmt, q, cluster, vschema); err != nil {
+					return err
+				}
 			}
 		}
 	}
 	return nil
 }
 
+// statementText returns the portion of the query string containing the statement.
+func statementText(query string, raw *ast.RawStmt) string {
+	if raw.StmtLen == 0 {
+		return strings.TrimSpace(query[raw.StmtLocation:])
+	}
+	return strings.TrimSpace(query[raw.StmtLocation : raw.StmtLocation+raw.StmtLen])
+}
+
 func appendToConcatenate(concat, val string) string {
 	if concat == "" {
 		return val
@@ -378,21 +497,354 @@ func appendToConcatenate(concat, val string) string {
 }
 
 // Limitations: primary vindex columns must be present in the list of values to insert
+// The keyspace id of each row is computed independently and rows are grouped by owning shard.
+// When all the rows belong to the same shard the statement is executed as is, otherwise each
+// shard receives an INSERT with only its own rows, and all of them are executed inside a
+// cross-shard transaction.
 func (mock *PGMock) processInsertStmt(s *pg.InsertStmt, q QueryMessage, cluster *Cluster, vschema *Vschema) error {
 	relation := *s.Relation.Relname
-	var columns []string
-	for _, item := range s.Cols.Items {
-		t := item.(*pg.ResTarget)
-		columns = append(columns, *t.Name)
+	table := vschema.GetTable(relation)
+	// Rows of unsharded tables are all inserted in the shard of the table, so the columns don't need to be listed
+	if table != nil && table.Type == Unsharded {
+		return mock.execUnshardedStmt("INSERT", s, table, q, cluster, vschema)
+	}
+	if isEmptyList(s.Cols) {
+		return fmt.Errorf("cannot insert rows without specifying the list of columns")
 	}
 	// build list of indexes of insert stmt columns that match the vschema table primary vindex columns.
 	// e.g. insert into orders(id, user_id, total_amount, order_date) -> primary vindex for table orders is `id`,
 	// so the result will be [0].
 	// Iterate first on table vindex columns, and  then on insert stmt columns
-	table := vschema.GetTable(relation)
 	if table == nil {
 		return fmt.Errorf("cannot process message, table %s is not part of the vschema", relation)
 	}
+	if table.Type == Reference {
+		if ss, ok := s.SelectStmt.(*pg.SelectStmt); ok && !isEmptyList(ss.FromClause) {
+			var sources []string
+			for _, fromClause := range ss.FromClause.Items {
+				walkJoinExpressionTree(fromClause, &sources)
+			}
+			for _, source := range sources {
+				if t := vschema.GetTable(source); t == nil || t.Type != Reference {
+					return fmt.Errorf("cannot insert rows selected from table %s into reference table %s", source, relation)
+				}
+			}
+		}
+		if err := checkReplicatedStmt(context.Background(), s, table, cluster); err != nil {
+			return err
+		}
+		return mock.replicateStmt("INSERT", q, cluster)
+	}
+	// The sequence column is filled before computing the keyspace ids, as it is usually part of the primary vindex
+	s, q, err := mock.fillSequenceColumn(s, q, table, cluster, vschema)
+	if err != nil {
+		return err
+	}
+	var columns []string
+	for _, item := range s.Cols.Items {
+		t := item.(*pg.ResTarget)
+		columns = append(columns, *t.Name)
+	}
+	indexes, err := primaryVIndexIndexes(table, columns)
+	if err != nil {
+		return err
+	}
+	if err := checkOnConflictClause(s.OnConflictClause, table); err != nil {
+		return err
+	}
+	if err := checkLookupInsert(s, table); err != nil {
+		return err
+	}
+	mock.logger.Log("msg", fmt.Sprintf("relation: %s, columns: %s", relation, columns))
+	ss, ok := s.SelectStmt.(*pg.SelectStmt)
+	if !ok {
+		return fmt.Errorf("unknown type in InsertStmt->SelectStmt %#v", s.SelectStmt)
+	}
+	if isEmptyList(ss.ValuesLists) {
+		return mock.processInsertSelectStmt(s, ss, columns, indexes, q, cluster, vschema)
+	}
+	targets, rowsByShard, _, err := insertRowsByShard(ss, indexes, table, cluster)
+	if err != nil {
+		return err
+	}
+	// rows of the lookup tables are inserted in the transaction inserting the rows of the table
+	changes, err := insertLookupChanges(ss, columns, table)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 1 && len(changes) == 0 {
+		mock.logger.Log("msg", fmt.Sprintf("shard selected: %s", targets[0].Name))
+		res, err := targets[0].Conn.Exec(context.Background(), q.String)
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+		results, err := res.ReadAll()
+		if err != nil {
+			return err
+		}
+		return mock.FinaliseExecuteSequence("INSERT", results)
+	}
+
+	var spans []textSpan
+	if len(targets) > 1 {
+		if spans, err = valuesListSpans(q.String); err != nil {
+			return fmt.Errorf("cannot split insert statement between shards: %w", err)
+		}
+		if len(spans) != len(ss.ValuesLists.Items) {
+			return fmt.Errorf("cannot split insert statement between shards: found %d rows, expected %d", len(spans), len(ss.ValuesLists.Items))
+		}
+	}
+	ctx := context.Background()
+	tx, err := NewShardTransaction()
+	if err != nil {
+		return err
+	}
+	var results []*pgconn.Result
+	for _, target := range targets {
+		mock.logger.Log("msg", fmt.Sprintf("shard selected: %s, rows: %v", target.Name, rowsByShard[target]))
+		sql := q.String
+		if len(targets) > 1 {
+			sql = rewriteValuesList(q.String, spans, rowsByShard[target])
+		}
+		res, err := tx.Exec(ctx, target, sql)
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		results = append(results, res...)
+	}
+	if err = applyLookupChanges(ctx, tx, cluster, changes); err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	return mock.FinaliseExecuteSequence("INSERT", []*pgconn.Result{mergeResults("INSERT", results)})
+}
+
+// checkOnConflictClause refuses ON CONFLICT clauses whose conflicting rows could live on other shards.
+// PostgreSQL can only detect conflicts with rows stored on the same shard, so the conflict target must
+// include every column of the primary vindex: rows sharing the same conflict target values then
+// share the same keyspace id. For the same reason, DO UPDATE cannot change primary vindex columns.
+func checkOnConflictClause(c *pg.OnConflictClause, table *Table) error {
+	if c == nil {
+		return nil
+	}
+	if c.Infer == nil {
+		return errors.New("ON CONFLICT without a conflict target is not supported, as conflicting rows could live on other shards")
+	}
+	if c.Infer.Conname != nil {
+		return errors.New("ON CONFLICT ON CONSTRAINT is not supported, please specify the conflict target columns")
+	}
+	var targetColumns []string
+	for _, item := range c.Infer.IndexElems.Items {
+		elem, ok := item.(*pg.IndexElem)
+		if !ok || elem.Name == nil {
+			return errors.New("ON CONFLICT target must be a list of column names")
+		}
+		targetColumns = append(targetColumns, *elem.Name)
+	}
+	primaryIndexColumns := table.GetPrimaryVIndex().Columns
+	for _, pc := range primaryIndexColumns {
+		if stringArrayContainsValue(targetColumns, pc) == -1 {
+			return fmt.Errorf("ON CONFLICT target must include column %s part of the primary vindex, as conflicting rows could live on other shards", pc)
+		}
+	}
+	// 0 = NONE, 1 = DO NOTHING, 2 = DO UPDATE
+	if c.Action == 2 {
+		for _, item := range c.TargetList.Items {
+			if t, ok := item.(*pg.ResTarget); ok && stringArrayContainsValue(primaryIndexColumns, *t.Name) > -1 {
+				return fmt.Errorf("cannot update column %s because it is part of the primary vindex", *t.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// processInsertSelectStmt executes an INSERT INTO ... SELECT statement.
+// When the primary vindex columns of the target table are filled with the primary vindex columns of
+// the source table, source and target rows are co-located: each selected row belongs to the shard it
+// is read from, so the statement is pushed down as is to the shards owning the selected rows.
+// Otherwise the selected rows are pulled through Matriarch and each one is inserted in the shard owning it.
+func (mock *PGMock) processInsertSelectStmt(s *pg.InsertStmt, source *pg.SelectStmt, columns []string, indexes []int,
+	q QueryMessage, cluster *Cluster, vschema *Vschema) error {
+	if s.WithClause != nil || source.WithClause != nil || source.Op > 0 {
+		return errors.New("WITH clauses and set operations are not supported in INSERT ... SELECT statements")
+	}
+	sources := cluster.Shards
+	if isEmptyList(source.FromClause) {
+		// Only constant values are selected, any shard can compute them.
+		sources = cluster.Shards[:1]
+	} else {
+		target, err := mock.routeSelectStmt(source, cluster, vschema)
+		if err == nil {
+			sources = []*Shard{target}
+		} else if !errors.Is(err, ErrMissingPrimaryVIndex) {
+			return err
+		}
+	}
+	ctx := context.Background()
+	tx, err := NewShardTransaction()
+	if err != nil {
+		return err
+	}
+	if isColocatedInsertSelect(source, vschema.GetTable(*s.Relation.Relname), indexes, vschema) {
+		var results []*pgconn.Result
+		for _, shard := range sources {
+			mock.logger.Log("msg", fmt.Sprintf("shard selected: %s", shard.Name))
+			res, err := tx.Exec(ctx, shard, q.String)
+			if err != nil {
+				tx.Rollback(ctx)
+				return err
+			}
+			results = append(results, res...)
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return err
+		}
+		return mock.FinaliseExecuteSequence("INSERT", []*pgconn.Result{mergeResults("INSERT", results)})
+	}
+
+	span, err := insertSelectSpan(q.String)
+	if err != nil {
+		return err
+	}
+	var rows [][][]byte
+	for _, shard := range sources {
+		mock.logger.Log("msg", fmt.Sprintf("reading rows to insert from shard: %s", shard.Name))
+		res, err := tx.Exec(ctx, shard, q.String[span.Start:span.End])
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		for _, r := range res {
+			rows = append(rows, r.Rows...)
+		}
+	}
+	table := vschema.GetTable(*s.Relation.Relname)
+	var targets []*Shard
+	rowsByShard := make(map[*Shard][]string)
+	for _, row := range rows {
+		if len(row) != len(columns) {
+			tx.Rollback(ctx)
+			return fmt.Errorf("INSERT has %d target columns but SELECT returned %d values", len(columns), len(row))
+		}
+		var values []string
+		for _, val := range indexes {
+			if row[val] == nil {
+				tx.Rollback(ctx)
+				return errors.New("cannot insert row with null value for column part of a primary VIndex")
+			}
+			values = append(values, string(row[val]))
+		}
+		concat, err := table.KeyspaceId(values)
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		target, err := cluster.GetShardForTable(table, concat)
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("cannot select destination shard for insert statement: %w", err)
+		}
+		if _, ok := rowsByShard[target]; !ok {
+			targets = append(targets, target)
+		}
+		rowsByShard[target] = append(rowsByShard[target], valuesRow(row))
+	}
+	results := []*pgconn.Result{{CommandTag: pgconn.CommandTag("INSERT 0 0")}}
+	for _, target := range targets {
+		mock.logger.Log("msg", fmt.Sprintf("shard selected: %s, rows: %d", target.Name, len(rowsByShard[target])))
+		sql := fmt.Sprintf("%s VALUES %s %s", strings.TrimSpace(q.String[:span.Start]),
+			strings.Join(rowsByShard[target], ", "), q.String[span.End:])
+		res, err := tx.Exec(ctx, target, strings.TrimSpace(sql))
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		results = append(results, res...)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	return mock.FinaliseExecuteSequence("INSERT", []*pgconn.Result{mergeResults("INSERT", results)})
+}
+
+// isColocatedInsertSelect reports whether the primary vindex columns of the inserted rows are selected
+// from the primary vindex columns, in the same order, of the single sharded table read by the SELECT, and
+// whether both tables map these values to the same keyspace ids, see SameKeyspaceIds.
+func isColocatedInsertSelect(source *pg.SelectStmt, table *Table, indexes []int, vschema *Vschema) bool {
+	if len(source.FromClause.Items) != 1 {
+		return false
+	}
+	rv, ok := source.FromClause.Items[0].(*pg.RangeVar)
+	if !ok {
+		return false
+	}
+	sourceTable := vschema.GetTable(*rv.Relname)
+	if sourceTable == nil || sourceTable.Type != Sharded {
+		return false
+	}
+	sourceColumns := sourceTable.GetPrimaryVIndex().Columns
+	if len(sourceColumns) != len(indexes) {
+		return false
+	}
+	for i, val := range indexes {
+		if val >= len(source.TargetList.Items) {
+			return false
+		}
+		target, ok := source.TargetList.Items[val].(*pg.ResTarget)
+		if !ok {
+			return false
+		}
+		column, ok := target.Val.(*pg.ColumnRef)
+		if !ok {
+			return false
+		}
+		name, ok := column.Fields.Items[len(column.Fields.Items)-1].(*pg.String)
+		if !ok || name.Str != sourceColumns[i] {
+			return false
+		}
+		if !SameKeyspaceIds(table, table.GetPrimaryVIndex().Columns[i], sourceTable, sourceColumns[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// valuesRow formats a row returned by a shard as a row of a VALUES list.
+// Values are sent as untyped literals, PostgreSQL coerces them to the type of the target column.
+func valuesRow(row [][]byte) string {
+	values := make([]string, len(row))
+	for i, v := range row {
+		if v == nil {
+			values[i] = "NULL"
+		} else {
+			values[i] = quoteLiteral(string(v))
+		}
+	}
+	return fmt.Sprintf("(%s)", strings.Join(values, ", "))
+}
+
+// insertValue returns the string representation of a value part of a primary VIndex,
+// used to compute the keyspace id of a row.
+func insertValue(node ast.Node) (string, error) {
+	if c, ok := node.(*pg.A_Const); ok {
+		if _, ok := c.Val.(*pg.Null); ok {
+			return "", errors.New("cannot insert row with null value for column part of a primary VIndex")
+		}
+	}
+	value, ok := constantValue(node)
+	if !ok {
+		return "", fmt.Errorf("cannot insert row with unknown value for column part of a primary VIndex %#v", node)
+	}
+	return value, nil
+}
+
+// primaryVIndexIndexes returns the index in the columns of an INSERT statement of each primary vindex column of the table.
+func primaryVIndexIndexes(table *Table, columns []string) ([]int, error) {
 	var indexes []int
 	primaryIndexColumns := table.GetPrimaryVIndex().Columns
 	for _, pc := range primaryIndexColumns {
@@ -403,62 +855,56 @@ func (mock *PGMock) processInsertStmt(s *pg.InsertStmt, q QueryMessage, cluster
 		}
 	}
 	if len(indexes) != len(primaryIndexColumns) {
-		return fmt.Errorf("cannot insert row without all primary vindex columns being present in the insert statement")
+		return nil, fmt.Errorf("cannot insert row without all primary vindex columns being present in the insert statement")
 	}
-	mock.logger.Log("msg", fmt.Sprintf("relation: %s, columns: %s", relation, columns))
-	switch ss := s.SelectStmt.(type) {
-	case *pg.SelectStmt:
-		for _, v := range ss.ValuesLists.Items {
-			switch t := v.(type) {
-			case *ast.List:
-				var concat string
-				for _, val := range indexes {
-					node := t.Items[val]
-					switch tt := node.(type) {
-					case *pg.A_Const:
-						switch vt := tt.Val.(type) {
-						case *pg.Integer:
-							concat = appendToConcatenate(concat, fmt.Sprintf("%d", vt.Ival))
-						case *pg.String:
-							concat = appendToConcatenate(concat, vt.Str)
-						case *pg.Null:
-							return errors.New("cannot insert row with null value for column part of a primary VIndex")
-						default:
-							return errors.New("cannot insert row with unknown value for column part of a primary VIndex")
-						}
-					default:
-						return fmt.Errorf("unknown type in InsertStmt->SelectStmt->ValuesList.Items %#v", tt)
-					}
-				}
-				target, err := cluster.GetShardForKeyspaceId(concat)
-				if err != nil {
-					return fmt.Errorf("cannot select destination shard for insert statement: %w", err)
-				}
-				mock.logger.Log("msg", fmt.Sprintf("shard selected: %s", target.Name))
-				res, err := target.Conn.Exec(context.Background(), q.String)
-				if err != nil {
-					return err
-				}
-				defer res.Close()
-				results, err := res.ReadAll()
-				if err != nil {
-					return err
-				}
-				return mock.FinaliseExecuteSequence("INSERT", results)
-			default:
-				return fmt.Errorf("unknown type in InsertStmt->SelectStmt->ValuesList %#v", t)
+	return indexes, nil
+}
+
+// insertRowsByShard computes the keyspace id of each row of the VALUES lists of an INSERT statement, from the values
+// at the indexes of the primary vindex columns, and groups the rows by owning shard.
+// It returns the shards in the order of the rows, the indexes of the rows owned by each shard and the keyspace id of each row.
+func insertRowsByShard(ss *pg.SelectStmt, indexes []int, table *Table, cluster *Cluster) ([]*Shard, map[*Shard][]int, []string, error) {
+	var targets []*Shard
+	var keyspaceIds []string
+	rowsByShard := make(map[*Shard][]int)
+	for i, v := range ss.ValuesLists.Items {
+		t, ok := v.(*ast.List)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("unknown type in InsertStmt->SelectStmt->ValuesList %#v", v)
+		}
+		var values []string
+		for _, val := range indexes {
+			value, err := insertValue(t.Items[val])
+			if err != nil {
+				return nil, nil, nil, err
 			}
+			values = append(values, value)
 		}
-	default:
-		return fmt.Errorf("unknown type in InsertStmt->SelectStmt %#v", ss)
+		concat, err := table.KeyspaceId(values)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		target, err := cluster.GetShardForTable(table, concat)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot select destination shard for insert statement: %w", err)
+		}
+		if _, ok := rowsByShard[target]; !ok {
+			targets = append(targets, target)
+		}
+		rowsByShard[target] = append(rowsByShard[target], i)
+		keyspaceIds = append(keyspaceIds, concat)
 	}
-	return fmt.Errorf("unknown error processing InsertStmt")
+	return targets, rowsByShard, keyspaceIds, nil
 }
 
-// Limitations: all primary vindex columns must be present and must be the only fields part of the where clause list of columns
+// Limitations: all primary vindex columns of the table, or all the columns of one of its lookup vindexes, must be present
+// in the where clause. Lookup tables are maintained inside a cross-shard transaction, see execWithLookups.
+// Sharded tables can only be joined on their primary vindex columns, so that joined rows live on the same shard
 // Column names must be used as left expression (i.e. order_id = '123342')
 // Expressions allowed in the where clause: =
 // where clause columns are linked by a AND boolean expression (i.e. column_1 = '123342 AND column_2 = 'abcd')
+// When the session setting matriarch.allow_scatter_dml is on, statements not satisfying these limitations
+// are executed on every shard.
 // Algo:
 // 1. extract all columns and their values involved in the where clause
 // 2. extract the boolean expression linking all clauses. If not "AND", return error
@@ -468,130 +914,49 @@ func (mock *PGMock) processInsertStmt(s *pg.InsertStmt, q QueryMessage, cluster
 //    3.2 in, for on each value and treat each iteration as a = expression -> not yet supported
 func (mock *PGMock) processDeleteStmt(s *pg.DeleteStmt, q QueryMessage, cluster *Cluster, vschema *Vschema) error {
 	relation := *s.Relation.Relname
-	var whereClauseColumns []string
-	var whereClauseValues []string
-	switch ss := s.WhereClause.(type) {
-	case *pg.A_Expr:
-		for _, expr := range ss.Name.Items {
-			switch exprElem := expr.(type) {
-			case *pg.String:
-				if exprElem.Str != "=" {
-					return fmt.Errorf("only equal expression is allowed in DELETE statements")
-				}
-			}
-		}
-		switch lexpr := ss.Lexpr.(type) {
-		case *pg.ColumnRef:
-			for _, column := range lexpr.Fields.Items {
-				switch columnElem := column.(type) {
-				case *pg.String:
-					whereClauseColumns = append(whereClauseColumns, columnElem.Str)
-				default:
-					return fmt.Errorf("left expression of where clause must be a column name")
-				}
-			}
-		}
-		switch rexpr := ss.Rexpr.(type) {
-		case *pg.A_Const:
-			switch rexprConst := rexpr.Val.(type) {
-			case *pg.String:
-				whereClauseValues = append(whereClauseValues, rexprConst.Str)
-			case *pg.Integer:
-				whereClauseValues = append(whereClauseValues, fmt.Sprintf("%d", rexprConst.Ival))
-			default:
-				return fmt.Errorf("unknown constant type in where clause. String and Integer only")
-			}
-		}
-	case *pg.BoolExpr:
-		// 0 = AND, 1 = OR, 2 NOT. See https://doxygen.postgresql.org/primnodes_8h.html#a27f637bf3e2c33cc8e48661a8864c7af
-		if ss.Boolop > 0 {
-			return fmt.Errorf("Only AND expression is allowed as a boolean operator in DELETE statements")
-		}
-		for _, argItem := range ss.Args.Items {
-			switch arg := argItem.(type) {
-			case *pg.A_Expr:
-				for _, expr := range arg.Name.Items {
-					switch exprElem := expr.(type) {
-					case *pg.String:
-						if exprElem.Str != "=" {
-							return fmt.Errorf("only equal expression is allowed in DELETE statements")
-						}
-					}
-				}
-				switch lexpr := arg.Lexpr.(type) {
-				case *pg.ColumnRef:
-					for _, column := range lexpr.Fields.Items {
-						switch columnElem := column.(type) {
-						case *pg.String:
-							whereClauseColumns = append(whereClauseColumns, columnElem.Str)
-						default:
-							return fmt.Errorf("left expression of where clause must be a column name")
-						}
-					}
-				}
-				switch rexpr := arg.Rexpr.(type) {
-				case *pg.A_Const:
-					switch rexprConst := rexpr.Val.(type) {
-					case *pg.String:
-						whereClauseValues = append(whereClauseValues, rexprConst.Str)
-					case *pg.Integer:
-						whereClauseValues = append(whereClauseValues, fmt.Sprintf("%d", rexprConst.Ival))
-					default:
-						return fmt.Errorf("unknown constant type in where clause. String and Integer only")
-					}
-				}
-			}
-		}
-	default:
-		return fmt.Errorf("expecting a list of columns in where clause, found unknown expression")
-	}
-	// build list of indexes of delete stmt columns that match the vschema table primary vindex columns.
-	// e.g. delete from orders(id, user_id, total_amount, order_date) -> primary vindex for table orders is `id`,
-	// so the result will be [0].
-	// Iterate first on table vindex columns, and then on insert stmt columns
 	table := vschema.GetTable(relation)
 	if table == nil {
 		return fmt.Errorf("cannot process delete statement, table %s is not part of the vschema", relation)
 	}
-	var indexes []int
-	for _, pc := range table.GetPrimaryVIndex().Columns {
-		for i, c := range whereClauseColumns {
-			if pc == c {
-				indexes = append(indexes, i)
-				continue
-			}
+	if table.Type == Reference {
+		if err := checkReplicatedStmt(context.Background(), s, table, cluster); err != nil {
+			return err
 		}
+		return mock.replicateStmt("DELETE", q, cluster)
 	}
-	if len(indexes) != len(whereClauseColumns) {
-		return fmt.Errorf("cannot execute delete statement without all primary vindex columns being present in the where clause")
-	}
-	mock.logger.Log("msg", fmt.Sprintf("relation: %s, columns: %s", relation, whereClauseColumns))
-	var concat string
-	for _, val := range indexes {
-		whereClauseValue := whereClauseValues[val]
-		concat = appendToConcatenate(concat, whereClauseValue)
+	if table.Type == Unsharded {
+		return mock.execUnshardedStmt("DELETE", s, table, q, cluster, vschema)
 	}
-	target, err := cluster.GetShardForKeyspaceId(concat)
-	if err != nil {
-		return fmt.Errorf("cannot select destination shard for delete statement: %w", err)
+	whereClauseColumns, whereClauseValues, err := parseDMLWhereClause(s.WhereClause, relation, "DELETE")
+	var targets []*Shard
+	if err == nil {
+		mock.logger.Log("msg", fmt.Sprintf("relation: %s, columns: %s", relation, whereClauseColumns))
+		targets, _, err = routeDMLShards(table, whereClauseColumns, whereClauseValues, cluster, "DELETE")
 	}
-	mock.logger.Log("msg", fmt.Sprintf("shard selected: %s\n", target.Name))
-	res, err := target.Conn.Exec(context.Background(), q.String)
+	lookups := table.LookupVIndexes()
 	if err != nil {
-		return err
+		if !mock.settings.AllowScatterDML {
+			return fmt.Errorf("%w. Set %s to on to execute the statement on every shard", err, settingAllowScatterDML)
+		}
+		if len(lookups) == 0 {
+			return mock.scatterDMLStmt("DELETE", q, cluster)
+		}
+		targets = cluster.Shards
 	}
-	defer res.Close()
-	results, err := res.ReadAll()
-	if err != nil {
-		return err
+	if len(lookups) > 0 {
+		return mock.execWithLookups("DELETE", s, table, lookups, q, targets, cluster)
 	}
-	return mock.FinaliseExecuteSequence("DELETE", results)
+	return mock.execDMLStmt("DELETE", q, targets, cluster)
 }
 
-// Limitations: all primary vindex columns must be present and must be the only fields part of the where clause list of columns
+// Limitations: all primary vindex columns of the table, or all the columns of one of its lookup vindexes, must be present
+// in the where clause. Lookup tables are maintained inside a cross-shard transaction, see execWithLookups.
+// Sharded tables can only be joined on their primary vindex columns, so that joined rows live on the same shard
 // Column names must be used as left expression (i.e. order_id = '123342')
 // Expressions allowed in the where clause: =
 // where clause columns are linked by a AND boolean expression (i.e. column_1 = '123342 AND column_2 = 'abcd')
+// When the session setting matriarch.allow_scatter_dml is on, statements not satisfying these limitations
+// are executed on every shard, as long as they don't update primary vindex columns.
 // Algo:
 // 1. extract all columns and their values involved in the where clause
 // 2. extract the boolean expression linking all clauses. If not "AND", return error
@@ -610,96 +975,180 @@ func (mock *PGMock) processUpdateStmt(s *pg.UpdateStmt, q QueryMessage, cluster
 		}
 	}
 	relation := *s.Relation.Relname
-	var whereClauseColumns []string
-	var whereClauseValues []string
-	switch ss := s.WhereClause.(type) {
-	case *pg.A_Expr:
-		for _, expr := range ss.Name.Items {
-			switch exprElem := expr.(type) {
-			case *pg.String:
-				if exprElem.Str != "=" {
-					return fmt.Errorf("only equal expression is allowed in UPDATE statements")
-				}
-			}
+	table := vschema.GetTable(relation)
+	if table == nil {
+		return fmt.Errorf("cannot process UPDATE statement, table %s is not part of the vschema", relation)
+	}
+	if table.Type == Reference {
+		if err := checkReplicatedStmt(context.Background(), s, table, cluster); err != nil {
+			return err
 		}
-		switch lexpr := ss.Lexpr.(type) {
-		case *pg.ColumnRef:
-			for _, column := range lexpr.Fields.Items {
-				switch columnElem := column.(type) {
-				case *pg.String:
-					whereClauseColumns = append(whereClauseColumns, columnElem.Str)
-				default:
-					return fmt.Errorf("left expression of where clause must be a column name")
-				}
+		return mock.replicateStmt("UPDATE", q, cluster)
+	}
+	if table.Type == Unsharded {
+		return mock.execUnshardedStmt("UPDATE", s, table, q, cluster, vschema)
+	}
+	primaryIndexColumns := table.GetPrimaryVIndex().Columns
+	whereClauseColumns, whereClauseValues, err := parseDMLWhereClause(s.WhereClause, relation, "UPDATE")
+	var targets []*Shard
+	var indexes []int
+	if err == nil {
+		mock.logger.Log("msg", fmt.Sprintf("relation: %s, columns: %s", relation, whereClauseColumns))
+		targets, indexes, err = routeDMLShards(table, whereClauseColumns, whereClauseValues, cluster, "UPDATE")
+	}
+	lookups := updatedLookupVIndexes(s, table)
+	if err != nil {
+		if !mock.settings.AllowScatterDML {
+			return fmt.Errorf("%w. Set %s to on to execute the statement on every shard", err, settingAllowScatterDML)
+		}
+		for _, pc := range primaryIndexColumns {
+			if stringArrayContainsValue(updatedColumns, pc) > -1 {
+				return fmt.Errorf("cannot update column %s part of the primary vindex on every shard", pc)
 			}
 		}
-		switch rexpr := ss.Rexpr.(type) {
-		case *pg.A_Const:
-			switch rexprConst := rexpr.Val.(type) {
-			case *pg.String:
-				whereClauseValues = append(whereClauseValues, rexprConst.Str)
-			case *pg.Integer:
-				whereClauseValues = append(whereClauseValues, fmt.Sprintf("%d", rexprConst.Ival))
-			default:
-				return fmt.Errorf("unknown constant type in where clause. String and Integer only")
+		if len(lookups) == 0 {
+			return mock.scatterDMLStmt("UPDATE", q, cluster)
+		}
+		targets = cluster.Shards
+	} else if indexes == nil {
+		// routed with a lookup vindex: the current keyspace id of the rows is unknown
+		for _, pc := range primaryIndexColumns {
+			if stringArrayContainsValue(updatedColumns, pc) > -1 {
+				return fmt.Errorf("cannot update column %s part of the primary vindex without all primary vindex columns being present in the where clause", pc)
 			}
 		}
+	} else {
+		target := targets[0]
+		mock.logger.Log("msg", fmt.Sprintf("shard selected: %s\n", target.Name))
+		// When primary vindex columns are updated, compute the new keyspace id of the rows
+		// to find out whether they have to move to another shard.
+		newConcat, primaryIndexUpdated, err := updatedKeyspaceId(s, table, whereClauseValues, indexes)
+		if err != nil {
+			return err
+		}
+		if primaryIndexUpdated && len(table.LookupVIndexes()) > 0 {
+			return fmt.Errorf("cannot update primary vindex columns of table %s with lookup vindexes", table.Key())
+		}
+		if primaryIndexUpdated {
+			newTarget, err := cluster.GetShardForTable(table, newConcat)
+			if err != nil {
+				return fmt.Errorf("cannot select destination shard for UPDATE statement: %w", err)
+			}
+			if newTarget != target {
+				mock.logger.Log("msg", fmt.Sprintf("rows moving from shard %s to shard %s", target.Name, newTarget.Name))
+				return mock.moveUpdatedRows(table, q, target, newTarget)
+			}
+		}
+	}
+	if len(lookups) > 0 {
+		return mock.execWithLookups("UPDATE", s, table, lookups, q, targets, cluster)
+	}
+	return mock.execDMLStmt("UPDATE", q, targets, cluster)
+}
+
+// updatedKeyspaceId returns the keyspace id of the rows updated by an UPDATE statement after the update,
+// from the values of the primary vindex columns in the where clause, at the indexes returned by routeDMLStmt,
+// and in the SET clause. updated is false when the statement doesn't update primary vindex columns.
+func updatedKeyspaceId(s *pg.UpdateStmt, table *Table, whereClauseValues []string, indexes []int) (keyspaceId string, updated bool, err error) {
+	var newValues []string
+	for i, pc := range table.GetPrimaryVIndex().Columns {
+		j := -1
+		for k, item := range s.TargetList.Items {
+			if t, ok := item.(*pg.ResTarget); ok && *t.Name == pc {
+				j = k
+				break
+			}
+		}
+		if j == -1 {
+			newValues = append(newValues, whereClauseValues[indexes[i]])
+			continue
+		}
+		value, err := insertValue(s.TargetList.Items[j].(*pg.ResTarget).Val)
+		if err != nil {
+			return "", false, fmt.Errorf("column %s part of the primary vindex can only be updated with a constant value: %w", pc, err)
+		}
+		newValues = append(newValues, value)
+		updated = true
+	}
+	if !updated {
+		return "", false, nil
+	}
+	keyspaceId, err = table.KeyspaceId(newValues)
+	if err != nil {
+		return "", false, err
+	}
+	return keyspaceId, true, nil
+}
+
+// parseDMLWhereClause extracts the columns and values of the where clause of an UPDATE or DELETE statement.
+// command is the name of the statement, used in error messages.
+func parseDMLWhereClause(node ast.Node, relation, command string) (whereClauseColumns, whereClauseValues []string, err error) {
+	var exprs []*pg.A_Expr
+	switch ss := node.(type) {
+	case *pg.A_Expr:
+		exprs = append(exprs, ss)
 	case *pg.BoolExpr:
 		// 0 = AND, 1 = OR, 2 NOT. See https://doxygen.postgresql.org/primnodes_8h.html#a27f637bf3e2c33cc8e48661a8864c7af
 		if ss.Boolop > 0 {
-			return fmt.Errorf("Only AND expression is allowed as a boolean operator in UPDATE statements")
+			return nil, nil, fmt.Errorf("Only AND expression is allowed as a boolean operator in %s statements", command)
 		}
 		for _, argItem := range ss.Args.Items {
-			switch arg := argItem.(type) {
-			case *pg.A_Expr:
-				for _, expr := range arg.Name.Items {
-					switch exprElem := expr.(type) {
-					case *pg.String:
-						if exprElem.Str != "=" {
-							return fmt.Errorf("only equal expression is allowed in UPDATE statements")
-						}
-					}
-				}
-				switch lexpr := arg.Lexpr.(type) {
-				case *pg.ColumnRef:
-					for _, column := range lexpr.Fields.Items {
-						switch columnElem := column.(type) {
-						case *pg.String:
-							whereClauseColumns = append(whereClauseColumns, columnElem.Str)
-						default:
-							return fmt.Errorf("left expression of where clause must be a column name")
-						}
-					}
+			if arg, ok := argItem.(*pg.A_Expr); ok {
+				exprs = append(exprs, arg)
+			}
+		}
+	case nil, *ast.TODO:
+		return nil, nil, fmt.Errorf("cannot execute %s statement without a where clause", command)
+	default:
+		return nil, nil, fmt.Errorf("expecting a list of columns in where clause, found unknown expression")
+	}
+	for _, expr := range exprs {
+		for _, name := range expr.Name.Items {
+			switch exprElem := name.(type) {
+			case *pg.String:
+				if exprElem.Str != "=" {
+					return nil, nil, fmt.Errorf("only equal expression is allowed in %s statements", command)
 				}
-				switch rexpr := arg.Rexpr.(type) {
-				case *pg.A_Const:
-					switch rexprConst := rexpr.Val.(type) {
-					case *pg.String:
-						whereClauseValues = append(whereClauseValues, rexprConst.Str)
-					case *pg.Integer:
-						whereClauseValues = append(whereClauseValues, fmt.Sprintf("%d", rexprConst.Ival))
-					default:
-						return fmt.Errorf("unknown constant type in where clause. String and Integer only")
-					}
+			}
+		}
+		switch lexpr := expr.Lexpr.(type) {
+		case *pg.ColumnRef:
+			var fields []string
+			for _, column := range lexpr.Fields.Items {
+				switch columnElem := column.(type) {
+				case *pg.String:
+					fields = append(fields, columnElem.Str)
+				default:
+					return nil, nil, fmt.Errorf("left expression of where clause must be a column name")
 				}
 			}
+			// columns qualified with the name or the alias of the table have been resolved to the table itself
+			if len(fields) == 2 && fields[0] == relation {
+				fields = fields[1:]
+			}
+			if len(fields) != 1 {
+				return nil, nil, fmt.Errorf("left expression of where clause must be a column of table %s", relation)
+			}
+			whereClauseColumns = append(whereClauseColumns, fields[0])
+		}
+		if value, ok := constantValue(expr.Rexpr); ok {
+			whereClauseValues = append(whereClauseValues, value)
 		}
-	default:
-		return fmt.Errorf("expecting a list of columns in where clause, found unknown expression")
 	}
-	// build list of indexes of update stmt columns that match the vschema table primary vindex columns.
+	return whereClauseColumns, whereClauseValues, nil
+}
+
+// routeDMLStmt returns the shard owning the rows targeted by an UPDATE or DELETE statement, and the index
+// in the where clause of each column of the table primary vindex.
+// command is the name of the statement, used in error messages.
+func routeDMLStmt(table *Table, whereClauseColumns, whereClauseValues []string, cluster *Cluster, command string) (*Shard, []int, error) {
+	// build list of indexes of where clause columns that match the vschema table primary vindex columns.
 	// e.g. update orders set amount = 500 where id = 'abcd' -> primary vindex for table orders is `id`,
 	// so the result will be [0].
-	// Iterate first on table vindex columns, and then on update stmt where clause columns
-	table := vschema.GetTable(relation)
-	if table == nil {
-		return fmt.Errorf("cannot process UPDATE statement, table %s is not part of the vschema", relation)
-	}
+	// Iterate first on table vindex columns, and then on where clause columns
 	var indexes []int
-	for _, pc := range table.GetPrimaryVIndex().Columns {
-		if stringArrayContainsValue(updatedColumns, pc) > -1 {
-			return fmt.Errorf("cannot update column %s because it is part of the primary vindex", pc)
-		}
+	primaryIndexColumns := table.GetPrimaryVIndex().Columns
+	for _, pc := range primaryIndexColumns {
 		for i, c := range whereClauseColumns {
 			if pc == c {
 				indexes = append(indexes, i)
@@ -707,30 +1156,103 @@ func (mock *PGMock) processUpdateStmt(s *pg.UpdateStmt, q QueryMessage, cluster
 			}
 		}
 	}
-	if len(indexes) != len(whereClauseColumns) {
-		return fmt.Errorf("cannot execute UPDATE statement without all primary vindex columns being present in the where clause")
+	if len(indexes) != len(whereClauseColumns) || len(indexes) != len(primaryIndexColumns) || len(indexes) != len(whereClauseValues) {
+		return nil, nil, fmt.Errorf("cannot execute %s statement without all primary vindex columns being present in the where clause", command)
 	}
-	mock.logger.Log("msg", fmt.Sprintf("relation: %s, columns: %s", relation, whereClauseColumns))
-	var concat string
+	var values []string
 	for _, val := range indexes {
-		whereClauseValue := whereClauseValues[val]
-		concat = appendToConcatenate(concat, whereClauseValue)
+		values = append(values, whereClauseValues[val])
 	}
-	target, err := cluster.GetShardForKeyspaceId(concat)
+	concat, err := table.KeyspaceId(values)
 	if err != nil {
-		return fmt.Errorf("cannot select destination shard for UPDATE statement: %w", err)
+		return nil, nil, err
 	}
-	mock.logger.Log("msg", fmt.Sprintf("shard selected: %s\n", target.Name))
-	res, err := target.Conn.Exec(context.Background(), q.String)
+	target, err := cluster.GetShardForTable(table, concat)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot select destination shard for %s statement: %w", command, err)
+	}
+	return target, indexes, nil
+}
+
+// scatterDMLStmt executes an UPDATE or DELETE statement on every shard inside a cross-shard transaction,
+// and sends back the total number of affected rows.
+func (mock *PGMock) scatterDMLStmt(command string, q QueryMessage, cluster *Cluster) error {
+	mock.logger.Log("msg", fmt.Sprintf("executing %s statement on every shard", command))
+	results, err := execInTransaction(context.Background(), cluster.Shards, q.String)
 	if err != nil {
 		return err
 	}
-	defer res.Close()
-	results, err := res.ReadAll()
+	return mock.FinaliseExecuteSequence(command, []*pgconn.Result{mergeResults(command, results)})
+}
+
+// replicateStmt executes a statement writing to a reference table on every shard inside a cross-shard
+// transaction, so that all the copies of the table stay identical. As every shard holds the same rows,
+// the result of the first shard is sent back.
+func (mock *PGMock) replicateStmt(command string, q QueryMessage, cluster *Cluster) error {
+	mock.logger.Log("msg", fmt.Sprintf("replicating %s statement on every shard", command))
+	results, err := execInTransaction(context.Background(), cluster.Shards, q.String)
 	if err != nil {
 		return err
 	}
-	return mock.FinaliseExecuteSequence("UPDATE", results)
+	return mock.FinaliseExecuteSequence(command, results[:1])
+}
+
+// generatedAlways is the SQLSTATE returned by PostgreSQL when a value is inserted in a generated column.
+const generatedAlways = "428C9"
+
+// moveUpdatedRows executes an UPDATE statement changing the shard owning the updated rows.
+// Inside a cross-shard transaction, the rows are updated on the shard currently owning them and
+// returned to Matriarch, then deleted from that shard and inserted in the new owner shard.
+// Rows are returned and inserted with all their columns, so tables with generated columns cannot be moved:
+// PostgreSQL rejects the INSERT with the SQLSTATE generatedAlways and the update is rolled back.
+func (mock *PGMock) moveUpdatedRows(table *Table, q QueryMessage, from, to *Shard) error {
+	relation := table.SQLName()
+	update, returning := splitReturningClause(q.String)
+	ctx := context.Background()
+	tx, err := NewShardTransaction()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(ctx, from, update+" RETURNING ctid, *")
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	updated := res[len(res)-1]
+	results := []*pgconn.Result{{CommandTag: pgconn.CommandTag("UPDATE 0")}}
+	if len(updated.Rows) > 0 {
+		var ctids, rows []string
+		var columns []string
+		for _, fd := range updated.FieldDescriptions[1:] {
+			columns = append(columns, quoteIdentifier(string(fd.Name)))
+		}
+		for _, row := range updated.Rows {
+			ctids = append(ctids, quoteLiteral(string(row[0])))
+			rows = append(rows, valuesRow(row[1:]))
+		}
+		deleteStmt := fmt.Sprintf("DELETE FROM %s WHERE ctid IN (%s)", relation, strings.Join(ctids, ", "))
+		if _, err = tx.Exec(ctx, from, deleteStmt); err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		insertStmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s %s", relation, strings.Join(columns, ", "),
+			strings.Join(rows, ", "), returning)
+		res, err = tx.Exec(ctx, to, strings.TrimSpace(insertStmt))
+		if err != nil {
+			tx.Rollback(ctx)
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == generatedAlways {
+				return fmt.Errorf("cannot move rows of table %s to shard %s, as the values of its generated columns cannot be inserted: %w",
+					table.Key(), to.Name, err)
+			}
+			return err
+		}
+		results = append(results, res...)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	return mock.FinaliseExecuteSequence("UPDATE", []*pgconn.Result{mergeResults("UPDATE", results)})
 }
 
 func walkJoinExpressionTree(node ast.Node, relations *[]string) error {
@@ -742,13 +1264,18 @@ func walkJoinExpressionTree(node ast.Node, relations *[]string) error {
 		case *pg.RangeVar:
 			*relations = append(*relations, *jlarg.Relname)
 		case *pg.JoinExpr:
-			walkJoinExpressionTree(jlarg, relations)
+			if err := walkJoinExpressionTree(jlarg, relations); err != nil {
+				return err
+			}
+		case *pg.RangeSubselect:
+			// subqueries are routed on their own
 		default:
 			return fmt.Errorf("cannot parse FROM clause for SELECT JOIN statement")
 		}
 		switch jrarg := fc.Rarg.(type) {
 		case *pg.RangeVar:
 			*relations = append(*relations, *jrarg.Relname)
+		case *pg.RangeSubselect:
 		default:
 			return fmt.Errorf("cannot parse FROM clause for SELECT JOIN statement")
 		}
@@ -756,150 +1283,308 @@ func walkJoinExpressionTree(node ast.Node, relations *[]string) error {
 	return nil
 }
 
-func parseWhereAExpression(node *pg.A_Expr, relations []string) (table, column, value string, err error) {
-	if node.Kind != 0 {
-		return table, column, value, fmt.Errorf("expression kind must be 0")
-	}
-	switch lexpr := node.Lexpr.(type) {
-	case *pg.ColumnRef:
-		var fields []string
-		for _, col := range lexpr.Fields.Items {
-			switch columnElem := col.(type) {
-			case *pg.String:
-				fields = append(fields, columnElem.Str)
-			default:
-				return table, column, value, fmt.Errorf("left expression of where clause must contain a column name")
+// joinCondition models the equality of two columns of two tables, used to join them.
+type joinCondition struct {
+	LeftTable   string
+	LeftColumn  string
+	RightTable  string
+	RightColumn string
+}
+
+// walkJoinConditions extracts the equalities between columns of the JOIN conditions of a FROM clause.
+// Other conditions are ignored, as they don't tell where joined rows live.
+func walkJoinConditions(node ast.Node, joins *[]joinCondition) {
+	fc, ok := node.(*pg.JoinExpr)
+	if !ok {
+		return
+	}
+	walkJoinConditions(fc.Larg, joins)
+	walkJoinConditions(fc.Rarg, joins)
+	if fc.UsingClause != nil {
+		larg, lok := fc.Larg.(*pg.RangeVar)
+		rarg, rok := fc.Rarg.(*pg.RangeVar)
+		if lok && rok {
+			for _, item := range fc.UsingClause.Items {
+				if column, ok := item.(*pg.String); ok {
+					*joins = append(*joins, joinCondition{*larg.Relname, column.Str, *rarg.Relname, column.Str})
+				}
 			}
 		}
-		switch len(fields) {
-		case 1:
-			table = relations[0]
-			column = fields[0]
-		case 2:
-			table = fields[0]
-			column = fields[1]
-		default:
-			return table, column, value, fmt.Errorf("only the form table.column_name is currently supported to specify clauses")
+	}
+	parseJoinQuals(fc.Quals, joins)
+}
+
+func parseJoinQuals(node ast.Node, joins *[]joinCondition) {
+	switch n := node.(type) {
+	case *pg.BoolExpr:
+		// 0 = AND, 1 = OR, 2 NOT. See https://doxygen.postgresql.org/primnodes_8h.html#a27f637bf3e2c33cc8e48661a8864c7af
+		if n.Boolop > 0 {
+			return
 		}
-		for _, expr := range node.Name.Items {
-			switch exprElem := expr.(type) {
-			case *pg.String:
-				if table == relations[0] && exprElem.Str != "=" {
-					return table, column, value,
-						fmt.Errorf("only equal expression is allowed in WHERE clauses for columns part of the primary vindex of the first table of the SELECT FROM statement")
-				}
-			}
+		for _, arg := range n.Args.Items {
+			parseJoinQuals(arg, joins)
 		}
-		switch rexpr := node.Rexpr.(type) {
-		case *pg.A_Const:
-			switch rexprConst := rexpr.Val.(type) {
-			case *pg.String:
-				value = rexprConst.Str
-			case *pg.Float:
-				value = rexprConst.Str
-			case *pg.Integer:
-				value = fmt.Sprintf("%d", rexprConst.Ival)
-			default:
-				return table, column, value, fmt.Errorf("unknown constant type in where clause. Only type string and integer are supported")
-			}
+	case *pg.A_Expr:
+		if join, ok := parseJoinCondition(n); ok {
+			*joins = append(*joins, join)
 		}
 	}
-	return table, column, value, nil
 }
 
-func walkWhereExpressionTree(node ast.Node, relations []string, whereClauseColumns, whereClauseValues map[string][]string) error {
+// parseJoinCondition returns the join condition expressed by an equality between two columns
+// qualified with their table name, e.g. order_items.order_id = orders.id.
+func parseJoinCondition(node *pg.A_Expr) (joinCondition, bool) {
+	if node.Kind != 0 || len(node.Name.Items) != 1 {
+		return joinCondition{}, false
+	}
+	if op, ok := node.Name.Items[0].(*pg.String); !ok || op.Str != "=" {
+		return joinCondition{}, false
+	}
+	leftTable, leftColumn, lok := qualifiedColumnName(node.Lexpr)
+	rightTable, rightColumn, rok := qualifiedColumnName(node.Rexpr)
+	if !lok || !rok {
+		return joinCondition{}, false
+	}
+	return joinCondition{leftTable, leftColumn, rightTable, rightColumn}, true
+}
+
+// qualifiedColumnName returns the table and column names of a column reference in the form table.column_name.
+func qualifiedColumnName(node ast.Node) (table, column string, ok bool) {
+	ref, ok := node.(*pg.ColumnRef)
+	if !ok || len(ref.Fields.Items) != 2 {
+		return "", "", false
+	}
+	t, tok := ref.Fields.Items[0].(*pg.String)
+	c, cok := ref.Fields.Items[1].(*pg.String)
+	if !tok || !cok {
+		return "", "", false
+	}
+	return t.Str, c.Str, true
+}
+
+var ErrNonColocatedJoin = errors.New("cannot execute select statement joining sharded tables which are not co-located")
+
+// checkColocation verifies that rows of the sharded tables joined by a statement live on the same shard.
+// Tables joined through a co-located join condition are grouped together: all the tables must end up in a
+// single group, otherwise the statement would need rows stored on different shards.
+func checkColocation(relations []string, joins []joinCondition, vschema *Vschema) error {
+	group := make(map[string]string)
+	for _, relation := range relations {
+		group[relation] = relation
+	}
+	var find func(relation string) string
+	find = func(relation string) string {
+		if group[relation] != relation {
+			group[relation] = find(group[relation])
+		}
+		return group[relation]
+	}
+	for _, join := range joins {
+		if _, ok := group[join.LeftTable]; !ok {
+			continue
+		}
+		if _, ok := group[join.RightTable]; !ok {
+			continue
+		}
+		if vschema.IsColocatedJoin(join.LeftTable, join.LeftColumn, join.RightTable, join.RightColumn) {
+			group[find(join.LeftTable)] = find(join.RightTable)
+		}
+	}
+	for _, relation := range relations[1:] {
+		if find(relation) != find(relations[0]) {
+			return fmt.Errorf("%w: rows of tables %s and %s could live on different shards. "+
+				"Join sharded tables on primary vindex columns linked by the references of the vschema", ErrNonColocatedJoin, relations[0], relation)
+		}
+	}
+	return nil
+}
+
+// tableColumn identifies a column of a table of the statement.
+type tableColumn struct {
+	Table  string
+	Column string
+}
+
+// columnValues maps columns to the constant they are equal to.
+type columnValues map[tableColumn]string
+
+// maxWhereAlternatives is the maximum number of alternatives of column values computed for a where clause,
+// beyond which the where clause is considered to select rows on every shard.
+const maxWhereAlternatives = 1024
+
+// parseWhereAExpression returns the table and column of an equality between a column and a constant,
+// or of a column IN a list of constants, with the values of the constants.
+// ok is false for expressions which cannot be used to route the statement, such as comparisons between columns,
+// range predicates or predicates on function calls, e.g. id < 'b', id BETWEEN 'a' AND 'b', lower(id) = 'a'.
+func parseWhereAExpression(node *pg.A_Expr, relations []string) (table, column string, values []string, ok bool) {
+	// 0 = AEXPR_OP, 7 = AEXPR_IN. See https://github.com/postgres/postgres/blob/REL_12_STABLE/src/include/nodes/parsenodes.h
+	if (node.Kind != 0 && node.Kind != 7) || len(node.Name.Items) != 1 {
+		return table, column, nil, false
+	}
+	if name, ok := node.Name.Items[0].(*pg.String); !ok || name.Str != "=" {
+		return table, column, nil, false
+	}
+	lexpr, rexpr := node.Lexpr, node.Rexpr
+	if _, ok := lexpr.(*pg.A_Const); ok && node.Kind == 0 {
+		lexpr, rexpr = rexpr, lexpr
+	}
+	ref, ok := lexpr.(*pg.ColumnRef)
+	if !ok {
+		return table, column, nil, false
+	}
+	var fields []string
+	for _, col := range ref.Fields.Items {
+		columnElem, ok := col.(*pg.String)
+		if !ok {
+			return table, column, nil, false
+		}
+		fields = append(fields, columnElem.Str)
+	}
+	switch len(fields) {
+	case 1:
+		table = relations[0]
+		column = fields[0]
+	case 2:
+		table = fields[0]
+		column = fields[1]
+	default:
+		return table, column, nil, false
+	}
+	constants := []ast.Node{rexpr}
+	if list, ok := rexpr.(*ast.List); ok && node.Kind == 7 {
+		constants = list.Items
+	}
+	for _, constant := range constants {
+		value, ok := constantValue(constant)
+		if !ok {
+			return table, column, nil, false
+		}
+		values = append(values, value)
+	}
+	return table, column, values, true
+}
+
+// walkWhereExpressionTree returns the alternatives of values of the columns compared to constants in a where clause:
+// every row selected by the where clause has the values of at least one of the alternatives, e.g.
+// where (id = 'a' or id = 'b') and amount > 10 has the alternatives {id: a} and {id: b}.
+// An alternative without a column places no constraint on its values, so where amount > 10 has a single empty alternative.
+// The equalities between columns which hold for every selected row, i.e. which are not nested in OR or NOT
+// expressions, are appended to joins, which may be nil.
+func walkWhereExpressionTree(node ast.Node, relations []string, joins *[]joinCondition) []columnValues {
 	switch ss := node.(type) {
 	case *pg.BoolExpr:
-		for _, argItem := range ss.Args.Items {
-			var err error
-			switch arg := argItem.(type) {
-			case *pg.A_Expr:
-				table, column, value, err := parseWhereAExpression(arg, relations)
-				if err != nil {
-					return err
-				}
-				// 0 = AND, 1 = OR, 2 NOT. See https://doxygen.postgresql.org/primnodes_8h.html#a27f637bf3e2c33cc8e48661a8864c7af
-				if ss.Boolop > 0 && table == relations[0] {
-					return fmt.Errorf("Only AND expression is allowed as a boolean operator in the WHERE clause")
+		// 0 = AND, 1 = OR, 2 NOT. See https://doxygen.postgresql.org/primnodes_8h.html#a27f637bf3e2c33cc8e48661a8864c7af
+		switch ss.Boolop {
+		case 0:
+			alternatives := []columnValues{{}}
+			for _, arg := range ss.Args.Items {
+				alternatives = combineAlternatives(alternatives, walkWhereExpressionTree(arg, relations, joins))
+			}
+			return alternatives
+		case 1:
+			var alternatives []columnValues
+			for _, arg := range ss.Args.Items {
+				for _, alternative := range walkWhereExpressionTree(arg, relations, nil) {
+					if len(alternative) == 0 {
+						// one of the operands selects any row
+						return []columnValues{{}}
+					}
+					alternatives = append(alternatives, alternative)
 				}
-				whereClauseColumns[table] = append(whereClauseColumns[table], column)
-				whereClauseValues[table] = append(whereClauseValues[table], value)
-			case *pg.BoolExpr:
-				err = walkWhereExpressionTree(arg, relations, whereClauseColumns, whereClauseValues)
 			}
-			if err != nil {
-				return err
+			if len(alternatives) > maxWhereAlternatives {
+				return []columnValues{{}}
 			}
+			return alternatives
 		}
 	case *pg.A_Expr:
-		table, column, value, err := parseWhereAExpression(ss, relations)
-		if err != nil {
-			return err
+		if join, ok := parseJoinCondition(ss); ok {
+			if joins != nil {
+				*joins = append(*joins, join)
+			}
+			return []columnValues{{}}
 		}
-		whereClauseColumns[table] = append(whereClauseColumns[table], column)
-		whereClauseValues[table] = append(whereClauseValues[table], value)
-	default:
-		return fmt.Errorf("expecting a list of columns in where clause, found unknown expression")
+		table, column, values, ok := parseWhereAExpression(ss, relations)
+		if !ok || len(values) > maxWhereAlternatives {
+			return []columnValues{{}}
+		}
+		var alternatives []columnValues
+		for _, value := range values {
+			alternatives = append(alternatives, columnValues{{table, column}: value})
+		}
+		return alternatives
 	}
-	return nil
+	// other predicates, e.g. function calls or subqueries, which are routed on their own, place no constraint on columns
+	return []columnValues{{}}
 }
 
-// Limitations: all primary vindex columns must be present and must be the only fields part of the where clause list of columns
-// Column names must be used as left expression (i.e. order_id = '123342')
-// Expressions allowed in the where clause: =
-// where clause columns are linked by a AND boolean expression (i.e. column_1 = '123342 AND column_2 = 'abcd')
+// combineAlternatives returns the alternatives of column values satisfying both the alternatives a and b.
+// When an alternative of a and an alternative of b specify different values for the same column, the value of a is kept.
+func combineAlternatives(a, b []columnValues) []columnValues {
+	if len(a)*len(b) > maxWhereAlternatives {
+		if len(a) <= len(b) {
+			return a
+		}
+		return b
+	}
+	var combined []columnValues
+	for _, x := range a {
+		for _, y := range b {
+			alternative := make(columnValues, len(x)+len(y))
+			for c, v := range y {
+				alternative[c] = v
+			}
+			for c, v := range x {
+				alternative[c] = v
+			}
+			combined = append(combined, alternative)
+		}
+	}
+	return combined
+}
+
+// Limitations: the statement is routed to a single shard when all primary vindex columns of one of the sharded tables
+// are compared to constants in the where clause. Otherwise it is executed on every shard owning the rows it reads,
+// see processScatterSelect.
+// Sharded tables can only be joined on their primary vindex columns, so that joined rows live on the same shard
 // Algo:
 // 1. extract the tables involved in the select operation
-// 2. extract all columns and their values involved in the where clause
-// 3. extract the boolean expression linking all clauses. If not "AND", return error
-// 4. extract the expression:
-// 5. if expr is
-//    5.1 =, build the concatenate, select the shard and issue the delete command
-//    5.2 in, for on each value and treat each iteration as a = expression -> not yet supported
+// 2. extract the alternatives of values of the columns compared to constants in the where clause
+// 3. for each alternative, build the concatenate of the primary vindex values and select the shard owning it
+// 4. execute the statement on the selected shard, or on the union of the selected shards
 func (mock *PGMock) processSelectStmt(s *pg.SelectStmt, q QueryMessage, cluster *Cluster, vschema *Vschema) error {
-	var relations []string
-	for _, fromClause := range s.FromClause.Items {
-		walkJoinExpressionTree(fromClause, &relations)
+	if s.Op > 0 || hasSubqueries(s) {
+		return mock.processSelectWithSubqueries(s, q, cluster, vschema)
+	}
+	target, err := mock.routeSelectStmt(s, cluster, vschema)
+	if errors.Is(err, ErrNonColocatedJoin) {
+		return mock.processCrossShardJoin(s, q, cluster, vschema)
+	}
+	if errors.Is(err, ErrMissingPrimaryVIndex) {
+		return mock.processScatterSelect(s, q, cluster, vschema, err)
 	}
-	var whereClauseColumns = make(map[string][]string)
-	var whereClauseValues = make(map[string][]string)
-	err := walkWhereExpressionTree(s.WhereClause, relations, whereClauseColumns, whereClauseValues)
 	if err != nil {
 		return err
 	}
-	mock.logger.Log("msg", fmt.Sprintf("where clause columns %s, values %s", whereClauseColumns, whereClauseValues))
+	return mock.executeSelect(target, q)
+}
 
-	// build list of indexes of select stmt where clause columns that match the vschema table primary vindex columns.
-	// e.g. select * from orders where id = 'abcd' -> primary vindex for table orders is `id`,
-	// so the result will be [0].
-	// Iterate first on table vindex columns, and then on select stmt columns
-	table := vschema.GetTable(relations[0])
-	if table == nil {
-		return fmt.Errorf("cannot process select statement, table %s is not part of the vschema", relations[0])
-	}
-	var indexes []int
-	for _, pc := range table.GetPrimaryVIndex().Columns {
-		for i, c := range whereClauseColumns[relations[0]] {
-			if pc == c {
-				indexes = append(indexes, i)
-				continue
-			}
-		}
+// processScatterSelect executes a select statement reading rows from several shards, see scatterSelect.
+// routeErr is the error returned by routeSelectStmt.
+func (mock *PGMock) processScatterSelect(s *pg.SelectStmt, q QueryMessage, cluster *Cluster, vschema *Vschema, routeErr error) error {
+	if !isEmptyList(s.SortClause) {
+		return fmt.Errorf("ORDER BY clauses require all primary vindex columns in the where clause: %w", routeErr)
 	}
-	if len(indexes) != len(whereClauseColumns[relations[0]]) {
-		return fmt.Errorf("cannot execute select statement without all primary vindex columns being present in the where clause")
-	}
-	var concat string
-	for _, val := range indexes {
-		whereClauseValue := whereClauseValues[relations[0]][val]
-		concat = appendToConcatenate(concat, whereClauseValue)
-	}
-	target, err := cluster.GetShardForKeyspaceId(concat)
+	result, err := mock.scatterSelect(q.String, s, cluster, vschema, routeErr)
 	if err != nil {
-		return fmt.Errorf("cannot select destination shard for delete statement: %w", err)
+		return err
 	}
-	mock.logger.Log("msg", fmt.Sprintf("shard selected: %s", target.Name))
+	result.CommandTag = pgconn.CommandTag(fmt.Sprintf("SELECT %d", len(result.Rows)))
+	return mock.FinaliseExecuteSequence("SELECT", []*pgconn.Result{result})
+}
 
+// executeSelect executes a select statement on the shard owning the rows it reads.
+func (mock *PGMock) executeSelect(target *Shard, q QueryMessage) error {
 	res, err := target.Conn.Exec(context.Background(), q.String)
 	if err != nil {
 		return err
@@ -912,6 +1597,248 @@ func (mock *PGMock) processSelectStmt(s *pg.SelectStmt, q QueryMessage, cluster
 	return mock.FinaliseExecuteSequence("SELECT", results)
 }
 
+var ErrMissingPrimaryVIndex = errors.New("cannot execute select statement without all primary vindex columns being present in the where clause")
+
+// routeSelectStmt returns the shard owning the rows selected by the statement.
+// It returns ErrMissingPrimaryVIndex when the where clause doesn't specify all the primary vindex columns
+// of one of the sharded tables of the FROM clause.
+// Statements containing subqueries are routed by routeSelectTree.
+func (mock *PGMock) routeSelectStmt(s *pg.SelectStmt, cluster *Cluster, vschema *Vschema) (*Shard, error) {
+	if isEmptyList(s.FromClause) {
+		return nil, errors.New("cannot route select statement without a FROM clause")
+	}
+	if hasSubqueries(s) {
+		return nil, errors.New("cannot route select statement containing subqueries")
+	}
+	target, err := mock.routeSelect(s, cluster, vschema, nil)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil {
+		target = cluster.AnyShard()
+		mock.logger.Log("msg", fmt.Sprintf("reading reference tables, shard selected: %s", target.Name))
+	}
+	return target, nil
+}
+
+// routeSelect returns the shard owning the rows read by the statement, ignoring its subqueries.
+// The shard is nil when the statement only reads reference tables or the results of the CTEs ctes, so it can be served by any shard.
+// It returns ErrMissingPrimaryVIndex when the rows could live on more than one shard.
+func (mock *PGMock) routeSelect(s *pg.SelectStmt, cluster *Cluster, vschema *Vschema, ctes []string) (*Shard, error) {
+	shards, err := mock.routeSelectShards(s, cluster, vschema, ctes)
+	if err != nil {
+		return nil, err
+	}
+	switch len(shards) {
+	case 0:
+		return nil, nil
+	case 1:
+		return shards[0], nil
+	}
+	return nil, fmt.Errorf("%w: rows could live on %d shards", ErrMissingPrimaryVIndex, len(shards))
+}
+
+// routeSelectShards returns the shards owning the rows read by the statement, ignoring its subqueries, e.g. the shards
+// owning the keyspace ids a and b for select * from orders where id = 'a' or id = 'b', and every shard when the where
+// clause doesn't compare the primary vindex columns to constants, e.g. for select * from orders where id < 'b'.
+// The shards are nil when the statement only reads reference tables or the results of the CTEs ctes, so it can be served by any shard.
+func (mock *PGMock) routeSelectShards(s *pg.SelectStmt, cluster *Cluster, vschema *Vschema, ctes []string) ([]*Shard, error) {
+	route, err := mock.planSelectRoute(s, cluster, vschema, ctes)
+	if err != nil {
+		return nil, err
+	}
+	return route.Shards, nil
+}
+
+// selectRoute describes how the shards owning the rows read by a select statement have been selected.
+type selectRoute struct {
+	// Relations are the tables read by the statement.
+	Relations []string
+	// Table is the sharded table whose primary vindex selected the shards, empty when the rows could live on every shard.
+	Table string
+	// KeyspaceIds are the distinct keyspace ids of the primary vindex values selected by the where clause, see Table.KeyspaceId.
+	KeyspaceIds []string
+	// Shards are the shards owning the rows, nil when the statement can be served by any shard.
+	Shards []*Shard
+	// Lookup is the lookup vindex of Table which selected the shards, nil when they were selected by its primary vindex.
+	Lookup *VIndex
+	// LookupValues are the distinct values of the lookup vindex selected by the where clause, see Table.LookupValue.
+	LookupValues []string
+	// LookupKeyspaceIds are the keyspace ids found in the lookup table for LookupValues.
+	LookupKeyspaceIds []uint64
+	// Unsharded is the first unsharded table read by the statement, whose shard is the single shard of Shards.
+	Unsharded string
+}
+
+// planSelectRoute returns the route of a select statement, see routeSelectShards.
+func (mock *PGMock) planSelectRoute(s *pg.SelectStmt, cluster *Cluster, vschema *Vschema, ctes []string) (*selectRoute, error) {
+	var relations []string
+	for _, fromClause := range s.FromClause.Items {
+		if err := walkJoinExpressionTree(fromClause, &relations); err != nil {
+			return nil, err
+		}
+	}
+	var tables []string
+	for _, relation := range relations {
+		if stringArrayContainsValue(ctes, relation) == -1 {
+			tables = append(tables, relation)
+		}
+	}
+	relations = tables
+	if len(relations) == 0 {
+		return &selectRoute{}, nil
+	}
+	// The statement is routed using the first sharded table of the FROM clause. Reference tables are
+	// copied on every shard, so joins with them are pushed down to the shard of the sharded table,
+	// and statements reading only reference tables can be served by any shard.
+	driving := -1
+	for i, relation := range relations {
+		table := vschema.GetTable(relation)
+		if table == nil {
+			return nil, fmt.Errorf("cannot process select statement, table %s is not part of the vschema", relation)
+		}
+		if table.Type == Sharded && driving == -1 {
+			driving = i
+		}
+	}
+	// Unsharded tables live on a single shard, so joins between them, and with reference tables, are pushed down to it
+	unsharded, unshardedRelation, err := unshardedRelationsShard(relations, cluster, vschema)
+	if err != nil {
+		return nil, err
+	}
+	if driving == -1 && unsharded != nil {
+		return &selectRoute{Relations: relations, Shards: []*Shard{unsharded}, Unsharded: unshardedRelation}, nil
+	}
+	if driving == -1 {
+		return &selectRoute{Relations: relations}, nil
+	}
+	if driving > 0 {
+		ordered := []string{relations[driving]}
+		ordered = append(ordered, relations[:driving]...)
+		ordered = append(ordered, relations[driving+1:]...)
+		relations = ordered
+	}
+	var sharded []string
+	for _, relation := range relations {
+		if vschema.GetTable(relation).Type == Sharded && stringArrayContainsValue(sharded, relation) == -1 {
+			sharded = append(sharded, relation)
+		}
+	}
+	var joins []joinCondition
+	for _, fromClause := range s.FromClause.Items {
+		walkJoinConditions(fromClause, &joins)
+	}
+	alternatives := []columnValues{{}}
+	if !isEmptyNode(s.WhereClause) {
+		alternatives = walkWhereExpressionTree(s.WhereClause, relations, &joins)
+	}
+	mock.logger.Log("msg", fmt.Sprintf("where clause alternatives %v", alternatives))
+	// Sharded tables can only be joined together when their rows live on the same shard,
+	// i.e. when they are joined on their primary vindex columns.
+	if err := checkColocation(sharded, joins, vschema); err != nil {
+		return nil, err
+	}
+
+	// As all the sharded tables are co-located, the statement can be routed using the primary vindex
+	// of any of them, e.g. select * from orders join order_items on order_items.order_id = orders.id
+	// where order_items.order_id = 'abcd'.
+	route := &selectRoute{Relations: relations, Shards: cluster.Shards}
+	for _, relation := range sharded {
+		r, err := primaryVIndexRoute(relation, vschema.GetTable(relation), alternatives, cluster)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil && len(r.Shards) < len(route.Shards) {
+			r.Relations = relations
+			route = r
+		}
+	}
+	// Lookup tables are only read when no primary vindex selects the shards, as they cost a round trip to a shard.
+	if route.Table == "" {
+		for _, relation := range sharded {
+			r, err := lookupVIndexRoute(relation, vschema.GetTable(relation), alternatives, cluster)
+			if err != nil {
+				return nil, err
+			}
+			if r != nil {
+				r.Relations = relations
+				route = r
+				break
+			}
+		}
+	}
+	// Joins between unsharded and sharded tables are pushed down when the rows of the sharded tables live on the
+	// shard of the unsharded tables
+	if unsharded != nil {
+		if len(route.Shards) != 1 || route.Shards[0] != unsharded {
+			return nil, fmt.Errorf("cannot execute select statement joining unsharded table %s, stored on shard %s, "+
+				"with sharded tables whose rows could live on %d shards", unshardedRelation, unsharded.Name, len(route.Shards))
+		}
+		route.Unsharded = unshardedRelation
+	}
+	var names []string
+	for _, shard := range route.Shards {
+		names = append(names, shard.Name)
+	}
+	mock.logger.Log("msg", fmt.Sprintf("shards selected: %s", strings.Join(names, ", ")))
+	return route, nil
+}
+
+// primaryVIndexRoute returns the route to the shards owning the rows of a table, referenced as relation in the statement,
+// whose column values are one of the alternatives of the where clause. Shards are in the order of the shards of the cluster.
+// The route is nil when an alternative doesn't specify all the primary vindex columns of the table.
+func primaryVIndexRoute(relation string, table *Table, alternatives []columnValues, cluster *Cluster) (*selectRoute, error) {
+	columns := table.GetPrimaryVIndex().Columns
+	if len(columns) == 0 {
+		return nil, nil
+	}
+	route := &selectRoute{Table: relation}
+	owners := make(map[*Shard]bool)
+	for _, alternative := range alternatives {
+		var values []string
+		for _, pc := range columns {
+			value, found := alternative[tableColumn{relation, pc}]
+			if !found {
+				return nil, nil
+			}
+			values = append(values, value)
+		}
+		concat, err := table.KeyspaceId(values)
+		if err != nil {
+			return nil, err
+		}
+		shard, err := cluster.GetShardForTable(table, concat)
+		if err != nil {
+			return nil, fmt.Errorf("cannot select destination shard for select statement: %w", err)
+		}
+		if stringArrayContainsValue(route.KeyspaceIds, concat) == -1 {
+			route.KeyspaceIds = append(route.KeyspaceIds, concat)
+		}
+		owners[shard] = true
+	}
+	for _, shard := range cluster.Shards {
+		if owners[shard] {
+			route.Shards = append(route.Shards, shard)
+		}
+	}
+	return route, nil
+}
+
+// isEmptyList reports whether a list of the parsed statement is empty, as the parser never leaves lists nil.
+func isEmptyList(l *ast.List) bool {
+	return l == nil || len(l.Items) == 0
+}
+
+// isEmptyNode reports whether an optional node of the parsed statement is missing, as the parser converts
+// missing nodes to ast.TODO.
+func isEmptyNode(node ast.Node) bool {
+	if node == nil {
+		return true
+	}
+	_, ok := node.(*ast.TODO)
+	return ok
+}
+
 // stringArrayContainsValue returns the index of the first occurence of the value in the array,
 // -1 otherwise
 func stringArrayContainsValue(a []string, v string) int {
@@ -0,0 +1,873 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/vgheri/matriarch/parser/engine"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+)
+
+var testVschema = &Vschema{
+	Keyspace: "ecommerce",
+	Tables: []Table{
+		{
+			Name:     "orders",
+			Type:     Sharded,
+			VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}},
+		},
+		{
+			Name: "orders_archive",
+			Type: Sharded,
+			VIndexes: []VIndex{{
+				Columns:    []string{"id"},
+				Type:       Primary,
+				References: &VIndexReference{Column: "id", ExternalTable: "orders", ExternalColumn: "id"},
+			}},
+		},
+		{
+			Name: "order_items",
+			Type: Sharded,
+			VIndexes: []VIndex{{
+				Columns:    []string{"order_id"},
+				Type:       Primary,
+				References: &VIndexReference{Column: "order_id", ExternalTable: "orders", ExternalColumn: "id"},
+			}},
+		},
+		{
+			Name: "members",
+			Type: Sharded,
+			VIndexes: []VIndex{
+				{Columns: []string{"id"}, Type: Primary},
+				{Columns: []string{"email"}, Type: Secondary, Lookup: &VIndexLookup{Table: "members_email_lookup"}},
+			},
+		},
+		{
+			Name:     "categories",
+			Type:     Reference,
+			VIndexes: nil,
+		},
+		{
+			Name:  "promotions",
+			Type:  Unsharded,
+			Shard: "ecommerce_80$",
+		},
+		{
+			Name:  "coupons",
+			Type:  Unsharded,
+			Shard: "ecommerce_80$",
+		},
+		{
+			Name:  "jobs",
+			Type:  Unsharded,
+			Shard: "ecommerce_$80",
+		},
+	},
+}
+
+func parseInsertStmt(t *testing.T, sql string) *pg.InsertStmt {
+	stmts, err := engine.NewParser().Parse(strings.NewReader(sql))
+	if err != nil {
+		t.Fatalf("cannot parse %s: %v", sql, err)
+	}
+	s, ok := stmts[0].Raw.Stmt.(*pg.InsertStmt)
+	if !ok {
+		t.Fatalf("expected an InsertStmt, got %T", stmts[0].Raw.Stmt)
+	}
+	return s
+}
+
+func TestCheckOnConflictClause(t *testing.T) {
+	tests := []struct {
+		name        string
+		sql         string
+		expectError bool
+	}{
+		{
+			name: "conflict target on the primary vindex is allowed",
+			sql:  "insert into orders(id, amount) values ('a', 1) on conflict (id) do update set amount = excluded.amount",
+		},
+		{
+			name: "conflict target including the primary vindex is allowed",
+			sql:  "insert into orders(id, amount) values ('a', 1) on conflict (amount, id) do nothing",
+		},
+		{
+			name:        "conflict target without the primary vindex should error",
+			sql:         "insert into orders(id, amount) values ('a', 1) on conflict (amount) do nothing",
+			expectError: true,
+		},
+		{
+			name:        "missing conflict target should error",
+			sql:         "insert into orders(id, amount) values ('a', 1) on conflict do nothing",
+			expectError: true,
+		},
+		{
+			name:        "conflict on constraint should error",
+			sql:         "insert into orders(id, amount) values ('a', 1) on conflict on constraint orders_pkey do nothing",
+			expectError: true,
+		},
+		{
+			name:        "updating the primary vindex should error",
+			sql:         "insert into orders(id, amount) values ('a', 1) on conflict (id) do update set id = 'b'",
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := parseInsertStmt(t, tt.sql)
+			err := checkOnConflictClause(s.OnConflictClause, testVschema.GetTable("orders"))
+			if tt.expectError && err == nil {
+				t.Fatalf("expected error, test succeeded")
+			}
+			if !tt.expectError && err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+		})
+	}
+}
+
+func TestIsColocatedInsertSelect(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected bool
+	}{
+		{
+			name:     "primary vindex selected from the source primary vindex is co-located",
+			sql:      "insert into orders_archive(amount, id) select amount, id from orders",
+			expected: true,
+		},
+		{
+			name:     "primary vindex selected from another column is not co-located",
+			sql:      "insert into orders_archive(amount, id) select id, amount from orders",
+			expected: false,
+		},
+		{
+			name:     "reference table source is not co-located",
+			sql:      "insert into orders_archive(id) select id from categories",
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := parseInsertStmt(t, tt.sql)
+			source := s.SelectStmt.(*pg.SelectStmt)
+			if observed := isColocatedInsertSelect(source, testVschema.GetTable("orders_archive"), []int{1}, testVschema); observed != tt.expected {
+				t.Fatalf("expected %v, observed %v", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestIsColocatedJoinReferences(t *testing.T) {
+	vschema := &Vschema{
+		Keyspace: "ecommerce",
+		Tables: []Table{
+			{
+				Name:     "orders",
+				Type:     Sharded,
+				VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}},
+			},
+			{
+				Name: "order_items",
+				Type: Sharded,
+				VIndexes: []VIndex{{
+					Columns:    []string{"order_id"},
+					Type:       Primary,
+					References: &VIndexReference{Column: "order_id", ExternalTable: "orders", ExternalColumn: "id"},
+				}},
+			},
+			{
+				Name: "shipments",
+				Type: Sharded,
+				VIndexes: []VIndex{{
+					Columns:    []string{"order_item_id"},
+					Type:       Primary,
+					References: &VIndexReference{Column: "order_item_id", ExternalTable: "order_items", ExternalColumn: "order_id"},
+				}},
+			},
+			{
+				Name: "reviews",
+				Type: Sharded,
+				VIndexes: []VIndex{{
+					Columns:    []string{"member_id"},
+					Type:       Primary,
+					References: &VIndexReference{Column: "member_id", ExternalTable: "members", ExternalColumn: "email"},
+				}},
+			},
+			{
+				Name: "members",
+				Type: Sharded,
+				VIndexes: []VIndex{
+					{Columns: []string{"id"}, Type: Primary},
+				},
+			},
+		},
+	}
+	tests := []struct {
+		name        string
+		left, right tableColumn
+		expected    bool
+	}{
+		{
+			name:     "table referencing the other is co-located",
+			left:     tableColumn{"order_items", "order_id"},
+			right:    tableColumn{"orders", "id"},
+			expected: true,
+		},
+		{
+			name:     "tables referencing the same table are co-located",
+			left:     tableColumn{"shipments", "order_item_id"},
+			right:    tableColumn{"orders", "id"},
+			expected: true,
+		},
+		{
+			name:     "table is co-located with itself",
+			left:     tableColumn{"members", "id"},
+			right:    tableColumn{"members", "id"},
+			expected: true,
+		},
+		{
+			name:     "primary vindexes without references are not co-located",
+			left:     tableColumn{"members", "id"},
+			right:    tableColumn{"orders", "id"},
+			expected: false,
+		},
+		{
+			name:     "reference to a column which is not the primary vindex is not co-located",
+			left:     tableColumn{"reviews", "member_id"},
+			right:    tableColumn{"members", "id"},
+			expected: false,
+		},
+		{
+			name:     "columns which are not the primary vindexes are not co-located",
+			left:     tableColumn{"order_items", "id"},
+			right:    tableColumn{"orders", "id"},
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observed := vschema.IsColocatedJoin(tt.left.Table, tt.left.Column, tt.right.Table, tt.right.Column)
+			if observed != tt.expected {
+				t.Fatalf("expected %v, observed %v", tt.expected, observed)
+			}
+			observed = vschema.IsColocatedJoin(tt.right.Table, tt.right.Column, tt.left.Table, tt.left.Column)
+			if observed != tt.expected {
+				t.Fatalf("expected %v with the tables swapped, observed %v", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestColocationRequiresSameKeyspaceIds(t *testing.T) {
+	vschema := &Vschema{
+		Keyspace: "ecommerce",
+		Tables: []Table{
+			{
+				Name:     "orders",
+				Type:     Sharded,
+				VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary, Function: "xxhash"}},
+			},
+			{
+				Name: "orders_archive",
+				Type: Sharded,
+				VIndexes: []VIndex{{
+					Columns:    []string{"id"},
+					Type:       Primary,
+					Function:   "xxhash",
+					References: &VIndexReference{Column: "id", ExternalTable: "orders", ExternalColumn: "id"},
+				}},
+			},
+			{
+				Name: "order_items",
+				Type: Sharded,
+				VIndexes: []VIndex{{
+					Columns:    []string{"order_id"},
+					Type:       Primary,
+					References: &VIndexReference{Column: "order_id", ExternalTable: "orders", ExternalColumn: "id"},
+				}},
+			},
+			{
+				Name: "invoices",
+				Type: Sharded,
+				VIndexes: []VIndex{{
+					Columns:    []string{"order_id"},
+					Type:       Primary,
+					Function:   "xxhash",
+					References: &VIndexReference{Column: "order_id", ExternalTable: "orders", ExternalColumn: "id"},
+				}},
+				ColumnTypes: map[string]string{"order_id": "uuid"},
+			},
+		},
+	}
+	tests := []struct {
+		name     string
+		table    string
+		column   string
+		expected bool
+	}{
+		{
+			name:     "tables with the same function are co-located",
+			table:    "orders_archive",
+			column:   "id",
+			expected: true,
+		},
+		{
+			name:     "tables with different functions are not co-located",
+			table:    "order_items",
+			column:   "order_id",
+			expected: false,
+		},
+		{
+			name:     "tables normalising their values differently are not co-located",
+			table:    "invoices",
+			column:   "order_id",
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if observed := vschema.IsColocatedJoin("orders", "id", tt.table, tt.column); observed != tt.expected {
+				t.Fatalf("expected join to be co-located %v, observed %v", tt.expected, observed)
+			}
+			s := parseInsertStmt(t, fmt.Sprintf("insert into %s(%s) select id from orders", tt.table, tt.column))
+			observed := isColocatedInsertSelect(s.SelectStmt.(*pg.SelectStmt), vschema.GetTable(tt.table), []int{0}, vschema)
+			if observed != tt.expected {
+				t.Fatalf("expected insert select to be co-located %v, observed %v", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestProcessInsertSelectStmt(t *testing.T) {
+	archived := map[string][][]string{
+		"ecommerce_$80": {{"a", "1"}},
+		"ecommerce_80$": {{"b", "2"}, {"c", "3"}},
+	}
+	cluster, shards := startFakeShards(t, "ecommerce", 2, func(shard, sql string) fakeResult {
+		switch {
+		case strings.HasPrefix(sql, "select ref, total from orders_archive"):
+			return fakeResult{columns: []string{"ref", "total"}, rows: archived[shard], tag: fmt.Sprintf("SELECT %d", len(archived[shard]))}
+		case strings.HasPrefix(sql, "insert"):
+			return fakeResult{tag: fmt.Sprintf("INSERT 0 %d", strings.Count(sql, "), (")+1)}
+		}
+		return fakeResult{}
+	})
+
+	t.Run("co-located rows are inserted by each shard", func(t *testing.T) {
+		sql := "insert into orders_archive (id, amount) select id, amount from orders"
+		tags, err := processQuery(t, sql, cluster, testVschema)
+		if err != nil {
+			t.Fatalf("expected test to succeed, got error %v", err)
+		}
+		if expected := []string{"INSERT 0 2"}; !reflect.DeepEqual(tags, expected) {
+			t.Fatalf("expected command tags %v, observed %v", expected, tags)
+		}
+		for name, shard := range shards {
+			if observed := shard.Queries(); !reflect.DeepEqual(observed, []string{sql}) {
+				t.Fatalf("expected shard %s to execute %v, observed %v", name, []string{sql}, observed)
+			}
+		}
+	})
+
+	t.Run("rows are pulled and inserted in the shard owning them", func(t *testing.T) {
+		for _, shard := range shards {
+			shard.mu.Lock()
+			shard.queries = nil
+			shard.mu.Unlock()
+		}
+		sql := "insert into orders (id, amount) select ref, total from orders_archive"
+		tags, err := processQuery(t, sql, cluster, testVschema)
+		if err != nil {
+			t.Fatalf("expected test to succeed, got error %v", err)
+		}
+		if expected := []string{"INSERT 0 3"}; !reflect.DeepEqual(tags, expected) {
+			t.Fatalf("expected command tags %v, observed %v", expected, tags)
+		}
+		rowsByShard := make(map[string][]string)
+		for _, shard := range cluster.Shards {
+			for _, row := range archived[shard.Name] {
+				target, err := cluster.GetShardForKeyspaceId(row[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				rowsByShard[target.Name] = append(rowsByShard[target.Name], fmt.Sprintf("('%s', '%s')", row[0], row[1]))
+			}
+		}
+		for name, shard := range shards {
+			expected := []string{"select ref, total from orders_archive"}
+			if rows := rowsByShard[name]; len(rows) > 0 {
+				expected = append(expected, "insert into orders (id, amount) VALUES "+strings.Join(rows, ", "))
+			}
+			if observed := shard.Queries(); !reflect.DeepEqual(observed, expected) {
+				t.Fatalf("expected shard %s to execute %v, observed %v", name, expected, observed)
+			}
+		}
+	})
+}
+
+func TestProcessMultiRowInsertStmt(t *testing.T) {
+	var first, second string
+	cluster, shards := startFakeShards(t, "ecommerce", 2, func(shard, sql string) fakeResult {
+		if !strings.HasPrefix(sql, "insert") {
+			return fakeResult{}
+		}
+		var rows [][]string
+		for _, id := range []string{first, second} {
+			for i := 0; i < strings.Count(sql, "'"+id+"'"); i++ {
+				rows = append(rows, []string{id})
+			}
+		}
+		return fakeResult{columns: []string{"id"}, rows: rows, tag: fmt.Sprintf("INSERT 0 %d", len(rows))}
+	})
+	first = findKeyspaceId(t, cluster, cluster.Shards[0], true)
+	second = findKeyspaceId(t, cluster, cluster.Shards[1], true)
+	sql := fmt.Sprintf("insert into orders (id, amount) values ('%s', 1), ('%s', 2), ('%s', 3) returning id", first, second, first)
+	tags, rows, err := processQueryRows(t, sql, cluster, testVschema)
+	if err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if expected := []string{"INSERT 0 3"}; !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected command tags %v, observed %v", expected, tags)
+	}
+	// the rows returned by the shards are merged in the order of the shards
+	if expected := [][]string{{first}, {first}, {second}}; !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("expected rows %v, observed %v", expected, rows)
+	}
+	expected := map[string][]string{
+		cluster.Shards[0].Name: {fmt.Sprintf("insert into orders (id, amount) values ('%s', 1), ('%s', 3) returning id", first, first)},
+		cluster.Shards[1].Name: {fmt.Sprintf("insert into orders (id, amount) values ('%s', 2) returning id", second)},
+	}
+	for name, shard := range shards {
+		if observed := shard.Queries(); !reflect.DeepEqual(observed, expected[name]) {
+			t.Fatalf("expected shard %s to execute %v, observed %v", name, expected[name], observed)
+		}
+		shard.mu.Lock()
+		queries := strings.Join(shard.queries, "\n")
+		shard.mu.Unlock()
+		if !strings.Contains(queries, "PREPARE TRANSACTION") || !strings.Contains(queries, "COMMIT PREPARED") {
+			t.Fatalf("expected shard %s to commit the insert with the two-phase commit protocol, observed %s", name, queries)
+		}
+	}
+}
+
+func TestProcessUpdateStmtWithoutWhereClause(t *testing.T) {
+	cluster, shards := startFakeShards(t, "ecommerce", 2, func(shard, sql string) fakeResult {
+		if strings.HasPrefix(sql, "update") {
+			return fakeResult{tag: "UPDATE 2"}
+		}
+		return fakeResult{}
+	})
+	sql := "update orders set amount = 0"
+	_, err := processQuery(t, sql, cluster, testVschema)
+	if err == nil || !strings.Contains(err.Error(), "cannot execute UPDATE statement without a where clause") {
+		t.Fatalf("expected missing where clause error, got %v", err)
+	}
+	for name, shard := range shards {
+		if observed := shard.Queries(); len(observed) > 0 {
+			t.Fatalf("expected shard %s to execute no statement, observed %v", name, observed)
+		}
+	}
+
+	tags, err := processQuery(t, "set matriarch.allow_scatter_dml = on; "+sql, cluster, testVschema)
+	if err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if expected := []string{"SET", "UPDATE 4"}; !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected command tags %v, observed %v", expected, tags)
+	}
+	for name, shard := range shards {
+		if observed := shard.Queries(); !reflect.DeepEqual(observed, []string{sql}) {
+			t.Fatalf("expected shard %s to execute %v, observed %v", name, []string{sql}, observed)
+		}
+	}
+}
+
+func TestMoveUpdatedRows(t *testing.T) {
+	var generated bool
+	cluster, shards := startFakeShards(t, "ecommerce", 2, func(shard, sql string) fakeResult {
+		switch {
+		case strings.HasSuffix(sql, "RETURNING ctid, *"):
+			// the updated row, whose id is the one set by the statement
+			id := strings.SplitN(sql, "'", 3)[1]
+			return fakeResult{columns: []string{"ctid", "id", "amount"}, rows: [][]string{{"(0,1)", id, "1"}}, tag: "UPDATE 1"}
+		case strings.HasPrefix(sql, "DELETE"):
+			return fakeResult{tag: "DELETE 1"}
+		case strings.HasPrefix(sql, "INSERT") && generated:
+			return fakeResult{err: "cannot insert a non-DEFAULT value into column \"total\"", code: generatedAlways}
+		case strings.HasPrefix(sql, "INSERT"):
+			return fakeResult{tag: "INSERT 0 1"}
+		case strings.HasPrefix(sql, "update"):
+			return fakeResult{tag: "UPDATE 1"}
+		}
+		return fakeResult{}
+	})
+	from, to := cluster.Shards[0], cluster.Shards[1]
+	old := findKeyspaceId(t, cluster, from, true)
+	moved := findKeyspaceId(t, cluster, from, false)
+	var stayed string
+	for i := 0; stayed == ""; i++ {
+		id := fmt.Sprintf("s%d", i)
+		if owner, err := cluster.GetShardForKeyspaceId(id); err == nil && owner == from {
+			stayed = id
+		}
+	}
+	moveSQL := fmt.Sprintf("update orders set id = '%s' where id = '%s'", moved, old)
+	staySQL := fmt.Sprintf("update orders set id = '%s' where id = '%s'", stayed, old)
+	tests := []struct {
+		name      string
+		sql       string
+		generated bool
+		expected  map[string][]string
+		committed bool
+		err       string
+	}{
+		{
+			name: "moved to another shard",
+			sql:  moveSQL,
+			expected: map[string][]string{
+				from.Name: {
+					moveSQL + " RETURNING ctid, *",
+					`DELETE FROM "orders" WHERE ctid IN ('(0,1)')`,
+				},
+				to.Name: {fmt.Sprintf(`INSERT INTO "orders" ("id", "amount") VALUES ('%s', '1')`, moved)},
+			},
+			committed: true,
+		},
+		{
+			name:     "updated in place",
+			sql:      staySQL,
+			expected: map[string][]string{from.Name: {staySQL}},
+		},
+		{
+			name:      "generated columns",
+			sql:       moveSQL,
+			generated: true,
+			expected: map[string][]string{
+				from.Name: {
+					moveSQL + " RETURNING ctid, *",
+					`DELETE FROM "orders" WHERE ctid IN ('(0,1)')`,
+				},
+				to.Name: {fmt.Sprintf(`INSERT INTO "orders" ("id", "amount") VALUES ('%s', '1')`, moved)},
+			},
+			err: "as the values of its generated columns cannot be inserted",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, shard := range shards {
+				shard.mu.Lock()
+				shard.queries = nil
+				shard.mu.Unlock()
+			}
+			generated = tt.generated
+			tags, err := processQuery(t, tt.sql, cluster, testVschema)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			} else if expected := []string{"UPDATE 1"}; !reflect.DeepEqual(tags, expected) {
+				t.Fatalf("expected command tags %v, observed %v", expected, tags)
+			}
+			for name, shard := range shards {
+				if observed := shard.Queries(); !reflect.DeepEqual(observed, tt.expected[name]) {
+					t.Fatalf("expected shard %s to execute %v, observed %v", name, tt.expected[name], observed)
+				}
+				if len(tt.expected[name]) == 0 {
+					continue
+				}
+				shard.mu.Lock()
+				queries := strings.Join(shard.queries, "\n")
+				shard.mu.Unlock()
+				prepared := strings.Contains(queries, "PREPARE TRANSACTION") && strings.Contains(queries, "COMMIT PREPARED")
+				if prepared != tt.committed {
+					t.Fatalf("expected shard %s to commit with the two-phase commit protocol: %t, observed %s", name, tt.committed, queries)
+				}
+				if tt.err != "" && (!strings.Contains(queries, "ROLLBACK") || strings.Contains(queries, "COMMIT")) {
+					t.Fatalf("expected shard %s to roll back the update, observed %s", name, queries)
+				}
+			}
+		})
+	}
+}
+
+func parseSelectStmt(t *testing.T, sql string) *pg.SelectStmt {
+	stmts, err := engine.NewParser().Parse(strings.NewReader(sql))
+	if err != nil {
+		t.Fatalf("cannot parse %s: %v", sql, err)
+	}
+	s, ok := stmts[0].Raw.Stmt.(*pg.SelectStmt)
+	if !ok {
+		t.Fatalf("expected a SelectStmt, got %T", stmts[0].Raw.Stmt)
+	}
+	return s
+}
+
+func testCluster(t *testing.T) *Cluster {
+	shards, err := buildShards("ecommerce", []string{"localhost:5432", "localhost:5433"})
+	if err != nil {
+		t.Fatalf("cannot build shards: %v", err)
+	}
+	return &Cluster{Shards: shards}
+}
+
+// findKeyspaceId returns a keyspace id owned, or not owned when owned is false, by the shard.
+func findKeyspaceId(t *testing.T, cluster *Cluster, shard *Shard, owned bool) string {
+	for i := 0; ; i++ {
+		id := fmt.Sprintf("k%d", i)
+		owner, err := cluster.GetShardForKeyspaceId(id)
+		if err != nil {
+			t.Fatalf("cannot find shard owning keyspace id: %v", err)
+		}
+		if (owner == shard) == owned {
+			return id
+		}
+	}
+}
+
+func TestRouteSelectStmt(t *testing.T) {
+	cluster := testCluster(t)
+	owner, err := cluster.GetShardForKeyspaceId("a")
+	if err != nil {
+		t.Fatalf("cannot find shard owning keyspace id: %v", err)
+	}
+	same := findKeyspaceId(t, cluster, owner, true)
+	other := findKeyspaceId(t, cluster, owner, false)
+	unsharded, err := cluster.GetShardByName("ecommerce_80$")
+	if err != nil {
+		t.Fatalf("cannot find shard: %v", err)
+	}
+	colocated := findKeyspaceId(t, cluster, unsharded, true)
+	mock := &PGMock{logger: log.NewNopLogger()}
+	tests := []struct {
+		name          string
+		sql           string
+		expected      *Shard
+		expectedError error
+	}{
+		{
+			name:     "select by primary vindex should be routed to the owner shard",
+			sql:      "select * from orders where id = 'a'",
+			expected: owner,
+		},
+		{
+			name:     "join with a reference table should be routed to the shard of the sharded table",
+			sql:      "select * from categories join orders on orders.category_id = categories.id where orders.id = 'a'",
+			expected: owner,
+		},
+		{
+			name:          "select without primary vindex should error",
+			sql:           "select * from orders where amount = 10",
+			expectedError: ErrMissingPrimaryVIndex,
+		},
+		{
+			name:          "select without where clause should error",
+			sql:           "select * from orders",
+			expectedError: ErrMissingPrimaryVIndex,
+		},
+		{
+			name:     "or of primary vindex values owned by the same shard should be routed to the owner shard",
+			sql:      fmt.Sprintf("select * from orders where (id = 'a' or id = '%s') and amount > 10", same),
+			expected: owner,
+		},
+		{
+			name:     "in list of primary vindex values owned by the same shard should be routed to the owner shard",
+			sql:      fmt.Sprintf("select * from orders where id in ('a', '%s')", same),
+			expected: owner,
+		},
+		{
+			name:          "or of primary vindex values owned by different shards should error",
+			sql:           fmt.Sprintf("select * from orders where id = 'a' or id = '%s'", other),
+			expectedError: ErrMissingPrimaryVIndex,
+		},
+		{
+			name:          "or with a predicate which is not on the primary vindex should error",
+			sql:           "select * from orders where id = 'a' or amount > 10",
+			expectedError: ErrMissingPrimaryVIndex,
+		},
+		{
+			name:          "range predicate on the primary vindex should error",
+			sql:           "select * from orders where id between 'a' and 'b'",
+			expectedError: ErrMissingPrimaryVIndex,
+		},
+		{
+			name:          "function call on the primary vindex should error",
+			sql:           "select * from orders where lower(id) = 'a' and id like 'a%'",
+			expectedError: ErrMissingPrimaryVIndex,
+		},
+		{
+			name:     "co-located join should be routed by the primary vindex of the first table",
+			sql:      "select * from orders join order_items on order_items.order_id = orders.id where orders.id = 'a'",
+			expected: owner,
+		},
+		{
+			name:     "co-located join should be routed by the primary vindex of the joined table",
+			sql:      "select * from orders join order_items on orders.id = order_items.order_id where order_items.order_id = 'a'",
+			expected: owner,
+		},
+		{
+			name:     "co-located join expressed in the where clause should be routed to the owner shard",
+			sql:      "select * from orders, order_items where orders.id = order_items.order_id and orders.id = 'a'",
+			expected: owner,
+		},
+		{
+			name:     "co-located join with using clause should be routed to the owner shard",
+			sql:      "select * from orders_archive join orders using (id) where orders.id = 'a'",
+			expected: owner,
+		},
+		{
+			name:          "join on a column which is not the primary vindex should error",
+			sql:           "select * from orders join members on members.id = orders.member_id where orders.id = 'a'",
+			expectedError: ErrNonColocatedJoin,
+		},
+		{
+			name:          "join without condition between sharded tables should error",
+			sql:           "select * from orders, order_items where orders.id = 'a'",
+			expectedError: ErrNonColocatedJoin,
+		},
+		{
+			name:     "join of unsharded tables should be routed to their shard",
+			sql:      "select * from promotions join coupons on coupons.promotion_id = promotions.id where coupons.code = 'a'",
+			expected: unsharded,
+		},
+		{
+			name:     "join of unsharded and reference tables should be routed to the shard of the unsharded tables",
+			sql:      "select * from categories join promotions on promotions.category_id = categories.id",
+			expected: unsharded,
+		},
+		{
+			name:     "join of unsharded and sharded tables should be routed to the shard storing both",
+			sql:      fmt.Sprintf("select * from promotions join orders on orders.promotion_id = promotions.id where orders.id = '%s'", colocated),
+			expected: unsharded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observed, err := mock.routeSelectStmt(parseSelectStmt(t, tt.sql), cluster, testVschema)
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if observed != tt.expected {
+				t.Fatalf("expected shard %s, observed %s", tt.expected.Name, observed.Name)
+			}
+		})
+	}
+	t.Run("select of reference tables should be served by any shard in turn", func(t *testing.T) {
+		s := parseSelectStmt(t, "select * from categories")
+		first, err := mock.routeSelectStmt(s, cluster, testVschema)
+		if err != nil {
+			t.Fatalf("expected test to succeed, got error %v", err)
+		}
+		second, err := mock.routeSelectStmt(s, cluster, testVschema)
+		if err != nil {
+			t.Fatalf("expected test to succeed, got error %v", err)
+		}
+		if first == second {
+			t.Fatalf("expected shards to be chosen in turn, got %s twice", first.Name)
+		}
+	})
+}
+
+func TestRouteSelectShards(t *testing.T) {
+	cluster := testCluster(t)
+	owner, err := cluster.GetShardForKeyspaceId("a")
+	if err != nil {
+		t.Fatalf("cannot find shard owning keyspace id: %v", err)
+	}
+	other := findKeyspaceId(t, cluster, owner, false)
+	mock := &PGMock{logger: log.NewNopLogger()}
+	tests := []struct {
+		name     string
+		sql      string
+		expected int
+	}{
+		{
+			name:     "or of primary vindex values should be routed to the union of the owner shards",
+			sql:      fmt.Sprintf("select * from orders where id = 'a' or id = '%s'", other),
+			expected: 2,
+		},
+		{
+			name:     "primary vindex values of a co-located table should be used",
+			sql:      "select * from orders join order_items on order_items.order_id = orders.id where orders.amount > 10 and order_items.order_id in ('a', 'a')",
+			expected: 1,
+		},
+		{
+			name:     "range predicate should be routed to every shard",
+			sql:      "select * from orders where id > 'a'",
+			expected: len(cluster.Shards),
+		},
+		{
+			name:     "reference tables can be served by any shard",
+			sql:      "select * from categories where id = 'a' or id = 'b'",
+			expected: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observed, err := mock.routeSelectShards(parseSelectStmt(t, tt.sql), cluster, testVschema, nil)
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if len(observed) != tt.expected {
+				t.Fatalf("expected %d shards, observed %d", tt.expected, len(observed))
+			}
+		})
+	}
+}
+
+func TestWalkWhereExpressionTree(t *testing.T) {
+	id := tableColumn{"orders", "id"}
+	tests := []struct {
+		name     string
+		sql      string
+		expected []columnValues
+	}{
+		{
+			name:     "conjunction of equalities",
+			sql:      "select * from orders where id = 'a' and amount = 10",
+			expected: []columnValues{{id: "a", {"orders", "amount"}: "10"}},
+		},
+		{
+			name:     "disjunction distributed over a conjunction",
+			sql:      "select * from orders where (id = 'a' or 'b' = orders.id) and (member_id = 'm' or amount > 10)",
+			expected: []columnValues{{id: "a"}, {id: "b"}},
+		},
+		{
+			name:     "in list",
+			sql:      "select * from orders where id in ('a', 'b') and member_id = 'm'",
+			expected: []columnValues{{id: "a", {"orders", "member_id"}: "m"}, {id: "b", {"orders", "member_id"}: "m"}},
+		},
+		{
+			name:     "negated equality",
+			sql:      "select * from orders where not (id = 'a')",
+			expected: []columnValues{{}},
+		},
+		{
+			name:     "range and pattern predicates",
+			sql:      "select * from orders where id >= 'a' and id not in ('b') and id like 'c%'",
+			expected: []columnValues{{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := parseSelectStmt(t, tt.sql)
+			observed := walkWhereExpressionTree(s.WhereClause, []string{"orders"}, nil)
+			if !reflect.DeepEqual(tt.expected, observed) {
+				t.Fatalf("expected alternatives %v, observed %v", tt.expected, observed)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package pgpool
+
+import (
+	"context"
+
+	"github.com/jackc/pgconn"
+)
+
+// Conn is an acquired connection from a Pool. Unlike Pool.Exec, it lets the caller issue
+// several commands on the same backend connection, e.g. to run them inside a transaction.
+type Conn struct {
+	res *connResource
+}
+
+// Acquire returns a connection from the Pool. The caller must call Release on the
+// connection once it is done with it.
+func (p *Pool) Acquire(ctx context.Context) (*Conn, error) {
+	c, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{res: c}, nil
+}
+
+// Release returns the connection to the pool it was acquired from. Connections left busy or
+// inside a transaction are destroyed instead of being returned to the pool.
+// It is safe to call Release multiple times. Subsequent calls after the first will be ignored.
+func (c *Conn) Release() {
+	if c.res == nil {
+		return
+	}
+	res := c.res
+	c.res = nil
+	res.Release()
+}
+
+// Exec executes sql on the connection. sql may contain multiple queries.
+func (c *Conn) Exec(ctx context.Context, sql string) *pgconn.MultiResultReader {
+	return c.res.conn.Exec(ctx, sql)
+}
+
+// PgConn returns the underlying *pgconn.PgConn.
+func (c *Conn) PgConn() *pgconn.PgConn {
+	return c.res.conn
+}
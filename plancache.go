@@ -0,0 +1,570 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+	"github.com/vgheri/matriarch/parser/sql/astutils"
+)
+
+// planKind models how a statement whose plan is cached is executed.
+type planKind int
+
+const (
+	// planUncacheable statements are parsed and planned on every execution.
+	planUncacheable planKind = iota
+	// planRoute statements are executed on the shard owning the keyspace id computed from their literals.
+	planRoute
+	// planAnyShard statements only read reference tables and are executed on any shard.
+	planAnyShard
+	// planReplicate statements write to a reference table and are executed on every shard.
+	planReplicate
+	// planUnsharded statements read or write unsharded tables, and reference tables, and are executed on the shard
+	// of the unsharded tables.
+	planUnsharded
+)
+
+// statementPlan is the plan of the statements sharing the same fingerprint, see fingerprintStatement.
+type statementPlan struct {
+	Kind planKind
+	// Command is the name of the statement, e.g. SELECT.
+	Command string
+	// Table is the table whose primary vindex routes planRoute statements.
+	Table *Table
+	// Values are the literals providing the values of the primary vindex columns of planRoute statements, in the order of the vindex.
+	Values []literalValue
+	// Shard is the shard executing planUnsharded statements.
+	Shard *Shard
+}
+
+// literalValue describes how the value of a primary vindex column is computed from a literal of the statement.
+type literalValue struct {
+	// Literal is the index of the literal among the literals of the statement.
+	Literal int
+	// Negate reports whether the literal is negated, e.g. -1.
+	Negate bool
+	// Cast is the type the literal is cast to, e.g. int for '1'::int, empty when the literal is not cast.
+	Cast string
+}
+
+// evaluate returns the value of a primary vindex column, as computed by constantValue, from the literals of a statement.
+func (v literalValue) evaluate(literals []token) (string, error) {
+	if v.Literal >= len(literals) {
+		return "", fmt.Errorf("cannot find literal %d of statement", v.Literal)
+	}
+	value, ok := literalText(literals[v.Literal])
+	if !ok {
+		return "", fmt.Errorf("cannot read literal %s", literals[v.Literal].Text)
+	}
+	if v.Negate {
+		if strings.HasPrefix(value, "-") {
+			value = value[1:]
+		} else {
+			value = "-" + value
+		}
+	}
+	if v.Cast != "" {
+		return normaliseValue(value, v.Cast)
+	}
+	return value, nil
+}
+
+// route returns the shard executing a planRoute statement, whose literals are given.
+func (p *statementPlan) route(literals []token, cluster *Cluster) (*Shard, error) {
+	var values []string
+	for _, v := range p.Values {
+		value, err := v.evaluate(literals)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	keyspaceId, err := p.Table.KeyspaceId(values)
+	if err != nil {
+		return nil, err
+	}
+	return cluster.GetShardForTable(p.Table, keyspaceId)
+}
+
+// planCache is a bounded LRU cache of statement plans keyed by fingerprint, shared by all the client connections.
+// Plans refer to the tables of the vschema they were computed with, so the cache is emptied when the vschema changes.
+// A nil cache caches nothing.
+type planCache struct {
+	mu       sync.Mutex
+	capacity int
+	vschema  *Vschema
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type planCacheEntry struct {
+	key  string
+	plan *statementPlan
+}
+
+// newPlanCache returns a cache holding at most capacity plans, or nil when capacity is not positive.
+func newPlanCache(capacity int) *planCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &planCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Get returns the plan cached for a key and computed with the vschema.
+func (c *planCache) Get(key string, vschema *Vschema) (*statementPlan, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkVschema(vschema)
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*planCacheEntry).plan, true
+}
+
+// Add caches the plan of a key computed with the vschema, evicting the least recently used plan when the cache is full.
+func (c *planCache) Add(key string, vschema *Vschema, plan *statementPlan) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkVschema(vschema)
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*planCacheEntry).plan = plan
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&planCacheEntry{key: key, plan: plan})
+	if c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*planCacheEntry).key)
+	}
+}
+
+// Len returns the number of cached plans.
+func (c *planCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// checkVschema empties the cache when the vschema differs from the one the cached plans were computed with.
+func (c *planCache) checkVschema(vschema *Vschema) {
+	if c.vschema == vschema {
+		return
+	}
+	c.vschema = vschema
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// literalPlaceholder replaces the literals of a statement in its fingerprint. As every string literal is replaced,
+// the placeholder cannot be confused with a token of the statement.
+const literalPlaceholder = "'?'"
+
+// fingerprintStatement returns the fingerprint of a query made of a single statement, the literals of the statement
+// and its text, as found by statementText. The fingerprint is the statement with literals replaced by placeholders,
+// comments removed, unquoted identifiers and keywords in lower case and tokens separated by a single space, so that
+// statements which only differ by their literals share the same fingerprint.
+// ok is false when the query contains several statements.
+func fingerprintStatement(sql string) (fingerprint string, literals []token, text string, ok bool) {
+	var tokens []token
+	for _, t := range tokenize(sql) {
+		if t.Kind != tokenComment {
+			tokens = append(tokens, t)
+		}
+	}
+	text = strings.TrimSpace(sql)
+	for i, t := range tokens {
+		if t.Text != ";" {
+			continue
+		}
+		if i != len(tokens)-1 {
+			return "", nil, "", false
+		}
+		text = strings.TrimSpace(sql[:t.Start])
+		tokens = tokens[:i]
+	}
+	if len(tokens) == 0 {
+		return "", nil, "", false
+	}
+	parts := make([]string, len(tokens))
+	for i, t := range tokens {
+		switch t.Kind {
+		case tokenString, tokenNumber:
+			parts[i] = literalPlaceholder
+			literals = append(literals, t)
+		case tokenIdent:
+			parts[i] = strings.ToLower(t.Text)
+		default:
+			parts[i] = t.Text
+		}
+	}
+	return strings.Join(parts, " "), literals, text, true
+}
+
+// literalText returns the value of a literal token. ok is false for strings with escapes, e.g. E'\n'.
+func literalText(t token) (string, bool) {
+	switch {
+	case t.Kind == tokenNumber:
+		return t.Text, true
+	case t.Kind != tokenString:
+		return "", false
+	case len(t.Text) >= 2 && strings.HasPrefix(t.Text, "'") && strings.HasSuffix(t.Text, "'"):
+		return strings.ReplaceAll(t.Text[1:len(t.Text)-1], "''", "'"), true
+	case strings.HasPrefix(t.Text, "$"):
+		tag, _ := dollarQuoteTag(t.Text)
+		if len(t.Text) < 2*len(tag) || !strings.HasSuffix(t.Text, tag) {
+			return "", false
+		}
+		return t.Text[len(tag) : len(t.Text)-len(tag)], true
+	}
+	return "", false
+}
+
+// planCacheKey returns the key of the plan of a query in the cache, see fingerprintStatement.
+// Relations are resolved with the search path of the session, so it is part of the key.
+func (mock *PGMock) planCacheKey(sql string) (string, []token, string, bool) {
+	fingerprint, literals, text, ok := fingerprintStatement(sql)
+	if !ok {
+		return "", nil, "", false
+	}
+	return strings.Join(mock.settings.SearchPathOrDefault(), ",") + "\n" + fingerprint, literals, text, true
+}
+
+// executePlan executes a statement with a cached plan. handled is false when the statement must be parsed
+// and planned, e.g. because its plan is not cacheable or a literal is not a valid primary vindex value.
+func (mock *PGMock) executePlan(plan *statementPlan, literals []token, q QueryMessage, cluster *Cluster) (handled bool, err error) {
+	switch plan.Kind {
+	case planReplicate:
+		return true, mock.replicateStmt(plan.Command, q, cluster)
+	case planAnyShard:
+		return true, mock.executeSelect(cluster.AnyShard(), q)
+	case planUnsharded:
+		if plan.Command == "SELECT" {
+			mock.logger.Log("msg", fmt.Sprintf("shard selected: %s", plan.Shard.Name))
+			return true, mock.executeSelect(plan.Shard, q)
+		}
+		return true, mock.execDMLStmt(plan.Command, q, []*Shard{plan.Shard}, cluster)
+	case planRoute:
+		target, err := plan.route(literals, cluster)
+		if err != nil {
+			return false, nil
+		}
+		mock.logger.Log("msg", fmt.Sprintf("shard selected: %s", target.Name))
+		res, err := target.Conn.Exec(context.Background(), q.String)
+		if err != nil {
+			return true, err
+		}
+		defer res.Close()
+		results, err := res.ReadAll()
+		if err != nil {
+			return true, err
+		}
+		return true, mock.FinaliseExecuteSequence(plan.Command, results)
+	}
+	return false, nil
+}
+
+// planStatement returns the plan of a statement whose relations have been resolved, to cache it.
+// Only statements executed on a single shard chosen from literals, on any shard or on every shard for reference tables,
+// or on the shard of unsharded tables get a plan. The plan of other statements is planUncacheable, so that their executions don't compute it again.
+// It returns nil when the statement cannot be planned, e.g. because of an invalid literal: the statement then fails
+// or is not cached, as another statement with the same fingerprint could get a plan.
+func (mock *PGMock) planStatement(stmt ast.Node, literals []token, cluster *Cluster, vschema *Vschema) *statementPlan {
+	uncacheable := &statementPlan{Kind: planUncacheable}
+	switch s := stmt.(type) {
+	case *pg.SelectStmt:
+		if s.Op > 0 || hasSubqueries(s) || isEmptyList(s.FromClause) {
+			return uncacheable
+		}
+		route, err := mock.planSelectRoute(s, cluster, vschema, nil)
+		if err != nil {
+			return nil
+		}
+		// lookup tables are read on every execution
+		if route.Lookup != nil {
+			return uncacheable
+		}
+		if route.Shards == nil {
+			return &statementPlan{Kind: planAnyShard, Command: "SELECT"}
+		}
+		// joins with sharded tables are only pushed down when the literals select the shard of the unsharded tables
+		if route.Unsharded != "" && route.Table == "" {
+			return &statementPlan{Kind: planUnsharded, Command: "SELECT", Shard: route.Shards[0]}
+		}
+		if route.Unsharded != "" {
+			return uncacheable
+		}
+		if len(route.Shards) != 1 || route.Table == "" {
+			return uncacheable
+		}
+		return routePlan("SELECT", s.WhereClause, route.Table, route.Relations[0], route.KeyspaceIds[0], literals, vschema)
+	case *pg.InsertStmt:
+		table := vschema.GetTable(*s.Relation.Relname)
+		if table != nil && table.Type == Unsharded {
+			return unshardedPlan("INSERT", s, table, cluster, vschema)
+		}
+		ss, ok := s.SelectStmt.(*pg.SelectStmt)
+		if table == nil || !ok || isEmptyList(s.Cols) || isEmptyList(ss.ValuesLists) {
+			return uncacheable
+		}
+		// the column defaults of reference tables are checked on every execution, see checkReplicatedStmt
+		if table.Type == Reference {
+			return uncacheable
+		}
+		// values of sequence columns are allocated, and lookup tables maintained, on every execution
+		if table.Sequence != nil || len(table.LookupVIndexes()) > 0 {
+			return uncacheable
+		}
+		var columns []string
+		for _, item := range s.Cols.Items {
+			columns = append(columns, *item.(*pg.ResTarget).Name)
+		}
+		indexes, err := primaryVIndexIndexes(table, columns)
+		if err != nil || checkOnConflictClause(s.OnConflictClause, table) != nil || len(ss.ValuesLists.Items) != 1 {
+			return uncacheable
+		}
+		row, ok := ss.ValuesLists.Items[0].(*ast.List)
+		if !ok {
+			return uncacheable
+		}
+		plan := &statementPlan{Kind: planRoute, Command: "INSERT", Table: table}
+		var values []string
+		for _, i := range indexes {
+			value, err := insertValue(row.Items[i])
+			if err != nil {
+				return nil
+			}
+			v, ok := literalTemplate(row.Items[i], literals)
+			if !ok {
+				return uncacheable
+			}
+			values = append(values, value)
+			plan.Values = append(plan.Values, v)
+		}
+		keyspaceId, err := table.KeyspaceId(values)
+		if err != nil {
+			return nil
+		}
+		return checkPlan(plan, keyspaceId, literals)
+	case *pg.UpdateStmt:
+		if table := vschema.GetTable(*s.Relation.Relname); table != nil && table.Type == Unsharded {
+			return unshardedPlan("UPDATE", s, table, cluster, vschema)
+		}
+		for _, item := range s.TargetList.Items {
+			t, ok := item.(*pg.ResTarget)
+			if !ok {
+				return uncacheable
+			}
+			if table := vschema.GetTable(*s.Relation.Relname); table != nil &&
+				stringArrayContainsValue(table.GetPrimaryVIndex().Columns, *t.Name) != -1 {
+				return uncacheable
+			}
+		}
+		if table := vschema.GetTable(*s.Relation.Relname); table != nil && len(updatedLookupVIndexes(s, table)) > 0 {
+			return uncacheable
+		}
+		return dmlPlan("UPDATE", s, *s.Relation.Relname, s.WhereClause, literals, cluster, vschema)
+	case *pg.DeleteStmt:
+		if table := vschema.GetTable(*s.Relation.Relname); table != nil && table.Type == Unsharded {
+			return unshardedPlan("DELETE", s, table, cluster, vschema)
+		}
+		if table := vschema.GetTable(*s.Relation.Relname); table != nil && len(table.LookupVIndexes()) > 0 {
+			return uncacheable
+		}
+		return dmlPlan("DELETE", s, *s.Relation.Relname, s.WhereClause, literals, cluster, vschema)
+	}
+	return uncacheable
+}
+
+// unshardedPlan returns the plan of an INSERT, UPDATE or DELETE statement writing to an unsharded table, see planStatement.
+func unshardedPlan(command string, stmt ast.Node, table *Table, cluster *Cluster, vschema *Vschema) *statementPlan {
+	shard, err := unshardedStmtShard(stmt, table, cluster, vschema)
+	if err != nil {
+		return nil
+	}
+	return &statementPlan{Kind: planUnsharded, Command: command, Shard: shard}
+}
+
+// dmlPlan returns the plan of an UPDATE or DELETE statement, see planStatement.
+func dmlPlan(command string, stmt ast.Node, relation string, where ast.Node, literals []token, cluster *Cluster, vschema *Vschema) *statementPlan {
+	table := vschema.GetTable(relation)
+	if table == nil {
+		return &statementPlan{Kind: planUncacheable}
+	}
+	if table.Type == Reference {
+		// statements with volatile expressions or defaults are rejected by checkReplicatedStmt
+		if _, defaulted, _ := defaultedColumns(stmt); volatileExpression(stmt) != "" || len(defaulted) > 0 {
+			return &statementPlan{Kind: planUncacheable}
+		}
+		return &statementPlan{Kind: planReplicate, Command: command}
+	}
+	whereClauseColumns, whereClauseValues, err := parseDMLWhereClause(where, relation, command)
+	if err != nil {
+		return &statementPlan{Kind: planUncacheable}
+	}
+	_, indexes, err := routeDMLStmt(table, whereClauseColumns, whereClauseValues, cluster, command)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, i := range indexes {
+		values = append(values, whereClauseValues[i])
+	}
+	keyspaceId, err := table.KeyspaceId(values)
+	if err != nil {
+		return nil
+	}
+	return routePlan(command, where, relation, relation, keyspaceId, literals, vschema)
+}
+
+// routePlan returns the plan of a statement routed with the primary vindex of a table, referenced as relation in the
+// statement, whose columns are compared to literals in the where clause. Unqualified columns belong to defaultRelation.
+// keyspaceId is the keyspace id the statement was routed to.
+// The statement is uncacheable unless every primary vindex column is referenced once in the where clause, by an
+// equality with a literal which is a term of the top-level AND expression: the statement is then always routed
+// to the keyspace id of these literals, whatever their values.
+func routePlan(command string, where ast.Node, relation, defaultRelation, keyspaceId string, literals []token, vschema *Vschema) *statementPlan {
+	uncacheable := &statementPlan{Kind: planUncacheable}
+	table := vschema.GetTable(relation)
+	column := func(node ast.Node) (tableColumn, bool) {
+		ref, ok := node.(*pg.ColumnRef)
+		if !ok {
+			return tableColumn{}, false
+		}
+		var fields []string
+		for _, item := range ref.Fields.Items {
+			field, ok := item.(*pg.String)
+			if !ok {
+				return tableColumn{}, false
+			}
+			fields = append(fields, field.Str)
+		}
+		switch len(fields) {
+		case 1:
+			return tableColumn{defaultRelation, fields[0]}, true
+		case 2:
+			return tableColumn{fields[0], fields[1]}, true
+		}
+		return tableColumn{}, false
+	}
+	references := make(map[tableColumn]int)
+	for _, node := range astutils.Search(where, func(node ast.Node) bool {
+		_, ok := node.(*pg.ColumnRef)
+		return ok
+	}).Items {
+		if c, ok := column(node); ok {
+			references[c]++
+		}
+	}
+	terms := []ast.Node{where}
+	if b, ok := where.(*pg.BoolExpr); ok && b.Boolop == 0 {
+		terms = b.Args.Items
+	}
+	constants := make(map[tableColumn]ast.Node)
+	for _, term := range terms {
+		expr, ok := term.(*pg.A_Expr)
+		if !ok || expr.Kind != 0 || len(expr.Name.Items) != 1 {
+			continue
+		}
+		if name, ok := expr.Name.Items[0].(*pg.String); !ok || name.Str != "=" {
+			continue
+		}
+		if c, ok := column(expr.Lexpr); ok {
+			constants[c] = expr.Rexpr
+		} else if c, ok := column(expr.Rexpr); ok {
+			constants[c] = expr.Lexpr
+		}
+	}
+	plan := &statementPlan{Kind: planRoute, Command: command, Table: table}
+	for _, pc := range table.GetPrimaryVIndex().Columns {
+		c := tableColumn{relation, pc}
+		constant, ok := constants[c]
+		if !ok || references[c] != 1 {
+			return uncacheable
+		}
+		v, ok := literalTemplate(constant, literals)
+		if !ok {
+			return uncacheable
+		}
+		plan.Values = append(plan.Values, v)
+	}
+	return checkPlan(plan, keyspaceId, literals)
+}
+
+// checkPlan returns the plan when it computes the keyspace id the statement was routed to from its literals,
+// and an uncacheable plan otherwise, e.g. for literals written in a form constantValue normalises, such as 007.
+func checkPlan(plan *statementPlan, keyspaceId string, literals []token) *statementPlan {
+	var values []string
+	for _, v := range plan.Values {
+		value, err := v.evaluate(literals)
+		if err != nil {
+			return &statementPlan{Kind: planUncacheable}
+		}
+		values = append(values, value)
+	}
+	if observed, err := plan.Table.KeyspaceId(values); err != nil || observed != keyspaceId {
+		return &statementPlan{Kind: planUncacheable}
+	}
+	return plan
+}
+
+// literalTemplate returns how the value of a constant expression, see constantValue, is computed from a literal
+// of the statement. The literal is the first one following the location of the expression in the query.
+func literalTemplate(node ast.Node, literals []token) (literalValue, bool) {
+	switch n := node.(type) {
+	case *pg.A_Const:
+		value, ok := constantValue(n)
+		if !ok {
+			return literalValue{}, false
+		}
+		for i, t := range literals {
+			if t.Start >= n.Location {
+				// negative numbers are parsed as constants located at the minus sign
+				text, _ := literalText(t)
+				return literalValue{Literal: i, Negate: strings.HasPrefix(value, "-") && !strings.HasPrefix(text, "-")}, true
+			}
+		}
+	case *pg.TypeCast:
+		v, ok := literalTemplate(n.Arg, literals)
+		if !ok || n.TypeName == nil || isEmptyList(n.TypeName.Names) || v.Cast != "" {
+			return literalValue{}, false
+		}
+		name, ok := n.TypeName.Names.Items[len(n.TypeName.Names.Items)-1].(*pg.String)
+		if !ok {
+			return literalValue{}, false
+		}
+		v.Cast = name.Str
+		return v, true
+	case *pg.A_Expr:
+		if _, ok := constantValue(n); !ok {
+			return literalValue{}, false
+		}
+		v, ok := literalTemplate(n.Rexpr, literals)
+		if !ok || v.Cast != "" {
+			return literalValue{}, false
+		}
+		v.Negate = !v.Negate
+		return v, true
+	}
+	return literalValue{}, false
+}
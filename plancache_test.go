@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/vgheri/matriarch/parser/engine"
+)
+
+func TestFingerprintStatement(t *testing.T) {
+	tests := []struct {
+		sql         string
+		fingerprint string
+		literals    []string
+		text        string
+		ok          bool
+	}{
+		{
+			sql:         "SELECT * FROM orders WHERE id = 'a' AND amount > 10.5;",
+			fingerprint: "select * from orders where id = '?' and amount > '?'",
+			literals:    []string{"'a'", "10.5"},
+			text:        "SELECT * FROM orders WHERE id = 'a' AND amount > 10.5",
+			ok:          true,
+		},
+		{
+			sql:         "/* c */ select  *\nfrom \"Orders\" where id = $$b$$ -- trailing",
+			fingerprint: "select * from \"Orders\" where id = '?'",
+			literals:    []string{"$$b$$"},
+			text:        "/* c */ select  *\nfrom \"Orders\" where id = $$b$$ -- trailing",
+			ok:          true,
+		},
+		{sql: "select 1; select 2"},
+		{sql: " ; "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			fingerprint, literals, text, ok := fingerprintStatement(tt.sql)
+			if ok != tt.ok || fingerprint != tt.fingerprint || text != tt.text {
+				t.Fatalf("expected (%s, %s, %t), observed (%s, %s, %t)", tt.fingerprint, tt.text, tt.ok, fingerprint, text, ok)
+			}
+			if len(literals) != len(tt.literals) {
+				t.Fatalf("expected literals %v, observed %v", tt.literals, literals)
+			}
+			for i, literal := range literals {
+				if literal.Text != tt.literals[i] {
+					t.Fatalf("expected literals %v, observed %v", tt.literals, literals)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanCache(t *testing.T) {
+	cache := newPlanCache(2)
+	plan := &statementPlan{Kind: planAnyShard}
+	cache.Add("a", testVschema, plan)
+	cache.Add("b", testVschema, plan)
+	if _, ok := cache.Get("a", testVschema); !ok {
+		t.Fatalf("expected plan a to be cached")
+	}
+	// b is the least recently used plan
+	cache.Add("c", testVschema, plan)
+	if _, ok := cache.Get("b", testVschema); ok {
+		t.Fatalf("expected plan b to be evicted")
+	}
+	if observed, ok := cache.Get("a", testVschema); !ok || observed != plan {
+		t.Fatalf("expected plan a to be cached")
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("expected 2 plans, observed %d", cache.Len())
+	}
+	if _, ok := cache.Get("a", testSchemaVschema); ok || cache.Len() != 0 {
+		t.Fatalf("expected the cache to be emptied when the vschema changes")
+	}
+	if newPlanCache(0) != nil {
+		t.Fatalf("expected a cache of size 0 to be disabled")
+	}
+}
+
+func TestPlanStatement(t *testing.T) {
+	cluster := testCluster(t)
+	owned := findKeyspaceId(t, cluster, cluster.Shards[0], true)
+	other := findKeyspaceId(t, cluster, cluster.Shards[0], false)
+	tests := []struct {
+		name string
+		sql  string
+		kind planKind
+		// reused is the statement sharing the fingerprint of sql, routed to shard 1 by the plan
+		reused string
+	}{
+		{
+			name:   "select routed by primary vindex",
+			sql:    fmt.Sprintf("select * from orders o where o.id = '%s' and amount > 10", owned),
+			kind:   planRoute,
+			reused: fmt.Sprintf("select * from orders o where o.id = '%s' and amount > 20", other),
+		},
+		{
+			name:   "select with literal on the left",
+			sql:    fmt.Sprintf("select * from orders where '%s' = id", owned),
+			kind:   planRoute,
+			reused: fmt.Sprintf("select * from orders where '%s' = id", other),
+		},
+		{
+			name:   "co-located join",
+			sql:    fmt.Sprintf("select * from orders join order_items on order_items.order_id = orders.id where orders.id = '%s'", owned),
+			kind:   planRoute,
+			reused: fmt.Sprintf("select * from orders join order_items on order_items.order_id = orders.id where orders.id = '%s'", other),
+		},
+		{
+			name: "select of reference tables",
+			sql:  "select * from categories where id = 1",
+			kind: planAnyShard,
+		},
+		{
+			name: "select with primary vindex in an OR expression",
+			sql:  fmt.Sprintf("select * from orders where id = '%s' and (id = '%s' or amount > 1)", owned, owned),
+			kind: planUncacheable,
+		},
+		{
+			name: "scatter select",
+			sql:  "select * from orders where amount > 1",
+			kind: planUncacheable,
+		},
+		{
+			name:   "single row insert",
+			sql:    fmt.Sprintf("insert into orders (amount, id) values (1, '%s') returning id", owned),
+			kind:   planRoute,
+			reused: fmt.Sprintf("insert into orders (amount, id) values (2, '%s') returning id", other),
+		},
+		{
+			name: "multi-row insert",
+			sql:  fmt.Sprintf("insert into orders (id) values ('%s'), ('%s')", owned, owned),
+			kind: planUncacheable,
+		},
+		{
+			name: "insert into reference table",
+			sql:  "insert into categories (id) values (1)",
+			kind: planUncacheable,
+		},
+		{
+			name: "update of reference table",
+			sql:  "update categories set name = 'books' where id = 1",
+			kind: planReplicate,
+		},
+		{
+			name: "update of reference table with a volatile expression",
+			sql:  "update categories set updated_at = now() where id = 1",
+			kind: planUncacheable,
+		},
+		{
+			name:   "update",
+			sql:    fmt.Sprintf("update orders set amount = 1 where id = '%s'", owned),
+			kind:   planRoute,
+			reused: fmt.Sprintf("update orders set amount = 1 where id = '%s'", other),
+		},
+		{
+			name: "update of the primary vindex",
+			sql:  fmt.Sprintf("update orders set id = '%s' where id = '%s'", other, owned),
+			kind: planUncacheable,
+		},
+		{
+			name:   "delete",
+			sql:    fmt.Sprintf("delete from orders where id = '%s'", owned),
+			kind:   planRoute,
+			reused: fmt.Sprintf("delete from orders where id = '%s'", other),
+		},
+		{
+			name: "insert into table with lookup vindex",
+			sql:  fmt.Sprintf("insert into members (id, email) values ('%s', 'a@b.c')", owned),
+			kind: planUncacheable,
+		},
+		{
+			name:   "update of table with lookup vindex",
+			sql:    fmt.Sprintf("update members set name = 'a' where id = '%s'", owned),
+			kind:   planRoute,
+			reused: fmt.Sprintf("update members set name = 'a' where id = '%s'", other),
+		},
+		{
+			name: "update of lookup vindex",
+			sql:  fmt.Sprintf("update members set email = 'a@b.c' where id = '%s'", owned),
+			kind: planUncacheable,
+		},
+		{
+			name: "delete from table with lookup vindex",
+			sql:  fmt.Sprintf("delete from members where id = '%s'", owned),
+			kind: planUncacheable,
+		},
+		{
+			name: "join of unsharded tables",
+			sql:  "select * from promotions p join coupons c on c.promotion_id = p.id join categories on categories.id = p.category_id",
+			kind: planUnsharded,
+		},
+		{
+			name: "join of unsharded and sharded tables",
+			sql:  fmt.Sprintf("select * from promotions join orders on orders.promotion_id = promotions.id where orders.id = '%s'", other),
+			kind: planUncacheable,
+		},
+		{
+			name: "insert into unsharded table",
+			sql:  "insert into coupons select id, 'WELCOME' from promotions where id = 1",
+			kind: planUnsharded,
+		},
+		{
+			name: "delete from unsharded table",
+			sql:  "delete from jobs where id = 1",
+			kind: planUnsharded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &PGMock{logger: log.NewNopLogger(), settings: defaultSessionSettings()}
+			key, literals, _, ok := mock.planCacheKey(tt.sql)
+			if !ok {
+				t.Fatalf("expected statement to be cacheable")
+			}
+			stmts, err := engine.NewParser().Parse(strings.NewReader(tt.sql))
+			if err != nil {
+				t.Fatalf("cannot parse %s: %v", tt.sql, err)
+			}
+			resolveRelations(stmts[0].Raw.Stmt, testVschema, []string{defaultSchema})
+			plan := mock.planStatement(stmts[0].Raw.Stmt, literals, cluster, testVschema)
+			if plan == nil || plan.Kind != tt.kind {
+				t.Fatalf("expected plan of kind %d, observed %+v", tt.kind, plan)
+			}
+			if plan.Kind != planRoute {
+				return
+			}
+			if target, err := plan.route(literals, cluster); err != nil || target != cluster.Shards[0] {
+				t.Fatalf("expected statement to be routed to shard %s, observed %v (%v)", cluster.Shards[0].Name, target, err)
+			}
+			reusedKey, reusedLiterals, _, _ := mock.planCacheKey(tt.reused)
+			if reusedKey != key {
+				t.Fatalf("expected %s to share the fingerprint %s, observed %s", tt.reused, key, reusedKey)
+			}
+			if target, err := plan.route(reusedLiterals, cluster); err != nil || target != cluster.Shards[1] {
+				t.Fatalf("expected statement to be routed to shard %s, observed %v (%v)", cluster.Shards[1].Name, target, err)
+			}
+		})
+	}
+}
+
+func TestLiteralValueEvaluate(t *testing.T) {
+	table := &Table{
+		Name:        "events",
+		Type:        Sharded,
+		ColumnTypes: map[string]string{"id": "integer"},
+		VIndexes:    []VIndex{{Columns: []string{"id"}, Type: Primary}},
+	}
+	for _, sql := range []string{
+		"select * from events where id = -5",
+		"select * from events where id = -'5'",
+		"select * from events where id = '-5.2'::int",
+		"select * from events where id = '-5'",
+	} {
+		t.Run(sql, func(t *testing.T) {
+			s := parseSelectStmt(t, sql)
+			_, literals, _, _ := fingerprintStatement(sql)
+			vschema := &Vschema{Tables: []Table{*table}}
+			plan := routePlan("SELECT", s.WhereClause, "events", "events", "-5", literals, vschema)
+			if plan.Kind != planRoute {
+				t.Fatalf("expected statement to be cacheable")
+			}
+			value, err := plan.Values[0].evaluate(literals)
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if normalised, _ := normaliseValue(value, "integer"); normalised != "-5" {
+				t.Fatalf("expected value -5, observed %s", value)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+	"github.com/vgheri/matriarch/parser/sql/astutils"
+)
+
+// resolvedRelation is a relation of a statement, referenced without schema, resolved to a table of the vschema.
+type resolvedRelation struct {
+	// Location is the position of the relation name in the statement text.
+	Location int
+	Table    *Table
+}
+
+// resolveRelations resolves the relations of a parsed statement to the tables of the vschema, looking up
+// the relations referenced without schema in the schemas of the search path.
+// The name of each resolved relation is replaced with the key of its table, and the columns qualified with the name
+// or the alias of a relation are qualified with the key of its table instead, so that routing functions identify tables
+// by their key only, e.g. in select * from public.orders o where o.id = 'a', both the relation and the column
+// reference the table orders.
+// Relations named after a CTE of the statement are not resolved. It returns the relations referenced without schema.
+func resolveRelations(stmt ast.Node, vschema *Vschema, searchPath []string) []resolvedRelation {
+	var ctes []string
+	for _, node := range astutils.Search(stmt, func(node ast.Node) bool {
+		_, ok := node.(*pg.CommonTableExpr)
+		return ok
+	}).Items {
+		ctes = append(ctes, *node.(*pg.CommonTableExpr).Ctename)
+	}
+	// scope maps the names used to qualify columns to the key of the table they reference
+	scope := make(map[string]string)
+	var unqualified []resolvedRelation
+	for _, node := range astutils.Search(stmt, func(node ast.Node) bool {
+		_, ok := node.(*pg.RangeVar)
+		return ok
+	}).Items {
+		rv := node.(*pg.RangeVar)
+		if rv.Relname == nil {
+			continue
+		}
+		var schema string
+		if rv.Schemaname != nil {
+			schema = *rv.Schemaname
+		}
+		if schema == "" && stringArrayContainsValue(ctes, *rv.Relname) != -1 {
+			continue
+		}
+		table := vschema.ResolveTable(schema, *rv.Relname, searchPath)
+		if table == nil {
+			continue
+		}
+		key := table.Key()
+		if rv.Alias != nil && rv.Alias.Aliasname != nil {
+			scope[*rv.Alias.Aliasname] = key
+		} else {
+			scope[*rv.Relname] = key
+			if schema != "" {
+				scope[schema+"."+*rv.Relname] = key
+			}
+		}
+		if schema == "" {
+			unqualified = append(unqualified, resolvedRelation{Location: rv.Location, Table: table})
+		}
+		rv.Relname = &key
+		rv.Schemaname = nil
+	}
+	for _, node := range astutils.Search(stmt, func(node ast.Node) bool {
+		_, ok := node.(*pg.ColumnRef)
+		return ok
+	}).Items {
+		ref := node.(*pg.ColumnRef)
+		fields := ref.Fields.Items
+		switch len(fields) {
+		case 2:
+			if relation, ok := fields[0].(*pg.String); ok {
+				if key, ok := scope[relation.Str]; ok {
+					fields[0] = &pg.String{Str: key}
+				}
+			}
+		case 3:
+			schema, sok := fields[0].(*pg.String)
+			relation, rok := fields[1].(*pg.String)
+			if sok && rok {
+				if key, ok := scope[schema.Str+"."+relation.Str]; ok {
+					ref.Fields.Items = []ast.Node{&pg.String{Str: key}, fields[2]}
+				}
+			}
+		}
+	}
+	return unqualified
+}
+
+// qualifyRelations qualifies the relation names of a statement text with the schema of the table they resolve to,
+// so that shards resolve them to the same table, whatever their own search path.
+// offset is the position of the statement text in the text the locations of the relations refer to.
+func qualifyRelations(sql string, relations []resolvedRelation, offset int) string {
+	if len(relations) == 0 {
+		return sql
+	}
+	var b strings.Builder
+	last := 0
+	for _, t := range tokenize(sql) {
+		if t.Kind != tokenIdent && t.Kind != tokenQuotedIdent {
+			continue
+		}
+		for _, relation := range relations {
+			if relation.Location-offset == t.Start {
+				b.WriteString(sql[last:t.Start])
+				b.WriteString(quoteIdentifier(relation.Table.SchemaName()))
+				b.WriteString(".")
+				last = t.Start
+				break
+			}
+		}
+	}
+	b.WriteString(sql[last:])
+	return b.String()
+}
+
+// resolveStatement resolves the relations of a statement with the search path of the session, see resolveRelations.
+// When the session changed its search path, the statement text is returned with relation names qualified with their
+// schema, as shards resolve names with their own search path.
+func (mock *PGMock) resolveStatement(stmt ast.Node, sql string, offset int, vschema *Vschema) string {
+	relations := resolveRelations(stmt, vschema, mock.settings.SearchPathOrDefault())
+	if mock.settings.SearchPath == nil {
+		return sql
+	}
+	return qualifyRelations(sql, relations, offset)
+}
+
+// parseSelect parses the text of a select statement and resolves its relations, see resolveRelations.
+func (mock *PGMock) parseSelect(sql string, vschema *Vschema) (*pg.SelectStmt, error) {
+	s, err := parseSelectText(sql)
+	if err != nil {
+		return nil, err
+	}
+	resolveRelations(s, vschema, mock.settings.SearchPathOrDefault())
+	return s, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/vgheri/matriarch/parser/engine"
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+	"github.com/vgheri/matriarch/parser/sql/astutils"
+)
+
+var testSchemaVschema = &Vschema{
+	Keyspace: "ecommerce",
+	Tables: []Table{
+		{
+			Name:     "orders",
+			Type:     Sharded,
+			VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}},
+		},
+		{
+			Schema:   "sales",
+			Name:     "Invoices",
+			Type:     Sharded,
+			VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}},
+		},
+	},
+}
+
+func TestResolveRelations(t *testing.T) {
+	tests := []struct {
+		name        string
+		sql         string
+		searchPath  []string
+		relations   []string
+		columns     []string
+		unqualified int
+	}{
+		{
+			name:        "alias",
+			sql:         "select * from orders o where o.id = 'a'",
+			searchPath:  []string{defaultSchema},
+			relations:   []string{"orders"},
+			columns:     []string{"orders"},
+			unqualified: 1,
+		},
+		{
+			name:       "schema qualified relation and column",
+			sql:        "select * from public.orders where public.orders.id = 'a'",
+			searchPath: []string{defaultSchema},
+			relations:  []string{"orders"},
+			columns:    []string{"orders"},
+		},
+		{
+			name:        "quoted relation resolved with the search path",
+			sql:         `select * from "Invoices" where "Invoices".id = 'a'`,
+			searchPath:  []string{"sales"},
+			relations:   []string{"sales.Invoices"},
+			columns:     []string{"sales.Invoices"},
+			unqualified: 1,
+		},
+		{
+			name:       "unquoted relation is folded to lower case",
+			sql:        "select * from sales.Invoices",
+			searchPath: []string{defaultSchema},
+			relations:  []string{"invoices"},
+		},
+		{
+			name:       "relation outside the search path",
+			sql:        `select * from "Invoices"`,
+			searchPath: []string{defaultSchema},
+			relations:  []string{"Invoices"},
+		},
+		{
+			name:       "CTE named after a table",
+			sql:        "with orders as (select 1 as id) select * from orders",
+			searchPath: []string{defaultSchema},
+			relations:  []string{"orders"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := parseSelectStmt(t, tt.sql)
+			unqualified := resolveRelations(s, testSchemaVschema, tt.searchPath)
+			if len(unqualified) != tt.unqualified {
+				t.Fatalf("expected %d relations without schema, observed %d", tt.unqualified, len(unqualified))
+			}
+			var relations []string
+			for _, node := range astutils.Search(s, func(node ast.Node) bool {
+				_, ok := node.(*pg.RangeVar)
+				return ok
+			}).Items {
+				relations = append(relations, *node.(*pg.RangeVar).Relname)
+			}
+			if len(relations) != len(tt.relations) {
+				t.Fatalf("expected relations %v, observed %v", tt.relations, relations)
+			}
+			for i := range relations {
+				if relations[i] != tt.relations[i] {
+					t.Fatalf("expected relations %v, observed %v", tt.relations, relations)
+				}
+			}
+			for i, column := range tt.columns {
+				where, ok := s.WhereClause.(*pg.A_Expr)
+				if !ok {
+					t.Fatalf("expected a where clause expression, got %T", s.WhereClause)
+				}
+				table, _, ok := qualifiedColumnName(where.Lexpr)
+				if !ok || table != column {
+					t.Fatalf("expected column %d to be qualified with %s, observed %s", i, column, table)
+				}
+			}
+		})
+	}
+}
+
+func TestQualifyRelations(t *testing.T) {
+	prefix := "begin; "
+	sql := `select * from "Invoices" i join orders on orders.id = i.id`
+	stmts, err := engine.NewParser().Parse(strings.NewReader(prefix + sql))
+	if err != nil {
+		t.Fatalf("cannot parse %s: %v", sql, err)
+	}
+	relations := resolveRelations(stmts[1].Raw.Stmt, testSchemaVschema, []string{"sales", defaultSchema})
+	expected := `select * from "sales"."Invoices" i join "public".orders on orders.id = i.id`
+	if observed := qualifyRelations(sql, relations, len(prefix)); observed != expected {
+		t.Fatalf("expected %s, observed %s", expected, observed)
+	}
+}
+
+func TestRouteSelectStmtWithResolvedRelations(t *testing.T) {
+	cluster := testCluster(t)
+	expected, err := cluster.GetShardForKeyspaceId("a")
+	if err != nil {
+		t.Fatalf("cannot find shard owning keyspace id: %v", err)
+	}
+	mock := &PGMock{logger: log.NewNopLogger(), settings: defaultSessionSettings()}
+	for _, sql := range []string{
+		"select * from orders o where o.id = 'a'",
+		"select * from public.orders where public.orders.id = 'a'",
+		`select * from sales."Invoices" where id = 'a'`,
+	} {
+		t.Run(sql, func(t *testing.T) {
+			s, err := mock.parseSelect(sql, testSchemaVschema)
+			if err != nil {
+				t.Fatalf("cannot parse %s: %v", sql, err)
+			}
+			observed, err := mock.routeSelectStmt(s, cluster, testSchemaVschema)
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if observed != expected {
+				t.Fatalf("expected shard %s, observed %s", expected.Name, observed.Name)
+			}
+		})
+	}
+}
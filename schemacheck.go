@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vgheri/matriarch/parser/engine"
+	"github.com/vgheri/matriarch/parser/sql/catalog"
+)
+
+// SchemaMismatchError lists the differences found between the vschema and the schemas of the shards,
+// and between the schemas of the shards themselves. Each problem starts with the shards it was found on.
+type SchemaMismatchError struct {
+	Problems []string
+}
+
+func (e *SchemaMismatchError) Error() string {
+	if len(e.Problems) == 1 {
+		return "vschema doesn't match the shard schemas: " + e.Problems[0]
+	}
+	return fmt.Sprintf("vschema doesn't match the shard schemas, %d problems:\n  %s", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// shardCatalogQuery returns the statement reading the columns of the tables of schemas from the catalog of a shard,
+// as expected by catalogDDL. The tables of every schema but the system ones are read when schemas is empty.
+func shardCatalogQuery(schemas []string) string {
+	literals := make([]string, len(schemas))
+	for i, schema := range schemas {
+		literals[i] = quoteLiteral(schema)
+	}
+	filter := fmt.Sprintf("n.nspname IN (%s)", strings.Join(literals, ", "))
+	if len(schemas) == 0 {
+		filter = "n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\\_%'"
+	}
+	return "SELECT n.nspname, c.relname, a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull, " +
+		"EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisunique AND i.indnatts = 1 " +
+		"AND i.indkey[0] = a.attnum AND i.indpred IS NULL) " +
+		"FROM pg_attribute a JOIN pg_class c ON c.oid = a.attrelid JOIN pg_namespace n ON n.oid = c.relnamespace " +
+		fmt.Sprintf("WHERE c.relkind IN ('r', 'p') AND a.attnum > 0 AND NOT a.attisdropped AND %s ", filter) +
+		"ORDER BY n.nspname, c.relname, a.attnum"
+}
+
+// catalogDDL returns the statements creating the schemas and tables described by the rows read with shardCatalogQuery:
+// the schema, table and column names, the type of the column, whether it is NOT NULL and whether it is UNIQUE.
+func catalogDDL(rows [][][]byte) string {
+	var ddl strings.Builder
+	var schema, table string
+	for _, row := range rows {
+		if string(row[0]) != schema {
+			if table != "" {
+				ddl.WriteString(");\n")
+				table = ""
+			}
+			schema = string(row[0])
+			if schema != defaultSchema {
+				fmt.Fprintf(&ddl, "CREATE SCHEMA %s;\n", quoteIdentifier(schema))
+			}
+		}
+		if string(row[1]) != table {
+			if table != "" {
+				ddl.WriteString(");\n")
+			}
+			table = string(row[1])
+			fmt.Fprintf(&ddl, "CREATE TABLE %s.%s (", quoteIdentifier(schema), quoteIdentifier(table))
+		} else {
+			ddl.WriteString(", ")
+		}
+		fmt.Fprintf(&ddl, "%s %s", quoteIdentifier(string(row[2])), row[3])
+		if string(row[4]) == "t" {
+			ddl.WriteString(" NOT NULL")
+		}
+		if string(row[5]) == "t" {
+			ddl.WriteString(" UNIQUE")
+		}
+	}
+	if table != "" {
+		ddl.WriteString(");\n")
+	}
+	return ddl.String()
+}
+
+// buildCatalog returns the catalog of the tables created by DDL statements.
+func buildCatalog(ddl string) (*catalog.Catalog, error) {
+	stmts, err := engine.NewParser().Parse(strings.NewReader(ddl))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse table definitions: %w", err)
+	}
+	c := catalog.New(defaultSchema)
+	if err := c.Build(stmts); err != nil {
+		return nil, fmt.Errorf("cannot build catalog: %w", err)
+	}
+	return c, nil
+}
+
+// loadShardCatalog reads the definitions of the tables of schemas from a shard into a catalog.
+func loadShardCatalog(ctx context.Context, shard *Shard, schemas []string) (*catalog.Catalog, error) {
+	result, err := queryShards(ctx, []*Shard{shard}, shardCatalogQuery(schemas))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read table definitions: %w", err)
+	}
+	return buildCatalog(catalogDDL(result.Rows))
+}
+
+// vschemaSchemas returns the schemas of the tables of the vschema, sorted.
+func vschemaSchemas(vschema *Vschema) []string {
+	var schemas []string
+	for i := range vschema.Tables {
+		if schema := vschema.Tables[i].SchemaName(); stringArrayContainsValue(schemas, schema) == -1 {
+			schemas = append(schemas, schema)
+		}
+	}
+	sort.Strings(schemas)
+	return schemas
+}
+
+// catalogTable returns the table of a catalog with the given schema and name, nil when it doesn't exist.
+func catalogTable(c *catalog.Catalog, schema, name string) *catalog.Table {
+	for _, s := range c.Schemas {
+		if s.Name != schema {
+			continue
+		}
+		for _, t := range s.Tables {
+			if t.Rel.Name == name {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// catalogColumn returns the column of a catalog table with the given name, nil when it doesn't exist.
+func catalogColumn(t *catalog.Table, name string) *catalog.Column {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// formatCatalogType returns the type of a catalog column as shown in problems, e.g. pg_catalog.int4[].
+// Type modifiers, such as the length of varchar columns, are not part of the catalog.
+func formatCatalogType(c *catalog.Column) string {
+	typ := c.Type.Name
+	if c.Type.Schema != "" {
+		typ = c.Type.Schema + "." + typ
+	}
+	if c.IsArray {
+		typ += "[]"
+	}
+	return typ
+}
+
+// columnTypeCategory returns the category of the type of a catalog column, see typeCategory. Text columns have
+// the category text. The category is empty for types whose values cannot be normalised before being hashed into
+// keyspace ids, e.g. timestamps or json documents, as different texts can then denote the same value.
+func columnTypeCategory(c *catalog.Column) string {
+	if c.IsArray || (c.Type.Schema != "" && c.Type.Schema != "pg_catalog") {
+		return ""
+	}
+	switch c.Type.Name {
+	case "text", "varchar", "name":
+		return "text"
+	}
+	return typeCategory(c.Type.Name)
+}
+
+// checkVschemaCatalog returns the problems found when comparing the tables of the vschema to the catalog of a shard:
+// tables, lookup tables and vindex columns must exist, the primary and lookup vindex columns must have a type
+// which can be hashed into keyspace ids, consistent with the types declared in the vschema, and the lookup tables
+// of unique vindexes must have a unique index on their value column.
+// Unsharded tables are only checked on their shard.
+func checkVschemaCatalog(vschema *Vschema, shard string, c *catalog.Catalog) []string {
+	var v validation
+	for i := range vschema.Tables {
+		table := &vschema.Tables[i]
+		if table.Type == Unsharded && table.Shard != shard {
+			continue
+		}
+		path := fmt.Sprintf("tables[%d] (%s)", i, table.Name)
+		t := catalogTable(c, table.SchemaName(), table.Name)
+		if t == nil {
+			v.addf(path, "table %s.%s does not exist", table.SchemaName(), table.Name)
+			continue
+		}
+		for j, index := range table.VIndexes {
+			hashed := index.Type == Primary || index.Lookup != nil
+			for k, column := range index.Columns {
+				columnPath := fmt.Sprintf("%s.vindexes[%d].columns[%d]", path, j, k)
+				col := catalogColumn(t, column)
+				if col == nil {
+					v.addf(columnPath, "column %s does not exist", column)
+					continue
+				}
+				if !hashed {
+					continue
+				}
+				category := columnTypeCategory(col)
+				if category == "" {
+					v.addf(columnPath, "column %s has type %s, which cannot be hashed into keyspace ids", column, formatCatalogType(col))
+					continue
+				}
+				if declared, ok := table.ColumnTypes[column]; ok && typeCategory(declared) != typeCategory(col.Type.Name) {
+					v.addf(fmt.Sprintf("%s.column_types.%s", path, column), "declared as %s, column has type %s", declared, formatCatalogType(col))
+				}
+				if f, err := GetVIndexFunction(index.Function); err == nil && index.Type == Primary {
+					if _, ok := f.(numericFunction); ok && category != "integer" {
+						v.addf(fmt.Sprintf("%s.vindexes[%d].function", path, j), "%s requires an integer column, column %s has type %s", f.Name(), column, formatCatalogType(col))
+					}
+				}
+			}
+			if index.Lookup != nil {
+				lookup := catalogTable(c, table.SchemaName(), index.Lookup.Table)
+				lookupPath := fmt.Sprintf("%s.vindexes[%d].lookup.table", path, j)
+				if lookup == nil {
+					v.addf(lookupPath, "table %s.%s does not exist", table.SchemaName(), index.Lookup.Table)
+					continue
+				}
+				for _, column := range []string{"value", "keyspace_id"} {
+					if col := catalogColumn(lookup, column); col == nil || columnTypeCategory(col) != "text" {
+						v.addf(lookupPath, "lookup table %s must have a text column %s", index.Lookup.Table, column)
+					}
+				}
+				// the value of a unique vindex is claimed with INSERT ... ON CONFLICT (value), see lookupChange
+				if col := catalogColumn(lookup, "value"); index.Lookup.Unique && col != nil && !col.IsUnique {
+					v.addf(lookupPath, "lookup table %s of a unique vindex must have a unique index on column value", index.Lookup.Table)
+				}
+			}
+			if r := index.References; r != nil {
+				if external := vschema.GetTable(r.ExternalTable); external != nil {
+					if et := catalogTable(c, external.SchemaName(), external.Name); et != nil && catalogColumn(et, r.ExternalColumn) == nil {
+						v.addf(fmt.Sprintf("%s.vindexes[%d].references.external_column", path, j), "column %s does not exist in table %s", r.ExternalColumn, r.ExternalTable)
+					}
+				}
+			}
+		}
+		if table.Sequence != nil && catalogColumn(t, table.Sequence.Column) == nil {
+			v.addf(path+".sequence.column", "column %s does not exist", table.Sequence.Column)
+		}
+	}
+	return v.problems
+}
+
+// schemaDrift returns the differences between the tables of the catalogs of shards: tables or columns missing from
+// some shards, and columns whose type or nullability differs. Each difference lists the definition found on each shard.
+// The unsharded tables, as schema.name, live on a single shard and are not compared.
+func schemaDrift(shards []*Shard, catalogs []*catalog.Catalog, unsharded []string) []string {
+	type definitions map[string][]string // definition to the names of the shards
+	var tables []string
+	columns := make(map[string][]string)
+	defs := make(map[string]definitions)
+	for i, c := range catalogs {
+		for _, s := range c.Schemas {
+			for _, t := range s.Tables {
+				table := s.Name + "." + t.Rel.Name
+				if stringArrayContainsValue(unsharded, table) != -1 {
+					continue
+				}
+				if _, ok := defs[table]; !ok {
+					tables = append(tables, table)
+					defs[table] = make(definitions)
+				}
+				defs[table]["exists"] = append(defs[table]["exists"], shards[i].Name)
+				for _, col := range t.Columns {
+					key := table + "." + col.Name
+					if _, ok := defs[key]; !ok {
+						columns[table] = append(columns[table], col.Name)
+						defs[key] = make(definitions)
+					}
+					def := formatCatalogType(col)
+					if col.IsNotNull {
+						def += " NOT NULL"
+					}
+					defs[key][def] = append(defs[key][def], shards[i].Name)
+				}
+			}
+		}
+	}
+	describe := func(d definitions) (string, bool) {
+		var names []string
+		count := 0
+		for def, onShards := range d {
+			names = append(names, fmt.Sprintf("%s on %s", def, strings.Join(onShards, ", ")))
+			count += len(onShards)
+		}
+		if count < len(shards) {
+			var missing []string
+			for _, shard := range shards {
+				found := false
+				for _, onShards := range d {
+					found = found || stringArrayContainsValue(onShards, shard.Name) != -1
+				}
+				if !found {
+					missing = append(missing, shard.Name)
+				}
+			}
+			names = append(names, fmt.Sprintf("missing on %s", strings.Join(missing, ", ")))
+		}
+		sort.Strings(names)
+		return strings.Join(names, "; "), len(names) > 1
+	}
+	var problems []string
+	sort.Strings(tables)
+	for _, table := range tables {
+		if description, drift := describe(defs[table]); drift {
+			problems = append(problems, fmt.Sprintf("table %s: %s", table, description))
+			continue
+		}
+		for _, column := range columns[table] {
+			if description, drift := describe(defs[table+"."+column]); drift {
+				problems = append(problems, fmt.Sprintf("table %s, column %s: %s", table, column, description))
+			}
+		}
+	}
+	return problems
+}
+
+// checkShardSchemas loads the definitions of the tables of the shards into catalogs, and returns a SchemaMismatchError
+// listing the differences between the schemas of the shards and the problems found when comparing the vschema to them.
+// Problems found on every shard are reported once. The shards of the unsharded tables must have been assigned,
+// see assignUnshardedShards.
+func checkShardSchemas(ctx context.Context, cluster *Cluster, vschema *Vschema) error {
+	schemas := vschemaSchemas(vschema)
+	catalogs := make([]*catalog.Catalog, len(cluster.Shards))
+	var problems []string
+	shardsByProblem := make(map[string][]string)
+	for i, shard := range cluster.Shards {
+		c, err := loadShardCatalog(ctx, shard, schemas)
+		if err != nil {
+			return fmt.Errorf("cannot load the schema of shard %s: %w", shard.Name, err)
+		}
+		catalogs[i] = c
+		for _, problem := range checkVschemaCatalog(vschema, shard.Name, c) {
+			if _, ok := shardsByProblem[problem]; !ok {
+				problems = append(problems, problem)
+			}
+			shardsByProblem[problem] = append(shardsByProblem[problem], shard.Name)
+		}
+	}
+	var mismatch SchemaMismatchError
+	for _, problem := range problems {
+		shards := shardsByProblem[problem]
+		if len(shards) == len(cluster.Shards) {
+			mismatch.Problems = append(mismatch.Problems, "all shards: "+problem)
+		} else {
+			mismatch.Problems = append(mismatch.Problems, fmt.Sprintf("shard %s: %s", strings.Join(shards, ", "), problem))
+		}
+	}
+	var unsharded []string
+	for i := range vschema.Tables {
+		if table := &vschema.Tables[i]; table.Type == Unsharded {
+			unsharded = append(unsharded, table.SchemaName()+"."+table.Name)
+		}
+	}
+	for _, drift := range schemaDrift(cluster.Shards, catalogs, unsharded) {
+		mismatch.Problems = append(mismatch.Problems, "schema drift: "+drift)
+	}
+	if len(mismatch.Problems) > 0 {
+		return &mismatch
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vgheri/matriarch/parser/sql/catalog"
+)
+
+// testCatalogRows returns rows as read by shardCatalogQuery from lines of schema, table, column, type, attnotnull
+// and whether the column has a unique index.
+func testCatalogRows(lines ...string) [][][]byte {
+	var rows [][][]byte
+	for _, line := range lines {
+		var row [][]byte
+		for _, field := range strings.Split(line, "|") {
+			row = append(row, []byte(field))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func testShardCatalog(t *testing.T, lines ...string) *catalog.Catalog {
+	c, err := buildCatalog(catalogDDL(testCatalogRows(lines...)))
+	if err != nil {
+		t.Fatalf("cannot build catalog: %v", err)
+	}
+	return c
+}
+
+func TestCatalogDDL(t *testing.T) {
+	rows := testCatalogRows(
+		"public|members|id|bigint|t|t",
+		"public|members|email|character varying(128)|f|f",
+		"sales|orders|id|uuid|t|f",
+	)
+	expected := `CREATE TABLE "public"."members" ("id" bigint NOT NULL UNIQUE, "email" character varying(128));` + "\n" +
+		`CREATE SCHEMA "sales";` + "\n" +
+		`CREATE TABLE "sales"."orders" ("id" uuid NOT NULL);` + "\n"
+	if observed := catalogDDL(rows); observed != expected {
+		t.Fatalf("expected %s, observed %s", expected, observed)
+	}
+	c, err := buildCatalog(expected)
+	if err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	column := catalogColumn(catalogTable(c, "sales", "orders"), "id")
+	if column == nil || formatCatalogType(column) != "uuid" || !column.IsNotNull {
+		t.Fatalf("expected column id uuid NOT NULL, observed %+v", column)
+	}
+}
+
+func TestCheckVschemaCatalog(t *testing.T) {
+	vschema := &Vschema{Keyspace: "ecommerce", Tables: []Table{
+		{Name: "members", Type: Sharded, ColumnTypes: map[string]string{"id": "uuid"}, VIndexes: []VIndex{
+			{Columns: []string{"id"}, Type: Primary, Function: "identity"},
+			{Columns: []string{"email"}, Type: Secondary, Lookup: &VIndexLookup{Table: "members_email_lookup"}},
+			{Columns: []string{"name"}, Type: Secondary},
+		}},
+		{Name: "orders", Type: Sharded, Sequence: &Sequence{Column: "number"}, VIndexes: []VIndex{
+			{Columns: []string{"created_at"}, Type: Primary, References: &VIndexReference{Column: "created_at", ExternalTable: "members", ExternalColumn: "created_at"}},
+		}},
+		{Name: "categories", Type: Reference},
+		{Name: "jobs", Type: Unsharded, Shard: "ecommerce_80$"},
+		{Name: "coupons", Type: Unsharded, Shard: "ecommerce_$80"},
+	}}
+	c := testShardCatalog(t,
+		"public|members|id|bigint|t|f",
+		"public|members|email|jsonb|f|f",
+		"public|members_email_lookup|value|text|t|f",
+		"public|orders|created_at|timestamp with time zone|f|f",
+	)
+	expected := []string{
+		"tables[0] (members).column_types.id: declared as uuid, column has type pg_catalog.int8",
+		"tables[0] (members).vindexes[1].columns[0]: column email has type jsonb, which cannot be hashed into keyspace ids",
+		"tables[0] (members).vindexes[1].lookup.table: lookup table members_email_lookup must have a text column keyspace_id",
+		"tables[0] (members).vindexes[2].columns[0]: column name does not exist",
+		"tables[1] (orders).vindexes[0].columns[0]: column created_at has type pg_catalog.timestamptz, which cannot be hashed into keyspace ids",
+		"tables[1] (orders).vindexes[0].references.external_column: column created_at does not exist in table members",
+		"tables[1] (orders).sequence.column: column number does not exist",
+		"tables[2] (categories): table public.categories does not exist",
+		"tables[4] (coupons): table public.coupons does not exist",
+	}
+	if observed := checkVschemaCatalog(vschema, "ecommerce_$80", c); !reflect.DeepEqual(observed, expected) {
+		t.Fatalf("expected problems\n%s\nobserved\n%s", strings.Join(expected, "\n"), strings.Join(observed, "\n"))
+	}
+	vschema.Tables[0].ColumnTypes = nil
+	vschema.Tables[0].VIndexes[0].Columns = []string{"email"}
+	c = testShardCatalog(t, "public|members|email|text|f|f")
+	expected = []string{"tables[0] (members).vindexes[0].function: identity requires an integer column, column email has type text"}
+	if observed := checkVschemaCatalog(vschema, "ecommerce_$80", c); !reflect.DeepEqual(observed[:1], expected) {
+		t.Fatalf("expected problems\n%s\nobserved\n%s", strings.Join(expected, "\n"), strings.Join(observed, "\n"))
+	}
+}
+
+func TestBuildCatalogUniqueColumns(t *testing.T) {
+	c, err := buildCatalog(`CREATE TABLE t (
+		a text PRIMARY KEY, b text UNIQUE, c text, d text, e text, f text, g text, h text, UNIQUE (c), UNIQUE (d, e));
+		CREATE UNIQUE INDEX t_f_idx ON t (f);
+		CREATE UNIQUE INDEX t_g_idx ON t (g) WHERE g <> '';
+		CREATE INDEX t_h_idx ON t (h);`)
+	if err != nil {
+		t.Fatalf("cannot build catalog: %v", err)
+	}
+	table := catalogTable(c, "public", "t")
+	for _, col := range table.Columns {
+		expected := strings.Contains("abcf", col.Name)
+		if col.IsUnique != expected {
+			t.Fatalf("expected column %s to be unique: %t, observed %t", col.Name, expected, col.IsUnique)
+		}
+	}
+}
+
+func TestCheckVschemaCatalogUniqueLookup(t *testing.T) {
+	vschema := &Vschema{Keyspace: "ecommerce", Tables: []Table{
+		{Name: "members", Type: Sharded, VIndexes: []VIndex{
+			{Columns: []string{"id"}, Type: Primary},
+			{Columns: []string{"email"}, Type: Secondary, Lookup: &VIndexLookup{Table: "members_email_lookup", Unique: true}},
+		}},
+	}}
+	lines := []string{"public|members|id|bigint|t|t", "public|members|email|text|f|f", "public|members_email_lookup|keyspace_id|text|t|f"}
+	c := testShardCatalog(t, append(lines, "public|members_email_lookup|value|text|t|f")...)
+	expected := []string{"tables[0] (members).vindexes[1].lookup.table: lookup table members_email_lookup of a unique vindex must have a unique index on column value"}
+	if observed := checkVschemaCatalog(vschema, "ecommerce_$80", c); !reflect.DeepEqual(observed, expected) {
+		t.Fatalf("expected problems\n%s\nobserved\n%s", strings.Join(expected, "\n"), strings.Join(observed, "\n"))
+	}
+	c = testShardCatalog(t, append(lines, "public|members_email_lookup|value|text|t|t")...)
+	if observed := checkVschemaCatalog(vschema, "ecommerce_$80", c); len(observed) > 0 {
+		t.Fatalf("expected no problem, observed\n%s", strings.Join(observed, "\n"))
+	}
+}
+
+func TestSchemaDrift(t *testing.T) {
+	shards := []*Shard{{Name: "ecommerce_$80"}, {Name: "ecommerce_80$"}}
+	catalogs := []*catalog.Catalog{
+		testShardCatalog(t,
+			"public|members|id|bigint|t|f",
+			"public|members|email|text|f|f",
+			"public|orders|id|bigint|t|f",
+		),
+		testShardCatalog(t,
+			"public|members|id|bigint|t|f",
+			"public|members|email|character varying(128)|f|f",
+			"public|members|name|text|f|f",
+		),
+	}
+	expected := []string{
+		"table public.members, column email: pg_catalog.varchar on ecommerce_80$; text on ecommerce_$80",
+		"table public.members, column name: missing on ecommerce_$80; text on ecommerce_80$",
+		"table public.orders: exists on ecommerce_$80; missing on ecommerce_80$",
+	}
+	if observed := schemaDrift(shards, catalogs, nil); !reflect.DeepEqual(observed, expected) {
+		t.Fatalf("expected drift\n%s\nobserved\n%s", strings.Join(expected, "\n"), strings.Join(observed, "\n"))
+	}
+	// unsharded tables only exist on their shard
+	if observed := schemaDrift(shards, catalogs, []string{"public.orders"}); !reflect.DeepEqual(observed, expected[:2]) {
+		t.Fatalf("expected drift\n%s\nobserved\n%s", strings.Join(expected[:2], "\n"), strings.Join(observed, "\n"))
+	}
+	if observed := schemaDrift(shards, []*catalog.Catalog{catalogs[0], catalogs[0]}, nil); len(observed) != 0 {
+		t.Fatalf("expected no drift, observed %v", observed)
+	}
+}
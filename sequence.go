@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vgheri/matriarch/parser/engine"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+)
+
+const (
+	// sequenceTable is the backing table of the sequences, created on the shard storing them with
+	// CREATE TABLE matriarch_sequences (name text PRIMARY KEY, next_value bigint NOT NULL).
+	sequenceTable = "matriarch_sequences"
+
+	defaultSequenceBlockSize = 1000
+)
+
+// SequenceName returns the name of the sequence of a table in the backing table.
+func (s *Sequence) SequenceName(table *Table) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return fmt.Sprintf("%s_%s", table.Name, s.Column)
+}
+
+// blockSize returns the number of values of the sequence allocated at once.
+func (s *Sequence) blockSize() int64 {
+	if s.BlockSize <= 0 {
+		return defaultSequenceBlockSize
+	}
+	return s.BlockSize
+}
+
+// sequenceBlocks holds the blocks of values allocated to each sequence, shared by all the client connections.
+// The zero value is ready to use.
+type sequenceBlocks struct {
+	mu     sync.Mutex
+	blocks map[string]*sequenceBlock
+}
+
+// sequenceBlock is a range of values allocated to a sequence: next is the next value to use and end follows the last one.
+type sequenceBlock struct {
+	next int64
+	end  int64
+}
+
+// Next returns the next n values of a sequence. When the values allocated to the sequence run out, allocate is called
+// to allocate a new block of at least blockSize values, and returns the first value of the block.
+func (b *sequenceBlocks) Next(name string, n int, blockSize int64, allocate func(size int64) (int64, error)) ([]int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.blocks == nil {
+		b.blocks = make(map[string]*sequenceBlock)
+	}
+	block, ok := b.blocks[name]
+	if !ok {
+		block = &sequenceBlock{}
+		b.blocks[name] = block
+	}
+	var values []int64
+	for len(values) < n {
+		if block.next == block.end {
+			size := blockSize
+			if missing := int64(n - len(values)); missing > size {
+				size = missing
+			}
+			start, err := allocate(size)
+			if err != nil {
+				return nil, fmt.Errorf("cannot allocate values of sequence %s: %w", name, err)
+			}
+			block.next, block.end = start, start+size
+		}
+		values = append(values, block.next)
+		block.next++
+	}
+	return values, nil
+}
+
+// NextSequenceValues returns the next n values of the sequence of a table.
+func (c *Cluster) NextSequenceValues(ctx context.Context, table *Table, n int) ([]int64, error) {
+	sequence := table.Sequence
+	shard, err := c.sequenceShard(table)
+	if err != nil {
+		return nil, err
+	}
+	name := sequence.SequenceName(table)
+	return c.sequences.Next(name, n, sequence.blockSize(), func(size int64) (int64, error) {
+		return allocateSequenceBlock(ctx, shard, name, size)
+	})
+}
+
+// allocateSequenceBlock allocates size values of a sequence in the backing table and returns the first one.
+// Sequences missing from the backing table start at 1.
+func allocateSequenceBlock(ctx context.Context, shard *Shard, name string, size int64) (int64, error) {
+	result, err := queryShards(ctx, []*Shard{shard}, sequenceAllocation(name, size))
+	if err != nil {
+		return 0, err
+	}
+	if len(result.Rows) != 1 || len(result.Rows[0]) != 1 {
+		return 0, errors.New("unexpected result of the allocation")
+	}
+	return strconv.ParseInt(string(result.Rows[0][0]), 10, 64)
+}
+
+// sequenceAllocation returns the statement allocating size values of a sequence in the backing table.
+func sequenceAllocation(name string, size int64) string {
+	return fmt.Sprintf("INSERT INTO %s (name, next_value) VALUES (%s, %d) "+
+		"ON CONFLICT (name) DO UPDATE SET next_value = %s.next_value + %d RETURNING next_value - %d",
+		sequenceTable, quoteLiteral(name), 1+size, sequenceTable, size, size)
+}
+
+// sequenceShard returns the shard storing the backing table of the sequence of a table.
+func (c *Cluster) sequenceShard(table *Table) (*Shard, error) {
+	if table.Sequence.Shard == "" {
+		return c.Shards[0], nil
+	}
+	shard, err := c.GetShardByName(table.Sequence.Shard)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the backing table of the sequence of table %s: %w", table.Key(), err)
+	}
+	return shard, nil
+}
+
+// sequenceColumnOmitted reports whether an INSERT statement in a table with a sequence omits the sequence column.
+func sequenceColumnOmitted(s *pg.InsertStmt, table *Table) bool {
+	if table.Sequence == nil {
+		return false
+	}
+	for _, item := range s.Cols.Items {
+		if t, ok := item.(*pg.ResTarget); ok && *t.Name == table.Sequence.Column {
+			return false
+		}
+	}
+	return true
+}
+
+// fillSequenceColumn returns the INSERT statement with the sequence column of the table added to its list of columns,
+// and filled with the next values of the sequence in each row of its VALUES list. The statement is returned
+// unchanged when it specifies the sequence column. The values can be read by the client with a RETURNING clause.
+func (mock *PGMock) fillSequenceColumn(s *pg.InsertStmt, q QueryMessage, table *Table, cluster *Cluster, vschema *Vschema) (*pg.InsertStmt, QueryMessage, error) {
+	if !sequenceColumnOmitted(s, table) {
+		return s, q, nil
+	}
+	ss, ok := s.SelectStmt.(*pg.SelectStmt)
+	if !ok || isEmptyList(ss.ValuesLists) {
+		return nil, q, fmt.Errorf("column %s of table %s can only be generated for rows of a VALUES list", table.Sequence.Column, table.Key())
+	}
+	values, err := cluster.NextSequenceValues(context.Background(), table, len(ss.ValuesLists.Items))
+	if err != nil {
+		return nil, q, err
+	}
+	sql, err := insertSequenceValues(q.String, table.Sequence.Column, values)
+	if err != nil {
+		return nil, q, fmt.Errorf("cannot fill column %s of table %s: %w", table.Sequence.Column, table.Key(), err)
+	}
+	mock.logger.Log("msg", fmt.Sprintf("sequence %s filled: %s", table.Sequence.SequenceName(table), sql))
+	stmts, err := engine.NewParser().Parse(strings.NewReader(sql))
+	if err != nil {
+		return nil, q, fmt.Errorf("cannot parse insert statement with generated values: %w", err)
+	}
+	filled, ok := stmts[0].Raw.Stmt.(*pg.InsertStmt)
+	if !ok || len(stmts) != 1 {
+		return nil, q, fmt.Errorf("cannot parse insert statement with generated values: %s", sql)
+	}
+	resolveRelations(filled, vschema, mock.settings.SearchPathOrDefault())
+	return filled, QueryMessage{Type: q.Type, String: sql}, nil
+}
+
+// insertSequenceValues returns a copy of the INSERT statement with the column appended to its list of columns,
+// and the values appended to the rows of its VALUES list, one value per row.
+func insertSequenceValues(sql, column string, values []int64) (string, error) {
+	end, err := columnListEnd(sql)
+	if err != nil {
+		return "", err
+	}
+	spans, err := valuesListSpans(sql)
+	if err != nil {
+		return "", err
+	}
+	if len(spans) != len(values) {
+		return "", fmt.Errorf("found %d rows, expected %d", len(spans), len(values))
+	}
+	var b strings.Builder
+	b.WriteString(sql[:end])
+	b.WriteString(", " + quoteIdentifier(column))
+	last := end
+	for i, span := range spans {
+		b.WriteString(sql[last : span.End-1])
+		b.WriteString(", " + strconv.FormatInt(values[i], 10))
+		last = span.End - 1
+	}
+	b.WriteString(sql[last:])
+	return b.String(), nil
+}
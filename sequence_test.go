@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInsertSequenceValues(t *testing.T) {
+	tests := []struct {
+		sql      string
+		values   []int64
+		expected string
+		err      bool
+	}{
+		{
+			sql:      "insert into orders (amount) values (10) returning id",
+			values:   []int64{1},
+			expected: `insert into orders (amount, "id") values (10, 1) returning id`,
+		},
+		{
+			sql:      `insert into public.orders as o (member_id, amount) values ('a', (1 + 2)), ('b', 3)`,
+			values:   []int64{41, 42},
+			expected: `insert into public.orders as o (member_id, amount, "id") values ('a', (1 + 2), 41), ('b', 3, 42)`,
+		},
+		{
+			sql:    "insert into orders (amount) values (10), (20)",
+			values: []int64{1},
+			err:    true,
+		},
+		{
+			sql:    "insert into orders values (10)",
+			values: []int64{1},
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			observed, err := insertSequenceValues(tt.sql, "id", tt.values)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, test succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if observed != tt.expected {
+				t.Fatalf("expected %s, observed %s", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestSequenceBlocksNext(t *testing.T) {
+	var blocks sequenceBlocks
+	next := int64(1)
+	var sizes []int64
+	allocate := func(size int64) (int64, error) {
+		start := next
+		next += size
+		sizes = append(sizes, size)
+		return start, nil
+	}
+	observed, err := blocks.Next("orders_id", 2, 3, allocate)
+	if err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if !reflect.DeepEqual(observed, []int64{1, 2}) {
+		t.Fatalf("expected values [1 2], observed %v", observed)
+	}
+	// the rest of the block is used before allocating a block large enough for the missing values
+	if observed, err = blocks.Next("orders_id", 5, 3, allocate); err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if !reflect.DeepEqual(observed, []int64{3, 4, 5, 6, 7}) {
+		t.Fatalf("expected values [3 4 5 6 7], observed %v", observed)
+	}
+	if !reflect.DeepEqual(sizes, []int64{3, 4}) {
+		t.Fatalf("expected blocks of sizes [3 4], observed %v", sizes)
+	}
+	failure := errors.New("shard unavailable")
+	if _, err = blocks.Next("members_id", 1, 3, func(int64) (int64, error) { return 0, failure }); !errors.Is(err, failure) {
+		t.Fatalf("expected error %v, got %v", failure, err)
+	}
+}
+
+func TestSequenceColumnOmitted(t *testing.T) {
+	table := &Table{Name: "orders", Type: Sharded, Sequence: &Sequence{Column: "id"}}
+	if !sequenceColumnOmitted(parseInsertStmt(t, "insert into orders (amount) values (1)"), table) {
+		t.Fatalf("expected sequence column to be omitted")
+	}
+	if sequenceColumnOmitted(parseInsertStmt(t, "insert into orders (id, amount) values (7, 1)"), table) {
+		t.Fatalf("expected sequence column to be specified")
+	}
+	if name := table.Sequence.SequenceName(table); name != "orders_id" {
+		t.Fatalf("expected sequence orders_id, observed %s", name)
+	}
+}
+
+func TestProcessInsertStmtWithSequence(t *testing.T) {
+	vschema := &Vschema{
+		Keyspace: "ecommerce",
+		Tables: []Table{{
+			Name:     "invoices",
+			Type:     Sharded,
+			VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}},
+			Sequence: &Sequence{Column: "id", Shard: "ecommerce_80$", BlockSize: 10},
+		}},
+	}
+	cluster, shards := startFakeShards(t, "ecommerce", 2, func(shard, sql string) fakeResult {
+		switch {
+		case strings.HasPrefix(sql, "INSERT INTO "+sequenceTable):
+			return fakeResult{columns: []string{"?column?"}, rows: [][]string{{"41"}}, tag: "INSERT 0 1"}
+		case strings.HasPrefix(sql, "insert"):
+			return fakeResult{tag: fmt.Sprintf("INSERT 0 %d", strings.Count(sql, "), (")+1)}
+		}
+		return fakeResult{}
+	})
+	tags, err := processQuery(t, "insert into invoices (amount) values (10), (20), (30)", cluster, vschema)
+	if err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if expected := []string{"INSERT 0 3"}; !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected command tags %v, observed %v", expected, tags)
+	}
+	// the rows are filled with the values 41 to 43 of the sequence, then routed to the shard owning them
+	rows := make(map[string][]string)
+	for i, id := range []string{"41", "42", "43"} {
+		shard, err := cluster.GetShardForTable(vschema.GetTable("invoices"), id)
+		if err != nil {
+			t.Fatalf("cannot find shard owning keyspace id: %v", err)
+		}
+		rows[shard.Name] = append(rows[shard.Name], fmt.Sprintf("(%d, %s)", 10*(i+1), id))
+	}
+	expected := make(map[string][]string)
+	expected["ecommerce_80$"] = []string{"INSERT INTO matriarch_sequences (name, next_value) VALUES ('invoices_id', 11) " +
+		"ON CONFLICT (name) DO UPDATE SET next_value = matriarch_sequences.next_value + 10 RETURNING next_value - 10"}
+	for name, r := range rows {
+		expected[name] = append(expected[name], `insert into invoices (amount, "id") values `+strings.Join(r, ", "))
+	}
+	for name, shard := range shards {
+		if observed := shard.Queries(); !reflect.DeepEqual(observed, expected[name]) {
+			t.Fatalf("expected shard %s to execute %v, observed %v", name, expected[name], observed)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+)
+
+const (
+	// settingAllowScatterDML allows UPDATE and DELETE statements that cannot be routed to a single shard
+	// to be executed on every shard.
+	settingAllowScatterDML = "matriarch.allow_scatter_dml"
+	// settingJoinRowLimit is the maximum number of rows Matriarch holds in memory to execute a join
+	// between sharded tables which are not co-located.
+	settingJoinRowLimit = "matriarch.join_row_limit"
+
+	// settingSearchPath is the PostgreSQL search_path setting, used to resolve the relations referenced without schema.
+	settingSearchPath = "search_path"
+
+	defaultJoinRowLimit = 10000
+)
+
+// SessionSettings models the Matriarch settings of a client session.
+// Settings are changed with SET matriarch.<name> = <value> and RESET matriarch.<name> statements,
+// and last until the client disconnects.
+type SessionSettings struct {
+	// AllowScatterDML is the value of the matriarch.allow_scatter_dml setting. Off by default,
+	// so that an accidental unqualified DELETE cannot wipe the whole keyspace.
+	AllowScatterDML bool
+	// JoinRowLimit is the value of the matriarch.join_row_limit setting.
+	JoinRowLimit int
+	// SearchPath is the list of schemas of the search_path setting, nil when the session didn't change it.
+	SearchPath []string
+}
+
+// SearchPathOrDefault returns the schemas of the search path of the session.
+// The default search path only contains the public schema: the "$user" schema is ignored.
+func (s *SessionSettings) SearchPathOrDefault() []string {
+	if s.SearchPath == nil {
+		return []string{defaultSchema}
+	}
+	return s.SearchPath
+}
+
+// defaultSessionSettings returns the settings of a new client session.
+func defaultSessionSettings() SessionSettings {
+	return SessionSettings{JoinRowLimit: defaultJoinRowLimit}
+}
+
+// Set changes the value of a setting.
+func (s *SessionSettings) Set(name, value string) error {
+	switch name {
+	case settingAllowScatterDML:
+		v, err := parseBoolSetting(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for parameter \"%s\": %w", name, err)
+		}
+		s.AllowScatterDML = v
+	case settingJoinRowLimit:
+		v, err := strconv.Atoi(value)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid value for parameter \"%s\": \"%s\" must be a positive integer", name, value)
+		}
+		s.JoinRowLimit = v
+	case settingSearchPath:
+		s.SearchPath = []string{}
+		for _, schema := range strings.Split(value, ",") {
+			schema = strings.TrimSpace(schema)
+			if strings.HasPrefix(schema, `"`) && strings.HasSuffix(schema, `"`) && len(schema) > 1 {
+				schema = strings.ReplaceAll(schema[1:len(schema)-1], `""`, `"`)
+			} else {
+				schema = strings.ToLower(schema)
+			}
+			if schema != "" && schema != "$user" {
+				s.SearchPath = append(s.SearchPath, schema)
+			}
+		}
+	default:
+		return fmt.Errorf("unrecognized configuration parameter \"%s\"", name)
+	}
+	return nil
+}
+
+// Reset restores the default value of a setting.
+func (s *SessionSettings) Reset(name string) error {
+	switch name {
+	case settingAllowScatterDML:
+		s.AllowScatterDML = false
+	case settingJoinRowLimit:
+		s.JoinRowLimit = defaultJoinRowLimit
+	case settingSearchPath:
+		s.SearchPath = nil
+	default:
+		return fmt.Errorf("unrecognized configuration parameter \"%s\"", name)
+	}
+	return nil
+}
+
+// parseBoolSetting parses a boolean setting value the same way PostgreSQL does.
+func parseBoolSetting(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1", "t", "y":
+		return true, nil
+	case "off", "false", "no", "0", "f", "n":
+		return false, nil
+	}
+	return false, fmt.Errorf("\"%s\" requires a Boolean value", value)
+}
+
+// processVariableSetStmt executes SET and RESET statements on Matriarch settings and on search_path.
+// Other settings are not supported, as statements are not bound to a single backend session.
+func (mock *PGMock) processVariableSetStmt(s *pg.VariableSetStmt, q QueryMessage) error {
+	var name string
+	if s.Name != nil {
+		name = strings.ToLower(*s.Name)
+	}
+	// 0 = SET var = value, 1 = SET var TO DEFAULT, 2 = SET var FROM CURRENT, 3 = SET TRANSACTION ...
+	// 4 = RESET var, 5 = RESET ALL
+	switch {
+	case s.Kind == 5:
+		mock.settings = defaultSessionSettings()
+		return mock.FinaliseExecuteSequence("RESET", []*pgconn.Result{{}})
+	case !strings.HasPrefix(name, "matriarch.") && name != settingSearchPath:
+		return fmt.Errorf("Unknown statement %s", q.String)
+	case s.Kind == 0:
+		if s.Args == nil || len(s.Args.Items) == 0 || (len(s.Args.Items) > 1 && name != settingSearchPath) {
+			return fmt.Errorf("SET %s takes only one argument", name)
+		}
+		var values []string
+		for _, arg := range s.Args.Items {
+			value, err := settingValue(arg)
+			if err != nil {
+				return err
+			}
+			if len(s.Args.Items) > 1 {
+				// schemas listed as separate arguments are taken literally, as identifiers quoted by the parser
+				value = quoteIdentifier(value)
+			}
+			values = append(values, value)
+		}
+		if err := mock.settings.Set(name, strings.Join(values, ",")); err != nil {
+			return err
+		}
+		return mock.FinaliseExecuteSequence("SET", []*pgconn.Result{{}})
+	case s.Kind == 1:
+		if err := mock.settings.Reset(name); err != nil {
+			return err
+		}
+		return mock.FinaliseExecuteSequence("SET", []*pgconn.Result{{}})
+	case s.Kind == 4:
+		if err := mock.settings.Reset(name); err != nil {
+			return err
+		}
+		return mock.FinaliseExecuteSequence("RESET", []*pgconn.Result{{}})
+	}
+	return fmt.Errorf("Unknown statement %s", q.String)
+}
+
+func settingValue(node ast.Node) (string, error) {
+	if c, ok := node.(*pg.A_Const); ok {
+		switch v := c.Val.(type) {
+		case *pg.String:
+			return v.Str, nil
+		case *pg.Integer:
+			return fmt.Sprintf("%d", v.Ival), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported setting value %#v", node)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSessionSettings(t *testing.T) {
+	settings := defaultSessionSettings()
+	if settings.AllowScatterDML {
+		t.Fatalf("expected %s to be off by default", settingAllowScatterDML)
+	}
+	if err := settings.Set(settingAllowScatterDML, "ON"); err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if !settings.AllowScatterDML {
+		t.Fatalf("expected %s to be on", settingAllowScatterDML)
+	}
+	if err := settings.Set(settingAllowScatterDML, "maybe"); err == nil {
+		t.Fatalf("expected invalid boolean value to error")
+	}
+	if err := settings.Reset(settingAllowScatterDML); err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if settings.AllowScatterDML {
+		t.Fatalf("expected %s to be off after reset", settingAllowScatterDML)
+	}
+	if err := settings.Set(settingJoinRowLimit, "500"); err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if settings.JoinRowLimit != 500 {
+		t.Fatalf("expected %s to be 500, observed %d", settingJoinRowLimit, settings.JoinRowLimit)
+	}
+	if err := settings.Set(settingJoinRowLimit, "-1"); err == nil {
+		t.Fatalf("expected negative row limit to error")
+	}
+	if err := settings.Reset(settingJoinRowLimit); err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if settings.JoinRowLimit != defaultJoinRowLimit {
+		t.Fatalf("expected %s to be %d after reset, observed %d", settingJoinRowLimit, defaultJoinRowLimit, settings.JoinRowLimit)
+	}
+	if observed := settings.SearchPathOrDefault(); !reflect.DeepEqual(observed, []string{defaultSchema}) {
+		t.Fatalf("expected default search path, observed %v", observed)
+	}
+	if err := settings.Set(settingSearchPath, `"$user", Sales, "Archive"`); err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if observed := settings.SearchPathOrDefault(); !reflect.DeepEqual(observed, []string{"sales", "Archive"}) {
+		t.Fatalf("expected search path [sales Archive], observed %v", observed)
+	}
+	if err := settings.Reset(settingSearchPath); err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if settings.SearchPath != nil {
+		t.Fatalf("expected %s to be unset after reset, observed %v", settingSearchPath, settings.SearchPath)
+	}
+	if err := settings.Set("matriarch.unknown", "on"); err == nil {
+		t.Fatalf("expected unknown setting to error")
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc64"
+	"math"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -17,6 +19,10 @@ import (
 
 type Cluster struct {
 	Shards []*Shard
+	// next is used to choose shards in turn when any of them can serve a statement
+	next uint64
+	// sequences holds the values allocated to the sequences of the vschema, see Sequence
+	sequences sequenceBlocks
 }
 
 type Shard struct {
@@ -171,13 +177,43 @@ func connect(shards []*Shard) error {
 var crc64Table = crc64.MakeTable(0xC96C5795D7870F42)
 
 // GetShardForKeyspaceId returns the shard owning a specific keyspace id, which is
-// calculated as the result crc64 checksum of the input string
+// calculated as the result crc64 checksum of the input string, the default vindex function.
+// Use GetShardForTable to honour the vindex function of a table.
 func (c *Cluster) GetShardForKeyspaceId(value string) (*Shard, error) {
-	keyspaceId := crc64.Checksum([]byte(value), crc64Table)
+	return c.GetShardForChecksum(keyspaceIdChecksum(value))
+}
+
+// GetShardForChecksum returns the shard owning a keyspace id already computed with keyspaceIdChecksum.
+func (c *Cluster) GetShardForChecksum(keyspaceId uint64) (*Shard, error) {
 	for _, s := range c.Shards {
-		if keyspaceId >= s.KeyspaceStart && keyspaceId < s.KeyspaceEnd {
+		// KeyspaceEnd is exclusive, except for the last shard, which also owns math.MaxUint64
+		if keyspaceId >= s.KeyspaceStart && (keyspaceId < s.KeyspaceEnd || s.KeyspaceEnd == math.MaxUint64) {
 			return s, nil
 		}
 	}
 	return nil, ErrCannotFindTargetShard
 }
+
+// keyspaceIdChecksum returns the keyspace id of the input string, see GetShardForKeyspaceId.
+func keyspaceIdChecksum(value string) uint64 {
+	return crc64.Checksum([]byte(value), crc64Table)
+}
+
+// AnyShard returns one of the shards of the cluster. Shards are chosen in turn,
+// so that statements which can be served by any shard are spread across all of them.
+func (c *Cluster) AnyShard() *Shard {
+	n := atomic.AddUint64(&c.next, 1)
+	return c.Shards[n%uint64(len(c.Shards))]
+}
+
+// GetShardByName returns the shard with the given name, e.g. ecommerce_$80.
+func (c *Cluster) GetShardByName(name string) (*Shard, error) {
+	var names []string
+	for _, s := range c.Shards {
+		if s.Name == name {
+			return s, nil
+		}
+		names = append(names, s.Name)
+	}
+	return nil, fmt.Errorf("unknown shard %s, shards are %s", name, strings.Join(names, ", "))
+}
@@ -90,7 +90,7 @@ func TestBuildShards(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			observed, err := buildShards(tt.keyspaceName, tt.hosts)
 			if tt.expectedError != nil {
-				if !errors.As(err, &tt.expectedError) {
+				if !errors.Is(err, tt.expectedError) {
 					t.Fatalf("expected error type %v, got %v", tt.expectedError, err)
 				}
 			} else {
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// tokenKind models the kind of lexical token found in a SQL statement.
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenQuotedIdent
+	tokenString
+	tokenNumber
+	tokenParam
+	tokenComment
+	tokenPunct
+)
+
+// token is a lexical token of a SQL statement, with its byte offsets in the statement.
+type token struct {
+	Kind  tokenKind
+	Start int
+	End   int
+	Text  string
+}
+
+// tokenize splits a SQL statement into tokens, skipping whitespace.
+// It only knows enough of the PostgreSQL lexical structure to find the boundaries of
+// strings, identifiers and comments, so that Matriarch can rewrite portions of a statement
+// without altering its content.
+func tokenize(sql string) []token {
+	var tokens []token
+	i := 0
+	for i < len(sql) {
+		c := sql[i]
+		start := i
+		var kind tokenKind
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+			continue
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			kind = tokenComment
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			kind = tokenComment
+			depth := 0
+			for i < len(sql) {
+				if strings.HasPrefix(sql[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(sql[i:], "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+		case c == '\'':
+			kind = tokenString
+			i = skipQuoted(sql, i, '\'', false)
+		case (c == 'E' || c == 'e') && i+1 < len(sql) && sql[i+1] == '\'':
+			kind = tokenString
+			i = skipQuoted(sql, i+1, '\'', true)
+		case c == '"':
+			kind = tokenQuotedIdent
+			i = skipQuoted(sql, i, '"', false)
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			kind = tokenParam
+			i++
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+		case c == '$':
+			if tag, ok := dollarQuoteTag(sql[i:]); ok {
+				kind = tokenString
+				end := strings.Index(sql[i+len(tag):], tag)
+				if end < 0 {
+					i = len(sql)
+				} else {
+					i += len(tag) + end + len(tag)
+				}
+			} else {
+				kind = tokenPunct
+				i++
+			}
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			kind = tokenNumber
+			for i < len(sql) && (isDigit(sql[i]) || sql[i] == '.' || sql[i] == 'e' || sql[i] == 'E' ||
+				((sql[i] == '+' || sql[i] == '-') && (sql[i-1] == 'e' || sql[i-1] == 'E'))) {
+				i++
+			}
+		case isIdentStart(c):
+			kind = tokenIdent
+			for i < len(sql) && (isIdentStart(sql[i]) || isDigit(sql[i]) || sql[i] == '$') {
+				i++
+			}
+		default:
+			kind = tokenPunct
+			i++
+		}
+		tokens = append(tokens, token{Kind: kind, Start: start, End: i, Text: sql[start:i]})
+	}
+	return tokens
+}
+
+// skipQuoted returns the offset following the closing quote of the quoted string or identifier
+// starting at offset i. Doubled quotes are part of the content.
+func skipQuoted(sql string, i int, quote byte, backslashEscapes bool) int {
+	i++
+	for i < len(sql) {
+		switch {
+		case backslashEscapes && sql[i] == '\\':
+			i += 2
+		case sql[i] == quote && i+1 < len(sql) && sql[i+1] == quote:
+			i += 2
+		case sql[i] == quote:
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return len(sql)
+}
+
+// dollarQuoteTag returns the opening tag of a dollar-quoted string, e.g. $$ or $body$.
+func dollarQuoteTag(s string) (string, bool) {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '$' {
+			return s[:i+1], true
+		}
+		if !isIdentStart(s[i]) && !(i > 1 && isDigit(s[i])) {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+// isKeyword reports whether the token is the unquoted keyword kw.
+func (t token) isKeyword(kw string) bool {
+	return t.Kind == tokenIdent && strings.EqualFold(t.Text, kw)
+}
+
+// textSpan is a portion of a SQL statement, delimited by byte offsets.
+type textSpan struct {
+	Start int
+	End   int
+}
+
+var errNoValuesList = errors.New("cannot find VALUES list in statement")
+
+// valuesListSpans returns the position of each row of the top level VALUES list
+// of an INSERT statement, including the enclosing parenthesis.
+func valuesListSpans(sql string) ([]textSpan, error) {
+	tokens := tokenize(sql)
+	depth := 0
+	i := 0
+	for ; i < len(tokens); i++ {
+		if tokens[i].Text == "(" {
+			depth++
+		} else if tokens[i].Text == ")" {
+			depth--
+		} else if depth == 0 && tokens[i].isKeyword("values") {
+			break
+		}
+	}
+	if i == len(tokens) {
+		return nil, errNoValuesList
+	}
+	i++
+	var spans []textSpan
+	for i < len(tokens) {
+		if tokens[i].Kind == tokenComment {
+			i++
+			continue
+		}
+		if tokens[i].Text != "(" {
+			break
+		}
+		start := tokens[i].Start
+		depth = 0
+		for ; i < len(tokens); i++ {
+			if tokens[i].Text == "(" {
+				depth++
+			} else if tokens[i].Text == ")" {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		if i == len(tokens) {
+			return nil, errors.New("unbalanced parenthesis in VALUES list")
+		}
+		spans = append(spans, textSpan{Start: start, End: tokens[i].End})
+		i++
+		for i < len(tokens) && tokens[i].Kind == tokenComment {
+			i++
+		}
+		if i < len(tokens) && tokens[i].Text == "," {
+			i++
+			continue
+		}
+		break
+	}
+	if len(spans) == 0 {
+		return nil, errNoValuesList
+	}
+	return spans, nil
+}
+
+// rewriteValuesList returns a copy of the INSERT statement whose VALUES list only contains
+// the rows at the given indexes, in the given order.
+func rewriteValuesList(sql string, spans []textSpan, rows []int) string {
+	var b strings.Builder
+	b.WriteString(sql[:spans[0].Start])
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(sql[spans[row].Start:spans[row].End])
+	}
+	b.WriteString(sql[spans[len(spans)-1].End:])
+	return b.String()
+}
+
+// insertSelectSpan returns the position of the SELECT statement providing the rows of an
+// INSERT INTO ... SELECT statement, excluding the ON CONFLICT and RETURNING clauses.
+func insertSelectSpan(sql string) (textSpan, error) {
+	tokens := tokenize(sql)
+	depth := 0
+	span := textSpan{Start: -1, End: len(sql)}
+	for i, t := range tokens {
+		if t.Text == "(" {
+			depth++
+		} else if t.Text == ")" {
+			depth--
+		} else if depth > 0 {
+			continue
+		} else if span.Start < 0 && t.isKeyword("select") {
+			span.Start = t.Start
+		} else if span.Start >= 0 && (t.isKeyword("returning") ||
+			(t.isKeyword("on") && i+1 < len(tokens) && tokens[i+1].isKeyword("conflict"))) {
+			span.End = t.Start
+			break
+		}
+	}
+	if span.Start < 0 {
+		return span, errors.New("cannot find SELECT statement in INSERT statement")
+	}
+	span.End = span.Start + len(strings.TrimRight(sql[span.Start:span.End], " \t\r\n;"))
+	return span, nil
+}
+
+// quoteLiteral quotes a value as a SQL string literal.
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// splitReturningClause splits a statement in the statement without its top level RETURNING clause,
+// and the RETURNING clause itself, which is empty when the statement doesn't have one.
+func splitReturningClause(sql string) (string, string) {
+	depth := 0
+	for _, t := range tokenize(sql) {
+		if t.Text == "(" {
+			depth++
+		} else if t.Text == ")" {
+			depth--
+		} else if depth == 0 && t.isKeyword("returning") {
+			return strings.TrimSpace(sql[:t.Start]), strings.TrimRight(sql[t.Start:], " \t\r\n;")
+		}
+	}
+	return strings.TrimRight(sql, " \t\r\n;"), ""
+}
+
+// quoteIdentifier quotes a name as a SQL identifier.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// whereClauseSpan returns the position of the condition of the top level WHERE clause of a SELECT, UPDATE or DELETE statement,
+// excluding the WHERE keyword. ok is false when the statement doesn't have a WHERE clause.
+func whereClauseSpan(sql string) (span textSpan, ok bool) {
+	tokens := tokenize(sql)
+	depth := 0
+	span = textSpan{Start: -1, End: len(sql)}
+	for _, t := range tokens {
+		if t.Text == "(" {
+			depth++
+		} else if t.Text == ")" {
+			depth--
+		} else if depth > 0 {
+			continue
+		} else if span.Start < 0 && t.isKeyword("where") {
+			span.Start = t.End
+		} else if span.Start >= 0 && (t.Text == ";" || t.isKeyword("group") || t.isKeyword("having") ||
+			t.isKeyword("window") || t.isKeyword("order") || t.isKeyword("limit") || t.isKeyword("offset") ||
+			t.isKeyword("fetch") || t.isKeyword("for") || t.isKeyword("union") || t.isKeyword("intersect") ||
+			t.isKeyword("except") || t.isKeyword("returning")) {
+			span.End = t.Start
+			break
+		}
+	}
+	if span.Start < 0 {
+		return span, false
+	}
+	return trimSpan(sql, span), true
+}
+
+// splitConjuncts splits the condition at span in the expressions linked by its top level AND operators.
+// The AND of a BETWEEN predicate is part of the predicate.
+func splitConjuncts(sql string, span textSpan) []textSpan {
+	var spans []textSpan
+	depth := 0
+	between := false
+	start := span.Start
+	for _, t := range tokenize(sql[:span.End]) {
+		if t.Start < span.Start {
+			continue
+		}
+		if t.Text == "(" {
+			depth++
+		} else if t.Text == ")" {
+			depth--
+		} else if depth > 0 {
+			continue
+		} else if t.isKeyword("between") {
+			between = true
+		} else if t.isKeyword("and") {
+			if between {
+				between = false
+				continue
+			}
+			spans = append(spans, trimSpan(sql, textSpan{Start: start, End: t.Start}))
+			start = t.End
+		}
+	}
+	return append(spans, trimSpan(sql, textSpan{Start: start, End: span.End}))
+}
+
+// trimSpan removes the leading and trailing whitespace from a span.
+func trimSpan(sql string, span textSpan) textSpan {
+	text := sql[span.Start:span.End]
+	span.Start += len(text) - len(strings.TrimLeft(text, " \t\r\n"))
+	span.End = span.Start + len(strings.TrimSpace(text))
+	return span
+}
+
+// subquerySpans returns the position of the outermost subqueries of a statement, including the enclosing
+// parenthesis: subqueries of the FROM and WHERE clauses, of the target list and bodies of CTEs.
+// Subqueries nested in another subquery are part of the span of the outermost one.
+func subquerySpans(sql string) []textSpan {
+	var tokens []token
+	for _, t := range tokenize(sql) {
+		if t.Kind != tokenComment {
+			tokens = append(tokens, t)
+		}
+	}
+	var spans []textSpan
+	depth := 0
+	start := -1
+	for i, t := range tokens {
+		if t.Text == "(" {
+			depth++
+			if start < 0 && i+1 < len(tokens) && (tokens[i+1].isKeyword("select") ||
+				tokens[i+1].isKeyword("with") || tokens[i+1].isKeyword("values")) {
+				start = i
+				depth = 1
+			}
+		} else if t.Text == ")" {
+			depth--
+			if start >= 0 && depth == 0 {
+				spans = append(spans, textSpan{Start: tokens[start].Start, End: t.End})
+				start = -1
+			}
+		}
+	}
+	return spans
+}
+
+// columnListEnd returns the offset of the parenthesis closing the list of columns of an INSERT statement.
+func columnListEnd(sql string) (int, error) {
+	tokens := tokenize(sql)
+	i := 0
+	for i < len(tokens) && !tokens[i].isKeyword("into") {
+		i++
+	}
+	// skip the relation name and its alias
+	for i < len(tokens) && tokens[i].Text != "(" {
+		if tokens[i].isKeyword("values") || tokens[i].isKeyword("select") || tokens[i].isKeyword("default") {
+			return 0, errors.New("cannot find the list of columns of the insert statement")
+		}
+		i++
+	}
+	depth := 0
+	for ; i < len(tokens); i++ {
+		if tokens[i].Text == "(" {
+			depth++
+		} else if tokens[i].Text == ")" {
+			depth--
+			if depth == 0 {
+				return tokens[i].Start, nil
+			}
+		}
+	}
+	return 0, errors.New("unbalanced parenthesis in the list of columns")
+}
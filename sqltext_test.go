@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestValuesListSpans(t *testing.T) {
+	tests := []struct {
+		name          string
+		sql           string
+		expected      []string
+		expectedError error
+	}{
+		{
+			name:     "it should find a single row",
+			sql:      "insert into company(id, name, age) values(1, 'Test ciccio', 24)",
+			expected: []string{"(1, 'Test ciccio', 24)"},
+		},
+		{
+			name:     "it should find multiple rows",
+			sql:      "INSERT INTO orders (id, amount) VALUES ('a', 1), ('b', 2) , ('c', 3) RETURNING id",
+			expected: []string{"('a', 1)", "('b', 2)", "('c', 3)"},
+		},
+		{
+			name:     "it should ignore parenthesis and keywords inside strings and comments",
+			sql:      "insert into t(id, name) values ('a', 'values (x)'), /* ( */ ('b', lower('it''s )'))",
+			expected: []string{"('a', 'values (x)')", "('b', lower('it''s )'))"},
+		},
+		{
+			name:     "it should handle dollar quoted strings",
+			sql:      "insert into t(id, name) values ('a', $$)$$), ('b', $tag$ ( $tag$)",
+			expected: []string{"('a', $$)$$)", "('b', $tag$ ( $tag$)"},
+		},
+		{
+			name:          "statement without VALUES list should error",
+			sql:           "insert into t(id) select id from s",
+			expectedError: errNoValuesList,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans, err := valuesListSpans(tt.sql)
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			var observed []string
+			for _, span := range spans {
+				observed = append(observed, tt.sql[span.Start:span.End])
+			}
+			if !reflect.DeepEqual(tt.expected, observed) {
+				t.Fatalf("expected rows %q, observed %q", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestRewriteValuesList(t *testing.T) {
+	sql := "insert into orders(id, amount) values ('a', 1), ('b', 2), ('c', 3) returning id"
+	spans, err := valuesListSpans(sql)
+	if err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	expected := "insert into orders(id, amount) values ('a', 1), ('c', 3) returning id"
+	if observed := rewriteValuesList(sql, spans, []int{0, 2}); observed != expected {
+		t.Fatalf("expected %q, observed %q", expected, observed)
+	}
+	expected = "insert into orders(id, amount) values ('b', 2) returning id"
+	if observed := rewriteValuesList(sql, spans, []int{1}); observed != expected {
+		t.Fatalf("expected %q, observed %q", expected, observed)
+	}
+}
+
+func TestInsertSelectSpan(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected string
+	}{
+		{
+			name:     "it should find the select statement",
+			sql:      "insert into archive(id, amount) select id, amount from orders where amount > 10",
+			expected: "select id, amount from orders where amount > 10",
+		},
+		{
+			name:     "it should exclude the returning clause",
+			sql:      "insert into archive(id) select id from orders returning id",
+			expected: "select id from orders",
+		},
+		{
+			name:     "it should not confuse join conditions with on conflict clauses",
+			sql:      "insert into archive(id) select o.id from orders o join members m on m.id = o.member_id on conflict (id) do nothing",
+			expected: "select o.id from orders o join members m on m.id = o.member_id",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span, err := insertSelectSpan(tt.sql)
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if observed := tt.sql[span.Start:span.End]; observed != tt.expected {
+				t.Fatalf("expected %q, observed %q", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestSplitReturningClause(t *testing.T) {
+	tests := []struct {
+		name              string
+		sql               string
+		expectedStatement string
+		expectedReturning string
+	}{
+		{
+			name:              "statement without returning clause",
+			sql:               "update orders set id = 'b' where id = 'a';",
+			expectedStatement: "update orders set id = 'b' where id = 'a'",
+			expectedReturning: "",
+		},
+		{
+			name:              "statement with returning clause",
+			sql:               "update orders set id = 'b', note = 'returning' where id = 'a' RETURNING id, amount",
+			expectedStatement: "update orders set id = 'b', note = 'returning' where id = 'a'",
+			expectedReturning: "RETURNING id, amount",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statement, returning := splitReturningClause(tt.sql)
+			if statement != tt.expectedStatement {
+				t.Fatalf("expected statement %q, observed %q", tt.expectedStatement, statement)
+			}
+			if returning != tt.expectedReturning {
+				t.Fatalf("expected returning clause %q, observed %q", tt.expectedReturning, returning)
+			}
+		})
+	}
+}
+
+func TestSplitConjuncts(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected []string
+	}{
+		{
+			name:     "statement without where clause",
+			sql:      "select * from orders",
+			expected: nil,
+		},
+		{
+			name:     "single expression",
+			sql:      "select * from orders where orders.id = 'a'",
+			expected: []string{"orders.id = 'a'"},
+		},
+		{
+			name:     "expressions linked by AND",
+			sql:      "select * from members join orders on orders.member_id = members.id where members.id = 'a' AND (orders.amount > 1 and orders.amount < 5) and orders.note = 'x and y' limit 10",
+			expected: []string{"members.id = 'a'", "(orders.amount > 1 and orders.amount < 5)", "orders.note = 'x and y'"},
+		},
+		{
+			name:     "between predicate",
+			sql:      "select * from orders where orders.amount between 1 and 5 and orders.id = 'a';",
+			expected: []string{"orders.amount between 1 and 5", "orders.id = 'a'"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span, ok := whereClauseSpan(tt.sql)
+			if !ok {
+				if tt.expected != nil {
+					t.Fatalf("expected where clause, found none")
+				}
+				return
+			}
+			var observed []string
+			for _, s := range splitConjuncts(tt.sql, span) {
+				observed = append(observed, tt.sql[s.Start:s.End])
+			}
+			if !reflect.DeepEqual(tt.expected, observed) {
+				t.Fatalf("expected conjuncts %q, observed %q", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestSubquerySpans(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected []string
+	}{
+		{
+			name:     "statement without subqueries",
+			sql:      "select * from orders where orders.id in ('a', 'b') and lower(orders.note) = '(select'",
+			expected: nil,
+		},
+		{
+			name:     "subqueries of the where clause",
+			sql:      "select * from orders where member_id in (select id from members where (age > 1)) and exists ( /* ( */ select 1 from items where items.order_id = orders.id)",
+			expected: []string{"(select id from members where (age > 1))", "( /* ( */ select 1 from items where items.order_id = orders.id)"},
+		},
+		{
+			name:     "CTEs and subqueries of the from clause",
+			sql:      "with recent as (select * from orders where amount > (select avg(amount) from orders)) select * from recent, (values (1)) v(n)",
+			expected: []string{"(select * from orders where amount > (select avg(amount) from orders))", "(values (1))"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var observed []string
+			for _, span := range subquerySpans(tt.sql) {
+				observed = append(observed, tt.sql[span.Start:span.End])
+			}
+			if !reflect.DeepEqual(tt.expected, observed) {
+				t.Fatalf("expected subqueries %q, observed %q", tt.expected, observed)
+			}
+		})
+	}
+}
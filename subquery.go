@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/vgheri/matriarch/parser/engine"
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+	"github.com/vgheri/matriarch/parser/sql/astutils"
+)
+
+var ErrSubqueriesOnDifferentShards = errors.New("cannot execute select statement whose subqueries read rows stored on different shards")
+
+// hasSubqueries reports whether a select statement contains CTEs, subqueries in the FROM clause or sublinks,
+// e.g. where id in (select ...).
+func hasSubqueries(s *pg.SelectStmt) bool {
+	if s.WithClause != nil {
+		return true
+	}
+	return len(astutils.Search(s, func(node ast.Node) bool {
+		switch node.(type) {
+		case *pg.SubLink, *pg.RangeSubselect, *pg.WithClause:
+			return true
+		}
+		return false
+	}).Items) > 0
+}
+
+// parseSelectText parses the text of a select statement.
+func parseSelectText(sql string) (*pg.SelectStmt, error) {
+	stmts, err := engine.NewParser().Parse(strings.NewReader(sql))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse subquery: %w", err)
+	}
+	if len(stmts) != 1 {
+		return nil, fmt.Errorf("cannot parse subquery %s", sql)
+	}
+	s, ok := stmts[0].Raw.Stmt.(*pg.SelectStmt)
+	if !ok {
+		return nil, fmt.Errorf("cannot parse subquery %s, only SELECT statements are supported", sql)
+	}
+	return s, nil
+}
+
+// withClauseNames returns the names of the CTEs of the statement, appended to the CTEs of the enclosing statements.
+func withClauseNames(s *pg.SelectStmt, ctes []string) ([]string, error) {
+	names := append([]string{}, ctes...)
+	if s.WithClause == nil {
+		return names, nil
+	}
+	for _, item := range s.WithClause.Ctes.Items {
+		cte, ok := item.(*pg.CommonTableExpr)
+		if !ok {
+			continue
+		}
+		if _, ok := cte.Ctequery.(*pg.SelectStmt); !ok {
+			return nil, fmt.Errorf("cannot execute CTE %s, only SELECT statements are supported in WITH clauses", *cte.Ctename)
+		}
+		names = append(names, *cte.Ctename)
+	}
+	return names, nil
+}
+
+// combineRoutes returns the shard serving two parts of a statement routed to the shards a and b,
+// nil meaning that any shard can serve the part.
+func combineRoutes(a, b *Shard) (*Shard, error) {
+	switch {
+	case a == nil:
+		return b, nil
+	case b == nil || a == b:
+		return a, nil
+	}
+	return nil, fmt.Errorf("%w: %s and %s", ErrSubqueriesOnDifferentShards, a.Name, b.Name)
+}
+
+// routeSelectTree returns the shard owning the rows read by a select statement and all its subqueries:
+// CTEs, subqueries of the FROM clause, sublinks and the branches of set operations.
+// The shard is nil when the statement can be served by any shard. It returns ErrSubqueriesOnDifferentShards
+// when two parts of the statement are routed to different shards.
+// sql is the text of the statement and ctes the names of the CTEs defined by the enclosing statements.
+func (mock *PGMock) routeSelectTree(sql string, s *pg.SelectStmt, cluster *Cluster, vschema *Vschema, ctes []string) (*Shard, error) {
+	ctes, err := withClauseNames(s, ctes)
+	if err != nil {
+		return nil, err
+	}
+	var target *Shard
+	for _, span := range subquerySpans(sql) {
+		text := sql[span.Start+1 : span.End-1]
+		sub, err := mock.parseSelect(text, vschema)
+		if err != nil {
+			return nil, err
+		}
+		shard, err := mock.routeSelectTree(text, sub, cluster, vschema, ctes)
+		if err != nil {
+			return nil, err
+		}
+		if target, err = combineRoutes(target, shard); err != nil {
+			return nil, err
+		}
+	}
+	shard, err := mock.routeSetOperation(s, cluster, vschema, ctes)
+	if err != nil {
+		return nil, err
+	}
+	return combineRoutes(target, shard)
+}
+
+// routeSetOperation routes each branch of a set operation, e.g. select ... union select ...
+func (mock *PGMock) routeSetOperation(s *pg.SelectStmt, cluster *Cluster, vschema *Vschema, ctes []string) (*Shard, error) {
+	if s.Op > 0 {
+		left, err := mock.routeSetOperation(s.Larg, cluster, vschema, ctes)
+		if err != nil {
+			return nil, err
+		}
+		right, err := mock.routeSetOperation(s.Rarg, cluster, vschema, ctes)
+		if err != nil {
+			return nil, err
+		}
+		return combineRoutes(left, right)
+	}
+	if isEmptyList(s.FromClause) {
+		// VALUES lists and constant values can be computed by any shard
+		return nil, nil
+	}
+	return mock.routeSelect(s, cluster, vschema, ctes)
+}
+
+// isRoutingError reports whether the error means that a statement cannot be executed on a single shard.
+func isRoutingError(err error) bool {
+	return errors.Is(err, ErrMissingPrimaryVIndex) || errors.Is(err, ErrSubqueriesOnDifferentShards) ||
+		errors.Is(err, ErrNonColocatedJoin)
+}
+
+// processSelectWithSubqueries executes a select statement containing subqueries.
+// The statement is pushed down to a single shard when all its parts are routed to the same shard.
+// Otherwise the uncorrelated subqueries are evaluated first, their results substituted in the statement,
+// and the resulting statement is executed.
+func (mock *PGMock) processSelectWithSubqueries(s *pg.SelectStmt, q QueryMessage, cluster *Cluster, vschema *Vschema) error {
+	target, err := mock.routeSelectTree(q.String, s, cluster, vschema, nil)
+	if err == nil {
+		if target == nil {
+			target = cluster.AnyShard()
+		}
+		mock.logger.Log("msg", fmt.Sprintf("shard selected: %s", target.Name))
+		return mock.executeSelect(target, q)
+	}
+	if !isRoutingError(err) {
+		return err
+	}
+	rewritten, substituted, serr := mock.substituteSubqueries(q.String, s, cluster, vschema)
+	if serr != nil {
+		return serr
+	}
+	if !substituted {
+		if errors.Is(err, ErrMissingPrimaryVIndex) {
+			return mock.processScatterSelect(s, q, cluster, vschema, err)
+		}
+		return err
+	}
+	mock.logger.Log("msg", fmt.Sprintf("subqueries evaluated, statement rewritten as %s", rewritten))
+	stmt, err := mock.parseSelect(rewritten, vschema)
+	if err != nil {
+		return err
+	}
+	return mock.processSelectStmt(stmt, QueryMessage{Type: q.Type, String: rewritten}, cluster, vschema)
+}
+
+// substituteSubqueries evaluates the outermost uncorrelated subqueries reading sharded tables, and returns the statement
+// with the subqueries replaced by their results. substituted is false when no subquery could be evaluated.
+// Correlated subqueries and subqueries reading CTEs are left untouched, as they cannot be executed on their own.
+func (mock *PGMock) substituteSubqueries(sql string, s *pg.SelectStmt, cluster *Cluster, vschema *Vschema) (rewritten string, substituted bool, err error) {
+	ctes, err := withClauseNames(s, nil)
+	if err != nil {
+		return "", false, err
+	}
+	var b strings.Builder
+	last := 0
+	for _, span := range subquerySpans(sql) {
+		text := sql[span.Start+1 : span.End-1]
+		sub, err := mock.parseSelect(text, vschema)
+		if err != nil {
+			return "", false, err
+		}
+		if referencesEnclosingRelations(sub, ctes) {
+			continue
+		}
+		if target, err := mock.routeSelectTree(text, sub, cluster, vschema, nil); err == nil && target == nil {
+			// Any shard can evaluate the subquery as part of the statement
+			continue
+		}
+		result, err := mock.evaluateSubquery(text, sub, cluster, vschema)
+		if err != nil {
+			return "", false, fmt.Errorf("cannot evaluate subquery %s: %w", text, err)
+		}
+		replacement, err := subqueryResultText(result, subqueryContextOf(sql, span))
+		if err != nil {
+			return "", false, err
+		}
+		b.WriteString(sql[last:span.Start])
+		b.WriteString(replacement)
+		last = span.End
+		substituted = true
+	}
+	b.WriteString(sql[last:])
+	return b.String(), substituted, nil
+}
+
+// evaluateSubquery executes an uncorrelated subquery and returns its rows.
+// The subquery is executed on the shard owning the rows it reads, or on every shard owning them, see scatterSelect.
+func (mock *PGMock) evaluateSubquery(sql string, s *pg.SelectStmt, cluster *Cluster, vschema *Vschema) (*pgconn.Result, error) {
+	ctx := context.Background()
+	target, err := mock.routeSelectTree(sql, s, cluster, vschema, nil)
+	if err == nil {
+		if target == nil {
+			target = cluster.AnyShard()
+		}
+		return queryShards(ctx, []*Shard{target}, sql)
+	}
+	if !isRoutingError(err) {
+		return nil, err
+	}
+	rewritten, substituted, serr := mock.substituteSubqueries(sql, s, cluster, vschema)
+	if serr != nil {
+		return nil, serr
+	}
+	if substituted {
+		stmt, err := mock.parseSelect(rewritten, vschema)
+		if err != nil {
+			return nil, err
+		}
+		return mock.evaluateSubquery(rewritten, stmt, cluster, vschema)
+	}
+	if !errors.Is(err, ErrMissingPrimaryVIndex) {
+		return nil, err
+	}
+	return mock.scatterSelect(sql, s, cluster, vschema, err)
+}
+
+// scatterSelect executes a select statement on every shard owning the rows it reads, see routeSelectShards,
+// and merges the rows. Aggregates, GROUP BY, LIMIT and set operations are not supported, as they would be computed
+// by each shard on its own rows, and the subqueries of the statement must be computable by any shard.
+// routeErr is the error returned when the statement cannot be executed this way.
+func (mock *PGMock) scatterSelect(sql string, s *pg.SelectStmt, cluster *Cluster, vschema *Vschema, routeErr error) (*pgconn.Result, error) {
+	for _, span := range subquerySpans(sql) {
+		text := sql[span.Start+1 : span.End-1]
+		sub, err := mock.parseSelect(text, vschema)
+		if err != nil {
+			return nil, err
+		}
+		if target, err := mock.routeSelectTree(text, sub, cluster, vschema, nil); err != nil || target != nil {
+			return nil, routeErr
+		}
+	}
+	if err := checkScatterSelect(s); err != nil {
+		return nil, err
+	}
+	ctes, err := withClauseNames(s, nil)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := mock.routeSelectShards(s, cluster, vschema, ctes)
+	if err != nil {
+		return nil, err
+	}
+	if shards == nil {
+		shards = []*Shard{cluster.AnyShard()}
+	}
+	result, err := queryShards(context.Background(), shards, sql)
+	if err != nil {
+		return nil, err
+	}
+	if !isEmptyList(s.DistinctClause) {
+		result.Rows = distinctRows(result.Rows)
+	}
+	return result, nil
+}
+
+// checkScatterSelect refuses statements whose result would be wrong when computed by each shard on its own rows.
+func checkScatterSelect(s *pg.SelectStmt) error {
+	switch {
+	case s.Op > 0:
+		return errors.New("set operations require all primary vindex columns in the where clause")
+	case !isEmptyList(s.GroupClause) || !isEmptyNode(s.HavingClause):
+		return errors.New("GROUP BY and HAVING clauses require all primary vindex columns in the where clause")
+	case !isEmptyNode(s.LimitCount) || !isEmptyNode(s.LimitOffset):
+		return errors.New("LIMIT and OFFSET clauses require all primary vindex columns in the where clause")
+	}
+	for _, item := range s.DistinctClause.Items {
+		if !isEmptyNode(item) {
+			return errors.New("DISTINCT ON clauses require all primary vindex columns in the where clause")
+		}
+	}
+	if len(astutils.Search(s.TargetList, func(node ast.Node) bool {
+		_, ok := node.(*ast.FuncCall)
+		return ok
+	}).Items) > 0 {
+		return errors.New("function calls in the target list require all primary vindex columns in the where clause")
+	}
+	return nil
+}
+
+// distinctRows removes the duplicated rows, keeping the first occurrence of each row.
+func distinctRows(rows [][][]byte) [][][]byte {
+	var distinct [][][]byte
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		var key strings.Builder
+		for _, value := range row {
+			if value == nil {
+				key.WriteString("N")
+			} else {
+				key.WriteString(fmt.Sprintf("V%d:%s", len(value), value))
+			}
+		}
+		if !seen[key.String()] {
+			seen[key.String()] = true
+			distinct = append(distinct, row)
+		}
+	}
+	return distinct
+}
+
+// referencesEnclosingRelations reports whether a subquery reads one of the CTEs ctes, or references columns of
+// relations it doesn't define, i.e. it is correlated with the enclosing statement.
+// Only columns qualified with their relation name can be detected: a subquery referencing an unqualified column of
+// the enclosing statement fails when executed on its own.
+func referencesEnclosingRelations(s *pg.SelectStmt, ctes []string) bool {
+	defined, err := withClauseNames(s, nil)
+	if err != nil {
+		return true
+	}
+	for _, node := range astutils.Search(s, func(node ast.Node) bool {
+		switch node.(type) {
+		case *pg.RangeVar, *pg.RangeSubselect:
+			return true
+		}
+		return false
+	}).Items {
+		switch n := node.(type) {
+		case *pg.RangeVar:
+			if stringArrayContainsValue(ctes, *n.Relname) != -1 && stringArrayContainsValue(defined, *n.Relname) == -1 {
+				return true
+			}
+			defined = append(defined, *n.Relname)
+			if n.Alias != nil && n.Alias.Aliasname != nil {
+				defined = append(defined, *n.Alias.Aliasname)
+			}
+		case *pg.RangeSubselect:
+			if n.Alias != nil && n.Alias.Aliasname != nil {
+				defined = append(defined, *n.Alias.Aliasname)
+			}
+		}
+	}
+	for _, node := range astutils.Search(s, func(node ast.Node) bool {
+		_, ok := node.(*pg.ColumnRef)
+		return ok
+	}).Items {
+		fields := node.(*pg.ColumnRef).Fields.Items
+		if len(fields) < 2 {
+			continue
+		}
+		if relation, ok := fields[0].(*pg.String); ok && stringArrayContainsValue(defined, relation.Str) == -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// subqueryContext models how the result of a subquery is used by the enclosing statement.
+type subqueryContext int
+
+const (
+	// subqueryRows is a subquery used as a set of rows, e.g. in the FROM clause or in EXISTS.
+	subqueryRows subqueryContext = iota
+	// subqueryList is a subquery used as the list of values of an IN expression.
+	subqueryList
+	// subqueryScalar is a subquery used as a single value, e.g. where id = (select ...).
+	subqueryScalar
+)
+
+// subqueryContextOf returns how the subquery at span is used, looking at the token preceding it.
+func subqueryContextOf(sql string, span textSpan) subqueryContext {
+	var previous token
+	for _, t := range tokenize(sql[:span.Start]) {
+		if t.Kind != tokenComment {
+			previous = t
+		}
+	}
+	switch {
+	case previous.isKeyword("in"):
+		return subqueryList
+	case previous.Kind == tokenPunct && (previous.Text == "=" || previous.Text == "<" || previous.Text == ">" ||
+		previous.Text == "+" || previous.Text == "-" || previous.Text == "*" || previous.Text == "/"):
+		return subqueryScalar
+	}
+	return subqueryRows
+}
+
+// subqueryResultText returns the text replacing a subquery with its result, according to the context of the subquery.
+// Single column results are replaced with literals when used as a single value or as the list of an IN expression,
+// so that Matriarch can route the resulting statement, otherwise with a VALUES list.
+func subqueryResultText(result *pgconn.Result, context subqueryContext) (string, error) {
+	if len(result.FieldDescriptions) == 0 {
+		return "", errors.New("cannot substitute subquery without columns")
+	}
+	if len(result.FieldDescriptions) == 1 {
+		switch {
+		case context == subqueryScalar && len(result.Rows) > 1:
+			return "", errors.New("more than one row returned by a subquery used as an expression")
+		case context == subqueryScalar && len(result.Rows) == 1:
+			return "(" + literal(result.Rows[0][0], 0) + ")", nil
+		case context == subqueryScalar:
+			return "(NULL)", nil
+		case context == subqueryList && len(result.Rows) > 0:
+			var values []string
+			for _, row := range result.Rows {
+				values = append(values, literal(row[0], 0))
+			}
+			return "(" + strings.Join(values, ", ") + ")", nil
+		}
+	}
+	var columns []string
+	for _, field := range result.FieldDescriptions {
+		columns = append(columns, quoteIdentifier(string(field.Name)))
+	}
+	if len(result.Rows) == 0 {
+		var nulls []string
+		for i, field := range result.FieldDescriptions {
+			nulls = append(nulls, literal(nil, field.DataTypeOID)+" AS "+columns[i])
+		}
+		return fmt.Sprintf("(SELECT %s WHERE false)", strings.Join(nulls, ", ")), nil
+	}
+	var rows []string
+	for _, row := range result.Rows {
+		var values []string
+		for i, value := range row {
+			values = append(values, literal(value, result.FieldDescriptions[i].DataTypeOID))
+		}
+		rows = append(rows, "("+strings.Join(values, ", ")+")")
+	}
+	return fmt.Sprintf("(SELECT * FROM (VALUES %s) AS matriarch_subquery(%s))", strings.Join(rows, ", "), strings.Join(columns, ", ")), nil
+}
+
+// typeNames maps the OIDs of the built-in PostgreSQL types to their name.
+// See https://github.com/postgres/postgres/blob/master/src/include/catalog/pg_type.dat
+var typeNames = map[uint32]string{
+	16:   "bool",
+	17:   "bytea",
+	20:   "int8",
+	21:   "int2",
+	23:   "int4",
+	25:   "text",
+	114:  "json",
+	700:  "float4",
+	701:  "float8",
+	1042: "bpchar",
+	1043: "varchar",
+	1082: "date",
+	1083: "time",
+	1114: "timestamp",
+	1184: "timestamptz",
+	1186: "interval",
+	1700: "numeric",
+	2950: "uuid",
+	3802: "jsonb",
+}
+
+// literal returns the SQL literal of a value in text format, cast to the type with the given OID when known.
+// An OID of zero leaves the literal untyped, so that PostgreSQL infers its type from the context.
+func literal(value []byte, oid uint32) string {
+	text := "NULL"
+	if value != nil {
+		text = quoteLiteral(string(value))
+	}
+	if name, ok := typeNames[oid]; ok {
+		return text + "::" + name
+	}
+	return text
+}
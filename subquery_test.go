@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+)
+
+func TestRouteSelectTree(t *testing.T) {
+	cluster := testCluster(t)
+	owner, err := cluster.GetShardForKeyspaceId("a")
+	if err != nil {
+		t.Fatalf("cannot find shard owning keyspace id: %v", err)
+	}
+	// find a keyspace id owned by another shard
+	var other string
+	for i := 0; other == ""; i++ {
+		shard, err := cluster.GetShardForKeyspaceId(fmt.Sprintf("k%d", i))
+		if err != nil {
+			t.Fatalf("cannot find shard owning keyspace id: %v", err)
+		}
+		if shard != owner {
+			other = fmt.Sprintf("k%d", i)
+		}
+	}
+	mock := &PGMock{logger: log.NewNopLogger()}
+	tests := []struct {
+		name          string
+		sql           string
+		expected      *Shard
+		expectedError error
+	}{
+		{
+			name:     "sublink routed to the same shard should be pushed down",
+			sql:      "select * from orders where orders.id = 'a' and exists (select 1 from order_items where order_items.order_id = 'a')",
+			expected: owner,
+		},
+		{
+			name:     "sublink reading reference tables should be pushed down",
+			sql:      "select * from orders where orders.id = 'a' and orders.category_id in (select id from categories where name = 'books')",
+			expected: owner,
+		},
+		{
+			name:     "CTE should be routed with the statement reading it",
+			sql:      "with o as (select * from orders where id = 'a') select * from o join categories on categories.id = o.category_id",
+			expected: owner,
+		},
+		{
+			name:     "subquery of the FROM clause should be routed",
+			sql:      "select * from (select * from orders where id = 'a') o",
+			expected: owner,
+		},
+		{
+			name:     "statement reading VALUES lists can be served by any shard",
+			sql:      "select * from (values (1), (2)) v(n) where v.n in (select 1)",
+			expected: nil,
+		},
+		{
+			name:          "subqueries routed to different shards should error",
+			sql:           fmt.Sprintf("select * from orders where orders.id = 'a' and orders.member_id in (select member_id from orders where id = '%s')", other),
+			expectedError: ErrSubqueriesOnDifferentShards,
+		},
+		{
+			name:          "set operations routed to different shards should error",
+			sql:           fmt.Sprintf("select id from orders where id = 'a' union select id from orders where id = '%s'", other),
+			expectedError: ErrSubqueriesOnDifferentShards,
+		},
+		{
+			name:          "subquery without primary vindex should error",
+			sql:           "select * from orders where orders.id = 'a' and orders.member_id in (select member_id from orders where amount = 10)",
+			expectedError: ErrMissingPrimaryVIndex,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observed, err := mock.routeSelectTree(tt.sql, parseSelectStmt(t, tt.sql), cluster, testVschema, nil)
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if observed != tt.expected {
+				t.Fatalf("expected shard %v, observed %v", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestReferencesEnclosingRelations(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected bool
+	}{
+		{
+			name:     "uncorrelated subquery",
+			sql:      "select o.member_id from orders o join members on members.id = o.member_id where o.amount > 10",
+			expected: false,
+		},
+		{
+			name:     "correlated subquery",
+			sql:      "select 1 from order_items where order_items.order_id = orders.id",
+			expected: true,
+		},
+		{
+			name:     "subquery reading a CTE",
+			sql:      "select id from recent",
+			expected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if observed := referencesEnclosingRelations(parseSelectStmt(t, tt.sql), []string{"recent"}); observed != tt.expected {
+				t.Fatalf("expected %t, observed %t", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestSubqueryResultText(t *testing.T) {
+	single := &pgconn.Result{
+		FieldDescriptions: []pgproto3.FieldDescription{{Name: []byte("id"), DataTypeOID: 2950}},
+		Rows:              [][][]byte{{[]byte("a")}, {[]byte("b'c")}},
+	}
+	multiple := &pgconn.Result{
+		FieldDescriptions: []pgproto3.FieldDescription{{Name: []byte("id"), DataTypeOID: 23}, {Name: []byte("note"), DataTypeOID: 25}},
+		Rows:              [][][]byte{{[]byte("1"), nil}},
+	}
+	empty := &pgconn.Result{FieldDescriptions: multiple.FieldDescriptions}
+	tests := []struct {
+		name     string
+		sql      string
+		result   *pgconn.Result
+		expected string
+		err      bool
+	}{
+		{
+			name:     "list of values",
+			sql:      "select * from orders where id in (select id from s)",
+			result:   single,
+			expected: "('a', 'b''c')",
+		},
+		{
+			name:     "scalar value",
+			sql:      "select * from orders where id = (select id from s)",
+			result:   &pgconn.Result{FieldDescriptions: single.FieldDescriptions, Rows: single.Rows[:1]},
+			expected: "('a')",
+		},
+		{
+			name:   "scalar value with more than one row",
+			sql:    "select * from orders where id = (select id from s)",
+			result: single,
+			err:    true,
+		},
+		{
+			name:     "set of rows",
+			sql:      "select * from orders join (select id, note from s) n on n.id = orders.id",
+			result:   multiple,
+			expected: `(SELECT * FROM (VALUES ('1'::int4, NULL::text)) AS matriarch_subquery("id", "note"))`,
+		},
+		{
+			name:     "empty set of rows",
+			sql:      "select * from orders where exists (select id, note from s)",
+			result:   empty,
+			expected: `(SELECT NULL::int4 AS "id", NULL::text AS "note" WHERE false)`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans := subquerySpans(tt.sql)
+			if len(spans) != 1 {
+				t.Fatalf("expected one subquery, found %d", len(spans))
+			}
+			observed, err := subqueryResultText(tt.result, subqueryContextOf(tt.sql, spans[0]))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, test succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if observed != tt.expected {
+				t.Fatalf("expected %s, observed %s", tt.expected, observed)
+			}
+		})
+	}
+}
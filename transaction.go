@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/vgheri/matriarch/pgpool"
+)
+
+const (
+	// commitPreparedAttempts is the number of times COMMIT PREPARED is executed on a shard before giving up.
+	commitPreparedAttempts = 3
+	// commitPreparedRetryDelay is the delay before the first retry of COMMIT PREPARED, doubled for every retry.
+	commitPreparedRetryDelay = 100 * time.Millisecond
+	// undefinedObject is the SQLSTATE returned by COMMIT PREPARED when the prepared transaction does not exist.
+	undefinedObject = "42704"
+)
+
+// PreparedTransaction is a transaction prepared on a shard, identified by its global identifier.
+type PreparedTransaction struct {
+	Shard string
+	Gid   string
+}
+
+// PartialCommitError is returned when a cross-shard transaction was prepared on every shard, but could only be
+// committed on some of them. The transaction is committed: the prepared transactions of the pending shards keep
+// their locks until they are committed by an operator with COMMIT PREPARED.
+type PartialCommitError struct {
+	Committed []string
+	Pending   []PreparedTransaction
+	Err       error
+}
+
+func (e *PartialCommitError) Error() string {
+	var pending []string
+	for _, p := range e.Pending {
+		pending = append(pending, fmt.Sprintf("COMMIT PREPARED '%s' on shard %s", p.Gid, p.Shard))
+	}
+	return fmt.Sprintf("transaction partially committed, committed on shards [%s], run %s to complete it: %v",
+		strings.Join(e.Committed, ", "), strings.Join(pending, ", "), e.Err)
+}
+
+func (e *PartialCommitError) Unwrap() error {
+	return e.Err
+}
+
+// ShardTransaction is a transaction spanning one or more shards.
+// A transaction is opened on a shard the first time a statement is executed on it.
+// When a single shard takes part in the transaction it is committed as a regular
+// transaction, otherwise the two-phase commit protocol is used, which requires
+// max_prepared_transactions to be greater than zero on every shard.
+type ShardTransaction struct {
+	id     string
+	shards []*Shard
+	conns  map[*Shard]*pgpool.Conn
+}
+
+func NewShardTransaction() (*ShardTransaction, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate transaction id: %w", err)
+	}
+	return &ShardTransaction{
+		id:    id.String(),
+		conns: make(map[*Shard]*pgpool.Conn),
+	}, nil
+}
+
+// Exec executes sql on the shard, opening the transaction on it if needed.
+func (t *ShardTransaction) Exec(ctx context.Context, shard *Shard, sql string) ([]*pgconn.Result, error) {
+	conn, ok := t.conns[shard]
+	if !ok {
+		var err error
+		conn, err = shard.Conn.Acquire(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cannot acquire connection to shard %s: %w", shard.Name, err)
+		}
+		t.conns[shard] = conn
+		t.shards = append(t.shards, shard)
+		if _, err = conn.Exec(ctx, "BEGIN").ReadAll(); err != nil {
+			return nil, err
+		}
+	}
+	return conn.Exec(ctx, sql).ReadAll()
+}
+
+// Commit commits the transaction on every shard taking part in it and releases the connections.
+func (t *ShardTransaction) Commit(ctx context.Context) error {
+	defer t.release()
+	if len(t.shards) == 1 {
+		_, err := t.conns[t.shards[0]].Exec(ctx, "COMMIT").ReadAll()
+		return err
+	}
+	// Phase 1: prepare the transaction on every shard. If any of them fails,
+	// roll back the ones already prepared and the ones still open.
+	for i, shard := range t.shards {
+		if _, err := t.conns[shard].Exec(ctx, fmt.Sprintf("PREPARE TRANSACTION '%s'", t.gid(shard))).ReadAll(); err != nil {
+			for _, prepared := range t.shards[:i] {
+				t.conns[prepared].Exec(ctx, fmt.Sprintf("ROLLBACK PREPARED '%s'", t.gid(prepared))).ReadAll()
+			}
+			for _, open := range t.shards[i:] {
+				t.conns[open].Exec(ctx, "ROLLBACK").ReadAll()
+			}
+			return fmt.Errorf("cannot prepare transaction on shard %s: %w", shard.Name, err)
+		}
+	}
+	// Phase 2: commit the prepared transactions. The transaction is committed once prepared on every shard,
+	// so a shard failing to commit it does not stop the other shards.
+	var committed []string
+	var pending []PreparedTransaction
+	var commitErr error
+	for _, shard := range t.shards {
+		if err := t.commitPrepared(ctx, shard); err != nil {
+			pending = append(pending, PreparedTransaction{Shard: shard.Name, Gid: t.gid(shard)})
+			if commitErr == nil {
+				commitErr = fmt.Errorf("cannot commit prepared transaction on shard %s: %w", shard.Name, err)
+			}
+			continue
+		}
+		committed = append(committed, shard.Name)
+	}
+	if len(pending) > 0 {
+		return &PartialCommitError{Committed: committed, Pending: pending, Err: commitErr}
+	}
+	return nil
+}
+
+// commitPrepared commits the prepared transaction on a shard, retrying with a new connection when it fails,
+// as the connection of the transaction may be broken and prepared transactions can be committed by any session.
+func (t *ShardTransaction) commitPrepared(ctx context.Context, shard *Shard) error {
+	sql := fmt.Sprintf("COMMIT PREPARED '%s'", t.gid(shard))
+	_, err := t.conns[shard].Exec(ctx, sql).ReadAll()
+	delay := commitPreparedRetryDelay
+	for attempt := 1; err != nil && attempt < commitPreparedAttempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		var conn *pgpool.Conn
+		conn, err = shard.Conn.Acquire(ctx)
+		if err != nil {
+			continue
+		}
+		_, err = conn.Exec(ctx, sql).ReadAll()
+		conn.Release()
+		// the previous attempt committed the transaction, but its response was lost
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == undefinedObject {
+			return nil
+		}
+	}
+	return err
+}
+
+// Rollback aborts the transaction on every shard taking part in it and releases the connections.
+func (t *ShardTransaction) Rollback(ctx context.Context) error {
+	defer t.release()
+	var rollbackErr error
+	for _, shard := range t.shards {
+		if _, err := t.conns[shard].Exec(ctx, "ROLLBACK").ReadAll(); err != nil && rollbackErr == nil {
+			rollbackErr = fmt.Errorf("cannot rollback transaction on shard %s: %w", shard.Name, err)
+		}
+	}
+	return rollbackErr
+}
+
+// gid returns the global identifier of the prepared transaction on a shard.
+func (t *ShardTransaction) gid(shard *Shard) string {
+	return fmt.Sprintf("matriarch_%s_%s", t.id, shard.Name)
+}
+
+func (t *ShardTransaction) release() {
+	for _, conn := range t.conns {
+		conn.Release()
+	}
+	t.conns = make(map[*Shard]*pgpool.Conn)
+	t.shards = nil
+}
+
+// execInTransaction executes sql on each shard inside a cross-shard transaction, and returns
+// the results of all the shards, in the same order as the shards.
+func execInTransaction(ctx context.Context, shards []*Shard, sql string) ([]*pgconn.Result, error) {
+	tx, err := NewShardTransaction()
+	if err != nil {
+		return nil, err
+	}
+	var results []*pgconn.Result
+	for _, shard := range shards {
+		res, err := tx.Exec(ctx, shard, sql)
+		if err != nil {
+			tx.Rollback(ctx)
+			return nil, err
+		}
+		results = append(results, res...)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
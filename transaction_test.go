@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestShardTransactionCommitPrepared(t *testing.T) {
+	tests := []struct {
+		name string
+		// failures is the number of times COMMIT PREPARED fails on the last shard
+		failures  int
+		code      string
+		committed []string
+		pending   []string
+	}{
+		{name: "committed on every shard", committed: []string{"ecommerce_$80", "ecommerce_80$"}},
+		{name: "committed after a retry", failures: 1, committed: []string{"ecommerce_$80", "ecommerce_80$"}},
+		{name: "committed by an attempt whose response was lost", failures: 1, code: undefinedObject,
+			committed: []string{"ecommerce_$80", "ecommerce_80$"}},
+		{name: "partially committed", failures: commitPreparedAttempts,
+			committed: []string{"ecommerce_$80"}, pending: []string{"ecommerce_80$"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			cluster, fakes := startFakeShards(t, "ecommerce", 2, func(shard, sql string) fakeResult {
+				if shard != "ecommerce_80$" || !strings.HasPrefix(sql, "COMMIT PREPARED") {
+					return fakeResult{}
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				switch {
+				case attempts == 2 && tt.code != "":
+					return fakeResult{err: "prepared transaction does not exist", code: tt.code}
+				case attempts <= tt.failures:
+					return fakeResult{err: "connection lost", code: "08006"}
+				}
+				return fakeResult{}
+			})
+			ctx := context.Background()
+			tx, err := NewShardTransaction()
+			if err != nil {
+				t.Fatalf("cannot create transaction: %v", err)
+			}
+			for _, shard := range cluster.Shards {
+				if _, err = tx.Exec(ctx, shard, "update categories set name = 'books'"); err != nil {
+					t.Fatalf("cannot execute statement on shard %s: %v", shard.Name, err)
+				}
+			}
+			gids := make(map[string]string)
+			for _, shard := range cluster.Shards {
+				gids[shard.Name] = tx.gid(shard)
+			}
+			err = tx.Commit(ctx)
+			if len(tt.pending) == 0 {
+				if err != nil {
+					t.Fatalf("expected test to succeed, got error %v", err)
+				}
+				return
+			}
+			var partial *PartialCommitError
+			if !errors.As(err, &partial) {
+				t.Fatalf("expected a partial commit error, got %v", err)
+			}
+			if strings.Join(partial.Committed, ",") != strings.Join(tt.committed, ",") {
+				t.Fatalf("expected committed shards %v, observed %v", tt.committed, partial.Committed)
+			}
+			if len(partial.Pending) != len(tt.pending) {
+				t.Fatalf("expected pending shards %v, observed %v", tt.pending, partial.Pending)
+			}
+			for i, p := range partial.Pending {
+				if p.Shard != tt.pending[i] || p.Gid != gids[p.Shard] {
+					t.Fatalf("expected pending shard %s with gid %s, observed %+v", tt.pending[i], gids[tt.pending[i]], p)
+				}
+				if !strings.Contains(err.Error(), "COMMIT PREPARED '"+p.Gid+"'") {
+					t.Fatalf("expected error to tell how to commit %s, observed %v", p.Gid, err)
+				}
+			}
+			if attempts != commitPreparedAttempts {
+				t.Fatalf("expected %d attempts to commit the prepared transaction, observed %d", commitPreparedAttempts, attempts)
+			}
+			committedShard := fakes["ecommerce_$80"]
+			committedShard.mu.Lock()
+			defer committedShard.mu.Unlock()
+			for _, q := range committedShard.queries {
+				if strings.HasPrefix(q, "ROLLBACK") {
+					t.Fatalf("expected committed shard not to be rolled back, observed %s", q)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/vgheri/matriarch/parser/sql/ast"
+)
+
+// UnshardedShard returns the shard storing the rows of an unsharded table.
+func (c *Cluster) UnshardedShard(table *Table) (*Shard, error) {
+	if table.Shard == "" {
+		return c.Shards[0], nil
+	}
+	shard, err := c.GetShardByName(table.Shard)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the shard of unsharded table %s: %w", table.Key(), err)
+	}
+	return shard, nil
+}
+
+// assignUnshardedShards checks that the shards of the unsharded tables of the vschema are shards of the cluster,
+// and assigns the first shard to the unsharded tables which don't name one, so that the schema check knows where
+// each unsharded table lives.
+func assignUnshardedShards(cluster *Cluster, vschema *Vschema) error {
+	var v validation
+	for i := range vschema.Tables {
+		table := &vschema.Tables[i]
+		if table.Type != Unsharded {
+			continue
+		}
+		if table.Shard == "" {
+			table.Shard = cluster.Shards[0].Name
+			continue
+		}
+		if _, err := cluster.GetShardByName(table.Shard); err != nil {
+			v.addf(fmt.Sprintf("tables[%d] (%s).shard", i, table.Name), "%s", err)
+		}
+	}
+	return v.err()
+}
+
+// unshardedRelationsShard returns the shard storing the unsharded tables among the relations of a statement,
+// and the first of these tables. The shard is nil when the statement doesn't read any unsharded table.
+// Unsharded tables stored on different shards cannot be read by the same statement.
+func unshardedRelationsShard(relations []string, cluster *Cluster, vschema *Vschema) (*Shard, string, error) {
+	var shard *Shard
+	var first string
+	for _, relation := range relations {
+		table := vschema.GetTable(relation)
+		if table == nil || table.Type != Unsharded {
+			continue
+		}
+		s, err := cluster.UnshardedShard(table)
+		if err != nil {
+			return nil, "", err
+		}
+		if shard == nil {
+			shard, first = s, relation
+		} else if s != shard {
+			return nil, "", fmt.Errorf("cannot execute statement joining unsharded tables %s and %s, stored on shards %s and %s",
+				first, relation, shard.Name, s.Name)
+		}
+	}
+	return shard, first, nil
+}
+
+// unshardedStmtShard returns the shard executing a statement writing to an unsharded table: the shard of the table.
+// The other tables read by the statement, e.g. by INSERT ... SELECT or by subqueries, must be reference tables or
+// unsharded tables stored on the same shard.
+func unshardedStmtShard(stmt ast.Node, table *Table, cluster *Cluster, vschema *Vschema) (*Shard, error) {
+	shard, err := cluster.UnshardedShard(table)
+	if err != nil {
+		return nil, err
+	}
+	for _, relation := range statementRelations(stmt) {
+		t := vschema.GetTable(relation)
+		if t == nil || t.Type == Reference {
+			continue
+		}
+		if t.Type == Sharded {
+			return nil, fmt.Errorf("cannot read sharded table %s in a statement writing to unsharded table %s", relation, table.Key())
+		}
+		s, err := cluster.UnshardedShard(t)
+		if err != nil {
+			return nil, err
+		}
+		if s != shard {
+			return nil, fmt.Errorf("cannot read unsharded table %s of shard %s in a statement writing to unsharded table %s of shard %s",
+				relation, s.Name, table.Key(), shard.Name)
+		}
+	}
+	return shard, nil
+}
+
+// execUnshardedStmt executes a statement writing to an unsharded table on the shard of the table, see unshardedStmtShard.
+func (mock *PGMock) execUnshardedStmt(command string, stmt ast.Node, table *Table, q QueryMessage, cluster *Cluster, vschema *Vschema) error {
+	shard, err := unshardedStmtShard(stmt, table, cluster, vschema)
+	if err != nil {
+		return err
+	}
+	return mock.execDMLStmt(command, q, []*Shard{shard}, cluster)
+}
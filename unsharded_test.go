@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/vgheri/matriarch/parser/engine"
+)
+
+func TestUnshardedStmtShard(t *testing.T) {
+	cluster := testCluster(t)
+	tests := []struct {
+		name     string
+		sql      string
+		expected string
+		err      string
+	}{
+		{name: "insert", sql: "insert into coupons values (1, 'WELCOME')", expected: "ecommerce_80$"},
+		{
+			name:     "insert selecting unsharded and reference tables of the same shard",
+			sql:      "insert into coupons (promotion_id, code) select p.id, c.name from promotions p join categories c on c.id = p.category_id",
+			expected: "ecommerce_80$",
+		},
+		{name: "update", sql: "update jobs set done = true where id = 1", expected: "ecommerce_$80"},
+		{
+			name: "delete reading a sharded table",
+			sql:  "delete from coupons where promotion_id in (select promotion_id from orders)",
+			err:  "cannot read sharded table orders in a statement writing to unsharded table coupons",
+		},
+		{
+			name: "insert selecting an unsharded table of another shard",
+			sql:  "insert into jobs (id) select id from promotions",
+			err:  "cannot read unsharded table promotions of shard ecommerce_80$ in a statement writing to unsharded table jobs of shard ecommerce_$80",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmts, err := engine.NewParser().Parse(strings.NewReader(tt.sql))
+			if err != nil {
+				t.Fatalf("cannot parse %s: %v", tt.sql, err)
+			}
+			stmt := stmts[0].Raw.Stmt
+			resolveRelations(stmt, testVschema, []string{defaultSchema})
+			var table *Table
+			for _, relation := range statementRelations(stmt) {
+				if table = testVschema.GetTable(relation); table != nil {
+					break
+				}
+			}
+			shard, err := unshardedStmtShard(stmt, table, cluster, testVschema)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %s, observed %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if shard.Name != tt.expected {
+				t.Fatalf("expected shard %s, observed %s", tt.expected, shard.Name)
+			}
+		})
+	}
+}
+
+func TestUnshardedSelectRoute(t *testing.T) {
+	cluster := testCluster(t)
+	mock := &PGMock{logger: log.NewNopLogger()}
+	tests := []struct {
+		name string
+		sql  string
+		err  string
+	}{
+		{
+			name: "join of unsharded tables of different shards",
+			sql:  "select * from promotions join jobs on jobs.promotion_id = promotions.id",
+			err:  "cannot execute statement joining unsharded tables promotions and jobs, stored on shards ecommerce_80$ and ecommerce_$80",
+		},
+		{
+			name: "join of unsharded and sharded tables whose rows could live on every shard",
+			sql:  "select * from promotions join orders on orders.promotion_id = promotions.id",
+			err:  "cannot execute select statement joining unsharded table promotions, stored on shard ecommerce_80$, with sharded tables whose rows could live on 2 shards",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := mock.planSelectRoute(parseSelectStmt(t, tt.sql), cluster, testVschema, nil)
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("expected error %s, observed %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestAssignUnshardedShards(t *testing.T) {
+	cluster := testCluster(t)
+	vschema := &Vschema{Keyspace: "ecommerce", Tables: []Table{
+		{Name: "promotions", Type: Unsharded},
+		{Name: "jobs", Type: Unsharded, Shard: "ecommerce_80$"},
+		{Name: "coupons", Type: Unsharded, Shard: "ecommerce_40$"},
+	}}
+	err := assignUnshardedShards(cluster, vschema)
+	validationErr, ok := err.(*ValidationError)
+	expected := []string{"tables[2] (coupons).shard: unknown shard ecommerce_40$, shards are ecommerce_$80, ecommerce_80$"}
+	if !ok || !reflect.DeepEqual(validationErr.Problems, expected) {
+		t.Fatalf("expected problems %v, observed %v", expected, err)
+	}
+	if vschema.Tables[0].Shard != "ecommerce_$80" || vschema.Tables[1].Shard != "ecommerce_80$" {
+		t.Fatalf("expected unsharded tables to be assigned to their shard, observed %+v", vschema.Tables)
+	}
+}
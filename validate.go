@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ValidationError lists the problems found in a vschema file. Each problem starts with the path of the offending
+// field, tables being identified by their index and name, e.g. tables[3] (product).vindexes[0].type.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid vschema: " + e.Problems[0]
+	}
+	return fmt.Sprintf("invalid vschema, %d problems:\n  %s", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// validation collects the problems found while validating a vschema.
+type validation struct {
+	problems []string
+}
+
+func (v *validation) addf(path, format string, args ...interface{}) {
+	if path == "" {
+		path = "vschema"
+	}
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validation) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+// fieldPath returns the path of a field of the object at path.
+func fieldPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// parseVschema decodes and validates the content of a vschema file. Unknown fields and values of the wrong type are
+// reported with their path before the vschema is decoded, then the vschema is checked with Validate.
+func parseVschema(data []byte) (*Vschema, error) {
+	var raw interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			// the offset follows the invalid character
+			line, column := textPosition(data, syntaxErr.Offset-1)
+			return nil, fmt.Errorf("cannot decode content of vschema file at line %d, column %d: %w", line, column, err)
+		}
+		return nil, fmt.Errorf("cannot decode content of vschema file: %w", err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("cannot decode content of vschema file: unexpected content after the vschema")
+	}
+	var v validation
+	checkFields(&v, "", raw, reflect.TypeOf(Vschema{}))
+	var vschema Vschema
+	if err := json.Unmarshal(data, &vschema); err != nil {
+		if len(v.problems) > 0 {
+			return nil, v.err()
+		}
+		return nil, fmt.Errorf("cannot decode content of vschema file: %w", err)
+	}
+	if err := vschema.Validate(); err != nil {
+		v.problems = append(v.problems, err.(*ValidationError).Problems...)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return &vschema, nil
+}
+
+// textPosition returns the line and column, starting from 1, of the byte at offset in a text.
+func textPosition(data []byte, offset int64) (line, column int) {
+	if offset < 0 {
+		offset = 0
+	} else if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// jsonFieldName returns the name of a struct field in JSON documents: the name of its json tag,
+// or the name of the field. Fields ignored by encoding/json return an empty name.
+func jsonFieldName(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	if tag == "-" || field.PkgPath != "" {
+		return ""
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
+
+// checkFields reports the fields of a decoded JSON value which are unknown to the Go type it is decoded into,
+// and the values which cannot be decoded into the type of their field. Field names are matched case insensitively,
+// as encoding/json does.
+func checkFields(v *validation, path string, value interface{}, typ reflect.Type) {
+	if value == nil {
+		return
+	}
+	switch typ.Kind() {
+	case reflect.Ptr:
+		checkFields(v, path, value, typ.Elem())
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			v.addf(path, "expected an object, got %s", jsonKind(value))
+			return
+		}
+		fields := make(map[string]reflect.StructField)
+		var names []string
+		for i := 0; i < typ.NumField(); i++ {
+			if name := jsonFieldName(typ.Field(i)); name != "" {
+				fields[strings.ToLower(name)] = typ.Field(i)
+				names = append(names, strings.ToLower(name))
+			}
+		}
+		for _, key := range sortedKeys(object) {
+			field, ok := fields[strings.ToLower(key)]
+			if !ok {
+				v.addf(path, "unknown field %q, fields are %s", key, strings.Join(names, ", "))
+				continue
+			}
+			checkFields(v, fieldPath(path, strings.ToLower(key)), object[key], field.Type)
+		}
+	case reflect.Slice:
+		array, ok := value.([]interface{})
+		if !ok {
+			v.addf(path, "expected an array, got %s", jsonKind(value))
+			return
+		}
+		for i, item := range array {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			if typ.Elem() == reflect.TypeOf(Table{}) {
+				if object, ok := item.(map[string]interface{}); ok {
+					if name, ok := object["name"].(string); ok {
+						itemPath = fmt.Sprintf("%s (%s)", itemPath, name)
+					}
+				}
+			}
+			checkFields(v, itemPath, item, typ.Elem())
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			v.addf(path, "expected an object, got %s", jsonKind(value))
+			return
+		}
+		for _, key := range sortedKeys(object) {
+			checkFields(v, fieldPath(path, key), object[key], typ.Elem())
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			v.addf(path, "expected a string, got %s", jsonKind(value))
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			v.addf(path, "expected a boolean, got %s", jsonKind(value))
+		}
+	case reflect.Int, reflect.Int64:
+		if number, ok := value.(json.Number); !ok {
+			v.addf(path, "expected an integer, got %s", jsonKind(value))
+		} else if _, err := number.Int64(); err != nil {
+			v.addf(path, "expected an integer, got %s", number)
+		}
+	}
+}
+
+// sortedKeys returns the keys of a decoded JSON object in order, so that problems are reported in the same order.
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonKind returns the kind of a decoded JSON value, as shown in validation errors.
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		return "a number"
+	}
+	return "null"
+}
+
+// Validate checks the vschema is consistent: tables are declared once with a valid type, sharded tables have exactly
+// one primary vindex and reference and unsharded tables none, vindexes have columns and only use the fields of their type.
+// All the problems found are returned in a ValidationError.
+func (vs *Vschema) Validate() error {
+	var v validation
+	if vs.Keyspace == "" {
+		v.addf("keyspace", "missing, the keyspace names the databases of the shards")
+	}
+	declared := make(map[string]string)
+	for i := range vs.Tables {
+		t := &vs.Tables[i]
+		path := fmt.Sprintf("tables[%d] (%s)", i, t.Name)
+		if t.Name == "" {
+			v.addf(fmt.Sprintf("tables[%d]", i), "missing name")
+			continue
+		}
+		if previous, ok := declared[t.Key()]; ok {
+			v.addf(path, "duplicate table %s, already declared by %s", t.Key(), previous)
+			continue
+		}
+		declared[t.Key()] = path
+		if err := t.Type.IsValid(); err != nil {
+			v.addf(path+".type", "%s, must be %s, %s or %s", invalidValue(string(t.Type)), Sharded, Reference, Unsharded)
+			continue
+		}
+		if t.Shard != "" && t.Type != Unsharded {
+			v.addf(path+".shard", "only for unsharded tables")
+		}
+		if t.Type == Reference || t.Type == Unsharded {
+			if len(t.VIndexes) > 0 {
+				placement := "are copied on every shard"
+				if t.Type == Unsharded {
+					placement = "live on a single shard"
+				}
+				v.addf(path+".vindexes", "%s tables %s and cannot have vindexes", t.Type, placement)
+			}
+			if len(t.ColumnTypes) > 0 {
+				v.addf(path+".column_types", "only for sharded tables")
+			}
+			if t.Sequence != nil {
+				v.addf(path+".sequence", "only for sharded tables")
+			}
+			continue
+		}
+		vs.validateShardedTable(&v, path, t)
+	}
+	return v.err()
+}
+
+// validateShardedTable checks the vindexes, column types and sequence of a sharded table.
+func (vs *Vschema) validateShardedTable(v *validation, path string, t *Table) {
+	primary := -1
+	for i, index := range t.VIndexes {
+		indexPath := fmt.Sprintf("%s.vindexes[%d]", path, i)
+		if len(index.Columns) == 0 {
+			v.addf(indexPath+".columns", "missing, a vindex has at least one column")
+		}
+		for j, column := range index.Columns {
+			if column == "" {
+				v.addf(fmt.Sprintf("%s.columns[%d]", indexPath, j), "empty column name")
+			} else if stringArrayContainsValue(index.Columns[:j], column) != -1 {
+				v.addf(fmt.Sprintf("%s.columns[%d]", indexPath, j), "duplicate column %s", column)
+			}
+		}
+		if err := index.Type.IsValid(); err != nil {
+			v.addf(indexPath+".type", "%s, must be %s or %s", invalidValue(string(index.Type)), Primary, Secondary)
+			continue
+		}
+		if index.Type == Primary {
+			if primary != -1 {
+				v.addf(indexPath, "second primary vindex, already declared by vindexes[%d]", primary)
+			}
+			primary = i
+			vs.validatePrimaryVIndex(v, indexPath, index)
+			continue
+		}
+		if index.References != nil {
+			v.addf(indexPath+".references", "only for primary vindexes")
+		}
+		if index.Function != "" {
+			v.addf(indexPath+".function", "only for primary vindexes")
+		}
+		if index.Lookup != nil && index.Lookup.Table == "" {
+			v.addf(indexPath+".lookup.table", "missing, the name of the lookup table")
+		}
+	}
+	if primary == -1 {
+		v.addf(path+".vindexes", "missing primary vindex, sharded tables must have exactly one")
+	}
+	columns := make([]string, 0, len(t.ColumnTypes))
+	for column := range t.ColumnTypes {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		if t.ColumnTypes[column] == "" {
+			v.addf(path+".column_types."+column, "empty type")
+		}
+	}
+	if t.Sequence != nil {
+		if t.Sequence.Column == "" {
+			v.addf(path+".sequence.column", "missing, the column filled with the values of the sequence")
+		}
+		if t.Sequence.BlockSize < 0 {
+			v.addf(path+".sequence.block_size", "must be positive, got %d", t.Sequence.BlockSize)
+		}
+	}
+}
+
+// validatePrimaryVIndex checks the function and references of a primary vindex.
+func (vs *Vschema) validatePrimaryVIndex(v *validation, path string, index VIndex) {
+	if index.Lookup != nil {
+		v.addf(path+".lookup", "only for secondary vindexes")
+	}
+	f, err := GetVIndexFunction(index.Function)
+	if err != nil {
+		v.addf(path+".function", "%s", err)
+	} else if _, ok := f.(numericFunction); ok && len(index.Columns) > 1 {
+		v.addf(path+".function", "%s requires a single integer column, got %d columns", f.Name(), len(index.Columns))
+	}
+	if r := index.References; r != nil {
+		if stringArrayContainsValue(index.Columns, r.Column) == -1 {
+			v.addf(path+".references.column", "%q is not a column of the vindex", r.Column)
+		}
+		external := vs.GetTable(r.ExternalTable)
+		if external == nil {
+			v.addf(path+".references.external_table", "unknown table %q", r.ExternalTable)
+		}
+		if r.ExternalColumn == "" {
+			v.addf(path+".references.external_column", "missing, the referenced column of the external table")
+		} else if external != nil {
+			// Only references to a primary vindex mapping values the same way co-locate the rows, see IsColocatedJoin
+			externalVIndex := external.GetPrimaryVIndex()
+			if len(externalVIndex.Columns) != 1 || externalVIndex.Columns[0] != r.ExternalColumn {
+				v.addf(path+".references.external_column", "%q is not the single column primary vindex of table %s, rows would not be co-located",
+					r.ExternalColumn, r.ExternalTable)
+			} else if ef, err := GetVIndexFunction(externalVIndex.Function); f != nil && err == nil && ef.Name() != f.Name() {
+				v.addf(path+".references", "the function %s differs from the function %s of the primary vindex of table %s, rows would not be co-located",
+					f.Name(), ef.Name(), r.ExternalTable)
+			}
+		}
+	}
+}
+
+// invalidValue describes an invalid value of an enumerated field in validation errors.
+func invalidValue(value string) string {
+	if value == "" {
+		return "missing"
+	}
+	return fmt.Sprintf("invalid value %q", value)
+}
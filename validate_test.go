@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVschema(t *testing.T) {
+	tests := []struct {
+		name     string
+		vschema  string
+		problems []string
+		err      string
+	}{
+		{
+			name: "valid",
+			vschema: `{"keyspace": "ecommerce", "tables": [
+				{"name": "members", "type": "sharded", "column_types": {"id": "bigint"}, "vindexes": [
+					{"columns": ["id"], "type": "primary", "function": "identity"},
+					{"columns": ["email"], "type": "secondary", "lookup": {"table": "members_email_lookup", "unique": true}}
+				]},
+				{"name": "orders", "schema": "sales", "type": "sharded", "sequence": {"column": "id", "block_size": 100}, "vindexes": [
+					{"columns": ["member_id"], "type": "primary", "function": "identity", "references": {"column": "member_id", "external_table": "members", "external_column": "id"}}
+				]},
+				{"name": "categories", "type": "reference"},
+				{"name": "jobs", "type": "unsharded", "shard": "ecommerce_80$"}
+			]}`,
+		},
+		{
+			name: "references",
+			vschema: `{"keyspace": "ecommerce", "tables": [
+				{"name": "members", "type": "sharded", "vindexes": [{"columns": ["id"], "type": "primary", "function": "xxhash"}]},
+				{"name": "orders", "type": "sharded", "vindexes": [
+					{"columns": ["member_id"], "type": "primary", "references": {"column": "member_id", "external_table": "members", "external_column": "id"}}
+				]},
+				{"name": "payments", "type": "sharded", "vindexes": [
+					{"columns": ["member_email"], "type": "primary", "function": "xxhash", "references": {"column": "member_email", "external_table": "members", "external_column": "email"}}
+				]},
+				{"name": "refunds", "type": "sharded", "vindexes": [
+					{"columns": ["category_id"], "type": "primary", "references": {"column": "category_id", "external_table": "categories", "external_column": "id"}}
+				]},
+				{"name": "categories", "type": "reference"}
+			]}`,
+			problems: []string{
+				`tables[1] (orders).vindexes[0].references: the function crc64 differs from the function xxhash of the primary vindex of table members, rows would not be co-located`,
+				`tables[2] (payments).vindexes[0].references.external_column: "email" is not the single column primary vindex of table members, rows would not be co-located`,
+				`tables[3] (refunds).vindexes[0].references.external_column: "id" is not the single column primary vindex of table categories, rows would not be co-located`,
+			},
+		},
+		{
+			name: "unknown fields",
+			vschema: `{"keyspace": "ecommerce", "backends": [], "tables": [
+				{"name": "product", "type": "sharded", "vindexes": [{"columns": ["id"], "name": "primary"}]}
+			]}`,
+			problems: []string{
+				`vschema: unknown field "backends", fields are keyspace, tables`,
+				`tables[0] (product).vindexes[0]: unknown field "name", fields are columns, type, references, function, lookup`,
+				`tables[0] (product).vindexes[0].type: missing, must be primary or secondary`,
+				`tables[0] (product).vindexes: missing primary vindex, sharded tables must have exactly one`,
+			},
+		},
+		{
+			name: "wrong types",
+			vschema: `{"keyspace": "ecommerce", "tables": [
+				{"name": "orders", "type": "sharded", "sequence": {"column": "id", "block_size": 1.5}, "vindexes": [{"columns": "id", "type": "primary"}]}
+			]}`,
+			problems: []string{
+				`tables[0] (orders).sequence.block_size: expected an integer, got 1.5`,
+				`tables[0] (orders).vindexes[0].columns: expected an array, got a string`,
+			},
+		},
+		{
+			name: "tables",
+			vschema: `{"tables": [
+				{"type": "sharded"},
+				{"name": "members", "type": "sharded", "vindexes": [{"columns": ["id"], "type": "primary"}]},
+				{"name": "members", "type": "reference"},
+				{"name": "orders", "type": "partitioned"},
+				{"name": "categories", "type": "reference", "column_types": {"id": "uuid"}, "vindexes": [{"columns": ["id"], "type": "primary"}]},
+				{"name": "jobs", "type": "unsharded", "vindexes": [{"columns": ["id"], "type": "primary"}]},
+				{"name": "coupons", "type": "reference", "shard": "ecommerce_80$"}
+			]}`,
+			problems: []string{
+				`keyspace: missing, the keyspace names the databases of the shards`,
+				`tables[0]: missing name`,
+				`tables[2] (members): duplicate table members, already declared by tables[1] (members)`,
+				`tables[3] (orders).type: invalid value "partitioned", must be sharded, reference or unsharded`,
+				`tables[4] (categories).vindexes: reference tables are copied on every shard and cannot have vindexes`,
+				`tables[4] (categories).column_types: only for sharded tables`,
+				`tables[5] (jobs).vindexes: unsharded tables live on a single shard and cannot have vindexes`,
+				`tables[6] (coupons).shard: only for unsharded tables`,
+			},
+		},
+		{
+			name: "vindexes",
+			vschema: `{"keyspace": "ecommerce", "tables": [
+				{"name": "orders", "type": "sharded", "sequence": {"block_size": -1}, "vindexes": [
+					{"columns": ["id", "region"], "type": "primary", "function": "identity", "lookup": {"table": "orders_lookup"}},
+					{"columns": ["id"], "type": "primary", "function": "md5", "references": {"column": "member_id", "external_table": "members"}},
+					{"columns": [], "type": "secondary", "function": "crc64"},
+					{"columns": ["email", "email", ""], "type": "unique", "lookup": {}},
+					{"columns": ["email"], "type": "secondary", "lookup": {}}
+				]}
+			]}`,
+			problems: []string{
+				`tables[0] (orders).vindexes[0].lookup: only for secondary vindexes`,
+				`tables[0] (orders).vindexes[0].function: identity requires a single integer column, got 2 columns`,
+				`tables[0] (orders).vindexes[1]: second primary vindex, already declared by vindexes[0]`,
+				`tables[0] (orders).vindexes[1].function: unknown vindex function md5, functions are crc64, identity, reverse_bits, sha1, xxhash`,
+				`tables[0] (orders).vindexes[1].references.column: "member_id" is not a column of the vindex`,
+				`tables[0] (orders).vindexes[1].references.external_table: unknown table "members"`,
+				`tables[0] (orders).vindexes[1].references.external_column: missing, the referenced column of the external table`,
+				`tables[0] (orders).vindexes[2].columns: missing, a vindex has at least one column`,
+				`tables[0] (orders).vindexes[2].function: only for primary vindexes`,
+				`tables[0] (orders).vindexes[3].columns[1]: duplicate column email`,
+				`tables[0] (orders).vindexes[3].columns[2]: empty column name`,
+				`tables[0] (orders).vindexes[3].type: invalid value "unique", must be primary or secondary`,
+				`tables[0] (orders).vindexes[4].lookup.table: missing, the name of the lookup table`,
+				`tables[0] (orders).sequence.column: missing, the column filled with the values of the sequence`,
+				`tables[0] (orders).sequence.block_size: must be positive, got -1`,
+			},
+		},
+		{
+			name:    "syntax error",
+			vschema: "{\"keyspace\": \"ecommerce\",\n  \"tables\": [}",
+			err:     "at line 2, column 14",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vschema, err := parseVschema([]byte(tt.vschema))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %s, observed %v", tt.err, err)
+				}
+				return
+			}
+			if tt.problems == nil {
+				if err != nil {
+					t.Fatalf("expected test to succeed, got error %v", err)
+				}
+				if vschema == nil || len(vschema.Tables) == 0 {
+					t.Fatalf("expected a vschema, observed %+v", vschema)
+				}
+				return
+			}
+			validationErr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("expected a validation error, observed %v", err)
+			}
+			if !reflect.DeepEqual(validationErr.Problems, tt.problems) {
+				t.Fatalf("expected problems\n%s\nobserved\n%s", strings.Join(tt.problems, "\n"), strings.Join(validationErr.Problems, "\n"))
+			}
+		})
+	}
+}
+
+func TestVschemaCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if status := vschemaCommand([]string{"validate", "vschema.json", "examples/vschema.json"}, &stdout, &stderr); status != 0 {
+		t.Fatalf("expected the vschema files to be valid, observed status %d: %s", status, stderr.String())
+	}
+	if expected := "vschema.json: valid\nexamples/vschema.json: valid\n"; stdout.String() != expected {
+		t.Fatalf("expected output %q, observed %q", expected, stdout.String())
+	}
+	stdout.Reset()
+	if status := vschemaCommand([]string{"validate", "-vschema", "missing.json"}, &stdout, &stderr); status != 1 {
+		t.Fatalf("expected status 1 for a missing vschema file, observed %d", status)
+	}
+	stdout.Reset()
+	if status := vschemaCommand([]string{"generate", "-keyspace", "ecommerce", "examples/schema.sql"}, &stdout, &stderr); status != 0 {
+		t.Fatalf("expected the vschema to be generated, observed status %d: %s", status, stderr.String())
+	}
+	if _, err := parseVschema(stdout.Bytes()); err != nil {
+		t.Fatalf("expected the generated vschema to be valid, observed %v", err)
+	}
+	if status := vschemaCommand([]string{"lint"}, &stdout, &stderr); status != 2 {
+		t.Fatalf("expected status 2 for an unknown command, observed %d", status)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VIndexFunction maps the values of a primary vindex to keyspace ids, which select the shard owning a row.
+// Every function is unique: a value always maps to a single keyspace id, so that rows are routed to a single shard.
+// Values are the normalised values of the vindex columns of a row, joined with &, as returned by Table.KeyspaceId.
+type VIndexFunction interface {
+	// Name returns the name of the function in the vschema, e.g. crc64.
+	Name() string
+	// Map returns the keyspace id of each value.
+	Map(values []string) ([]uint64, error)
+}
+
+// defaultVIndexFunction is the function of the primary vindexes which don't declare one.
+const defaultVIndexFunction = "crc64"
+
+// vindexFunctions are the functions which can be selected with the function field of a primary vindex.
+var vindexFunctions = map[string]VIndexFunction{
+	"crc64":        hashFunction{name: "crc64", hash: keyspaceIdChecksum},
+	"xxhash":       hashFunction{name: "xxhash", hash: func(value string) uint64 { return xxhash64([]byte(value)) }},
+	"sha1":         hashFunction{name: "sha1", hash: sha1Checksum},
+	"identity":     numericFunction{name: "identity"},
+	"reverse_bits": numericFunction{name: "reverse_bits", transform: bits.Reverse64},
+}
+
+// GetVIndexFunction returns the vindex function with the given name, or the default function when name is empty.
+func GetVIndexFunction(name string) (VIndexFunction, error) {
+	if name == "" {
+		name = defaultVIndexFunction
+	}
+	f, ok := vindexFunctions[name]
+	if !ok {
+		var names []string
+		for n := range vindexFunctions {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown vindex function %s, functions are %s", name, strings.Join(names, ", "))
+	}
+	return f, nil
+}
+
+// MapKeyspaceId returns the keyspace id of a row, from the value returned by KeyspaceId, with the function
+// of the primary vindex of the table.
+func (t *Table) MapKeyspaceId(value string) (uint64, error) {
+	f, err := GetVIndexFunction(t.GetPrimaryVIndex().Function)
+	if err != nil {
+		return 0, fmt.Errorf("invalid primary vindex of table %s: %w", t.Key(), err)
+	}
+	keyspaceIds, err := f.Map([]string{value})
+	if err != nil {
+		return 0, fmt.Errorf("cannot map value %s of the primary vindex of table %s: %w", value, t.Key(), err)
+	}
+	return keyspaceIds[0], nil
+}
+
+// SameKeyspaceIds reports whether equal values of a primary vindex column of two tables produce the same keyspace id,
+// so that rows sharing these values live on the same shard: both primary vindexes must use the same function, and
+// the values of both columns must be normalised the same way, see normaliseValue.
+func SameKeyspaceIds(left *Table, leftColumn string, right *Table, rightColumn string) bool {
+	leftFunction, err := GetVIndexFunction(left.GetPrimaryVIndex().Function)
+	if err != nil {
+		return false
+	}
+	rightFunction, err := GetVIndexFunction(right.GetPrimaryVIndex().Function)
+	if err != nil {
+		return false
+	}
+	return leftFunction.Name() == rightFunction.Name() &&
+		typeCategory(left.ColumnTypes[leftColumn]) == typeCategory(right.ColumnTypes[rightColumn])
+}
+
+// GetShardForTable returns the shard owning a row of a table, from the value returned by Table.KeyspaceId.
+func (c *Cluster) GetShardForTable(table *Table, value string) (*Shard, error) {
+	keyspaceId, err := table.MapKeyspaceId(value)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetShardForChecksum(keyspaceId)
+}
+
+// hashFunction maps values to keyspace ids with a hash function, spreading rows evenly across shards.
+type hashFunction struct {
+	name string
+	hash func(value string) uint64
+}
+
+func (f hashFunction) Name() string { return f.name }
+
+func (f hashFunction) Map(values []string) ([]uint64, error) {
+	keyspaceIds := make([]uint64, len(values))
+	for i, value := range values {
+		keyspaceIds[i] = f.hash(value)
+	}
+	return keyspaceIds, nil
+}
+
+// numericFunction maps integer values to keyspace ids, optionally transformed, e.g. with their bits reversed.
+// With identity, consecutive values live on the same shard, so it is best suited to values already spread
+// across the 64 bits space. reverse_bits spreads consecutive values across shards.
+type numericFunction struct {
+	name      string
+	transform func(uint64) uint64
+}
+
+func (f numericFunction) Name() string { return f.name }
+
+func (f numericFunction) Map(values []string) ([]uint64, error) {
+	keyspaceIds := make([]uint64, len(values))
+	for i, value := range values {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			signed, serr := strconv.ParseInt(value, 10, 64)
+			if serr != nil {
+				return nil, fmt.Errorf("vindex function %s requires a single integer column, got value %s", f.name, value)
+			}
+			n = uint64(signed)
+		}
+		if f.transform != nil {
+			n = f.transform(n)
+		}
+		keyspaceIds[i] = n
+	}
+	return keyspaceIds, nil
+}
+
+// sha1Checksum returns the first 64 bits of the SHA-1 digest of a value.
+func sha1Checksum(value string) uint64 {
+	sum := sha1.Sum([]byte(value))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 returns the XXH64 digest of b with a zero seed.
+// See https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md
+func xxhash64(b []byte) uint64 {
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		v1, v2, v3, v4 := xxPrime1, xxPrime2, uint64(0), uint64(0)
+		v1 += xxPrime2
+		v4 -= xxPrime1
+		for len(b) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+			b = b[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		for _, v := range []uint64{v1, v2, v3, v4} {
+			h ^= xxRound(0, v)
+			h = h*xxPrime1 + xxPrime4
+		}
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b[:8]))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b[:4])) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
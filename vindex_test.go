@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestXxhash64(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected uint64
+	}{
+		{input: "", expected: 0xef46db3751d8e999},
+		{input: "a", expected: 0xd24ec4f1a98c6e5b},
+		{input: "abc", expected: 0x44bc2cf5ad770999},
+		{input: "Nobody inspects the spammish repetition", expected: 0xfbcea83c8a378bf1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if observed := xxhash64([]byte(tt.input)); observed != tt.expected {
+				t.Fatalf("expected %016x, observed %016x", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestVIndexFunctionMap(t *testing.T) {
+	tests := []struct {
+		function string
+		value    string
+		expected uint64
+		err      bool
+	}{
+		{function: "", value: "a", expected: keyspaceIdChecksum("a")},
+		{function: "crc64", value: "a", expected: keyspaceIdChecksum("a")},
+		{function: "xxhash", value: "a", expected: 0xd24ec4f1a98c6e5b},
+		{function: "sha1", value: "abc", expected: 0xa9993e364706816a},
+		{function: "identity", value: "42", expected: 42},
+		{function: "identity", value: "-1", expected: 0xffffffffffffffff},
+		{function: "identity", value: "a", err: true},
+		{function: "identity", value: "1&2", err: true},
+		{function: "reverse_bits", value: "1", expected: 0x8000000000000000},
+		{function: "md5", value: "a", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.function+" "+tt.value, func(t *testing.T) {
+			table := &Table{Name: "orders", Type: Sharded, VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary, Function: tt.function}}}
+			observed, err := table.MapKeyspaceId(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, test succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if observed != tt.expected {
+				t.Fatalf("expected %016x, observed %016x", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestGetShardForTable(t *testing.T) {
+	cluster := testCluster(t)
+	table := &Table{Name: "orders", Type: Sharded, VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary, Function: "reverse_bits"}}}
+	// consecutive values are spread across shards by reversing their bits
+	for value, expected := range map[string]*Shard{"2": cluster.Shards[0], "1": cluster.Shards[1], "3": cluster.Shards[1]} {
+		observed, err := cluster.GetShardForTable(table, value)
+		if err != nil {
+			t.Fatalf("expected test to succeed, got error %v", err)
+		}
+		if observed != expected {
+			t.Fatalf("expected shard %s for value %s, observed %s", expected.Name, value, observed.Name)
+		}
+	}
+}
+
+func TestGetShardForTableMaxKeyspaceId(t *testing.T) {
+	cluster := testCluster(t)
+	// -1 is mapped to the last keyspace id, owned by the last shard
+	for _, function := range []string{"identity", "reverse_bits"} {
+		table := &Table{Name: "orders", Type: Sharded, VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary, Function: function}}}
+		observed, err := cluster.GetShardForTable(table, "-1")
+		if err != nil {
+			t.Fatalf("expected test to succeed with function %s, got error %v", function, err)
+		}
+		if expected := cluster.Shards[len(cluster.Shards)-1]; observed != expected {
+			t.Fatalf("expected shard %s with function %s, observed %s", expected.Name, function, observed.Name)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/ast/pg"
+	"github.com/vgheri/matriarch/parser/sql/astutils"
+)
+
+// volatileFunctions are the functions returning a different value on each shard, even when called by the
+// same statement: writes to reference tables using them would make the copies of the table diverge.
+var volatileFunctions = map[string]bool{
+	"clock_timestamp":       true,
+	"current_database":      true,
+	"currval":               true,
+	"gen_random_uuid":       true,
+	"inet_server_addr":      true,
+	"inet_server_port":      true,
+	"lastval":               true,
+	"nextval":               true,
+	"now":                   true,
+	"pg_backend_pid":        true,
+	"pg_current_xact_id":    true,
+	"random":                true,
+	"setseed":               true,
+	"setval":                true,
+	"statement_timestamp":   true,
+	"timeofday":             true,
+	"transaction_timestamp": true,
+	"txid_current":          true,
+	"uuid_generate_v1":      true,
+	"uuid_generate_v1mc":    true,
+	"uuid_generate_v4":      true,
+}
+
+// Operations of SQLValueFunction nodes, in the order of PostgreSQL. The operations up to
+// sqlValueFunctionLocalTimestampN return the start time of the transaction, which differs between shards.
+const (
+	sqlValueFunctionLocalTimestampN pg.SQLValueFunctionOp = 8
+	sqlValueFunctionCurrentCatalog  pg.SQLValueFunctionOp = 13
+)
+
+// volatileExpression returns the first expression of a statement whose value could differ between shards,
+// e.g. now(), or an empty string when the statement has none.
+func volatileExpression(stmt ast.Node) string {
+	for _, node := range astutils.Search(stmt, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FuncCall:
+			return n.Func != nil && volatileFunctions[strings.ToLower(n.Func.Name)]
+		case *pg.SQLValueFunction:
+			return n.Op <= sqlValueFunctionLocalTimestampN || n.Op == sqlValueFunctionCurrentCatalog
+		}
+		return false
+	}).Items {
+		if n, ok := node.(*ast.FuncCall); ok {
+			return n.Func.Name + "()"
+		}
+		return "the current time or database"
+	}
+	return ""
+}
+
+// columnDefault is the default value of a column, as declared in a shard.
+type columnDefault struct {
+	Column     string
+	Expression string
+}
+
+// volatileDefaults returns the columns of a table whose default value could differ between shards,
+// i.e. identity columns and columns whose default calls a volatile function, such as serial columns.
+// The definition of the table is read from the first shard, as reference tables are identical on every shard.
+func volatileDefaults(ctx context.Context, table *Table, cluster *Cluster) ([]columnDefault, error) {
+	sql := fmt.Sprintf("SELECT a.attname, coalesce(pg_get_expr(d.adbin, d.adrelid), ''), a.attidentity <> '' "+
+		"FROM pg_attribute a LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum "+
+		"WHERE a.attrelid = to_regclass(%s) AND a.attnum > 0 AND NOT a.attisdropped "+
+		"AND (d.adbin IS NOT NULL OR a.attidentity <> '')",
+		quoteLiteral(quoteIdentifier(table.SchemaName())+"."+quoteIdentifier(table.Name)))
+	result, err := queryShards(ctx, cluster.Shards[:1], sql)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read column defaults of table %s: %w", table.Key(), err)
+	}
+	var defaults []columnDefault
+	for _, row := range result.Rows {
+		column, expression, identity := string(row[0]), string(row[1]), string(row[2]) == "t"
+		if identity {
+			defaults = append(defaults, columnDefault{Column: column, Expression: "GENERATED AS IDENTITY"})
+			continue
+		}
+		s, err := parseSelectText("SELECT " + expression)
+		if err != nil || volatileExpression(s) != "" {
+			defaults = append(defaults, columnDefault{Column: column, Expression: expression})
+		}
+	}
+	return defaults, nil
+}
+
+// defaultedColumns returns the columns given their default value by an INSERT or UPDATE statement:
+// the columns set to DEFAULT and, for INSERT statements, the columns missing from the column list.
+// all is true when the default value of every column not in listed is used.
+func defaultedColumns(stmt ast.Node) (listed, defaulted []string, all bool) {
+	switch s := stmt.(type) {
+	case *pg.InsertStmt:
+		if !isEmptyList(s.Cols) {
+			for _, item := range s.Cols.Items {
+				listed = append(listed, *item.(*pg.ResTarget).Name)
+			}
+		}
+		if ss, ok := s.SelectStmt.(*pg.SelectStmt); ok && !isEmptyList(ss.ValuesLists) {
+			for _, row := range ss.ValuesLists.Items {
+				values, ok := row.(*ast.List)
+				if !ok {
+					continue
+				}
+				for i, v := range values.Items {
+					if _, ok := v.(*pg.SetToDefault); ok && i < len(listed) {
+						defaulted = append(defaulted, listed[i])
+					}
+				}
+			}
+		}
+		return listed, defaulted, true
+	case *pg.UpdateStmt:
+		for _, item := range s.TargetList.Items {
+			if target, ok := item.(*pg.ResTarget); ok && target.Name != nil {
+				if _, ok := target.Val.(*pg.SetToDefault); ok {
+					defaulted = append(defaulted, *target.Name)
+				}
+			}
+		}
+	}
+	return nil, defaulted, false
+}
+
+// checkReplicatedStmt returns an error when a statement writing to a reference table could write different rows
+// on each shard, because it uses volatile expressions or volatile column defaults.
+func checkReplicatedStmt(ctx context.Context, stmt ast.Node, table *Table, cluster *Cluster) error {
+	if expr := volatileExpression(stmt); expr != "" {
+		return fmt.Errorf("cannot write to reference table %s with %s, as each shard would compute a different value. "+
+			"Compute the value in the application instead", table.Key(), expr)
+	}
+	listed, defaulted, all := defaultedColumns(stmt)
+	if !all && len(defaulted) == 0 {
+		return nil
+	}
+	defaults, err := volatileDefaults(ctx, table, cluster)
+	if err != nil {
+		return err
+	}
+	for _, d := range defaults {
+		if stringArrayContainsValue(defaulted, d.Column) != -1 || (all && stringArrayContainsValue(listed, d.Column) == -1) {
+			return fmt.Errorf("cannot write to reference table %s without a value for column %s, "+
+				"as each shard would compute a different default value with %s", table.Key(), d.Column, d.Expression)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vgheri/matriarch/parser/engine"
+)
+
+func TestVolatileExpression(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected string
+	}{
+		{sql: "insert into categories (id, name) values (1, 'books')"},
+		{sql: "insert into categories (id, name) values (1, upper('books'))"},
+		{sql: "insert into categories (id, created_at) values (1, now())", expected: "now()"},
+		{sql: "insert into categories (id) values (gen_random_uuid())", expected: "gen_random_uuid()"},
+		{sql: "insert into categories (id) select nextval('categories_id_seq')", expected: "nextval()"},
+		{sql: "update categories set created_at = current_timestamp", expected: "the current time or database"},
+		{sql: "update categories set name = current_user"},
+		{sql: "delete from categories where random() < 0.5", expected: "random()"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			stmts, err := engine.NewParser().Parse(strings.NewReader(tt.sql))
+			if err != nil {
+				t.Fatalf("cannot parse %s: %v", tt.sql, err)
+			}
+			if observed := volatileExpression(stmts[0].Raw.Stmt); observed != tt.expected {
+				t.Fatalf("expected volatile expression %q, observed %q", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestCheckReplicatedStmt(t *testing.T) {
+	cluster, shards := startFakeShards(t, "ecommerce", 2, func(shard, sql string) fakeResult {
+		switch {
+		case strings.HasPrefix(sql, "SELECT a.attname"):
+			return fakeResult{
+				columns: []string{"attname", "default", "identity"},
+				rows: [][]string{
+					{"id", "nextval('categories_id_seq'::regclass)", "f"},
+					{"name", "'unnamed'::text", "f"},
+					{"created_at", "now()", "f"},
+				},
+			}
+		case strings.HasPrefix(sql, "insert"):
+			return fakeResult{tag: "INSERT 0 1"}
+		case strings.HasPrefix(sql, "update"):
+			return fakeResult{tag: "UPDATE 1"}
+		}
+		return fakeResult{}
+	})
+	tests := []struct {
+		sql      string
+		expected []string
+		err      bool
+	}{
+		{sql: "insert into categories (id, name, created_at) values (1, 'books', '2020-01-01')", expected: []string{"INSERT 0 1"}},
+		{sql: "insert into categories (id, created_at) values (1, '2020-01-01')", expected: []string{"INSERT 0 1"}},
+		{sql: "insert into categories (id, name, created_at) values (1, DEFAULT, '2020-01-01')", expected: []string{"INSERT 0 1"}},
+		{sql: "insert into categories (name, created_at) values ('books', '2020-01-01')", err: true},
+		{sql: "insert into categories (id, name, created_at) values (DEFAULT, 'books', '2020-01-01')", err: true},
+		{sql: "insert into categories (id, name, created_at) values (1, 'books', now())", err: true},
+		{sql: "update categories set name = 'books' where id = 1", expected: []string{"UPDATE 1"}},
+		{sql: "update categories set name = DEFAULT where id = 1", expected: []string{"UPDATE 1"}},
+		{sql: "update categories set created_at = DEFAULT where id = 1", err: true},
+		{sql: "update categories set created_at = current_timestamp where id = 1", err: true},
+		{sql: "delete from categories where created_at < now()", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			for _, shard := range shards {
+				shard.mu.Lock()
+				shard.queries = nil
+				shard.mu.Unlock()
+			}
+			tags, err := processQuery(t, tt.sql, cluster, testVschema)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, test succeeded")
+				}
+				for name, shard := range shards {
+					for _, q := range shard.Queries() {
+						if q == tt.sql {
+							t.Fatalf("expected the statement not to be executed, observed it on shard %s", name)
+						}
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if !reflect.DeepEqual(tags, tt.expected) {
+				t.Fatalf("expected command tags %v, observed %v", tt.expected, tags)
+			}
+			for name, shard := range shards {
+				queries := shard.Queries()
+				if len(queries) == 0 || queries[len(queries)-1] != tt.sql {
+					t.Fatalf("expected shard %s to execute %s, observed %v", name, tt.sql, queries)
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"io/ioutil"
 )
 
 // VTableType models the type of tables in Matriarch.
@@ -15,15 +14,17 @@ const (
 	Sharded VTableType = "sharded"
 	// Reference means the content of the table is duplicated on each shard.
 	Reference VTableType = "reference"
+	// Unsharded means the content of the table lives on a single shard.
+	Unsharded VTableType = "unsharded"
 )
 
 // IsValid checks the VTableType assigned value is valid.
 func (v VTableType) IsValid() error {
 	switch v {
-	case Sharded, Reference:
+	case Sharded, Reference, Unsharded:
 		return nil
 	}
-	return errors.New("Inalid VTableType")
+	return errors.New("invalid VTableType")
 }
 
 // VIndexType models the type of vindex in Matriarch.
@@ -36,33 +37,94 @@ const (
 	Secondary VIndexType = "secondary"
 )
 
-// IsValid checks the VTableType assigned value is valid.
+// IsValid checks the VIndexType assigned value is valid.
 func (v VIndexType) IsValid() error {
 	switch v {
 	case Primary, Secondary:
 		return nil
 	}
-	return errors.New("Inalid VIndexType")
+	return errors.New("invalid VIndexType")
 }
 
 // VIndex models a VIndex section in the vschema file
 type VIndex struct {
 	// List of columns part of the vschema.
-	Columns []string
+	Columns []string `json:"columns"`
 	// Type of the  vindex. Can be either "primary" or "secondary".
 	// Only one of the two must be set.
-	Type VIndexType
+	Type VIndexType `json:"type"`
+	// References declares that the values of the vindex column are values of a column of another table.
+	// Only for primary vindexes.
+	References *VIndexReference `json:"references,omitempty"`
+	// Function maps the values of the vindex columns to keyspace ids: crc64 (the default), xxhash, sha1,
+	// identity or reverse_bits. Only for primary vindexes.
+	Function string `json:"function,omitempty"`
+	// Lookup declares the lookup table of the vindex, used to route statements filtering on the vindex columns.
+	// Only for secondary vindexes.
+	Lookup *VIndexLookup `json:"lookup,omitempty"`
+}
+
+// VIndexLookup models the lookup section of a secondary vindex. The lookup table stores the keyspace id of each row
+// of the table by the values of the vindex columns. It is maintained by Matriarch on INSERT, UPDATE and DELETE,
+// inside the cross-shard transaction writing the rows.
+type VIndexLookup struct {
+	// The name of the lookup table, in the schema of the table. It is created on every shard with
+	// CREATE TABLE <name> (value text NOT NULL, keyspace_id text NOT NULL), and an index on value.
+	Table string `json:"table"`
+	// Unique enforces the uniqueness of the values of the vindex columns across all the shards. The index on value
+	// of the lookup table must then be a unique index, so that inserting a value stored in the lookup table fails.
+	Unique bool `json:"unique,omitempty"`
+}
+
+// VIndexReference models the references section of a primary vindex, usually matching a foreign key.
+// When the external column is the primary vindex of the external table, rows of both tables sharing the same
+// value live on the same shard, so a join on these columns can be executed by a single shard.
+type VIndexReference struct {
+	// The column of the vindex holding the values of the external column.
+	Column string `json:"column"`
+	// The name of the referenced table.
+	ExternalTable string `json:"external_table"`
+	// The referenced column of the external table.
+	ExternalColumn string `json:"external_column"`
 }
 
+// defaultSchema is the schema of the tables which don't specify one.
+const defaultSchema = "public"
+
 // Table models a Table section in the vschema file.
 type Table struct {
+	// The schema of the table. Defaults to public.
+	Schema string `json:"schema,omitempty"`
 	// The name of the table.
-	Name string
-	// The type of the table. Can be either "sharded" or "reference".
-	// Only one of the two must be set.
-	Type VTableType
+	// Names are case sensitive, as PostgreSQL catalog names: unquoted identifiers of statements are folded to lower case.
+	Name string `json:"name"`
+	// The type of the table. Can be "sharded", "reference" or "unsharded".
+	Type VTableType `json:"type"`
+	// The name of the shard storing the rows of an unsharded table, e.g. ecommerce_$80. Defaults to the first shard.
+	// Only for unsharded tables.
+	Shard string `json:"shard,omitempty"`
+	// ColumnTypes maps the primary and lookup vindex columns to their PostgreSQL type, e.g. uuid, bigint or numeric,
+	// used to normalise their values before computing keyspace ids. The types which are not declared are read
+	// from the catalog of the shards on startup.
+	ColumnTypes map[string]string `json:"column_types,omitempty"`
+	// Sequence declares a column whose values are generated by Matriarch. Only for sharded tables.
+	Sequence *Sequence `json:"sequence,omitempty"`
 
-	VIndexes []VIndex
+	VIndexes []VIndex `json:"vindexes,omitempty"`
+}
+
+// Sequence models the sequence section of a table. When an INSERT statement omits the sequence column,
+// Matriarch fills it with the next values of the sequence before routing the rows, as the column is usually
+// part of the primary vindex. Values are allocated in blocks from a backing table stored on a single shard.
+type Sequence struct {
+	// The column filled with the values of the sequence.
+	Column string `json:"column"`
+	// The name of the sequence in the backing table. Defaults to <table name>_<column>, e.g. orders_id.
+	Name string `json:"name,omitempty"`
+	// The name of the shard storing the backing table, e.g. ecommerce_$80. Defaults to the first shard.
+	Shard string `json:"shard,omitempty"`
+	// The number of values allocated at once. Defaults to 1000.
+	BlockSize int64 `json:"block_size,omitempty"`
 }
 
 // Vschema models the content of the vschema file, with all its options.
@@ -73,31 +135,68 @@ type Vschema struct {
 	Tables []Table `json:"tables"`
 }
 
+// readVschemaFile reads and validates a vschema file, see parseVschema.
 func readVschemaFile(path string) (*Vschema, error) {
-	var vschema Vschema
-	file, err := os.Open(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open %v: %w", path, err)
 	}
-	jsonParser := json.NewDecoder(file)
-	if err = jsonParser.Decode(&vschema); err != nil {
-		return nil, fmt.Errorf("cannot decode content of vschema file: %w", err)
-	}
-
-	// TODO
-	// Use https://pkg.go.dev/gopkg.in/go-playground/validator.v9?tab=doc to validate struct content
-	return &vschema, nil
+	return parseVschema(data)
 }
 
-func (v *Vschema) GetTable(name string) *Table {
+// GetTable returns the table with the given key, as returned by Table.Key.
+func (v *Vschema) GetTable(key string) *Table {
 	for _, t := range v.Tables {
-		if t.Name == name {
+		if t.Key() == key {
 			return &t
 		}
 	}
 	return nil
 }
 
+// ResolveTable returns the table referenced by a relation name in a statement. When the schema is empty,
+// the table is looked up in the schemas of the search path, in order, as PostgreSQL does.
+func (v *Vschema) ResolveTable(schema, name string, searchPath []string) *Table {
+	schemas := searchPath
+	if schema != "" {
+		schemas = []string{schema}
+	}
+	for _, s := range schemas {
+		for _, t := range v.Tables {
+			if t.SchemaName() == s && t.Name == name {
+				return &t
+			}
+		}
+	}
+	return nil
+}
+
+// SchemaName returns the schema of the table.
+func (t *Table) SchemaName() string {
+	if t.Schema == "" {
+		return defaultSchema
+	}
+	return t.Schema
+}
+
+// Key returns the name identifying the table inside Matriarch: the name of the table,
+// qualified with its schema when the vschema specifies one.
+func (t *Table) Key() string {
+	if t.Schema == "" {
+		return t.Name
+	}
+	return t.Schema + "." + t.Name
+}
+
+// SQLName returns the name of the table to use in SQL statements, quoted and qualified with its schema
+// when the vschema specifies one.
+func (t *Table) SQLName() string {
+	if t.Schema == "" {
+		return quoteIdentifier(t.Name)
+	}
+	return quoteIdentifier(t.Schema) + "." + quoteIdentifier(t.Name)
+}
+
 func (t *Table) GetPrimaryVIndex() *VIndex {
 	var index VIndex
 	for _, i := range t.VIndexes {
@@ -107,3 +206,51 @@ func (t *Table) GetPrimaryVIndex() *VIndex {
 	}
 	return &index
 }
+
+// IsColocatedJoin reports whether rows of two sharded tables joined on the equality of two columns
+// live on the same shard. Both columns must be the single column primary vindex of their table, equal values
+// must produce the same keyspace id, see SameKeyspaceIds, and the tables must be linked by the references
+// sections of their primary vindexes: one table references the other, e.g. order_items.order_id referencing
+// orders.id, or both reference the same table, directly or through other tables. A table is co-located with itself.
+func (v *Vschema) IsColocatedJoin(leftTable, leftColumn, rightTable, rightColumn string) bool {
+	left := v.GetTable(leftTable)
+	right := v.GetTable(rightTable)
+	if left == nil || right == nil {
+		return false
+	}
+	leftVIndex := left.GetPrimaryVIndex()
+	rightVIndex := right.GetPrimaryVIndex()
+	if len(leftVIndex.Columns) != 1 || len(rightVIndex.Columns) != 1 {
+		return false
+	}
+	if leftVIndex.Columns[0] != leftColumn || rightVIndex.Columns[0] != rightColumn ||
+		!SameKeyspaceIds(left, leftColumn, right, rightColumn) {
+		return false
+	}
+	return v.referencedTable(left) == v.referencedTable(right)
+}
+
+// referencedTable follows the references sections of the primary vindexes from a table to the table referenced
+// by its rows, directly or through other tables, and returns its key. A reference is only followed when the
+// referenced column is the single column primary vindex of its table, mapping values to the same keyspace ids.
+func (v *Vschema) referencedTable(table *Table) string {
+	seen := make(map[string]bool)
+	for {
+		seen[table.Key()] = true
+		vindex := table.GetPrimaryVIndex()
+		r := vindex.References
+		if r == nil || len(vindex.Columns) != 1 || vindex.Columns[0] != r.Column {
+			return table.Key()
+		}
+		external := v.GetTable(r.ExternalTable)
+		if external == nil || seen[external.Key()] {
+			return table.Key()
+		}
+		externalVIndex := external.GetPrimaryVIndex()
+		if len(externalVIndex.Columns) != 1 || externalVIndex.Columns[0] != r.ExternalColumn ||
+			!SameKeyspaceIds(table, r.Column, external, r.ExternalColumn) {
+			return table.Key()
+		}
+		table = external
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vgheri/matriarch/parser/engine"
+	"github.com/vgheri/matriarch/parser/sql/ast"
+	"github.com/vgheri/matriarch/parser/sql/catalog"
+)
+
+// annotationPrefix introduces the Matriarch annotations in the comments of a DDL file, e.g.
+// -- matriarch: primary_vindex(id) or COMMENT ON TABLE members IS 'matriarch: reference'.
+const annotationPrefix = "matriarch:"
+
+// annotationOptions lists the annotations of tables and columns, with the options they accept as key=value arguments.
+var annotationOptions = map[string][]string{
+	"sharded":          nil,
+	"reference":        nil,
+	"unsharded":        {"shard"},
+	"primary_vindex":   {"function"},
+	"secondary_vindex": nil,
+	"lookup_vindex":    {"table", "unique"},
+	"sequence":         {"name", "shard", "block_size"},
+	"references":       nil,
+}
+
+// annotation is a Matriarch annotation of a table or column, e.g. lookup_vindex(email, table=members_email_lookup).
+// Names are folded to lower case unless they are double quoted, as PostgreSQL does with identifiers.
+type annotation struct {
+	Name string
+	// Args are the positional arguments, columns or table.column references.
+	Args []string
+	// Options are the key=value arguments.
+	Options map[string]string
+}
+
+// commentAnnotations returns the text following the annotation prefix of a table or column comment, up to the end
+// of its line. ok is false when the comment has no annotation.
+func commentAnnotations(comment string) (text string, ok bool) {
+	i := strings.Index(comment, annotationPrefix)
+	if i == -1 {
+		return "", false
+	}
+	text = comment[i+len(annotationPrefix):]
+	if j := strings.IndexByte(text, '\n'); j != -1 {
+		text = text[:j]
+	}
+	text = strings.TrimSpace(text)
+	return strings.TrimSpace(strings.TrimSuffix(text, "*/")), true
+}
+
+// sqlCommentAnnotations returns the annotations of a -- or /* */ comment, which must start with the annotation
+// prefix, so that comments merely mentioning Matriarch are not annotations.
+func sqlCommentAnnotations(comment string) (string, bool) {
+	text := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(comment, "--"), "/*"))
+	if !strings.HasPrefix(text, annotationPrefix) {
+		return "", false
+	}
+	return commentAnnotations(text)
+}
+
+// parseAnnotations parses the annotations of a comment, separated by spaces or commas,
+// e.g. primary_vindex(id, function=xxhash) sequence(id).
+func parseAnnotations(text string) ([]annotation, error) {
+	tokens := tokenize(text)
+	var annotations []annotation
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].Text == "," {
+			continue
+		}
+		if tokens[i].Kind != tokenIdent {
+			return nil, fmt.Errorf("unexpected %s in annotations %q", tokens[i].Text, text)
+		}
+		a := annotation{Name: strings.ToLower(tokens[i].Text)}
+		if i+1 < len(tokens) && tokens[i+1].Text == "(" {
+			end := i + 2
+			for end < len(tokens) && tokens[end].Text != ")" {
+				end++
+			}
+			if end == len(tokens) {
+				return nil, fmt.Errorf("missing ) after the arguments of %s in annotations %q", a.Name, text)
+			}
+			if err := a.parseArgs(tokens[i+2 : end]); err != nil {
+				return nil, fmt.Errorf("invalid arguments of %s in annotations %q: %w", a.Name, text, err)
+			}
+			i = end
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, nil
+}
+
+// parseArgs parses the comma separated arguments of an annotation.
+func (a *annotation) parseArgs(tokens []token) error {
+	for len(tokens) > 0 {
+		end := 0
+		for end < len(tokens) && tokens[end].Text != "," {
+			end++
+		}
+		arg := tokens[:end]
+		switch {
+		case len(arg) == 0:
+			return fmt.Errorf("empty argument")
+		case len(arg) >= 3 && arg[1].Text == "=" && arg[0].Kind == tokenIdent:
+			if a.Options == nil {
+				a.Options = make(map[string]string)
+			}
+			a.Options[strings.ToLower(arg[0].Text)] = annotationName(arg[2:])
+		default:
+			a.Args = append(a.Args, annotationName(arg))
+		}
+		if end == len(tokens) {
+			break
+		}
+		tokens = tokens[end+1:]
+		if len(tokens) == 0 {
+			return fmt.Errorf("empty argument")
+		}
+	}
+	return nil
+}
+
+// annotationName returns the name made of the tokens of an argument, e.g. orders.id, folding unquoted identifiers
+// to lower case.
+func annotationName(tokens []token) string {
+	var name strings.Builder
+	for _, t := range tokens {
+		switch t.Kind {
+		case tokenIdent:
+			name.WriteString(strings.ToLower(t.Text))
+		case tokenQuotedIdent:
+			name.WriteString(strings.ReplaceAll(t.Text[1:len(t.Text)-1], `""`, `"`))
+		default:
+			name.WriteString(t.Text)
+		}
+	}
+	return name.String()
+}
+
+// ddlTableKey returns the key of the table created by a CREATE TABLE statement, as returned by Table.Key.
+func ddlTableKey(name *ast.TableName) string {
+	if name.Schema == "" || name.Schema == defaultSchema {
+		return name.Name
+	}
+	return name.Schema + "." + name.Name
+}
+
+// ddlCommentAnnotations returns the annotations of the -- and /* */ comments of the CREATE TABLE statements of a DDL
+// file, by table key and by column, the annotations of the table itself having an empty column.
+// A comment before the column list annotates the table. Inside the column list, a comment annotates the element
+// defined on the same line, or the next element when it stands on its own lines. Annotations of table constraints
+// annotate the table.
+func ddlCommentAnnotations(ddl string, stmts []ast.Statement) map[string]map[string][]string {
+	annotations := make(map[string]map[string][]string)
+	for _, stmt := range stmts {
+		create, ok := stmt.Raw.Stmt.(*ast.CreateTableStmt)
+		if !ok || create.Name == nil {
+			continue
+		}
+		end := len(ddl)
+		if stmt.Raw.StmtLen > 0 {
+			end = stmt.Raw.StmtLocation + stmt.Raw.StmtLen
+		}
+		text := ddl[stmt.Raw.StmtLocation:end]
+		byColumn := make(map[string][]string)
+		var pending []string
+		depth := 0
+		listDone := false
+		expectElement := false
+		element := ""
+		lastEnd := -1
+		for _, t := range tokenize(text) {
+			if t.Kind == tokenComment {
+				a, ok := sqlCommentAnnotations(t.Text)
+				switch {
+				case !ok:
+				case depth != 1 || listDone:
+					byColumn[""] = append(byColumn[""], a)
+				case lastEnd != -1 && !strings.Contains(text[lastEnd:t.Start], "\n"):
+					byColumn[element] = append(byColumn[element], a)
+				default:
+					pending = append(pending, a)
+				}
+				continue
+			}
+			lastEnd = t.End
+			switch {
+			case t.Text == "(":
+				depth++
+				if depth == 1 && !listDone {
+					expectElement = true
+				}
+			case t.Text == ")":
+				if depth == 1 && !listDone {
+					byColumn[""] = append(byColumn[""], pending...)
+					pending = nil
+					listDone = true
+					element = ""
+				}
+				depth--
+			case depth == 1 && !listDone && t.Text == ",":
+				expectElement = true
+			case depth == 1 && !listDone && expectElement:
+				element = ddlColumn(t, create.Cols)
+				byColumn[element] = append(byColumn[element], pending...)
+				pending = nil
+				expectElement = false
+			}
+		}
+		key := ddlTableKey(create.Name)
+		if annotations[key] == nil {
+			annotations[key] = byColumn
+			continue
+		}
+		for column, texts := range byColumn {
+			annotations[key][column] = append(annotations[key][column], texts...)
+		}
+	}
+	return annotations
+}
+
+// ddlColumn returns the column defined by the element of a column list starting with token t,
+// or an empty name when the element is a table constraint.
+func ddlColumn(t token, cols []*ast.ColumnDef) string {
+	var name string
+	switch t.Kind {
+	case tokenIdent:
+		name = strings.ToLower(t.Text)
+	case tokenQuotedIdent:
+		name = annotationName([]token{t})
+	default:
+		return ""
+	}
+	for _, col := range cols {
+		if col.Colname == name {
+			return name
+		}
+	}
+	return ""
+}
+
+// generateVschema returns the vschema of a keyspace described by a DDL file whose tables and columns are annotated
+// with COMMENT ON statements or -- matriarch: comments, see annotationOptions. Tables without annotations, e.g.
+// lookup tables, are not part of the vschema. The column types of the primary and lookup vindexes are read from
+// the DDL, and the generated vschema is validated as Matriarch does on startup and checked against the DDL.
+func generateVschema(keyspace, ddl string) (*Vschema, error) {
+	stmts, err := engine.NewParser().Parse(strings.NewReader(ddl))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse table definitions: %w", err)
+	}
+	c := catalog.New(defaultSchema)
+	if err = c.Build(stmts); err != nil {
+		return nil, fmt.Errorf("cannot build catalog: %w", err)
+	}
+	comments := ddlCommentAnnotations(ddl, stmts)
+	var v validation
+	vschema := &Vschema{Keyspace: keyspace, Tables: []Table{}}
+	for _, s := range c.Schemas {
+		for _, t := range s.Tables {
+			table := Table{Name: t.Rel.Name}
+			if s.Name != defaultSchema {
+				table.Schema = s.Name
+			}
+			texts := comments[table.Key()]
+			if texts == nil {
+				texts = make(map[string][]string)
+			}
+			if text, ok := commentAnnotations(t.Comment); ok {
+				texts[""] = append([]string{text}, texts[""]...)
+			}
+			for _, col := range t.Columns {
+				if text, ok := commentAnnotations(col.Comment); ok {
+					texts[col.Name] = append([]string{text}, texts[col.Name]...)
+				}
+			}
+			if annotateTable(&v, &table, t, texts) {
+				vschema.Tables = append(vschema.Tables, table)
+			}
+		}
+	}
+	if err = v.err(); err != nil {
+		return nil, err
+	}
+	// Validate the vschema as read from a vschema file
+	data, err := json.Marshal(vschema)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode vschema: %w", err)
+	}
+	if _, err = parseVschema(data); err != nil {
+		return nil, err
+	}
+	// Unsharded tables live on a single shard, which the DDL describes as well
+	checked := *vschema
+	checked.Tables = make([]Table, len(vschema.Tables))
+	for i, table := range vschema.Tables {
+		table.Shard = ""
+		checked.Tables[i] = table
+	}
+	if problems := checkVschemaCatalog(&checked, "", c); len(problems) > 0 {
+		return nil, &SchemaMismatchError{Problems: problems}
+	}
+	return vschema, nil
+}
+
+// annotateTable fills a table of the vschema from the annotations of a catalog table and of its columns, by column,
+// the annotations of the table having an empty column. It reports whether the table has annotations.
+// The type of the table defaults to sharded. Columns annotated with primary_vindex compose the primary vindex,
+// in the order of the table definition.
+func annotateTable(v *validation, table *Table, t *catalog.Table, texts map[string][]string) bool {
+	type columnAnnotation struct {
+		annotation
+		path   string
+		column string
+	}
+	var annotations []columnAnnotation
+	columns := []string{""}
+	for _, col := range t.Columns {
+		columns = append(columns, col.Name)
+	}
+	for _, column := range columns {
+		path := table.Key()
+		if column != "" {
+			path += "." + column
+		}
+		for _, text := range texts[column] {
+			parsed, err := parseAnnotations(text)
+			if err != nil {
+				v.addf(path, "%s", err)
+				continue
+			}
+			for _, a := range parsed {
+				annotations = append(annotations, columnAnnotation{annotation: a, path: path, column: column})
+			}
+		}
+	}
+	if len(annotations) == 0 {
+		return false
+	}
+
+	primary := -1
+	primaryByColumns := false
+	var references []columnAnnotation
+	for _, a := range annotations {
+		options, ok := annotationOptions[a.Name]
+		if !ok {
+			v.addf(a.path, "unknown annotation %s, annotations are %s", a.Name, strings.Join(annotationNames(), ", "))
+			continue
+		}
+		valid := true
+		for _, option := range sortedOptions(a.Options) {
+			if stringArrayContainsValue(options, option) == -1 {
+				v.addf(a.path, "unknown option %s of %s", option, a.Name)
+				valid = false
+			}
+		}
+		// Annotations of columns apply to their column, annotations of tables name their columns
+		args := a.Args
+		if a.column != "" && a.Name != "references" {
+			if len(args) > 0 {
+				v.addf(a.path, "%s of a column takes no column argument", a.Name)
+				continue
+			}
+			args = []string{a.column}
+		}
+		if !valid {
+			continue
+		}
+		switch a.Name {
+		case "sharded", "reference", "unsharded":
+			if a.column != "" || len(args) > 0 {
+				v.addf(a.path, "%s only annotates tables, without arguments", a.Name)
+				continue
+			}
+			typ := VTableType(a.Name)
+			if table.Type != "" && table.Type != typ {
+				v.addf(a.path, "table cannot be both %s and %s", table.Type, typ)
+				continue
+			}
+			table.Type = typ
+			table.Shard = a.Options["shard"]
+		case "primary_vindex":
+			if len(args) == 0 {
+				v.addf(a.path, "primary_vindex needs the columns of the vindex")
+				continue
+			}
+			if primary == -1 {
+				table.VIndexes = append(table.VIndexes, VIndex{Type: Primary})
+				primary = len(table.VIndexes) - 1
+				primaryByColumns = a.column != ""
+			} else if a.column == "" || !primaryByColumns {
+				v.addf(a.path, "table has several primary vindexes")
+				continue
+			}
+			table.VIndexes[primary].Columns = append(table.VIndexes[primary].Columns, args...)
+			if f := a.Options["function"]; f != "" {
+				table.VIndexes[primary].Function = f
+			}
+		case "secondary_vindex", "lookup_vindex":
+			if len(args) == 0 {
+				v.addf(a.path, "%s needs the columns of the vindex", a.Name)
+				continue
+			}
+			index := VIndex{Columns: args, Type: Secondary}
+			if a.Name == "lookup_vindex" {
+				unique, err := optionBool(a.Options["unique"])
+				if err != nil {
+					v.addf(a.path, "unique: %s", err)
+					continue
+				}
+				index.Lookup = &VIndexLookup{Table: a.Options["table"], Unique: unique}
+			}
+			table.VIndexes = append(table.VIndexes, index)
+		case "sequence":
+			if len(args) != 1 {
+				v.addf(a.path, "sequence needs a single column")
+				continue
+			}
+			if table.Sequence != nil {
+				v.addf(a.path, "table has several sequences")
+				continue
+			}
+			table.Sequence = &Sequence{Column: args[0], Name: a.Options["name"], Shard: a.Options["shard"]}
+			if blockSize := a.Options["block_size"]; blockSize != "" {
+				n, err := strconv.ParseInt(blockSize, 10, 64)
+				if err != nil {
+					v.addf(a.path, "block_size: %s is not an integer", blockSize)
+					continue
+				}
+				table.Sequence.BlockSize = n
+			}
+		case "references":
+			references = append(references, a)
+		}
+	}
+	for _, a := range references {
+		args := a.Args
+		if a.column != "" {
+			args = append([]string{a.column}, args...)
+		}
+		dot := -1
+		if len(args) == 2 {
+			dot = strings.LastIndex(args[1], ".")
+		}
+		if dot <= 0 || dot == len(args[1])-1 {
+			v.addf(a.path, "references needs the referenced column, as table.column")
+			continue
+		}
+		if primary == -1 {
+			v.addf(a.path, "references only applies to the primary vindex")
+			continue
+		}
+		table.VIndexes[primary].References = &VIndexReference{Column: args[0], ExternalTable: args[1][:dot], ExternalColumn: args[1][dot+1:]}
+	}
+
+	if table.Type == "" {
+		table.Type = Sharded
+	}
+	if table.Type != Sharded {
+		return true
+	}
+	// Declare the types of the hashed columns, so that Matriarch doesn't read them from the shards
+	for _, index := range table.VIndexes {
+		if index.Type != Primary && index.Lookup == nil {
+			continue
+		}
+		for _, column := range index.Columns {
+			col := catalogColumn(t, column)
+			if col == nil || columnTypeCategory(col) == "" {
+				continue
+			}
+			if table.ColumnTypes == nil {
+				table.ColumnTypes = make(map[string]string)
+			}
+			table.ColumnTypes[column] = col.Type.Name
+		}
+	}
+	return true
+}
+
+// annotationNames returns the names of the annotations, sorted.
+func annotationNames() []string {
+	names := make([]string, 0, len(annotationOptions))
+	for name := range annotationOptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedOptions returns the keys of the options of an annotation, sorted.
+func sortedOptions(options map[string]string) []string {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// optionBool parses the value of a boolean option, false when it is not set.
+func optionBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s is not a boolean", value)
+	}
+	return b, nil
+}
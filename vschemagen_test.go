@@ -0,0 +1,167 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []annotation
+		err      string
+	}{
+		{text: "reference", expected: []annotation{{Name: "reference"}}},
+		{
+			text: "primary_vindex(ID, function=XXHash) sequence(id, block_size=100)",
+			expected: []annotation{
+				{Name: "primary_vindex", Args: []string{"id"}, Options: map[string]string{"function": "xxhash"}},
+				{Name: "sequence", Args: []string{"id"}, Options: map[string]string{"block_size": "100"}},
+			},
+		},
+		{
+			text:     `references(member_id, "Members".id), unsharded(shard=ecommerce_$80)`,
+			expected: []annotation{{Name: "references", Args: []string{"member_id", "Members.id"}}, {Name: "unsharded", Options: map[string]string{"shard": "ecommerce_$80"}}},
+		},
+		{text: "primary_vindex(id", err: "missing )"},
+		{text: "primary_vindex(id,)", err: "empty argument"},
+		{text: "'reference'", err: "unexpected 'reference'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			observed, err := parseAnnotations(tt.text)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %s, observed %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if !reflect.DeepEqual(observed, tt.expected) {
+				t.Fatalf("expected %+v, observed %+v", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestGenerateVschema(t *testing.T) {
+	tests := []struct {
+		name     string
+		ddl      string
+		expected []Table
+		err      string
+	}{
+		{
+			name: "column comments",
+			ddl: `CREATE TABLE members (
+				id bigint, -- matriarch: primary_vindex(function=xxhash) sequence(block_size=100)
+				-- matriarch: lookup_vindex(table=members_email_lookup, unique=true)
+				email text,
+				name text /* matriarch: secondary_vindex */
+			);
+			CREATE TABLE members_email_lookup (value text PRIMARY KEY, keyspace_id text NOT NULL);`,
+			expected: []Table{{
+				Name:        "members",
+				Type:        Sharded,
+				ColumnTypes: map[string]string{"id": "int8", "email": "text"},
+				Sequence:    &Sequence{Column: "id", BlockSize: 100},
+				VIndexes: []VIndex{
+					{Columns: []string{"id"}, Type: Primary, Function: "xxhash"},
+					{Columns: []string{"email"}, Type: Secondary, Lookup: &VIndexLookup{Table: "members_email_lookup", Unique: true}},
+					{Columns: []string{"name"}, Type: Secondary},
+				},
+			}},
+		},
+		{
+			name: "table comments",
+			ddl: `CREATE SCHEMA sales;
+			-- matriarch: primary_vindex(id)
+			CREATE TABLE sales.members (id uuid);
+			-- Orders of the members
+			-- matriarch: primary_vindex(member_id, id)
+			CREATE TABLE sales.orders (
+				id uuid,
+				member_id uuid,
+				PRIMARY KEY (id) -- matriarch: references(member_id, sales.members.id)
+			);
+			-- matriarch: unsharded(shard=ecommerce_$80)
+			CREATE TABLE jobs (id bigint);`,
+			expected: []Table{
+				{Name: "jobs", Type: Unsharded, Shard: "ecommerce_$80"},
+				{Schema: "sales", Name: "members", Type: Sharded, ColumnTypes: map[string]string{"id": "uuid"}, VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}}},
+				{
+					Schema:      "sales",
+					Name:        "orders",
+					Type:        Sharded,
+					ColumnTypes: map[string]string{"id": "uuid", "member_id": "uuid"},
+					VIndexes: []VIndex{{Columns: []string{"member_id", "id"}, Type: Primary,
+						References: &VIndexReference{Column: "member_id", ExternalTable: "sales.members", ExternalColumn: "id"}}},
+				},
+			},
+		},
+		{
+			name: "comment on",
+			ddl: `CREATE TABLE categories (id uuid, name text);
+			CREATE TABLE products (id uuid, category_id uuid);
+			COMMENT ON TABLE categories IS 'Product categories, matriarch: reference';
+			COMMENT ON COLUMN products.id IS 'matriarch: primary_vindex';`,
+			expected: []Table{
+				{Name: "categories", Type: Reference},
+				{Name: "products", Type: Sharded, ColumnTypes: map[string]string{"id": "uuid"}, VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}}},
+			},
+		},
+		{
+			name: "comments mentioning matriarch",
+			ddl: `-- Read by matriarch: not an annotation
+			CREATE TABLE members (id uuid);`,
+			expected: []Table{},
+		},
+		{
+			name: "unknown annotation",
+			ddl: `CREATE TABLE members (
+				id uuid -- matriarch: primary_index
+			);`,
+			err: "members.id: unknown annotation primary_index",
+		},
+		{
+			name: "conflicting types",
+			ddl: `-- matriarch: reference unsharded
+			CREATE TABLE categories (id uuid);`,
+			err: "categories: table cannot be both reference and unsharded",
+		},
+		{
+			name: "invalid vschema",
+			ddl: `-- matriarch: reference secondary_vindex(id)
+			CREATE TABLE categories (id uuid);`,
+			err: "reference tables are copied on every shard and cannot have vindexes",
+		},
+		{
+			name: "mismatching schema",
+			ddl: `CREATE TABLE members (
+				created_at timestamp, -- matriarch: primary_vindex
+				email text -- matriarch: lookup_vindex(table=members_email_lookup)
+			);`,
+			err: "vschema doesn't match the shard schemas, 2 problems",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observed, err := generateVschema("ecommerce", tt.ddl)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %s, observed %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if observed.Keyspace != "ecommerce" || !reflect.DeepEqual(observed.Tables, tt.expected) {
+				t.Fatalf("expected %+v, observed %+v", tt.expected, observed.Tables)
+			}
+		})
+	}
+}
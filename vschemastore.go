@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// ErrKeyspaceChanged is returned when a reloaded vschema declares another keyspace than the active one,
+// as the databases of the shards are named after the keyspace.
+var ErrKeyspaceChanged = errors.New("the keyspace of the vschema cannot change without restarting")
+
+// vschemaStore holds the active vschema, read from a file. Reloading the file swaps the vschema atomically:
+// statements read the active vschema once, when they start, so statements in flight, and the cross-shard
+// transactions executing them, keep using the version they started with. A vschema is never modified once active.
+type vschemaStore struct {
+	path        string
+	cluster     *Cluster
+	schemaCheck string
+	logger      log.Logger
+	// mu serialises reloads
+	mu      sync.Mutex
+	current atomic.Value // *Vschema
+	// version of the active vschema, starting from 1 and incremented by each reload
+	version uint64
+}
+
+// newVschemaStore returns a store of the vschema read from path, prepared for the cluster with prepareVschema.
+func newVschemaStore(path string, vschema *Vschema, cluster *Cluster, schemaCheck string, logger log.Logger) *vschemaStore {
+	s := &vschemaStore{path: path, cluster: cluster, schemaCheck: schemaCheck, logger: logger, version: 1}
+	s.current.Store(vschema)
+	return s
+}
+
+// Load returns the active vschema.
+func (s *vschemaStore) Load() *Vschema {
+	return s.current.Load().(*Vschema)
+}
+
+// Reload reads and validates the vschema file, prepares it with prepareVschema and makes it the active vschema,
+// returned with its version. When the file is invalid, the active vschema is left unchanged and the error is returned.
+func (s *vschemaStore) Reload(ctx context.Context) (*Vschema, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vschema, err := readVschemaFile(s.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if vschema.Keyspace != s.Load().Keyspace {
+		return nil, 0, fmt.Errorf("cannot reload keyspace %s, active keyspace is %s: %w", vschema.Keyspace, s.Load().Keyspace, ErrKeyspaceChanged)
+	}
+	if err = prepareVschema(ctx, s.cluster, vschema, s.schemaCheck, s.logger); err != nil {
+		return nil, 0, err
+	}
+	s.current.Store(vschema)
+	version := atomic.AddUint64(&s.version, 1)
+	level.Info(s.logger).Log("msg", fmt.Sprintf("vschema %s reloaded, version %d", s.path, version))
+	return vschema, version, nil
+}
+
+// UpdateColumnTypes reads from the catalog the types of the vindex columns missing from the active vschema,
+// e.g. of a table created by a DDL statement after the vschema was loaded. The types found are declared in a copy
+// of the active vschema, which becomes the active one, as the active vschema is never modified.
+func (s *vschemaStore) UpdateColumnTypes(c *schemaCatalog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.Load()
+	var updated *Vschema
+	for i := range current.Tables {
+		table := &current.Tables[i]
+		types := make(map[string]string)
+		for _, column := range missingColumnTypes(table) {
+			if typ := c.ColumnType(table.SchemaName(), table.Name, column); typ != "" {
+				types[column] = typ
+			}
+		}
+		if len(types) == 0 {
+			continue
+		}
+		if updated == nil {
+			updated = &Vschema{Keyspace: current.Keyspace, Tables: append([]Table{}, current.Tables...)}
+		}
+		for column, typ := range table.ColumnTypes {
+			types[column] = typ
+		}
+		updated.Tables[i].ColumnTypes = types
+	}
+	if updated == nil {
+		return
+	}
+	s.current.Store(updated)
+	version := atomic.AddUint64(&s.version, 1)
+	level.Info(s.logger).Log("msg", fmt.Sprintf("vschema column types read from the catalog, version %d", version))
+}
+
+// prepareVschema completes a vschema before it becomes active: unsharded tables are assigned to their shard, the types
+// of the vindex columns not declared in the vschema are read from the shards, and the vschema is compared to the schemas
+// of the shards according to schemaCheck: problems are logged as warnings, returned as an error when schemaCheck
+// is strict, and the comparison is skipped when off.
+func prepareVschema(ctx context.Context, cluster *Cluster, vschema *Vschema, schemaCheck string, logger log.Logger) error {
+	if err := assignUnshardedShards(cluster, vschema); err != nil {
+		return err
+	}
+	// Read the types of the primary vindex columns not declared in the vschema, to normalise their values. Values of
+	// columns without a type are hashed as they are written, so the same key could be routed to different shards
+	if err := loadColumnTypes(ctx, cluster, vschema); err != nil {
+		if schemaCheck == "strict" {
+			return err
+		}
+		level.Warn(logger).Log("msg", fmt.Sprintf("cannot read column types from the shard catalog: %s", err.Error()))
+	}
+	if schemaCheck == "off" {
+		return nil
+	}
+	// Check the tables and vindex columns of the vschema exist on every shard, with the same definition
+	if err := checkShardSchemas(ctx, cluster, vschema); err != nil {
+		if schemaCheck == "strict" {
+			return err
+		}
+		level.Warn(logger).Log("msg", err.Error())
+	}
+	return nil
+}
+
+// reloadVschemaStatement reports whether a statement is the RELOAD VSCHEMA admin command.
+func reloadVschemaStatement(sql string) bool {
+	var words []string
+	for _, t := range tokenize(sql) {
+		if t.Kind != tokenComment && t.Text != ";" {
+			words = append(words, t.Text)
+		}
+	}
+	return len(words) == 2 && strings.EqualFold(words[0], "reload") && strings.EqualFold(words[1], "vschema")
+}
+
+// processReloadVschema reloads the vschema file and returns the keyspace, the number of tables and the version
+// of the active vschema. Statements of the connection started after the command use the new vschema.
+func (mock *PGMock) processReloadVschema() error {
+	if mock.vschemas == nil {
+		return errors.New("RELOAD VSCHEMA is not available")
+	}
+	vschema, version, err := mock.vschemas.Reload(context.Background())
+	if err != nil {
+		return fmt.Errorf("cannot reload vschema, the active vschema is unchanged: %w", err)
+	}
+	result := &pgconn.Result{}
+	for _, column := range []string{"keyspace", "tables", "version"} {
+		result.FieldDescriptions = append(result.FieldDescriptions, pgproto3.FieldDescription{
+			Name: []byte(column), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1,
+		})
+	}
+	result.Rows = [][][]byte{{
+		[]byte(vschema.Keyspace),
+		[]byte(fmt.Sprint(len(vschema.Tables))),
+		[]byte(fmt.Sprint(version)),
+	}}
+	return mock.FinaliseExecuteSequence("RELOAD", []*pgconn.Result{result})
+}
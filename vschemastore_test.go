@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// testVschemaFile writes a vschema file with a single sharded table whose column types are declared,
+// so that reloading it doesn't read the shard catalogs.
+func testVschemaFile(t *testing.T, path, keyspace, table string) {
+	content := `{"keyspace": "` + keyspace + `", "tables": [{"name": "` + table + `", "type": "sharded", ` +
+		`"column_types": {"id": "bigint"}, "vindexes": [{"columns": ["id"], "type": "primary"}]}]}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("cannot write vschema file: %v", err)
+	}
+}
+
+func TestVschemaStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vschema")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vschema.json")
+	testVschemaFile(t, path, "ecommerce", "members")
+	initial, err := readVschemaFile(path)
+	if err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	store := newVschemaStore(path, initial, testCluster(t), "off", log.NewNopLogger())
+
+	testVschemaFile(t, path, "ecommerce", "orders")
+	reloaded, version, err := store.Reload(context.Background())
+	if err != nil {
+		t.Fatalf("expected test to succeed, got error %v", err)
+	}
+	if version != 2 || store.Load() != reloaded || reloaded.GetTable("orders") == nil {
+		t.Fatalf("expected version 2 with table orders to be active, observed version %d %+v", version, store.Load())
+	}
+	// statements which started with the initial vschema keep using it
+	if initial.GetTable("members") == nil || initial.GetTable("orders") != nil {
+		t.Fatalf("expected the initial vschema to be unchanged, observed %+v", initial)
+	}
+
+	if err = ioutil.WriteFile(path, []byte(`{"keyspace": "ecommerce", "tables": [{"name": "orders"}]}`), 0644); err != nil {
+		t.Fatalf("cannot write vschema file: %v", err)
+	}
+	if _, _, err = store.Reload(context.Background()); err == nil {
+		t.Fatalf("expected invalid vschema to be rejected")
+	}
+	testVschemaFile(t, path, "billing", "orders")
+	if _, _, err = store.Reload(context.Background()); !errors.Is(err, ErrKeyspaceChanged) {
+		t.Fatalf("expected error %v, observed %v", ErrKeyspaceChanged, err)
+	}
+	if store.Load() != reloaded {
+		t.Fatalf("expected rejected vschemas to leave the active vschema unchanged")
+	}
+}
+
+func TestVschemaStoreUpdateColumnTypes(t *testing.T) {
+	initial := &Vschema{Keyspace: "ecommerce", Tables: []Table{
+		{Name: "orders", Type: Sharded, ColumnTypes: map[string]string{"id": "bigint"}, VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}}},
+		{Name: "carts", Type: Sharded, VIndexes: []VIndex{{Columns: []string{"member_id"}, Type: Primary}}},
+	}}
+	store := newVschemaStore("vschema.json", initial, testCluster(t), "off", log.NewNopLogger())
+	c, err := buildCatalog("CREATE TABLE orders (id bigint);")
+	if err != nil {
+		t.Fatalf("cannot build catalog: %v", err)
+	}
+	catalog := &schemaCatalog{catalog: c}
+	store.UpdateColumnTypes(catalog)
+	if store.Load() != initial {
+		t.Fatalf("expected the active vschema to be unchanged when no type is found")
+	}
+	if err = catalog.Apply(parseStatement(t, "create table carts (id bigint, member_id uuid)")); err != nil {
+		t.Fatalf("cannot apply statement: %v", err)
+	}
+	store.UpdateColumnTypes(catalog)
+	updated := store.Load()
+	if updated == initial || updated.GetTable("carts").ColumnTypes["member_id"] != "uuid" || updated.GetTable("orders").ColumnTypes["id"] != "bigint" {
+		t.Fatalf("expected the type of carts.member_id to be read from the catalog, observed %+v", updated)
+	}
+	if initial.GetTable("carts").ColumnTypes != nil {
+		t.Fatalf("expected the initial vschema to be unchanged, observed %+v", initial)
+	}
+}
+
+func TestReloadVschemaStatement(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{sql: "RELOAD VSCHEMA", expected: true},
+		{sql: "/* admin */ reload vschema;", expected: true},
+		{sql: "reload", expected: false},
+		{sql: "reload vschema now", expected: false},
+		{sql: "select 'reload vschema'", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			if observed := reloadVschemaStatement(tt.sql); observed != tt.expected {
+				t.Fatalf("expected %t, observed %t", tt.expected, observed)
+			}
+		})
+	}
+}
+
+func TestPrepareVschemaColumnTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		types       map[string][][]string
+		schemaCheck string
+		expected    string
+		err         string
+	}{
+		{
+			name:        "types read from every shard",
+			types:       map[string][][]string{"ecommerce_$80": {{"id", "uuid"}}, "ecommerce_80$": {{"id", "uuid"}}},
+			schemaCheck: "off",
+			expected:    "uuid",
+		},
+		{
+			name:        "types differing between shards are a warning",
+			types:       map[string][][]string{"ecommerce_$80": {{"id", "uuid"}}, "ecommerce_80$": {{"id", "text"}}},
+			schemaCheck: "warn",
+		},
+		{
+			name:        "tables missing from a shard are a warning",
+			types:       map[string][][]string{"ecommerce_80$": {{"id", "uuid"}}},
+			schemaCheck: "off",
+		},
+		{
+			name:        "types differing between shards are an error when strict",
+			types:       map[string][][]string{"ecommerce_$80": {{"id", "uuid"}}, "ecommerce_80$": {{"id", "text"}}},
+			schemaCheck: "strict",
+			err:         "column id of table members is of type uuid on shard ecommerce_$80 and text on shard ecommerce_80$",
+		},
+		{
+			name:        "tables missing from a shard are an error when strict",
+			types:       map[string][][]string{"ecommerce_$80": {{"id", "uuid"}}},
+			schemaCheck: "strict",
+			err:         "column id of table members not found on shard ecommerce_80$",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster, _ := startFakeShards(t, "ecommerce", 2, func(shard, sql string) fakeResult {
+				if strings.HasPrefix(sql, "SELECT attname, format_type") {
+					return fakeResult{columns: []string{"attname", "format_type"}, rows: tt.types[shard]}
+				}
+				return fakeResult{}
+			})
+			vschema := &Vschema{Keyspace: "ecommerce", Tables: []Table{
+				{Name: "members", Type: Sharded, VIndexes: []VIndex{{Columns: []string{"id"}, Type: Primary}}},
+			}}
+			err := prepareVschema(context.Background(), cluster, vschema, tt.schemaCheck, log.NewNopLogger())
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected test to succeed, got error %v", err)
+			}
+			if observed := vschema.GetTable("members").ColumnTypes["id"]; observed != tt.expected {
+				t.Fatalf("expected type %s, observed %s", tt.expected, observed)
+			}
+		})
+	}
+}